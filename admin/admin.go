@@ -0,0 +1,461 @@
+// Package admin implements an HTTP API for administration of the server
+//
+// All endpoints return JSON and require the admin token in an "Authorization: Bearer <token>" header, except on
+// the control socket, which can only be used by processes of the user that runs the server:
+//
+//	GET    /clients                  connected clients
+//	GET    /clients/<client-id>      connected client
+//	DELETE /clients/<client-id>      kick the client, with an optional ?reason=<reason-code>
+//	GET    /sessions                 sessions
+//	GET    /sessions/<client-id>     session with its subscriptions
+//	DELETE /sessions/<client-id>     disconnect the client and delete its session
+//	GET    /subscriptions            subscriptions, with an optional ?filter=<topic-filter> and ?client=<client-id>
+//	GET    /retained                 retained messages, with an optional ?filter=<topic-filter>
+//	GET    /retained/<topic>         retained message of the topic
+//	DELETE /retained/<topic>         delete the retained message of the topic
+//	POST   /publish                  publish the message in the request body
+//	GET    /stats                    stats of the server
+//
+// Retained messages are deleted only on this server. When it is part of a cluster, the other nodes delete their copy
+// when they sync retained messages with this server after a reconnect.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/listener"
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/server"
+	"github.com/htdvisser/squatt/topic"
+	"go.uber.org/zap"
+)
+
+// Errors
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	ErrUnauthorized     = errors.New("unauthorized")
+)
+
+// API is the admin HTTP API of a server
+type API struct {
+	server  *server.Server
+	token   string
+	control bool // requests on the control socket do not need a token
+	log     *zap.Logger
+	mux     *http.ServeMux
+}
+
+// New returns the admin API for the server, which requires the given token
+// Requests are refused if the token is empty.
+func New(s *server.Server, token string) *API {
+	api := &API{server: s, token: token, log: zap.NewNop(), mux: http.NewServeMux()}
+	api.handle()
+	return api
+}
+
+// NewControl returns the admin API for the server on the control socket, which does not require a token
+// Requests are refused if they do not come from a process of the user that runs the server, which is checked with
+// the credentials of the peer of the socket. Because those are only available on Linux, requests are refused on
+// other platforms.
+func NewControl(s *server.Server) *API {
+	api := &API{server: s, control: true, log: zap.NewNop(), mux: http.NewServeMux()}
+	api.handle()
+	return api
+}
+
+// ListenControl listens on the control socket at the path
+// A socket that is left at the path is removed. The socket can only be used by the owner of the process.
+func ListenControl(path string) (net.Listener, error) {
+	return listener.ListenUnix(path, 0600)
+}
+
+func (a *API) handle() {
+	a.mux.HandleFunc("/clients", a.clients)
+	a.mux.HandleFunc("/clients/", a.client)
+	a.mux.HandleFunc("/sessions", a.sessions)
+	a.mux.HandleFunc("/sessions/", a.session)
+	a.mux.HandleFunc("/subscriptions", a.subscriptions)
+	a.mux.HandleFunc("/retained", a.retainedMessages)
+	a.mux.HandleFunc("/retained/", a.retainedMessage)
+	a.mux.HandleFunc("/publish", a.publish)
+	a.mux.HandleFunc("/stats", a.stats)
+}
+
+// SetLogger sets the logger
+func (a *API) SetLogger(log *zap.Logger) {
+	a.log = log
+}
+
+// peerKey is the context key of the credentials of the peer of a connection to the control socket
+type peerKey struct{}
+
+// Serve the API on the listener
+func (a *API) Serve(lis net.Listener) error {
+	srv := &http.Server{
+		Handler: a,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, peerKey{}, listener.PeerCredentials(conn))
+		},
+	}
+	return srv.Serve(lis)
+}
+
+func (a *API) authorized(r *http.Request) bool {
+	if a.control {
+		peer, _ := r.Context().Value(peerKey{}).(*auth.PeerCredentials)
+		return peer != nil && int64(peer.UID) == int64(os.Getuid())
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// ServeHTTP implements http.Handler
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		writeError(w, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	a.log.Info("admin request", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.String("addr", r.RemoteAddr))
+	a.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// methods checks the method of the request, and writes an error if it is not allowed
+func methods(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, method := range allowed {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+	return false
+}
+
+// Client is a connected client
+type Client struct {
+	ClientID    string    `json:"client_id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Listener    string    `json:"listener"`
+	Username    string    `json:"username,omitempty"`
+	Version     byte      `json:"protocol_version"`
+	KeepAlive   int       `json:"keep_alive"` // seconds
+	ConnectedAt time.Time `json:"connected_at"`
+	InFlight    int       `json:"in_flight"`
+	Queued      int       `json:"queued"`
+}
+
+func newClient(info server.ClientInfo) Client {
+	return Client{
+		ClientID:    info.ClientID,
+		RemoteAddr:  info.RemoteAddr,
+		Listener:    info.Listener,
+		Username:    info.Username,
+		Version:     info.Version,
+		KeepAlive:   int(info.KeepAlive / time.Second),
+		ConnectedAt: info.ConnectedAt,
+		InFlight:    info.InFlight,
+		Queued:      info.Queued,
+	}
+}
+
+func (a *API) clients(w http.ResponseWriter, r *http.Request) {
+	if !methods(w, r, http.MethodGet) {
+		return
+	}
+	clients := make([]Client, 0)
+	for _, info := range a.server.Clients() {
+		clients = append(clients, newClient(info))
+	}
+	writeJSON(w, http.StatusOK, clients)
+}
+
+func (a *API) client(w http.ResponseWriter, r *http.Request) {
+	if !methods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	clientID := strings.TrimPrefix(r.URL.Path, "/clients/")
+	info, ok := a.server.Client(clientID)
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, newClient(info))
+		return
+	}
+	var reasonCode byte = packets.AdministrativeAction
+	if reason := r.URL.Query().Get("reason"); reason != "" {
+		code, err := strconv.ParseUint(reason, 0, 8)
+		if err != nil || code < 0x80 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid reason code"))
+			return
+		}
+		reasonCode = byte(code)
+	}
+	if err := a.server.Kick(clientID, reasonCode); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Subscription is a subscription of a session
+type Subscription struct {
+	ClientID          string `json:"client_id,omitempty"`
+	Filter            string `json:"filter"`
+	QoS               byte   `json:"qos"`
+	NoLocal           bool   `json:"no_local,omitempty"`
+	RetainAsPublished bool   `json:"retain_as_published,omitempty"`
+	RetainHandling    byte   `json:"retain_handling,omitempty"`
+	Identifier        uint32 `json:"identifier,omitempty"`
+}
+
+func newSubscription(clientID string, state server.SubscriptionState) Subscription {
+	return Subscription{
+		ClientID:          clientID,
+		Filter:            state.Filter,
+		QoS:               state.QoS,
+		NoLocal:           state.Options.NoLocal,
+		RetainAsPublished: state.Options.RetainAsPublished,
+		RetainHandling:    state.Options.RetainHandling,
+		Identifier:        state.Identifier,
+	}
+}
+
+// Session is a session
+type Session struct {
+	ClientID      string         `json:"client_id"`
+	Connected     bool           `json:"connected"`
+	Persistent    bool           `json:"persistent"`
+	Expiry        int            `json:"expiry,omitempty"` // seconds
+	Disconnected  *time.Time     `json:"disconnected_at,omitempty"`
+	InFlight      int            `json:"in_flight"`
+	Queued        int            `json:"queued"`
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+}
+
+func newSession(info server.SessionInfo, withSubscriptions bool) Session {
+	session := Session{
+		ClientID:   info.ClientID,
+		Connected:  info.Connected,
+		Persistent: info.Persistent,
+		Expiry:     int(info.Expiry / time.Second),
+		InFlight:   info.InFlight,
+		Queued:     info.Queued,
+	}
+	if !info.Disconnected.IsZero() {
+		session.Disconnected = &info.Disconnected
+	}
+	if withSubscriptions {
+		session.Subscriptions = make([]Subscription, 0, len(info.Subscriptions))
+		for _, state := range info.Subscriptions {
+			session.Subscriptions = append(session.Subscriptions, newSubscription("", state))
+		}
+	}
+	return session
+}
+
+func (a *API) sessions(w http.ResponseWriter, r *http.Request) {
+	if !methods(w, r, http.MethodGet) {
+		return
+	}
+	sessions := make([]Session, 0)
+	for _, info := range a.server.Sessions() {
+		sessions = append(sessions, newSession(info, false))
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (a *API) session(w http.ResponseWriter, r *http.Request) {
+	if !methods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	clientID := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	if r.Method == http.MethodDelete {
+		if !a.server.DeleteSession(clientID) {
+			writeError(w, http.StatusNotFound, ErrNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	info, ok := a.server.Session(clientID)
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSession(info, true))
+}
+
+func (a *API) subscriptions(w http.ResponseWriter, r *http.Request) {
+	if !methods(w, r, http.MethodGet) {
+		return
+	}
+	clientID := r.URL.Query().Get("client")
+	subscriptions := make([]Subscription, 0)
+	for _, info := range a.server.Subscriptions(r.URL.Query().Get("filter")) {
+		if clientID != "" && info.ClientID != clientID {
+			continue
+		}
+		subscriptions = append(subscriptions, newSubscription(info.ClientID, info.SubscriptionState))
+	}
+	writeJSON(w, http.StatusOK, subscriptions)
+}
+
+// Message is a published or retained message
+// The payload is in Payload if it is valid UTF-8, otherwise it is base64 encoded in PayloadBase64.
+type Message struct {
+	Topic         string     `json:"topic"`
+	QoS           byte       `json:"qos"`
+	Retain        bool       `json:"retain,omitempty"`
+	Payload       *string    `json:"payload,omitempty"`
+	PayloadBase64 []byte     `json:"payload_base64,omitempty"`
+	ContentType   string     `json:"content_type,omitempty"`
+	Expires       *time.Time `json:"expires_at,omitempty"`
+}
+
+func newMessage(msg *packets.PublishPacket) Message {
+	message := Message{
+		Topic:       msg.TopicName,
+		QoS:         msg.Qos,
+		Retain:      msg.Retain,
+		ContentType: msg.Properties.ContentType,
+	}
+	if utf8.Valid(msg.Payload) {
+		payload := string(msg.Payload)
+		message.Payload = &payload
+	} else {
+		message.PayloadBase64 = msg.Payload
+	}
+	if !msg.Expires.IsZero() {
+		expires := msg.Expires
+		message.Expires = &expires
+	}
+	return message
+}
+
+func (a *API) retainedMessages(w http.ResponseWriter, r *http.Request) {
+	if !methods(w, r, http.MethodGet) {
+		return
+	}
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+	if err := topic.Validate(filter, true); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	messages := make([]Message, 0)
+	for _, msg := range a.server.RetainedMessagesMatching(filter) {
+		messages = append(messages, newMessage(msg))
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
+
+func (a *API) retainedMessage(w http.ResponseWriter, r *http.Request) {
+	if !methods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	topicName := strings.TrimPrefix(r.URL.Path, "/retained/")
+	if err := topic.Validate(topicName, false); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if !a.server.DeleteRetainedMessage(topicName) {
+			writeError(w, http.StatusNotFound, ErrNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	msgs := a.server.RetainedMessagesMatching(topicName)
+	if len(msgs) == 0 {
+		writeError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, newMessage(msgs[0]))
+}
+
+func (a *API) publish(w http.ResponseWriter, r *http.Request) {
+	if !methods(w, r, http.MethodPost) {
+		return
+	}
+	var message Message
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := topic.Validate(message.Topic, false); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if message.QoS > 2 {
+		writeError(w, http.StatusBadRequest, errors.New("invalid QoS"))
+		return
+	}
+	msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	msg.TopicName, msg.Qos, msg.Retain = message.Topic, message.QoS, message.Retain
+	msg.Payload = message.PayloadBase64
+	if message.Payload != nil {
+		msg.Payload = []byte(*message.Payload)
+	}
+	msg.Properties.ContentType = message.ContentType
+	if message.Expires != nil {
+		msg.Expires = *message.Expires
+	}
+	a.server.Publish() <- msg
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Stats are the stats of the server
+type Stats struct {
+	Connections         int64            `json:"connections"`
+	Clients             int              `json:"clients"`
+	Sessions            int              `json:"sessions"`
+	Subscriptions       int              `json:"subscriptions"`
+	RetainedMessages    int              `json:"retained_messages"`
+	ListenerConnections map[string]int64 `json:"listener_connections"`
+	RejectedConnections map[string]int64 `json:"rejected_connections"`
+	ExceededQuotas      map[string]int64 `json:"exceeded_quotas"`
+}
+
+func (a *API) stats(w http.ResponseWriter, r *http.Request) {
+	if !methods(w, r, http.MethodGet) {
+		return
+	}
+	stats := a.server.Stats()
+	writeJSON(w, http.StatusOK, Stats{
+		Connections:         stats.Connections,
+		Clients:             stats.Clients,
+		Sessions:            stats.Sessions,
+		Subscriptions:       stats.Subscriptions,
+		RetainedMessages:    stats.RetainedMessages,
+		ListenerConnections: stats.ListenerConnections,
+		RejectedConnections: stats.RejectedConnections,
+		ExceededQuotas:      stats.ExceededQuotas,
+	})
+}
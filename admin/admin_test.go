@@ -0,0 +1,255 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/client"
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAPI(t *testing.T) {
+	Convey(`Given a Server with a connected client and the admin API`, t, func() {
+		s := server.NewServer()
+		go s.Route()
+		api := New(s, "token")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		received := make(chan *packets.PublishPacket, 10)
+		clientConn, serverConn := net.Pipe()
+		go s.ServeConn(serverConn, server.ListenerConfig{Name: "test"})
+		c, err := client.Connect(ctx, clientConn, client.Config{ClientID: "foo", Username: "user", KeepAlive: time.Minute, OnPublish: func(msg *packets.PublishPacket) {
+			received <- msg
+		}})
+		So(err, ShouldBeNil)
+		defer c.Close()
+		subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subscribe.Topics, subscribe.Qoss = []string{"foo/#"}, []byte{1}
+		_, err = c.Subscribe(ctx, subscribe)
+		So(err, ShouldBeNil)
+
+		retained := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		retained.TopicName, retained.Retain, retained.Payload = "status/foo", true, []byte("online")
+		s.RetainMessage(retained)
+
+		request := func(method, path, body string) (*httptest.ResponseRecorder, interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer token")
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+			var res interface{}
+			json.Unmarshal(rec.Body.Bytes(), &res)
+			return rec, res
+		}
+
+		Convey(`When a request has no token`, func() {
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, httptest.NewRequest("GET", "/clients", nil))
+			Convey(`Then it should be unauthorized`, func() {
+				So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+
+		Convey(`When the clients are listed`, func() {
+			rec, res := request("GET", "/clients", "")
+			Convey(`Then the client should be returned`, func() {
+				So(rec.Code, ShouldEqual, http.StatusOK)
+				So(res, ShouldHaveLength, 1)
+				info := res.([]interface{})[0].(map[string]interface{})
+				So(info["client_id"], ShouldEqual, "foo")
+				So(info["listener"], ShouldEqual, "test")
+				So(info["username"], ShouldEqual, "user")
+				So(info["keep_alive"], ShouldEqual, 60)
+				So(info["in_flight"], ShouldEqual, 0)
+			})
+		})
+
+		Convey(`When an unknown client is requested`, func() {
+			rec, _ := request("GET", "/clients/bar", "")
+			Convey(`Then it should not be found`, func() {
+				So(rec.Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey(`When the client is kicked`, func() {
+			rec, _ := request("DELETE", "/clients/foo", "")
+			Convey(`Then it should be disconnected`, func() {
+				So(rec.Code, ShouldEqual, http.StatusNoContent)
+				select {
+				case <-c.Done():
+				case <-time.After(time.Second):
+				}
+				So(c.Err(), ShouldResemble, client.ReasonCodeError{Packet: "DISCONNECT", ReasonCode: packets.AdministrativeAction})
+			})
+		})
+
+		Convey(`When the session is requested`, func() {
+			rec, res := request("GET", "/sessions/foo", "")
+			Convey(`Then it should be returned with its subscriptions`, func() {
+				So(rec.Code, ShouldEqual, http.StatusOK)
+				session := res.(map[string]interface{})
+				So(session["connected"], ShouldBeTrue)
+				So(session["subscriptions"], ShouldResemble, []interface{}{
+					map[string]interface{}{"filter": "foo/#", "qos": 1.0},
+				})
+			})
+		})
+
+		Convey(`When the session is deleted`, func() {
+			rec, _ := request("DELETE", "/sessions/foo", "")
+			Convey(`Then it should be gone`, func() {
+				So(rec.Code, ShouldEqual, http.StatusNoContent)
+				_, res := request("GET", "/sessions", "")
+				So(res, ShouldBeEmpty)
+				_, res = request("GET", "/subscriptions", "")
+				So(res, ShouldBeEmpty)
+			})
+		})
+
+		Convey(`When the subscriptions to a filter are listed`, func() {
+			_, res := request("GET", "/subscriptions?filter=foo/%23", "")
+			Convey(`Then the subscriptions should be returned with their client`, func() {
+				So(res, ShouldResemble, []interface{}{
+					map[string]interface{}{"client_id": "foo", "filter": "foo/#", "qos": 1.0},
+				})
+			})
+		})
+
+		Convey(`When the subscriptions of a client are listed`, func() {
+			_, res := request("GET", "/subscriptions?client=foo", "")
+			_, none := request("GET", "/subscriptions?client=bar", "")
+			Convey(`Then only the subscriptions of the client should be returned`, func() {
+				So(res, ShouldHaveLength, 1)
+				So(none, ShouldBeEmpty)
+			})
+		})
+
+		Convey(`When the stats are requested`, func() {
+			rec, res := request("GET", "/stats", "")
+			Convey(`Then they should be returned`, func() {
+				So(rec.Code, ShouldEqual, http.StatusOK)
+				stats := res.(map[string]interface{})
+				So(stats["connections"], ShouldEqual, 1)
+				So(stats["clients"], ShouldEqual, 1)
+				So(stats["subscriptions"], ShouldEqual, 1)
+				So(stats["retained_messages"], ShouldEqual, 1)
+				So(stats["listener_connections"], ShouldResemble, map[string]interface{}{"test": 1.0})
+			})
+		})
+
+		Convey(`When the retained messages are listed`, func() {
+			_, res := request("GET", "/retained", "")
+			Convey(`Then they should be returned`, func() {
+				So(res, ShouldResemble, []interface{}{
+					map[string]interface{}{"topic": "status/foo", "qos": 0.0, "retain": true, "payload": "online"},
+				})
+			})
+		})
+
+		Convey(`When a retained message is deleted`, func() {
+			rec, _ := request("DELETE", "/retained/status/foo", "")
+			Convey(`Then it should be gone`, func() {
+				So(rec.Code, ShouldEqual, http.StatusNoContent)
+				rec, _ = request("GET", "/retained/status/foo", "")
+				So(rec.Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey(`When a message is published`, func() {
+			rec, _ := request("POST", "/publish", `{"topic":"foo/bar","qos":1,"payload_base64":"AAE="}`)
+			Convey(`Then it should be delivered to the client`, func() {
+				So(rec.Code, ShouldEqual, http.StatusAccepted)
+				select {
+				case msg := <-received:
+					So(msg.TopicName, ShouldEqual, "foo/bar")
+					So(msg.Payload, ShouldResemble, []byte{0, 1})
+				case <-time.After(time.Second):
+					So("no message received", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey(`When an invalid message is published`, func() {
+			rec, _ := request("POST", "/publish", `{"topic":"foo/#"}`)
+			Convey(`Then it should be rejected`, func() {
+				So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+	})
+}
+
+func TestControl(t *testing.T) {
+	Convey(`Given a control socket`, t, func() {
+		dir, err := ioutil.TempDir("", "squatt")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "squatt.sock")
+
+		s := server.NewServer()
+		lis, err := ListenControl(path)
+		So(err, ShouldBeNil)
+		defer lis.Close()
+		go NewControl(s).Serve(lis)
+
+		Convey(`Then only the owner should have access`, func() {
+			info, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, 0600)
+		})
+
+		Convey(`When another server listens on the same path`, func() {
+			_, err := ListenControl(path)
+			Convey(`Then it should fail`, func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey(`When a request is done without token`, func() {
+			c := http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			}}
+			res, err := c.Get("http://squatt/stats")
+			So(err, ShouldBeNil)
+			defer res.Body.Close()
+			Convey(`Then it should be authorized`, func() {
+				So(res.StatusCode, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey(`When a request is done without peer credentials`, func() {
+			rec := httptest.NewRecorder()
+			NewControl(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+			Convey(`Then it should not be authorized`, func() {
+				So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+
+		Convey(`When a request is done by another user`, func() {
+			peer := &auth.PeerCredentials{UID: uint32(os.Getuid()) + 1}
+			req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+			req = req.WithContext(context.WithValue(req.Context(), peerKey{}, peer))
+			rec := httptest.NewRecorder()
+			NewControl(s).ServeHTTP(rec, req)
+			Convey(`Then it should not be authorized`, func() {
+				So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+	})
+}
@@ -1,6 +1,8 @@
 // Package auth contains authentication for the MQTT Server
 package auth
 
+import "time"
+
 // Interface for authentication
 type Interface interface {
 	Username() string
@@ -9,6 +11,18 @@ type Interface interface {
 	CanSubscribeTo(topic string) bool
 }
 
+// SessionExpirer can be implemented by an Interface to override the session expiry interval of the server for a user
+// The expiry of the server is used if ok is false. An expiry of zero means that sessions of the user do not expire.
+type SessionExpirer interface {
+	SessionExpiry() (expiry time.Duration, ok bool)
+}
+
+// PacketSizeLimiter can be implemented by an Interface to override the maximum packet size of the listener for a user
+// The maximum packet size of the listener is used if MaxPacketSize returns zero.
+type PacketSizeLimiter interface {
+	MaxPacketSize() int
+}
+
 // Plugin for authentication
 type Plugin func(clientIdentifier string, username string, password []byte) (Interface, error)
 
@@ -25,3 +39,47 @@ func (n noAuth) Username() string                 { return n.username }
 func (n noAuth) CanConnect() bool                 { return true }
 func (n noAuth) CanPublishTo(topic string) bool   { return true }
 func (n noAuth) CanSubscribeTo(topic string) bool { return true }
+
+// Connection is the network connection of a client that authenticates
+type Connection struct {
+	// Listener is the name of the listener that the client connected to
+	Listener   string
+	RemoteAddr string
+	// Peer are the credentials of the process of the client, if it connected over a Unix socket
+	Peer *PeerCredentials
+}
+
+// ConnectionPlugin is similar to Plugin, except that it also gets the connection of the client
+type ConnectionPlugin func(conn Connection, clientIdentifier string, username string, password []byte) (Interface, error)
+
+// WithConnection returns a ConnectionPlugin that ignores the connection
+func (p Plugin) WithConnection() ConnectionPlugin {
+	return func(_ Connection, clientIdentifier string, username string, password []byte) (Interface, error) {
+		return p(clientIdentifier, username, password)
+	}
+}
+
+// Anonymous returns a ConnectionPlugin that authorizes clients with the given plugin without username
+// The username and password that the client sent are ignored, so that a client that failed to authenticate earlier
+// in a Chain can not claim the username of another user.
+func Anonymous(authorize Plugin) ConnectionPlugin {
+	return func(_ Connection, clientIdentifier string, _ string, _ []byte) (Interface, error) {
+		return authorize(clientIdentifier, "", nil)
+	}
+}
+
+// Chain returns a ConnectionPlugin that tries the plugins in order, and uses the first that does not return an error
+// The error of the last plugin is returned if all plugins return an error. A plugin that authenticates the client
+// but does not allow it to connect ends the chain.
+func Chain(plugins ...ConnectionPlugin) ConnectionPlugin {
+	return func(conn Connection, clientIdentifier string, username string, password []byte) (Interface, error) {
+		err := ErrNotAuthorized
+		for _, plugin := range plugins {
+			var auth Interface
+			if auth, err = plugin(conn, clientIdentifier, username, password); err == nil {
+				return auth, nil
+			}
+		}
+		return nil, err
+	}
+}
@@ -16,3 +16,121 @@ func TestAuth(t *testing.T) {
 		Convey(`Then Subscribing should be allowed`, func() { So(auth.CanSubscribeTo(""), ShouldBeTrue) })
 	})
 }
+
+func TestQuotaAction(t *testing.T) {
+	Convey(`When parsing quota actions`, t, func() {
+		for _, action := range []QuotaAction{Throttle, Drop, Disconnect} {
+			parsed, err := ParseQuotaAction(action.String())
+			So(err, ShouldBeNil)
+			So(parsed, ShouldEqual, action)
+		}
+		_, err := ParseQuotaAction("ignore")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestChain(t *testing.T) {
+	Convey(`Given a chain of plugins`, t, func() {
+		var listeners []string
+		deny := func(conn Connection, clientIdentifier string, username string, password []byte) (Interface, error) {
+			listeners = append(listeners, conn.Listener)
+			return nil, ErrNotAuthorized
+		}
+		passwords := NewPasswordStore()
+		So(passwords.SetPassword("user", []byte("secret")), ShouldBeNil)
+		chain := Chain(deny, passwords.Plugin(NoAuth).WithConnection())
+		conn := Connection{Listener: "internal", RemoteAddr: "127.0.0.1:1234"}
+
+		Convey(`When a plugin further in the chain authenticates the client`, func() {
+			auth, err := chain(conn, "id", "user", []byte("secret"))
+			Convey(`Then the client should be authenticated`, func() {
+				So(err, ShouldBeNil)
+				So(auth.Username(), ShouldEqual, "user")
+			})
+			Convey(`Then the plugins should get the connection`, func() {
+				So(listeners, ShouldResemble, []string{"internal"})
+			})
+		})
+
+		Convey(`When no plugin authenticates the client`, func() {
+			_, err := chain(conn, "id", "user", []byte("wrong"))
+			Convey(`Then the error of the last plugin should be returned`, func() {
+				So(err, ShouldEqual, ErrNotAuthorized)
+			})
+		})
+
+		Convey(`When the chain ends with anonymous access`, func() {
+			chain := Chain(passwords.Plugin(NoAuth).WithConnection(), Anonymous(NoAuth))
+			Convey(`When a client authenticates with a wrong password`, func() {
+				auth, err := chain(conn, "id", "user", []byte("wrong"))
+				Convey(`Then the client should be anonymous`, func() {
+					So(err, ShouldBeNil)
+					So(auth.Username(), ShouldBeEmpty)
+				})
+			})
+			Convey(`When a client authenticates with the right password`, func() {
+				auth, err := chain(conn, "id", "user", []byte("secret"))
+				Convey(`Then the client should be the user`, func() {
+					So(err, ShouldBeNil)
+					So(auth.Username(), ShouldEqual, "user")
+				})
+			})
+		})
+
+		Convey(`When the chain is empty`, func() {
+			_, err := Chain()(conn, "id", "user", nil)
+			Convey(`Then the client should not be authenticated`, func() {
+				So(err, ShouldEqual, ErrNotAuthorized)
+			})
+		})
+	})
+}
+
+func TestPeerPlugin(t *testing.T) {
+	Convey(`Given a peer plugin that allows some Unix users`, t, func() {
+		defer func(lookup func(uint32) string) { lookupUsername = lookup }(lookupUsername)
+		lookupUsername = func(uid uint32) string {
+			if uid == 1000 {
+				return "sidecar"
+			}
+			return "other"
+		}
+		plugin := PeerPlugin([]string{"sidecar", "0"}, NoAuth)
+
+		Convey(`When an allowed user connects without username`, func() {
+			auth, err := plugin(Connection{Peer: &PeerCredentials{UID: 1000, GID: 1000, PID: 42}}, "id", "", nil)
+			Convey(`Then the client should be authenticated as the Unix user`, func() {
+				So(err, ShouldBeNil)
+				So(auth.Username(), ShouldEqual, "sidecar")
+			})
+		})
+
+		Convey(`When a user that is allowed by uid connects`, func() {
+			_, err := plugin(Connection{Peer: &PeerCredentials{UID: 0}}, "id", "", nil)
+			Convey(`Then the client should be authenticated`, func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey(`When an allowed user connects with another username`, func() {
+			_, err := plugin(Connection{Peer: &PeerCredentials{UID: 1000}}, "id", "admin", nil)
+			Convey(`Then the client should not be authenticated`, func() {
+				So(err, ShouldEqual, ErrNotAuthorized)
+			})
+		})
+
+		Convey(`When another user connects`, func() {
+			_, err := plugin(Connection{Peer: &PeerCredentials{UID: 1001}}, "id", "", nil)
+			Convey(`Then the client should not be authenticated`, func() {
+				So(err, ShouldEqual, ErrNotAuthorized)
+			})
+		})
+
+		Convey(`When a client connects without peer credentials`, func() {
+			_, err := plugin(Connection{RemoteAddr: "127.0.0.1:1234"}, "id", "", nil)
+			Convey(`Then the client should not be authenticated`, func() {
+				So(err, ShouldEqual, ErrNotAuthorized)
+			})
+		})
+	})
+}
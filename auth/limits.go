@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// userLimits are the limits of a user in a password file, that override the limits of the server
+type userLimits struct {
+	sessionExpiry *time.Duration
+	maxPacketSize int
+	quotas        []func(*Quotas)
+}
+
+// parseUserLimits parses the options after the secret of a user in a password file
+// Each option is formatted as name=value.
+func parseUserLimits(options []string) (*userLimits, error) {
+	limits := new(userLimits)
+	for _, option := range options {
+		sep := strings.Index(option, "=")
+		if sep < 1 {
+			return nil, fmt.Errorf("expected option=value instead of %q", option)
+		}
+		name, value := option[:sep], option[sep+1:]
+		switch name {
+		case "session-expiry":
+			expiry, err := time.ParseDuration(value)
+			if err != nil || expiry < 0 {
+				return nil, fmt.Errorf("invalid session-expiry: %q", value)
+			}
+			limits.sessionExpiry = &expiry
+		case "max-packet-size":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 1 {
+				return nil, fmt.Errorf("invalid max-packet-size: %q", value)
+			}
+			limits.maxPacketSize = size
+		case "messages", "bytes", "subscriptions":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				return nil, fmt.Errorf("invalid %s quota: %q", name, value)
+			}
+			limits.quotas = append(limits.quotas, func(q *Quotas) { q.quota(name).Limit = limit })
+		case "messages-action", "bytes-action", "subscriptions-action":
+			action, err := ParseQuotaAction(value)
+			if err != nil {
+				return nil, err
+			}
+			quota := strings.TrimSuffix(name, "-action")
+			limits.quotas = append(limits.quotas, func(q *Quotas) { q.quota(quota).Action = action })
+		case "per-user":
+			perUser, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid per-user: %q", value)
+			}
+			limits.quotas = append(limits.quotas, func(q *Quotas) { q.PerUser = perUser })
+		default:
+			return nil, fmt.Errorf("unknown option: %s", name)
+		}
+	}
+	return limits, nil
+}
+
+// limitedAuth is the Interface of a user with limits in a password file
+// Limits that are not in the password file are taken from the Interface of the authorize plugin.
+type limitedAuth struct {
+	Interface
+	limits *userLimits
+}
+
+func (a limitedAuth) SessionExpiry() (time.Duration, bool) {
+	if a.limits.sessionExpiry != nil {
+		return *a.limits.sessionExpiry, true
+	}
+	if expirer, ok := a.Interface.(SessionExpirer); ok {
+		return expirer.SessionExpiry()
+	}
+	return 0, false
+}
+
+func (a limitedAuth) MaxPacketSize() int {
+	if a.limits.maxPacketSize != 0 {
+		return a.limits.maxPacketSize
+	}
+	if limiter, ok := a.Interface.(PacketSizeLimiter); ok {
+		return limiter.MaxPacketSize()
+	}
+	return 0
+}
+
+func (a limitedAuth) Quotas(server Quotas) Quotas {
+	quotas := server
+	if limiter, ok := a.Interface.(QuotaLimiter); ok {
+		quotas = limiter.Quotas(server)
+	}
+	for _, set := range a.limits.quotas {
+		set(&quotas)
+	}
+	return quotas
+}
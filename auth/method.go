@@ -0,0 +1,24 @@
+package auth
+
+import "errors"
+
+// ErrNotAuthorized is returned when authentication fails
+var ErrNotAuthorized = errors.New("not authorized")
+
+// Method is an enhanced authentication method of MQTT 5, such as SCRAM-SHA-256
+type Method interface {
+	// Name of the method, as used in the Authentication Method property
+	Name() string
+	// Start an authentication exchange for a client
+	// The username is empty if the client did not send one.
+	Start(clientIdentifier string, username string) Exchange
+}
+
+// Exchange is a challenge/response authentication exchange with a client
+// The same Method is used to re-authenticate clients during their connection.
+type Exchange interface {
+	// Respond to the authentication data of the client
+	// If the exchange is not done, the result is nil and the response is sent to the client as challenge.
+	// If the exchange is done, the response is sent to the client with the result of the authentication.
+	Respond(data []byte) (response []byte, result Interface, err error)
+}
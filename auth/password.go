@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SCRAMIterations is the number of iterations for new SCRAM secrets
+var SCRAMIterations = 4096
+
+var errInvalidSecret = errors.New("invalid SCRAM secret")
+
+type scramSecret struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+func newSCRAMSecret(password []byte, salt []byte, iterations int) scramSecret {
+	saltedPassword := pbkdf2SHA256(password, salt, iterations)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return scramSecret{
+		iterations: iterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  hmacSHA256(saltedPassword, []byte("Server Key")),
+	}
+}
+
+// String returns the secret in the format SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+func (s scramSecret) String() string {
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s",
+		s.iterations,
+		base64.StdEncoding.EncodeToString(s.salt),
+		base64.StdEncoding.EncodeToString(s.storedKey),
+		base64.StdEncoding.EncodeToString(s.serverKey),
+	)
+}
+
+func parseSCRAMSecret(str string) (secret scramSecret, err error) {
+	parts := strings.FieldsFunc(str, func(r rune) bool { return r == '$' || r == ':' })
+	if len(parts) != 5 || parts[0] != "SCRAM-SHA-256" {
+		return secret, errInvalidSecret
+	}
+	if secret.iterations, err = strconv.Atoi(parts[1]); err != nil || secret.iterations < 1 {
+		return secret, errInvalidSecret
+	}
+	for i, dst := range []*[]byte{&secret.salt, &secret.storedKey, &secret.serverKey} {
+		if *dst, err = base64.StdEncoding.DecodeString(parts[2+i]); err != nil {
+			return secret, errInvalidSecret
+		}
+	}
+	if len(secret.storedKey) != sha256.Size || len(secret.serverKey) != sha256.Size {
+		return secret, errInvalidSecret
+	}
+	return secret, nil
+}
+
+// SCRAMSecret returns the SCRAM-SHA-256 secret for a password, that can be used in a password file
+func SCRAMSecret(password []byte) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return newSCRAMSecret(password, salt, SCRAMIterations).String(), nil
+}
+
+// PasswordStore stores salted SCRAM-SHA-256 secrets of user passwords
+type PasswordStore struct {
+	unknownKey []byte // key for the salts of unknown users
+
+	// BEGIN mu protected
+	mu      sync.RWMutex
+	secrets map[string]scramSecret
+	limits  map[string]*userLimits
+	// END mu protected
+}
+
+// NewPasswordStore returns a new, empty, password store
+func NewPasswordStore() *PasswordStore {
+	unknownKey := make([]byte, sha256.Size)
+	if _, err := rand.Read(unknownKey); err != nil {
+		panic(err)
+	}
+	return &PasswordStore{unknownKey: unknownKey, secrets: make(map[string]scramSecret), limits: make(map[string]*userLimits)}
+}
+
+// LoadPasswordFile returns a password store with the users in the password file
+// Each line of the file contains a username and a secret as returned by SCRAMSecret, separated by a colon.
+// The secret can be followed by options that override the limits of the server for the user:
+//
+//	session-expiry=<duration>      session expiry interval (0 for no expiry)
+//	max-packet-size=<bytes>        maximum size of packets that the user can send
+//	messages=<limit>               quota of messages per second (0 for no limit)
+//	messages-action=<action>       action when the message quota is exceeded (throttle, drop or disconnect)
+//	bytes=<limit>                  quota of payload bytes per second (0 for no limit)
+//	bytes-action=<action>          action when the byte quota is exceeded (throttle, drop or disconnect)
+//	subscriptions=<limit>          quota of subscriptions of a session (0 for no limit)
+//	subscriptions-action=<action>  action when the subscription quota is exceeded (drop or disconnect)
+//	per-user=<bool>                share the message and byte quotas between all clients of the user
+//
+// Quotas that are not in the password file are taken from the server.
+//
+// Empty lines and lines starting with # are ignored.
+func LoadPasswordFile(filename string) (*PasswordStore, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := NewPasswordStore()
+	if err = s.read(f); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return s, nil
+}
+
+// Reload replaces the users in the store with the users in the password file
+// The store is not changed if the file can not be read.
+func (s *PasswordStore) Reload(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = s.read(f); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	return nil
+}
+
+// read replaces the users in the store with the users in r
+func (s *PasswordStore) read(r io.Reader) error {
+	secrets := make(map[string]scramSecret)
+	limits := make(map[string]*userLimits)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		sep := strings.Index(text, ":")
+		fields := strings.Fields(text[sep+1:])
+		if sep < 1 || len(fields) == 0 {
+			return fmt.Errorf("line %d: expected username:secret", line)
+		}
+		username := text[:sep]
+		secret, err := parseSCRAMSecret(fields[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		secrets[username] = secret
+		if len(fields) > 1 {
+			if limits[username], err = parseUserLimits(fields[1:]); err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets, s.limits = secrets, limits
+	return nil
+}
+
+// SetPassword sets the password of a user
+func (s *PasswordStore) SetPassword(username string, password []byte) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets[username] = newSCRAMSecret(password, salt, SCRAMIterations)
+	return nil
+}
+
+// Delete a user from the store
+func (s *PasswordStore) Delete(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.secrets, username)
+	delete(s.limits, username)
+}
+
+func (s *PasswordStore) secret(username string) (scramSecret, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	secret, ok := s.secrets[username]
+	return secret, ok
+}
+
+// withLimits returns the Interface with the limits of the user in the password file, if the user has any
+func (s *PasswordStore) withLimits(username string, a Interface) Interface {
+	s.mu.RLock()
+	limits, ok := s.limits[username]
+	s.mu.RUnlock()
+	if !ok {
+		return a
+	}
+	return limitedAuth{Interface: a, limits: limits}
+}
+
+// unknownSecret returns a fake secret for a user that is not in the store
+// The salt is derived from the username, so that it is the same every time the user is looked up.
+func (s *PasswordStore) unknownSecret(username string) scramSecret {
+	return scramSecret{iterations: SCRAMIterations, salt: hmacSHA256(s.unknownKey, []byte(username))[:16]}
+}
+
+// CheckPassword returns true if the password of the user is correct
+// The password of an unknown user is checked against a fake secret, so that it takes as long as for a known user.
+func (s *PasswordStore) CheckPassword(username string, password []byte) bool {
+	secret, ok := s.secret(username)
+	if !ok {
+		secret = s.unknownSecret(username)
+	}
+	storedKey := newSCRAMSecret(password, secret.salt, secret.iterations).storedKey
+	return ok && hmac.Equal(storedKey, secret.storedKey)
+}
+
+// Plugin returns an auth Plugin that checks the passwords in CONNECT packets against the store
+// Clients with valid passwords are authorized by the given plugin, and get the limits of the user in the store.
+func (s *PasswordStore) Plugin(authorize Plugin) Plugin {
+	return func(clientIdentifier string, username string, password []byte) (Interface, error) {
+		if !s.CheckPassword(username, password) {
+			return nil, ErrNotAuthorized
+		}
+		a, err := authorize(clientIdentifier, username, nil)
+		if err != nil {
+			return nil, err
+		}
+		return s.withLimits(username, a), nil
+	}
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a key of sha256.Size bytes from the password (RFC 8018)
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	mac.Write(block[:])
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPasswordStore(t *testing.T) {
+	Convey(`Given a PasswordStore with a user`, t, func() {
+		s := NewPasswordStore()
+		So(s.SetPassword("user", []byte("pencil")), ShouldBeNil)
+
+		Convey(`Then the correct password should be accepted`, func() { So(s.CheckPassword("user", []byte("pencil")), ShouldBeTrue) })
+		Convey(`Then a wrong password should be rejected`, func() { So(s.CheckPassword("user", []byte("pen")), ShouldBeFalse) })
+		Convey(`Then an unknown user should be rejected`, func() { So(s.CheckPassword("other", []byte("pencil")), ShouldBeFalse) })
+
+		Convey(`When the user is deleted`, func() {
+			s.Delete("user")
+			Convey(`Then the password should be rejected`, func() { So(s.CheckPassword("user", []byte("pencil")), ShouldBeFalse) })
+		})
+
+		Convey(`When using the store as plugin`, func() {
+			plugin := s.Plugin(NoAuth)
+			Convey(`Then the correct password should be accepted`, func() {
+				auth, err := plugin("id", "user", []byte("pencil"))
+				So(err, ShouldBeNil)
+				So(auth.Username(), ShouldEqual, "user")
+			})
+			Convey(`Then a wrong password should be rejected`, func() {
+				_, err := plugin("id", "user", []byte("pen"))
+				So(err, ShouldEqual, ErrNotAuthorized)
+			})
+		})
+	})
+
+	Convey(`Given a password file`, t, func() {
+		secret, err := SCRAMSecret([]byte("pencil"))
+		So(err, ShouldBeNil)
+		So(secret, ShouldStartWith, "SCRAM-SHA-256$4096:")
+
+		Convey(`When reading the file`, func() {
+			s := NewPasswordStore()
+			err := s.read(strings.NewReader("# users\n\nuser:" + secret + "\n"))
+			Convey(`Then there should be no error`, func() { So(err, ShouldBeNil) })
+			Convey(`Then the password should be accepted`, func() { So(s.CheckPassword("user", []byte("pencil")), ShouldBeTrue) })
+		})
+
+		Convey(`When reading a file into a store with other users`, func() {
+			s := NewPasswordStore()
+			So(s.SetPassword("other", []byte("pen")), ShouldBeNil)
+			err := s.read(strings.NewReader("user:" + secret + "\n"))
+			Convey(`Then there should be no error`, func() { So(err, ShouldBeNil) })
+			Convey(`Then the users should be replaced`, func() {
+				So(s.CheckPassword("user", []byte("pencil")), ShouldBeTrue)
+				So(s.CheckPassword("other", []byte("pen")), ShouldBeFalse)
+			})
+		})
+
+		Convey(`When reading a file with limits of a user`, func() {
+			s := NewPasswordStore()
+			err := s.read(strings.NewReader("user:" + secret + " session-expiry=1m max-packet-size=1024 messages=10 messages-action=drop per-user=true\nother:" + secret + "\n"))
+			So(err, ShouldBeNil)
+			plugin := s.Plugin(NoAuth)
+			Convey(`Then the user should get its limits`, func() {
+				auth, err := plugin("id", "user", []byte("pencil"))
+				So(err, ShouldBeNil)
+				So(auth.Username(), ShouldEqual, "user")
+				So(auth, ShouldImplement, (*SessionExpirer)(nil))
+				expiry, ok := auth.(SessionExpirer).SessionExpiry()
+				So(ok, ShouldBeTrue)
+				So(expiry, ShouldEqual, time.Minute)
+				So(auth.(PacketSizeLimiter).MaxPacketSize(), ShouldEqual, 1024)
+				server := Quotas{MessagesPerSecond: Quota{Limit: 100}, Subscriptions: Quota{Limit: 5, Action: Drop}}
+				So(auth.(QuotaLimiter).Quotas(server), ShouldResemble, Quotas{
+					MessagesPerSecond: Quota{Limit: 10, Action: Drop},
+					Subscriptions:     Quota{Limit: 5, Action: Drop},
+					PerUser:           true,
+				})
+			})
+			Convey(`Then other users should not get limits`, func() {
+				auth, err := plugin("id", "other", []byte("pencil"))
+				So(err, ShouldBeNil)
+				So(auth, ShouldNotImplement, (*SessionExpirer)(nil))
+				So(auth, ShouldNotImplement, (*PacketSizeLimiter)(nil))
+				So(auth, ShouldNotImplement, (*QuotaLimiter)(nil))
+			})
+		})
+
+		Convey(`When reading a file with an invalid option`, func() {
+			s := NewPasswordStore()
+			for _, options := range []string{"session-expiry", "session-expiry=forever", "session-expiry=-1s", "max-packet-size=0", "messages=-1", "bytes-action=ignore", "per-user=maybe", "unknown=1"} {
+				err := s.read(strings.NewReader("user:" + secret + " " + options + "\n"))
+				So(err, ShouldNotBeNil)
+			}
+		})
+
+		Convey(`When reading a file with an invalid secret`, func() {
+			s := NewPasswordStore()
+			So(s.SetPassword("user", []byte("pen")), ShouldBeNil)
+			err := s.read(strings.NewReader("user:SCRAM-SHA-256$4096:c2FsdA==$foo:bar\n"))
+			Convey(`Then there should be an error`, func() { So(err, ShouldNotBeNil) })
+			Convey(`Then the store should not be changed`, func() { So(s.CheckPassword("user", []byte("pen")), ShouldBeTrue) })
+		})
+	})
+}
+
+func TestPBKDF2(t *testing.T) {
+	Convey(`When deriving a key (RFC 7914 test vector)`, t, func() {
+		key := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1)
+		Convey(`Then it should match`, func() {
+			So(key, ShouldResemble, []byte{
+				0x55, 0xac, 0x04, 0x6e, 0x56, 0xe3, 0x08, 0x9f, 0xec, 0x16, 0x91, 0xc2, 0x25, 0x44, 0xb6, 0x05,
+				0xf9, 0x41, 0x85, 0x21, 0x6d, 0xde, 0x04, 0x65, 0xe6, 0x8b, 0x9d, 0x57, 0xc2, 0x0d, 0xac, 0xbc,
+			})
+		})
+	})
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"os/user"
+	"strconv"
+)
+
+// PeerCredentials are the credentials of the process on the other end of a Unix socket (SO_PEERCRED)
+type PeerCredentials struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+// lookupUsername returns the name of the Unix user with the uid, or the uid if the user is unknown
+var lookupUsername = func(uid uint32) string {
+	id := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(id); err == nil {
+		return u.Username
+	}
+	return id
+}
+
+// PeerPlugin returns a ConnectionPlugin that authenticates clients on Unix sockets by the user of their process
+// The username of the client is the name of the Unix user, clients that send another username are not authorized.
+// If users is not empty, only the Unix users with those names or uids are authorized. Clients are authorized by the
+// given plugin.
+func PeerPlugin(users []string, authorize Plugin) ConnectionPlugin {
+	return func(conn Connection, clientIdentifier string, username string, password []byte) (Interface, error) {
+		if conn.Peer == nil {
+			return nil, ErrNotAuthorized
+		}
+		name := lookupUsername(conn.Peer.UID)
+		if username != "" && username != name {
+			return nil, ErrNotAuthorized
+		}
+		if len(users) > 0 {
+			var allowed bool
+			uid := strconv.FormatUint(uint64(conn.Peer.UID), 10)
+			for _, user := range users {
+				if user == name || user == uid {
+					allowed = true
+				}
+			}
+			if !allowed {
+				return nil, ErrNotAuthorized
+			}
+		}
+		return authorize(clientIdentifier, name, nil)
+	}
+}
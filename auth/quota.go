@@ -0,0 +1,74 @@
+package auth
+
+import "fmt"
+
+// QuotaAction is the action that is taken when a client exceeds a quota
+type QuotaAction byte
+
+// Quota actions
+const (
+	// Throttle stops reading from the client until it is within the quota
+	Throttle QuotaAction = iota
+	// Drop drops the messages or subscriptions that exceed the quota
+	Drop
+	// Disconnect disconnects the client
+	Disconnect
+)
+
+var quotaActionNames = map[QuotaAction]string{
+	Throttle:   "throttle",
+	Drop:       "drop",
+	Disconnect: "disconnect",
+}
+
+func (a QuotaAction) String() string {
+	return quotaActionNames[a]
+}
+
+// ParseQuotaAction parses the name of a quota action
+func ParseQuotaAction(name string) (QuotaAction, error) {
+	for action, actionName := range quotaActionNames {
+		if name == actionName {
+			return action, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown quota action: %s", name)
+}
+
+// Quota is a limit and the action when it is exceeded
+// A Limit of zero means no limit.
+type Quota struct {
+	Limit  int
+	Action QuotaAction
+}
+
+// Quotas limit the publishing and subscribing of clients
+type Quotas struct {
+	// MessagesPerSecond limits the number of PUBLISH packets
+	MessagesPerSecond Quota
+	// BytesPerSecond limits the size of the payloads of PUBLISH packets
+	BytesPerSecond Quota
+	// Subscriptions limits the number of subscriptions of a session
+	// Subscriptions can not be throttled, so they are dropped instead.
+	Subscriptions Quota
+	// PerUser shares the messages and bytes per second between all clients of a user
+	PerUser bool
+}
+
+// QuotaLimiter can be implemented by an Interface to override the quotas of the server for a user
+// Quotas is called with the quotas of the server and returns the quotas of the user.
+type QuotaLimiter interface {
+	Quotas(server Quotas) Quotas
+}
+
+// quota returns the quota with the name that is used in configs (messages, bytes or subscriptions)
+func (q *Quotas) quota(name string) *Quota {
+	switch name {
+	case "messages":
+		return &q.MessagesPerSecond
+	case "bytes":
+		return &q.BytesPerSecond
+	default:
+		return &q.Subscriptions
+	}
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errInvalidSCRAMMessage = errors.New("invalid SCRAM message")
+
+// SCRAMSHA256 is the SCRAM-SHA-256 authentication method (RFC 7677)
+type SCRAMSHA256 struct {
+	store     *PasswordStore
+	authorize Plugin
+}
+
+// NewSCRAMSHA256 returns the SCRAM-SHA-256 authentication method for the users in the password store
+// Authenticated clients are authorized by the given plugin, which is called with a nil password, and get the limits
+// of the user in the store.
+func NewSCRAMSHA256(store *PasswordStore, authorize Plugin) *SCRAMSHA256 {
+	return &SCRAMSHA256{store: store, authorize: authorize}
+}
+
+// Name of the method
+func (m *SCRAMSHA256) Name() string { return "SCRAM-SHA-256" }
+
+// Start an authentication exchange
+func (m *SCRAMSHA256) Start(clientIdentifier string, username string) Exchange {
+	return &scramExchange{method: m, clientIdentifier: clientIdentifier, username: username}
+}
+
+type scramExchange struct {
+	method           *SCRAMSHA256
+	clientIdentifier string
+	username         string
+	step             int
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	secret          scramSecret
+	known           bool
+}
+
+func (e *scramExchange) Respond(data []byte) (response []byte, result Interface, err error) {
+	e.step++
+	switch e.step {
+	case 1:
+		response, err = e.clientFirst(string(data))
+		return response, nil, err
+	case 2:
+		return e.clientFinal(string(data))
+	}
+	return nil, nil, errInvalidSCRAMMessage
+}
+
+// clientFirst handles the client-first-message and returns the server-first-message
+func (e *scramExchange) clientFirst(msg string) ([]byte, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") || parts[1] != "" {
+		return nil, errInvalidSCRAMMessage // channel binding and authzid are not supported
+	}
+	e.gs2Header = parts[0] + ",,"
+	e.clientFirstBare = parts[2]
+	attrs, err := scramAttributes(e.clientFirstBare, "n", "r")
+	if err != nil {
+		return nil, err
+	}
+	username, err := decodeSASLName(attrs[0])
+	if err != nil {
+		return nil, err
+	}
+	if e.username != "" && username != e.username {
+		return nil, ErrNotAuthorized
+	}
+	e.username = username
+	e.secret, e.known = e.method.store.secret(username)
+	if !e.known {
+		// Continue the exchange with a fake secret, so that unknown users can not be discovered
+		e.secret = e.method.store.unknownSecret(username)
+	}
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	e.nonce = attrs[1] + base64.StdEncoding.EncodeToString(serverNonce)
+	e.serverFirst = "r=" + e.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(e.secret.salt) +
+		",i=" + strconv.Itoa(e.secret.iterations)
+	return []byte(e.serverFirst), nil
+}
+
+// clientFinal handles the client-final-message and returns the server-final-message
+func (e *scramExchange) clientFinal(msg string) ([]byte, Interface, error) {
+	proofIdx := strings.LastIndex(msg, ",p=")
+	if proofIdx < 0 {
+		return nil, nil, errInvalidSCRAMMessage
+	}
+	withoutProof := msg[:proofIdx]
+	attrs, err := scramAttributes(withoutProof, "c", "r")
+	if err != nil {
+		return nil, nil, err
+	}
+	if attrs[0] != base64.StdEncoding.EncodeToString([]byte(e.gs2Header)) || attrs[1] != e.nonce {
+		return nil, nil, errInvalidSCRAMMessage
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[proofIdx+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, nil, errInvalidSCRAMMessage
+	}
+	if !e.known {
+		return nil, nil, ErrNotAuthorized
+	}
+	authMessage := []byte(e.clientFirstBare + "," + e.serverFirst + "," + withoutProof)
+	clientSignature := hmacSHA256(e.secret.storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientSignature[i] // proof is now the ClientKey
+	}
+	storedKey := sha256.Sum256(proof)
+	if !hmac.Equal(storedKey[:], e.secret.storedKey) {
+		return nil, nil, ErrNotAuthorized
+	}
+	result, err := e.method.authorize(e.clientIdentifier, e.username, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverSignature := hmacSHA256(e.secret.serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), e.method.store.withLimits(e.username, result), nil
+}
+
+// scramAttributes returns the values of the given leading attributes of a SCRAM message
+// Extensions after the given attributes are ignored.
+func scramAttributes(msg string, names ...string) ([]string, error) {
+	parts := strings.Split(msg, ",")
+	if len(parts) < len(names) {
+		return nil, errInvalidSCRAMMessage
+	}
+	values := make([]string, len(names))
+	for i, name := range names {
+		if !strings.HasPrefix(parts[i], name+"=") {
+			return nil, errInvalidSCRAMMessage
+		}
+		values[i] = parts[i][len(name)+1:]
+	}
+	for _, part := range parts[len(names):] {
+		if strings.HasPrefix(part, "m=") {
+			return nil, errInvalidSCRAMMessage // mandatory extensions are not supported
+		}
+	}
+	return values, nil
+}
+
+func decodeSASLName(name string) (string, error) {
+	for i := 0; i < len(name); i++ {
+		if name[i] == '=' && !strings.HasPrefix(name[i:], "=2C") && !strings.HasPrefix(name[i:], "=3D") {
+			return "", errInvalidSCRAMMessage
+		}
+	}
+	return strings.Replace(strings.Replace(name, "=2C", ",", -1), "=3D", "=", -1), nil
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// scramClientFinal returns the client-final-message and the expected server-final-message
+func scramClientFinal(password, clientFirstBare, serverFirst string) (string, string) {
+	attrs, _ := scramAttributes(serverFirst, "r", "s", "i")
+	salt, _ := base64.StdEncoding.DecodeString(attrs[1])
+	iterations, _ := strconv.Atoi(attrs[2])
+	saltedPassword := pbkdf2SHA256([]byte(password), salt, iterations)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + attrs[0]
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," + withoutProof)
+	clientSignature := hmacSHA256(storedKey[:], authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= clientSignature[i]
+	}
+	serverSignature := hmacSHA256(hmacSHA256(saltedPassword, []byte("Server Key")), authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey),
+		"v=" + base64.StdEncoding.EncodeToString(serverSignature)
+}
+
+func TestSCRAMSHA256(t *testing.T) {
+	Convey(`Given the SCRAM-SHA-256 method`, t, func() {
+		store := NewPasswordStore()
+		store.SetPassword("user", []byte("pencil"))
+		method := NewSCRAMSHA256(store, NoAuth)
+		So(method.Name(), ShouldEqual, "SCRAM-SHA-256")
+
+		clientFirstBare := "n=user,r=rOprNGfwEbeRWgbNEkqO"
+
+		Convey(`When a user with limits in the password file authenticates`, func() {
+			secret, err := SCRAMSecret([]byte("pencil"))
+			So(err, ShouldBeNil)
+			So(store.read(strings.NewReader("user:"+secret+" session-expiry=1m\n")), ShouldBeNil)
+			exchange := method.Start("id", "")
+			serverFirst, _, err := exchange.Respond([]byte("n,," + clientFirstBare))
+			So(err, ShouldBeNil)
+			clientFinal, _ := scramClientFinal("pencil", clientFirstBare, string(serverFirst))
+			_, result, err := exchange.Respond([]byte(clientFinal))
+			So(err, ShouldBeNil)
+			Convey(`Then the user should get its limits`, func() {
+				So(result, ShouldImplement, (*SessionExpirer)(nil))
+				expiry, ok := result.(SessionExpirer).SessionExpiry()
+				So(ok, ShouldBeTrue)
+				So(expiry, ShouldEqual, time.Minute)
+			})
+		})
+
+		Convey(`When a client starts an exchange`, func() {
+			exchange := method.Start("id", "")
+			serverFirst, result, err := exchange.Respond([]byte("n,," + clientFirstBare))
+			Convey(`Then the server should send a challenge`, func() {
+				So(err, ShouldBeNil)
+				So(result, ShouldBeNil)
+				So(string(serverFirst), ShouldStartWith, "r=rOprNGfwEbeRWgbNEkqO")
+				So(string(serverFirst), ShouldContainSubstring, ",i=4096")
+			})
+
+			Convey(`When the client sends the correct proof`, func() {
+				clientFinal, expected := scramClientFinal("pencil", clientFirstBare, string(serverFirst))
+				serverFinal, result, err := exchange.Respond([]byte(clientFinal))
+				Convey(`Then the user should be authenticated`, func() {
+					So(err, ShouldBeNil)
+					So(result, ShouldNotBeNil)
+					So(result.Username(), ShouldEqual, "user")
+				})
+				Convey(`Then the server should prove that it knows the password`, func() {
+					So(string(serverFinal), ShouldEqual, expected)
+				})
+				Convey(`Then the exchange should not continue`, func() {
+					_, _, err := exchange.Respond([]byte(clientFinal))
+					So(err, ShouldNotBeNil)
+				})
+			})
+
+			Convey(`When the client sends a wrong proof`, func() {
+				clientFinal, _ := scramClientFinal("pen", clientFirstBare, string(serverFirst))
+				_, result, err := exchange.Respond([]byte(clientFinal))
+				Convey(`Then the user should not be authenticated`, func() {
+					So(err, ShouldEqual, ErrNotAuthorized)
+					So(result, ShouldBeNil)
+				})
+			})
+
+			Convey(`When the client changes the nonce`, func() {
+				clientFinal, _ := scramClientFinal("pencil", clientFirstBare, string(serverFirst))
+				_, _, err := exchange.Respond([]byte(strings.Replace(clientFinal, "r=rOpr", "r=xxxx", 1)))
+				Convey(`Then there should be an error`, func() { So(err, ShouldNotBeNil) })
+			})
+		})
+
+		Convey(`When an unknown user starts an exchange`, func() {
+			exchange := method.Start("id", "")
+			clientFirstBare := "n=other,r=rOprNGfwEbeRWgbNEkqO"
+			serverFirst, _, err := exchange.Respond([]byte("n,," + clientFirstBare))
+			Convey(`Then the server should send a challenge`, func() { So(err, ShouldBeNil) })
+			Convey(`Then the user should not be authenticated`, func() {
+				clientFinal, _ := scramClientFinal("pencil", clientFirstBare, string(serverFirst))
+				_, _, err := exchange.Respond([]byte(clientFinal))
+				So(err, ShouldEqual, ErrNotAuthorized)
+			})
+			Convey(`Then the salt should be the same in the next exchange`, func() {
+				nextServerFirst, _, err := method.Start("id", "").Respond([]byte("n,," + clientFirstBare))
+				So(err, ShouldBeNil)
+				salt := func(serverFirst []byte) string { return strings.Split(string(serverFirst), ",")[1] }
+				So(salt(nextServerFirst), ShouldEqual, salt(serverFirst))
+			})
+		})
+
+		Convey(`When the username does not match the CONNECT username`, func() {
+			_, _, err := method.Start("id", "other").Respond([]byte("n,," + clientFirstBare))
+			Convey(`Then there should be an error`, func() { So(err, ShouldEqual, ErrNotAuthorized) })
+		})
+
+		Convey(`When the client requests channel binding`, func() {
+			_, _, err := method.Start("id", "").Respond([]byte("p=tls-unique,," + clientFirstBare))
+			Convey(`Then there should be an error`, func() { So(err, ShouldNotBeNil) })
+		})
+	})
+}
+
+func TestDecodeSASLName(t *testing.T) {
+	Convey(`When decoding SASL names`, t, func() {
+		name, err := decodeSASLName("a=2Cb=3Dc")
+		So(err, ShouldBeNil)
+		So(name, ShouldEqual, "a,b=c")
+		_, err = decodeSASLName("a=b")
+		So(err, ShouldNotBeNil)
+	})
+}
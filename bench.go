@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/htdvisser/pkg/config"
+	"github.com/htdvisser/squatt/bench"
+	"github.com/htdvisser/squatt/client"
+	"github.com/htdvisser/squatt/server"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var benchCfg *config.Config
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Benchmark a broker",
+	Long:  "Benchmark a broker with publishers and subscribers, and report throughput, latency and message loss.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := benchCfg.ReadInConfig(); err != nil {
+			log.Debug("not using config file", zap.Error(err))
+		}
+		tlsConfig, clientConfig, err := brokerClientConfig(benchCfg)
+		if err != nil {
+			log.Fatal("invalid broker config", zap.Error(err))
+		}
+		if clientConfig.ClientID == "" {
+			clientConfig.ClientID = "bench"
+		}
+		clientConfig.CleanSession = true
+
+		dial := func(ctx context.Context, config client.Config) (*client.Client, error) {
+			return client.Dial(ctx, "tcp", benchCfg.GetString("broker.address"), tlsConfig, config)
+		}
+		if benchCfg.GetBool("in-process") {
+			s := server.NewServer()
+			go s.Route()
+			go s.Reap()
+			dial = bench.InProcess(s)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigChan
+			cancel()
+		}()
+
+		config := bench.Config{
+			Client:       clientConfig,
+			Publishers:   benchCfg.GetInt("publishers"),
+			Subscribers:  benchCfg.GetInt("subscribers"),
+			Topics:       benchCfg.GetInt("topics"),
+			Prefix:       benchCfg.GetString("prefix"),
+			PayloadSize:  benchCfg.GetInt("payload-size"),
+			QoS:          byte(benchCfg.GetInt("qos")),
+			Rate:         benchCfg.GetInt("rate"),
+			Duration:     benchCfg.GetDuration("duration"),
+			DrainTimeout: benchCfg.GetDuration("drain-timeout"),
+		}
+		log.Info("starting benchmark",
+			zap.Int("publishers", config.Publishers),
+			zap.Int("subscribers", config.Subscribers),
+			zap.Int("topics", config.Topics),
+			zap.Duration("duration", config.Duration),
+		)
+		result, err := bench.Run(ctx, dial, config)
+		if err != nil {
+			log.Fatal("benchmark failed", zap.Error(err))
+		}
+		result.Report(os.Stdout)
+	},
+}
+
+type benchConfig struct {
+	Broker       brokerConfig  `name:"broker"`
+	InProcess    bool          `name:"in-process" description:"Benchmark an in-process server instead of the broker"`
+	Publishers   int           `name:"publishers" description:"Number of publishers"`
+	Subscribers  int           `name:"subscribers" description:"Number of subscribers"`
+	Topics       int           `name:"topics" description:"Number of topics that publishers and subscribers are distributed over"`
+	Prefix       string        `name:"prefix" description:"Prefix of the topics (default random)"`
+	PayloadSize  int           `name:"payload-size" description:"Size of the payload of messages in bytes (minimum 16)"`
+	QoS          int           `name:"qos" description:"QoS of messages and subscriptions (0, 1 or 2)"`
+	Rate         int           `name:"rate" description:"Messages per second of each publisher (0 for no limit)"`
+	Duration     time.Duration `name:"duration" description:"Duration of publishing"`
+	DrainTimeout time.Duration `name:"drain-timeout" description:"Maximum time to wait for messages after publishing stops"`
+}
+
+func benchDefaults() (defaults benchConfig) {
+	config := bench.DefaultConfig()
+	defaults.Broker = defaultBrokerConfig()
+	defaults.Publishers = config.Publishers
+	defaults.Subscribers = config.Subscribers
+	defaults.Topics = config.Topics
+	defaults.PayloadSize = config.PayloadSize
+	defaults.Rate = config.Rate
+	defaults.Duration = config.Duration
+	defaults.DrainTimeout = config.DrainTimeout
+	return
+}
+
+func init() {
+	benchCfg = config.Initialize("squatt", benchDefaults())
+	benchCmd.Flags().AddFlagSet(benchCfg.Flags())
+	cmd.AddCommand(benchCmd)
+}
@@ -0,0 +1,308 @@
+// Package bench generates load on an MQTT broker and measures throughput, latency and loss
+//
+// Publishers publish to topics under a prefix, subscribers each subscribe to one of these topics. Messages contain
+// the time at which they were published, the publisher and a sequence number, so that subscribers can measure the
+// end-to-end latency and count lost and duplicate messages.
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/htdvisser/squatt/client"
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/server"
+)
+
+// headerSize is the size of the time, publisher and sequence number at the start of payloads
+const headerSize = 16
+
+// Dialer connects a client to the broker
+type Dialer func(ctx context.Context, config client.Config) (*client.Client, error)
+
+// InProcess returns a Dialer that connects clients to the server in-process
+func InProcess(s *server.Server) Dialer {
+	return func(ctx context.Context, config client.Config) (*client.Client, error) {
+		clientConn, serverConn := net.Pipe()
+		go s.ServeConn(serverConn, server.InProcessListener("bench"))
+		return client.Connect(ctx, clientConn, config)
+	}
+}
+
+// Config of a benchmark
+type Config struct {
+	// Client is the config of the clients, the client identifiers get the index of the client as suffix
+	Client      client.Config
+	Publishers  int
+	Subscribers int
+	// Topics is the number of topics that publishers and subscribers are distributed over
+	// Each message is delivered to Subscribers/Topics subscribers.
+	Topics int
+	// Prefix of the topics, a random prefix is used if empty
+	Prefix      string
+	PayloadSize int
+	QoS         byte
+	// Rate is the number of messages per second of each publisher, at most one per nanosecond, zero for no limit
+	Rate int
+	// Duration of publishing
+	Duration time.Duration
+	// DrainTimeout is the maximum time to wait for messages after publishing stops
+	DrainTimeout time.Duration
+}
+
+// DefaultConfig returns the default config of a benchmark
+func DefaultConfig() Config {
+	return Config{
+		Client:       client.Config{ClientID: "bench", CleanSession: true, KeepAlive: time.Minute},
+		Publishers:   1,
+		Subscribers:  1,
+		Topics:       1,
+		PayloadSize:  64,
+		QoS:          0,
+		Rate:         100,
+		Duration:     10 * time.Second,
+		DrainTimeout: 5 * time.Second,
+	}
+}
+
+func (c Config) validate() error {
+	switch {
+	case c.Publishers < 1:
+		return errors.New("need at least one publisher")
+	case c.Subscribers < 0:
+		return errors.New("invalid number of subscribers")
+	case c.Topics < 1:
+		return errors.New("need at least one topic")
+	case c.QoS > 2:
+		return errors.New("invalid QoS")
+	case c.Rate < 0 || c.Rate > int(time.Second):
+		return errors.New("invalid rate")
+	case c.Duration <= 0:
+		return errors.New("invalid duration")
+	}
+	return nil
+}
+
+func (c Config) topic(i int) string {
+	return fmt.Sprintf("%s/%d", c.Prefix, i%c.Topics)
+}
+
+// Result of a benchmark
+type Result struct {
+	Duration   time.Duration // time that publishers published
+	Published  uint64
+	Errors     uint64 // messages that could not be published
+	Expected   uint64 // deliveries of the published messages to subscribers
+	Received   uint64 // deliveries, without duplicates
+	Duplicates uint64
+	Latencies  []time.Duration // sorted end-to-end latencies of received messages
+}
+
+// Lost returns the number of expected deliveries that were not received
+func (r Result) Lost() uint64 {
+	if r.Received > r.Expected {
+		return 0
+	}
+	return r.Expected - r.Received
+}
+
+// Percentile returns the latency percentile (0-100)
+func (r Result) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	return r.Latencies[int(p/100*float64(len(r.Latencies)-1)+0.5)]
+}
+
+// Report writes a report of the result
+func (r Result) Report(w io.Writer) error {
+	seconds := r.Duration.Seconds()
+	var lostPercentage float64
+	if r.Expected > 0 {
+		lostPercentage = float64(r.Lost()) / float64(r.Expected) * 100
+	}
+	_, err := fmt.Fprintf(w, `duration:   %s
+published:  %d (%.1f msg/s), %d errors
+received:   %d of %d (%.1f msg/s), %d duplicates
+lost:       %d (%.2f%%)
+latency:    p50 %s, p90 %s, p99 %s, max %s
+`,
+		r.Duration,
+		r.Published, float64(r.Published)/seconds, r.Errors,
+		r.Received, r.Expected, float64(r.Received)/seconds, r.Duplicates,
+		r.Lost(), lostPercentage,
+		r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100),
+	)
+	return err
+}
+
+// subscriber receives the messages of one topic
+type subscriber struct {
+	mu        sync.Mutex
+	seen      map[uint64]struct{} // publisher<<32 | sequence number
+	latencies []time.Duration
+	duplicate uint64
+}
+
+func (s *subscriber) receive(msg *packets.PublishPacket) {
+	now := time.Now()
+	if len(msg.Payload) < headerSize {
+		return
+	}
+	published := time.Unix(0, int64(binary.BigEndian.Uint64(msg.Payload)))
+	id := binary.BigEndian.Uint64(msg.Payload[8:])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[id]; ok {
+		s.duplicate++
+		return
+	}
+	s.seen[id] = struct{}{}
+	s.latencies = append(s.latencies, now.Sub(published))
+}
+
+// Run runs the benchmark
+func Run(ctx context.Context, dial Dialer, config Config) (*Result, error) {
+	if config.PayloadSize < headerSize {
+		config.PayloadSize = headerSize
+	}
+	if config.Prefix == "" {
+		config.Prefix = fmt.Sprintf("bench/%08x", rand.Uint32())
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	var clients []*client.Client
+	defer func() {
+		for _, c := range clients {
+			c.Disconnect()
+		}
+	}()
+	connect := func(name string, i int, onPublish func(*packets.PublishPacket)) (*client.Client, error) {
+		clientConfig := config.Client
+		clientConfig.ClientID = fmt.Sprintf("%s-%s-%d", config.Client.ClientID, name, i)
+		clientConfig.OnPublish = onPublish
+		c, err := dial(ctx, clientConfig)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+		return c, nil
+	}
+
+	subscribersPerTopic := make([]uint64, config.Topics)
+	subscribers := make([]*subscriber, config.Subscribers)
+	for i := range subscribers {
+		sub := &subscriber{seen: make(map[uint64]struct{})}
+		subscribers[i] = sub
+		c, err := connect("sub", i, sub.receive)
+		if err != nil {
+			return nil, err
+		}
+		subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subscribe.Topics, subscribe.Qoss = []string{config.topic(i)}, []byte{config.QoS}
+		suback, err := c.Subscribe(ctx, subscribe)
+		if err != nil {
+			return nil, err
+		}
+		if suback.ReturnCodes[0] >= packets.UnspecifiedError {
+			return nil, fmt.Errorf("subscription refused with reason code 0x%02X", suback.ReturnCodes[0])
+		}
+		subscribersPerTopic[i%config.Topics]++
+	}
+
+	publishers := make([]*client.Client, config.Publishers)
+	for i := range publishers {
+		c, err := connect("pub", i, nil)
+		if err != nil {
+			return nil, err
+		}
+		publishers[i] = c
+	}
+
+	var result Result
+	publishCtx, cancel := context.WithTimeout(ctx, config.Duration)
+	defer cancel()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, c := range publishers {
+		wg.Add(1)
+		go func(i int, c *client.Client) {
+			defer wg.Done()
+			var tick <-chan time.Time
+			if config.Rate > 0 {
+				ticker := time.NewTicker(time.Second / time.Duration(config.Rate))
+				defer ticker.Stop()
+				tick = ticker.C
+			}
+			for seq := uint32(0); ; seq++ {
+				if tick != nil {
+					select {
+					case <-tick:
+					case <-publishCtx.Done():
+						return
+					}
+				} else if publishCtx.Err() != nil {
+					return
+				}
+				msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				msg.TopicName, msg.Qos = config.topic(i), config.QoS
+				msg.Payload = make([]byte, config.PayloadSize)
+				binary.BigEndian.PutUint32(msg.Payload[8:], uint32(i))
+				binary.BigEndian.PutUint32(msg.Payload[12:], seq)
+				binary.BigEndian.PutUint64(msg.Payload, uint64(time.Now().UnixNano()))
+				if err := c.Publish(ctx, msg); err != nil {
+					atomic.AddUint64(&result.Errors, 1)
+					if ctx.Err() != nil {
+						return
+					}
+					continue
+				}
+				atomic.AddUint64(&result.Published, 1)
+				atomic.AddUint64(&result.Expected, subscribersPerTopic[i%config.Topics])
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	result.Duration = time.Since(start)
+
+	received := func() (received uint64) {
+		for _, sub := range subscribers {
+			sub.mu.Lock()
+			received += uint64(len(sub.seen))
+			sub.mu.Unlock()
+		}
+		return
+	}
+	drainTimeout := time.After(config.DrainTimeout)
+drain:
+	for received() < result.Expected {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-drainTimeout:
+			break drain
+		case <-ctx.Done():
+			break drain
+		}
+	}
+
+	for _, sub := range subscribers {
+		sub.mu.Lock()
+		result.Received += uint64(len(sub.seen))
+		result.Duplicates += sub.duplicate
+		result.Latencies = append(result.Latencies, sub.latencies...)
+		sub.mu.Unlock()
+	}
+	sort.Slice(result.Latencies, func(i, j int) bool { return result.Latencies[i] < result.Latencies[j] })
+	return &result, nil
+}
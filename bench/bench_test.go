@@ -0,0 +1,60 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBench(t *testing.T) {
+	Convey(`Given an in-process Server`, t, func() {
+		s := server.NewServer()
+		go s.Route()
+
+		Convey(`When a benchmark runs`, func() {
+			config := DefaultConfig()
+			config.Publishers, config.Subscribers, config.Topics = 2, 4, 2
+			config.QoS, config.Rate, config.Duration = 1, 100, 200*time.Millisecond
+			result, err := Run(context.Background(), InProcess(s), config)
+
+			Convey(`Then all messages should be delivered`, func() {
+				So(err, ShouldBeNil)
+				So(result.Published, ShouldBeGreaterThan, 0)
+				So(result.Errors, ShouldEqual, 0)
+				So(result.Expected, ShouldEqual, result.Published*2)
+				So(result.Received, ShouldEqual, result.Expected)
+				So(result.Lost(), ShouldEqual, 0)
+				So(result.Latencies, ShouldHaveLength, result.Received)
+				So(result.Percentile(50), ShouldBeLessThanOrEqualTo, result.Percentile(100))
+			})
+
+			Convey(`Then the report should be written`, func() {
+				var buf bytes.Buffer
+				So(result.Report(&buf), ShouldBeNil)
+				So(buf.String(), ShouldContainSubstring, "lost:       0 (0.00%)")
+			})
+		})
+
+		Convey(`When a benchmark has no publishers`, func() {
+			config := DefaultConfig()
+			config.Publishers = 0
+			_, err := Run(context.Background(), InProcess(s), config)
+			Convey(`Then it should fail`, func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey(`When a benchmark has a rate of more than one message per nanosecond`, func() {
+			config := DefaultConfig()
+			config.Rate = int(time.Second) + 1
+			_, err := Run(context.Background(), InProcess(s), config)
+			Convey(`Then it should fail`, func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
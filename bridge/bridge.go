@@ -0,0 +1,279 @@
+// Package bridge forwards messages between the server and remote MQTT brokers
+package bridge
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/htdvisser/squatt/client"
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/server"
+	"github.com/htdvisser/squatt/topic"
+	"go.uber.org/zap"
+)
+
+// LoopProperty is the user property that bridges add to forwarded messages
+// Its value is the client identifier of the bridge, bridges do not forward messages that they already forwarded.
+const LoopProperty = "squatt-bridge"
+
+// Bridge forwards messages between the local server and a remote broker
+// The bridge connects to the local server in-process, so that its messages are handled like those of other
+// clients. The subscriptions on both sides are No Local, so that forwarded messages are not sent back.
+type Bridge struct {
+	server *server.Server
+	config Config
+	log    *zap.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	local *client.Client
+
+	mu            sync.Mutex
+	remote        *client.Client
+	remoteChanged chan struct{} // closed when remote changes
+}
+
+// New returns a new bridge for the server
+func New(s *server.Server, config Config) *Bridge {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Bridge{
+		server:        s,
+		config:        config,
+		log:           zap.NewNop(),
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+		remoteChanged: make(chan struct{}),
+	}
+}
+
+// SetLogger sets the logger
+func (b *Bridge) SetLogger(log *zap.Logger) {
+	b.log = log.With(zap.String("bridge", b.config.Name))
+}
+
+// Config returns the config of the bridge
+func (b *Bridge) Config() Config {
+	return b.config
+}
+
+// Start connects the bridge to the local server and starts connecting to the remote broker
+func (b *Bridge) Start() error {
+	clientConn, serverConn := net.Pipe()
+	go b.server.ServeConn(serverConn, server.InProcessListener("bridge-"+b.config.Name))
+	ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+	defer cancel()
+	local, err := client.Connect(ctx, clientConn, client.Config{
+		ClientID:     "bridge-" + b.config.Name,
+		CleanSession: true,
+		OnPublish:    b.forwardOut,
+	})
+	if err != nil {
+		return err
+	}
+	b.local = local
+	subscribe := b.subscribePacket(func(t Topic) (string, bool) { return t.localFilter(), t.Direction.out() })
+	if len(subscribe.Topics) > 0 {
+		if _, err = local.Subscribe(ctx, subscribe); err != nil {
+			local.Disconnect()
+			return err
+		}
+	}
+	go b.run()
+	return nil
+}
+
+// Stop disconnects the bridge
+func (b *Bridge) Stop() {
+	b.cancel()
+	<-b.done
+	b.local.Disconnect()
+}
+
+// Connected returns true if the bridge is connected to the remote broker
+func (b *Bridge) Connected() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.remote != nil
+}
+
+func (b *Bridge) subscribePacket(filter func(Topic) (string, bool)) *packets.SubscribePacket {
+	subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	for _, t := range b.config.Topics {
+		if filter, ok := filter(t); ok {
+			subscribe.Topics = append(subscribe.Topics, filter)
+			subscribe.Qoss = append(subscribe.Qoss, t.QoS)
+			subscribe.Options = append(subscribe.Options, packets.SubscriptionOptions{NoLocal: true, RetainAsPublished: true})
+		}
+	}
+	return subscribe
+}
+
+// run keeps the bridge connected to the remote broker, with exponential backoff between attempts
+func (b *Bridge) run() {
+	defer close(b.done)
+	backoff := b.config.ReconnectMin
+	for {
+		remote, err := b.connect()
+		if err == nil {
+			b.log.Info("bridge connected", zap.String("address", b.config.Address))
+			backoff = b.config.ReconnectMin
+			b.setRemote(remote)
+			select {
+			case <-remote.Done():
+				err = remote.Err()
+			case <-b.ctx.Done():
+				remote.Disconnect()
+			}
+			b.setRemote(nil)
+		}
+		if b.ctx.Err() != nil {
+			return
+		}
+		b.log.Warn("bridge disconnected", zap.String("address", b.config.Address), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-b.ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > b.config.ReconnectMax {
+			backoff = b.config.ReconnectMax
+		}
+	}
+}
+
+func (b *Bridge) connect() (*client.Client, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+	defer cancel()
+	remote, err := client.Dial(ctx, "tcp", b.config.Address, b.config.TLS, client.Config{
+		Version:      b.config.Version,
+		ClientID:     b.config.ClientID,
+		Username:     b.config.Username,
+		Password:     b.config.Password,
+		CleanSession: b.config.CleanSession,
+		KeepAlive:    b.config.KeepAlive,
+		OnPublish:    b.forwardIn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	subscribe := b.subscribePacket(func(t Topic) (string, bool) { return t.remoteFilter(), t.Direction.in() })
+	if len(subscribe.Topics) > 0 {
+		if _, err = remote.Subscribe(ctx, subscribe); err != nil {
+			remote.Close()
+			return nil, err
+		}
+	}
+	return remote, nil
+}
+
+func (b *Bridge) setRemote(remote *client.Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remote = remote
+	close(b.remoteChanged)
+	b.remoteChanged = make(chan struct{})
+}
+
+// waitRemote returns the connection to the remote broker, waiting for it if the bridge is not connected
+// It returns nil if the bridge is stopped, or if the bridge is not connected and wait is false.
+func (b *Bridge) waitRemote(wait bool) *client.Client {
+	for {
+		b.mu.Lock()
+		remote, changed := b.remote, b.remoteChanged
+		b.mu.Unlock()
+		if remote != nil && !closed(remote) || !wait {
+			return remote
+		}
+		select {
+		case <-changed:
+		case <-b.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// forwarded returns true if the bridge already forwarded the message
+func (b *Bridge) forwarded(msg *packets.PublishPacket) bool {
+	for _, prop := range msg.Properties.UserProperties {
+		if prop.Key == LoopProperty && prop.Value == b.config.ClientID {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite returns the message for the other side of the bridge, or nil if it should not be forwarded
+func (b *Bridge) rewrite(msg *packets.PublishPacket, out bool) *packets.PublishPacket {
+	if b.forwarded(msg) {
+		return nil
+	}
+	for _, t := range b.config.Topics {
+		from, to, filter := t.RemotePrefix, t.LocalPrefix, t.remoteFilter()
+		if out {
+			from, to, filter = t.LocalPrefix, t.RemotePrefix, t.localFilter()
+		}
+		if (out && !t.Direction.out()) || (!out && !t.Direction.in()) {
+			continue
+		}
+		if !strings.HasPrefix(msg.TopicName, from) || !topic.Match(filter, msg.TopicName) {
+			continue
+		}
+		forward := *msg
+		forward.TopicName = to + strings.TrimPrefix(msg.TopicName, from)
+		forward.Properties = msg.Properties.Copy()
+		forward.Properties.TopicAlias = nil
+		forward.Properties.SubscriptionIdentifiers = nil
+		forward.Properties.UserProperties = append(forward.Properties.UserProperties, packets.UserProperty{Key: LoopProperty, Value: b.config.ClientID})
+		return &forward
+	}
+	return nil
+}
+
+// forwardOut forwards a message of the local server to the remote broker
+// Messages with QoS 1 and 2 wait until the bridge is connected, so that they stay queued in the local session.
+func (b *Bridge) forwardOut(msg *packets.PublishPacket) {
+	forward := b.rewrite(msg, true)
+	if forward == nil {
+		return
+	}
+	for {
+		remote := b.waitRemote(forward.Qos > 0)
+		if remote == nil {
+			return
+		}
+		err := remote.Publish(b.ctx, forward)
+		if err != nil && closed(remote) && forward.Qos > 0 {
+			continue // retry when the bridge is reconnected
+		}
+		if err != nil {
+			b.log.Debug("message not forwarded", zap.String("topic", forward.TopicName), zap.Error(err))
+		}
+		return
+	}
+}
+
+func closed(c *client.Client) bool {
+	select {
+	case <-c.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// forwardIn publishes a message of the remote broker on the local server
+func (b *Bridge) forwardIn(msg *packets.PublishPacket) {
+	forward := b.rewrite(msg, false)
+	if forward == nil {
+		return
+	}
+	if err := b.local.Publish(b.ctx, forward); err != nil {
+		b.log.Debug("message not forwarded", zap.String("topic", forward.TopicName), zap.Error(err))
+	}
+}
@@ -0,0 +1,154 @@
+package bridge
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/client"
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBridge(t *testing.T) {
+	Convey(`Given an edge Server and a central Server`, t, func() {
+		edge, central := server.NewServer(), server.NewServer()
+		go edge.Route()
+		go central.Route()
+		lis, err := net.Listen("tcp", "localhost:0")
+		So(err, ShouldBeNil)
+		go central.Serve(lis)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// connect returns a client of s that subscribes to filter
+		connect := func(s *server.Server, clientID, filter string) (*client.Client, chan *packets.PublishPacket) {
+			received := make(chan *packets.PublishPacket, 10)
+			clientConn, serverConn := net.Pipe()
+			go s.ServeConn(serverConn, server.ListenerConfig{Name: "test"})
+			c, err := client.Connect(ctx, clientConn, client.Config{ClientID: clientID, CleanSession: true, OnPublish: func(msg *packets.PublishPacket) {
+				received <- msg
+			}})
+			So(err, ShouldBeNil)
+			subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subscribe.Topics, subscribe.Qoss = []string{filter}, []byte{1}
+			_, err = c.Subscribe(ctx, subscribe)
+			So(err, ShouldBeNil)
+			return c, received
+		}
+
+		publish := func(c *client.Client, topicName string) {
+			msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			msg.TopicName, msg.Qos, msg.Payload = topicName, 1, []byte(topicName)
+			So(c.Publish(ctx, msg), ShouldBeNil)
+		}
+
+		receive := func(received chan *packets.PublishPacket, timeout time.Duration) string {
+			select {
+			case msg := <-received:
+				return msg.TopicName
+			case <-time.After(timeout):
+				return ""
+			}
+		}
+
+		config := DefaultConfig("central")
+		config.ClientID = "edge"
+		config.Address = lis.Addr().String()
+		config.ReconnectMin, config.ReconnectMax = 10*time.Millisecond, 100*time.Millisecond
+		config.Topics = []Topic{
+			{Pattern: "sensors/#", Direction: Out, QoS: 1, RemotePrefix: "edge/"},
+			{Pattern: "commands/#", Direction: In, QoS: 1, RemotePrefix: "edge/"},
+			{Pattern: "chat/#", Direction: Both, QoS: 1},
+		}
+		b := New(edge, config)
+		So(b.Start(), ShouldBeNil)
+		for i := 0; i < 100 && !b.Connected(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(b.Connected(), ShouldBeTrue)
+
+		Convey(`When a message is published on the edge`, func() {
+			edgeClient, _ := connect(edge, "edge-client", "#")
+			defer edgeClient.Disconnect()
+			centralClient, centralReceived := connect(central, "central-client", "#")
+			defer centralClient.Disconnect()
+			publish(edgeClient, "sensors/temperature")
+			Convey(`Then it should be forwarded to the central broker with the remote prefix`, func() {
+				So(receive(centralReceived, time.Second), ShouldEqual, "edge/sensors/temperature")
+			})
+		})
+
+		Convey(`When a message is published on the central broker`, func() {
+			edgeClient, edgeReceived := connect(edge, "edge-client", "#")
+			defer edgeClient.Disconnect()
+			centralClient, _ := connect(central, "central-client", "#")
+			defer centralClient.Disconnect()
+			publish(centralClient, "edge/commands/reboot")
+			publish(centralClient, "other/commands/reboot")
+			Convey(`Then only bridged topics should be forwarded to the edge without the remote prefix`, func() {
+				So(receive(edgeReceived, time.Second), ShouldEqual, "commands/reboot")
+				So(receive(edgeReceived, 100*time.Millisecond), ShouldBeEmpty)
+			})
+		})
+
+		Convey(`When a message is published on a topic that is bridged in both directions`, func() {
+			edgeClient, edgeReceived := connect(edge, "edge-client", "chat/#")
+			defer edgeClient.Disconnect()
+			centralClient, centralReceived := connect(central, "central-client", "chat/#")
+			defer centralClient.Disconnect()
+			publish(edgeClient, "chat/hello")
+			Convey(`Then it should be forwarded once and not come back`, func() {
+				So(receive(edgeReceived, time.Second), ShouldEqual, "chat/hello")
+				So(receive(centralReceived, time.Second), ShouldEqual, "chat/hello")
+				So(receive(edgeReceived, 100*time.Millisecond), ShouldBeEmpty)
+				So(receive(centralReceived, 100*time.Millisecond), ShouldBeEmpty)
+			})
+		})
+
+		Convey(`When the bridge is disconnected from the central broker`, func() {
+			edgeClient, _ := connect(edge, "edge-client", "#")
+			defer edgeClient.Disconnect()
+			centralClient, centralReceived := connect(central, "central-client", "#")
+			defer centralClient.Disconnect()
+			So(central.Kick("edge", packets.AdministrativeAction), ShouldBeNil)
+			publish(edgeClient, "sensors/humidity")
+			Convey(`Then it should reconnect and forward the messages that were published in the meantime`, func() {
+				So(receive(centralReceived, time.Second), ShouldEqual, "edge/sensors/humidity")
+				So(b.Connected(), ShouldBeTrue)
+			})
+		})
+
+		Reset(func() {
+			b.Stop()
+			lis.Close()
+		})
+	})
+}
+
+func TestBridgeWithPasswords(t *testing.T) {
+	Convey(`Given a Server that requires passwords`, t, func() {
+		s := server.NewServer()
+		go s.Route()
+		passwords := auth.NewPasswordStore()
+		So(passwords.SetPassword("user", []byte("secret")), ShouldBeNil)
+		s.SetAuth(passwords.Plugin(auth.NoAuth))
+
+		Convey(`When a bridge is started`, func() {
+			config := DefaultConfig("central")
+			config.Address = "localhost:1"
+			config.ReconnectMin, config.ReconnectMax = time.Second, time.Second
+			config.Topics = []Topic{{Pattern: "sensors/#", Direction: Out, QoS: 1}}
+			b := New(s, config)
+			err := b.Start()
+			Convey(`Then it should connect to the server without credentials`, func() {
+				So(err, ShouldBeNil)
+				b.Stop()
+			})
+		})
+	})
+}
@@ -0,0 +1,243 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/topic"
+)
+
+// Direction of the messages of a bridged topic
+type Direction byte
+
+// Directions
+const (
+	// Out forwards local messages to the remote broker
+	Out Direction = iota
+	// In forwards messages of the remote broker to the local server
+	In
+	// Both forwards messages in both directions
+	Both
+)
+
+var directionNames = map[Direction]string{
+	Out:  "out",
+	In:   "in",
+	Both: "both",
+}
+
+func (d Direction) String() string {
+	return directionNames[d]
+}
+
+func (d Direction) out() bool { return d == Out || d == Both }
+
+func (d Direction) in() bool { return d == In || d == Both }
+
+// Topic is a bridged topic pattern
+// The pattern is subscribed to with the LocalPrefix on the local server and with the RemotePrefix on the remote
+// broker. The prefixes of forwarded messages are replaced.
+type Topic struct {
+	Pattern      string
+	Direction    Direction
+	QoS          byte
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+func (t Topic) localFilter() string { return t.LocalPrefix + t.Pattern }
+
+func (t Topic) remoteFilter() string { return t.RemotePrefix + t.Pattern }
+
+// Config of a bridge
+type Config struct {
+	// Name of the bridge
+	Name string
+	// Address of the remote broker
+	Address string
+	// TLS config for the connection to the remote broker, nil for plain TCP
+	TLS *tls.Config
+	// ClientID of the bridge on the remote broker, also used for loop prevention
+	ClientID string
+	Username string
+	Password []byte
+	// Version is the protocol version for the remote broker
+	// MQTT 3.1.1 brokers can send forwarded messages back, because they do not support No Local subscriptions.
+	Version      byte
+	CleanSession bool
+	KeepAlive    time.Duration
+	// ReconnectMin and ReconnectMax limit the exponential backoff between connection attempts
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+	Topics       []Topic
+}
+
+// DefaultConfig returns the config with defaults for the bridge with the given name
+func DefaultConfig(name string) Config {
+	hostname, _ := os.Hostname()
+	return Config{
+		Name:         name,
+		ClientID:     hostname + "." + name,
+		Version:      packets.Version5,
+		KeepAlive:    time.Minute,
+		ReconnectMin: time.Second,
+		ReconnectMax: time.Minute,
+	}
+}
+
+func (c Config) validate() error {
+	if c.Address == "" {
+		return errors.New("no address")
+	}
+	if len(c.Topics) == 0 {
+		return errors.New("no topics")
+	}
+	for _, t := range c.Topics {
+		if err := topic.Validate(t.localFilter(), true); err != nil {
+			return fmt.Errorf("invalid local topic %s: %s", t.localFilter(), err)
+		}
+		if err := topic.Validate(t.remoteFilter(), true); err != nil {
+			return fmt.Errorf("invalid remote topic %s: %s", t.remoteFilter(), err)
+		}
+	}
+	return nil
+}
+
+// Settings of a bridge in the config of the server
+// Settings that are not set are taken from DefaultConfig.
+type Settings struct {
+	Name            string          `mapstructure:"name"`
+	Address         string          `mapstructure:"address"`
+	TLS             bool            `mapstructure:"tls"`
+	TLSCAFile       string          `mapstructure:"tls-ca-file"`
+	TLSInsecure     bool            `mapstructure:"tls-insecure"`
+	ClientID        string          `mapstructure:"client-id"`
+	Username        string          `mapstructure:"username"`
+	Password        string          `mapstructure:"password"`
+	ProtocolVersion string          `mapstructure:"protocol-version"` // 3.1.1 or 5
+	CleanSession    bool            `mapstructure:"clean-session"`
+	KeepAlive       time.Duration   `mapstructure:"keepalive"`
+	ReconnectMin    time.Duration   `mapstructure:"reconnect-min"`
+	ReconnectMax    time.Duration   `mapstructure:"reconnect-max"`
+	Topics          []TopicSettings `mapstructure:"topics"`
+}
+
+// TopicSettings are the settings of a bridged topic
+type TopicSettings struct {
+	Pattern      string `mapstructure:"pattern"`
+	Direction    string `mapstructure:"direction"` // out, in or both, default out
+	QoS          byte   `mapstructure:"qos"`
+	LocalPrefix  string `mapstructure:"local-prefix"`
+	RemotePrefix string `mapstructure:"remote-prefix"`
+}
+
+// Configs returns the configs of the bridges with the given settings
+// The settings are typically read from the bridges list in the config file of the server:
+//
+//	bridges:
+//	- name: central
+//	  address: central.example.com:8883
+//	  tls: true
+//	  tls-ca-file: ca.pem
+//	  username: edge
+//	  password: secret
+//	  topics:
+//	  - pattern: sensors/#
+//	    direction: out
+//	    qos: 1
+//	    remote-prefix: edge/
+//	  - pattern: commands/#
+//	    direction: in
+//	    qos: 1
+//	    local-prefix: edge/
+func Configs(settings []Settings) ([]Config, error) {
+	configs := make([]Config, 0, len(settings))
+	names := make(map[string]bool)
+	for _, s := range settings {
+		if s.Name == "" {
+			return nil, errors.New("bridge without name")
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("duplicate bridge %s", s.Name)
+		}
+		names[s.Name] = true
+		config, err := s.config()
+		if err == nil {
+			err = config.validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bridge %s: %s", s.Name, err)
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func (s Settings) config() (Config, error) {
+	c := DefaultConfig(s.Name)
+	c.Address = s.Address
+	if s.TLS || s.TLSCAFile != "" || s.TLSInsecure {
+		c.TLS = &tls.Config{InsecureSkipVerify: s.TLSInsecure}
+	}
+	if s.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(s.TLSCAFile)
+		if err != nil {
+			return c, err
+		}
+		c.TLS.RootCAs = x509.NewCertPool()
+		if !c.TLS.RootCAs.AppendCertsFromPEM(pem) {
+			return c, fmt.Errorf("no certificates in %s", s.TLSCAFile)
+		}
+	}
+	if s.ClientID != "" {
+		c.ClientID = s.ClientID
+	}
+	c.Username = s.Username
+	if s.Password != "" {
+		c.Password = []byte(s.Password)
+	}
+	switch s.ProtocolVersion {
+	case "":
+	case "3.1.1":
+		c.Version = packets.Version311
+	case "5":
+		c.Version = packets.Version5
+	default:
+		return c, fmt.Errorf("unsupported protocol version %s", s.ProtocolVersion)
+	}
+	c.CleanSession = s.CleanSession
+	if s.KeepAlive != 0 {
+		c.KeepAlive = s.KeepAlive
+	}
+	if s.ReconnectMin != 0 {
+		c.ReconnectMin = s.ReconnectMin
+	}
+	if s.ReconnectMax != 0 {
+		c.ReconnectMax = s.ReconnectMax
+	}
+	for _, t := range s.Topics {
+		topic := Topic{Pattern: t.Pattern, QoS: t.QoS, LocalPrefix: t.LocalPrefix, RemotePrefix: t.RemotePrefix}
+		if t.Direction != "" {
+			var ok bool
+			for direction, name := range directionNames {
+				if t.Direction == name {
+					topic.Direction, ok = direction, true
+				}
+			}
+			if !ok {
+				return c, fmt.Errorf("unknown direction %s", t.Direction)
+			}
+		}
+		if t.QoS > 2 {
+			return c, fmt.Errorf("invalid QoS %d", t.QoS)
+		}
+		c.Topics = append(c.Topics, topic)
+	}
+	return c, nil
+}
@@ -0,0 +1,79 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigs(t *testing.T) {
+	Convey(`Given bridge settings`, t, func() {
+		configs, err := Configs([]Settings{
+			{
+				Name:            "central",
+				Address:         "central.example.com:8883",
+				TLS:             true,
+				ClientID:        "edge",
+				Username:        "edge",
+				Password:        "secret password",
+				ProtocolVersion: "3.1.1",
+				KeepAlive:       30 * time.Second,
+				Topics: []TopicSettings{
+					{Pattern: "sensors/#", Direction: "out", QoS: 1, RemotePrefix: "edge/"},
+					{Pattern: "commands/#", Direction: "in", QoS: 2, LocalPrefix: "edge/"},
+					{Pattern: "chat/#", Direction: "both"},
+				},
+			},
+			{
+				Name:    "backup",
+				Address: "backup.example.com:1883",
+				Topics:  []TopicSettings{{Pattern: "#"}},
+			},
+		})
+		Convey(`Then they should be converted to configs`, func() {
+			So(err, ShouldBeNil)
+			So(configs, ShouldHaveLength, 2)
+			central := configs[0]
+			So(central.Name, ShouldEqual, "central")
+			So(central.Address, ShouldEqual, "central.example.com:8883")
+			So(central.TLS, ShouldNotBeNil)
+			So(central.ClientID, ShouldEqual, "edge")
+			So(central.Username, ShouldEqual, "edge")
+			So(string(central.Password), ShouldEqual, "secret password")
+			So(central.Version, ShouldEqual, packets.Version311)
+			So(central.CleanSession, ShouldBeFalse)
+			So(central.KeepAlive, ShouldEqual, 30*time.Second)
+			So(central.Topics, ShouldResemble, []Topic{
+				{Pattern: "sensors/#", Direction: Out, QoS: 1, RemotePrefix: "edge/"},
+				{Pattern: "commands/#", Direction: In, QoS: 2, LocalPrefix: "edge/"},
+				{Pattern: "chat/#", Direction: Both},
+			})
+			backup := configs[1]
+			So(backup.TLS, ShouldBeNil)
+			So(backup.Version, ShouldEqual, packets.Version5)
+			So(backup.KeepAlive, ShouldEqual, time.Minute)
+			So(backup.ReconnectMin, ShouldEqual, time.Second)
+			So(backup.Topics, ShouldResemble, []Topic{{Pattern: "#"}})
+		})
+	})
+
+	Convey(`Given invalid bridge settings`, t, func() {
+		topics := []TopicSettings{{Pattern: "#"}}
+		for _, settings := range [][]Settings{
+			{{Address: "localhost:1883", Topics: topics}},
+			{{Name: "foo", Topics: topics}},
+			{{Name: "foo", Address: "localhost:1883"}},
+			{{Name: "foo", Address: "localhost:1883", Topics: []TopicSettings{{Pattern: "#", Direction: "sideways"}}}},
+			{{Name: "foo", Address: "localhost:1883", Topics: []TopicSettings{{Pattern: "#", QoS: 3}}}},
+			{{Name: "foo", Address: "localhost:1883", Topics: []TopicSettings{{Pattern: "foo/#/bar"}}}},
+			{{Name: "foo", Address: "localhost:1883", Topics: topics, ProtocolVersion: "4"}},
+			{{Name: "foo", Address: "localhost:1883", Topics: topics, TLSCAFile: "does-not-exist.pem"}},
+			{{Name: "foo", Address: "localhost:1883", Topics: topics}, {Name: "foo", Address: "localhost:1884", Topics: topics}},
+		} {
+			_, err := Configs(settings)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/htdvisser/pkg/config"
+	"github.com/htdvisser/squatt/client"
+	"github.com/htdvisser/squatt/packets"
+)
+
+// brokerConfig is the config of the connection of the client commands to the broker
+type brokerConfig struct {
+	Address         string        `name:"address" description:"Address of the broker"`
+	TLS             bool          `name:"tls" description:"Connect with TLS"`
+	TLSCAFile       string        `name:"tls-ca-file" description:"Path to CA certificates for TLS (default system CAs)"`
+	TLSInsecure     bool          `name:"tls-insecure" description:"Do not verify the certificate of the broker"`
+	ClientID        string        `name:"client-id" description:"Client identifier (default generated by the broker)"`
+	Username        string        `name:"username" description:"Username"`
+	Password        string        `name:"password" description:"Password"`
+	ProtocolVersion string        `name:"protocol-version" description:"MQTT protocol version (3.1.1 or 5)"`
+	CleanSession    bool          `name:"clean-session" description:"Start a new session"`
+	KeepAlive       time.Duration `name:"keepalive" description:"Keep-alive"`
+	Timeout         time.Duration `name:"timeout" description:"Time for connecting to the broker and for acknowledgements"`
+}
+
+func defaultBrokerConfig() (defaults brokerConfig) {
+	defaults.Address = "localhost:1883"
+	defaults.ProtocolVersion = "5"
+	defaults.CleanSession = true
+	defaults.KeepAlive = time.Minute
+	defaults.Timeout = 10 * time.Second
+	return
+}
+
+// brokerClientConfig returns the TLS config and client config for the broker.* settings of cfg
+func brokerClientConfig(cfg *config.Config) (*tls.Config, client.Config, error) {
+	var version byte
+	switch cfg.GetString("broker.protocol-version") {
+	case "3.1.1":
+		version = packets.Version311
+	case "5":
+		version = packets.Version5
+	default:
+		return nil, client.Config{}, fmt.Errorf("unsupported protocol version %s", cfg.GetString("broker.protocol-version"))
+	}
+	var tlsConfig *tls.Config
+	if cfg.GetBool("broker.tls") {
+		tlsConfig = &tls.Config{InsecureSkipVerify: cfg.GetBool("broker.tls-insecure")}
+		if caFile := cfg.GetString("broker.tls-ca-file"); caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, client.Config{}, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, client.Config{}, errors.New("no certificates in " + caFile)
+			}
+		}
+	}
+	var password []byte
+	if p := cfg.GetString("broker.password"); p != "" {
+		password = []byte(p)
+	}
+	return tlsConfig, client.Config{
+		Version:      version,
+		ClientID:     cfg.GetString("broker.client-id"),
+		Username:     cfg.GetString("broker.username"),
+		Password:     password,
+		CleanSession: cfg.GetBool("broker.clean-session"),
+		KeepAlive:    cfg.GetDuration("broker.keepalive"),
+	}, nil
+}
+
+// dialBroker connects to the broker with the broker.* settings of cfg
+func dialBroker(cfg *config.Config, onPublish func(*packets.PublishPacket)) (*client.Client, error) {
+	tlsConfig, clientConfig, err := brokerClientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig.OnPublish = onPublish
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.GetDuration("broker.timeout"))
+	defer cancel()
+	return client.Dial(ctx, "tcp", cfg.GetString("broker.address"), tlsConfig, clientConfig)
+}
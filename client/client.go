@@ -0,0 +1,532 @@
+// Package client implements an MQTT client with the packets of the server
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+)
+
+// ErrClosed is returned when the connection of the client is closed
+var ErrClosed = errors.New("client closed")
+
+var (
+	errUnexpectedPacket = errors.New("unexpected packet")
+	errNoPacketID       = errors.New("no packet identifier available")
+	errPingTimeout      = errors.New("no PINGRESP from server")
+)
+
+// PingrespMargin is the time that the server gets in addition to the keep-alive to respond to a PINGREQ
+// The connection is closed if the server does not respond in time.
+var PingrespMargin = 5 * time.Second
+
+// noSessionExpiry is the MQTT 5 Session Expiry Interval for sessions that do not expire
+const noSessionExpiry = 0xFFFFFFFF
+
+// ReasonCodeError is returned when the server responds with a reason code that indicates failure
+type ReasonCodeError struct {
+	Packet     string
+	ReasonCode byte
+}
+
+func (e ReasonCodeError) Error() string {
+	return fmt.Sprintf("%s with reason code 0x%02X", e.Packet, e.ReasonCode)
+}
+
+func reasonCodeError(packetType byte, reasonCode byte) error {
+	if reasonCode < packets.UnspecifiedError {
+		return nil
+	}
+	return ReasonCodeError{Packet: packets.PacketNames[packetType], ReasonCode: reasonCode}
+}
+
+// Config of a Client
+type Config struct {
+	// Version is the protocol version, MQTT 5 is used if zero
+	Version  byte
+	ClientID string
+	Username string
+	Password []byte
+	// CleanSession starts a new session, for MQTT 5 clients it is the Clean Start flag
+	CleanSession bool
+	// SessionExpiry of MQTT 5 sessions, sessions of clients without CleanSession never expire if zero
+	SessionExpiry time.Duration
+	KeepAlive     time.Duration
+	Will          *packets.PublishPacket
+	// UserProperties are sent in the CONNECT of MQTT 5 clients
+	UserProperties []packets.UserProperty
+	// OnPublish is called for the messages from the server, one at a time and in order
+	// Messages with QoS 1 and 2 are acknowledged when OnPublish returns.
+	OnPublish func(*packets.PublishPacket)
+}
+
+// Client is a connection to an MQTT server
+type Client struct {
+	conn    net.Conn
+	config  Config
+	version byte
+	connack *packets.ConnackPacket
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	nextID   uint16
+	inFlight map[uint16]chan packets.ControlPacket // channels of requests that wait for acknowledgements
+
+	received map[uint16]bool // QoS 2 messages that wait for PUBREL, only used by the receive routine
+
+	deliverMu sync.Mutex
+	deliver   []*packets.PublishPacket
+	deliverCh chan struct{}
+
+	pingresp chan struct{}
+
+	done  chan struct{}
+	errMu sync.Mutex
+	err   error
+}
+
+// Dial connects to the MQTT server at the address, using TLS if tlsConfig is not nil
+// The context limits the time for setting up the connection and waiting for the CONNACK.
+func Dial(ctx context.Context, network, address string, tlsConfig *tls.Config, config Config) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if deadline, ok := ctx.Deadline(); ok {
+			tlsConn.SetDeadline(deadline)
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	return Connect(ctx, conn, config)
+}
+
+// Connect sends a CONNECT on the connection and waits for the CONNACK
+// The connection is closed if the server does not accept the client.
+func Connect(ctx context.Context, conn net.Conn, config Config) (*Client, error) {
+	c := &Client{
+		conn:      conn,
+		config:    config,
+		version:   config.Version,
+		inFlight:  make(map[uint16]chan packets.ControlPacket),
+		received:  make(map[uint16]bool),
+		deliverCh: make(chan struct{}, 1),
+		pingresp:  make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if c.version == 0 {
+		c.version = packets.Version5
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	connack, err := c.connect()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	c.connack = connack
+	go c.receiveRoutine()
+	go c.deliverRoutine()
+	if keepAlive := c.keepAlive(); keepAlive > 0 {
+		go c.pingRoutine(keepAlive)
+	}
+	return c, nil
+}
+
+func (c *Client) connect() (*packets.ConnackPacket, error) {
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName, connect.ProtocolVersion = "MQTT", c.version
+	if c.version == packets.Version31 {
+		connect.ProtocolName = "MQIsdp"
+	}
+	connect.ClientIdentifier = c.config.ClientID
+	connect.CleanSession = c.config.CleanSession
+	connect.Keepalive = uint16(c.config.KeepAlive / time.Second)
+	if c.config.Username != "" {
+		connect.UsernameFlag, connect.Username = true, c.config.Username
+	}
+	if c.config.Password != nil {
+		connect.PasswordFlag, connect.Password = true, c.config.Password
+	}
+	if will := c.config.Will; will != nil {
+		connect.WillFlag = true
+		connect.WillTopic, connect.WillMessage = will.TopicName, will.Payload
+		connect.WillQos, connect.WillRetain = will.Qos, will.Retain
+		connect.WillProperties = will.Properties.Copy()
+	}
+	if c.version >= packets.Version5 {
+		connect.Properties.UserProperties = c.config.UserProperties
+		if expiry := c.config.SessionExpiry; expiry > 0 {
+			connect.Properties.SessionExpiryInterval = packets.Uint32(uint32(expiry / time.Second))
+		} else if !c.config.CleanSession {
+			connect.Properties.SessionExpiryInterval = packets.Uint32(noSessionExpiry)
+		}
+	}
+	if err := connect.Write(c.conn, c.version); err != nil {
+		return nil, err
+	}
+	packet, err := packets.ReadPacket(c.conn, c.version)
+	if err != nil {
+		return nil, err
+	}
+	connack, ok := packet.(*packets.ConnackPacket)
+	if !ok {
+		return nil, errUnexpectedPacket
+	}
+	if connack.ReturnCode != packets.Accepted {
+		if c.version < packets.Version5 {
+			if err, ok := packets.ConnErrors[connack.ReturnCode]; ok {
+				return nil, err
+			}
+		}
+		return nil, ReasonCodeError{Packet: "CONNACK", ReasonCode: connack.ReturnCode}
+	}
+	return connack, nil
+}
+
+// keepAlive returns the keep-alive of the client, or the Server Keep Alive if the server set it
+func (c *Client) keepAlive() time.Duration {
+	if serverKeepAlive := c.connack.Properties.ServerKeepAlive; serverKeepAlive != nil {
+		return time.Duration(*serverKeepAlive) * time.Second
+	}
+	return c.config.KeepAlive / time.Second * time.Second
+}
+
+// Connack returns the CONNACK that the server sent
+func (c *Client) Connack() *packets.ConnackPacket {
+	return c.connack
+}
+
+// Done returns a channel that is closed when the connection of the client is closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that closed the connection of the client
+func (c *Client) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+func (c *Client) setError(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+// Disconnect sends a DISCONNECT to the server and closes the connection
+func (c *Client) Disconnect() error {
+	err := c.write(packets.NewControlPacket(packets.Disconnect))
+	c.setError(ErrClosed)
+	return err
+}
+
+// Close closes the connection without DISCONNECT, so that the server publishes the will of the client
+func (c *Client) Close() error {
+	c.setError(ErrClosed)
+	return nil
+}
+
+func (c *Client) write(packet packets.ControlPacket) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+	if err := packet.Write(c.conn, c.version); err != nil {
+		c.setError(err)
+		return err
+	}
+	return nil
+}
+
+// register a packet identifier for a request
+func (c *Client) register() (uint16, chan packets.ControlPacket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < 0xFFFF; i++ {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		if _, inUse := c.inFlight[c.nextID]; !inUse {
+			ch := make(chan packets.ControlPacket, 1)
+			c.inFlight[c.nextID] = ch
+			return c.nextID, ch, nil
+		}
+	}
+	return 0, nil, errNoPacketID
+}
+
+func (c *Client) unregister(id uint16) {
+	c.mu.Lock()
+	delete(c.inFlight, id)
+	c.mu.Unlock()
+}
+
+// acknowledge sends the acknowledgement to the request that waits for it
+func (c *Client) acknowledge(id uint16, ack packets.ControlPacket) {
+	c.mu.Lock()
+	ch, ok := c.inFlight[id]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- ack:
+	default:
+	}
+}
+
+func (c *Client) wait(ctx context.Context, ch chan packets.ControlPacket) (packets.ControlPacket, error) {
+	select {
+	case ack := <-ch:
+		return ack, nil
+	case <-c.done:
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Publish publishes the message and waits for its acknowledgements
+// The packet identifier is set by the client.
+func (c *Client) Publish(ctx context.Context, packet *packets.PublishPacket) error {
+	msg := *packet
+	if msg.Qos == 0 {
+		msg.MessageID = 0
+		return c.write(&msg)
+	}
+	id, ch, err := c.register()
+	if err != nil {
+		return err
+	}
+	defer c.unregister(id)
+	msg.MessageID = id
+	if err = c.write(&msg); err != nil {
+		return err
+	}
+	ack, err := c.wait(ctx, ch)
+	if err != nil {
+		return err
+	}
+	switch ack := ack.(type) {
+	case *packets.PubackPacket:
+		return reasonCodeError(packets.Puback, ack.ReasonCode)
+	case *packets.PubrecPacket:
+		if err = reasonCodeError(packets.Pubrec, ack.ReasonCode); err != nil {
+			return err
+		}
+		pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pubrel.MessageID = id
+		if err = c.write(pubrel); err != nil {
+			return err
+		}
+		comp, err := c.wait(ctx, ch)
+		if err != nil {
+			return err
+		}
+		if pubcomp, ok := comp.(*packets.PubcompPacket); ok {
+			return reasonCodeError(packets.Pubcomp, pubcomp.ReasonCode)
+		}
+	}
+	return errUnexpectedPacket
+}
+
+// Subscribe sends the SUBSCRIBE and returns the SUBACK
+// The packet identifier is set by the client.
+func (c *Client) Subscribe(ctx context.Context, packet *packets.SubscribePacket) (*packets.SubackPacket, error) {
+	subscribe := *packet
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+	subscribe.MessageID = id
+	if err = c.write(&subscribe); err != nil {
+		return nil, err
+	}
+	ack, err := c.wait(ctx, ch)
+	if err != nil {
+		return nil, err
+	}
+	suback, ok := ack.(*packets.SubackPacket)
+	if !ok {
+		return nil, errUnexpectedPacket
+	}
+	return suback, nil
+}
+
+// Unsubscribe sends the UNSUBSCRIBE and returns the UNSUBACK
+// The packet identifier is set by the client.
+func (c *Client) Unsubscribe(ctx context.Context, packet *packets.UnsubscribePacket) (*packets.UnsubackPacket, error) {
+	unsubscribe := *packet
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+	unsubscribe.MessageID = id
+	if err = c.write(&unsubscribe); err != nil {
+		return nil, err
+	}
+	ack, err := c.wait(ctx, ch)
+	if err != nil {
+		return nil, err
+	}
+	unsuback, ok := ack.(*packets.UnsubackPacket)
+	if !ok {
+		return nil, errUnexpectedPacket
+	}
+	return unsuback, nil
+}
+
+func (c *Client) receiveRoutine() {
+	for {
+		packet, err := packets.ReadPacket(c.conn, c.version)
+		if err != nil {
+			c.setError(err)
+			return
+		}
+		switch packet := packet.(type) {
+		case *packets.PublishPacket:
+			if packet.Qos == 2 {
+				if c.received[packet.MessageID] {
+					pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+					pubrec.MessageID = packet.MessageID
+					c.write(pubrec)
+					continue
+				}
+				c.received[packet.MessageID] = true
+			}
+			c.deliverMu.Lock()
+			c.deliver = append(c.deliver, packet)
+			c.deliverMu.Unlock()
+			select {
+			case c.deliverCh <- struct{}{}:
+			default:
+			}
+		case *packets.PubrelPacket:
+			delete(c.received, packet.MessageID)
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = packet.MessageID
+			c.write(pubcomp)
+		case *packets.PubackPacket:
+			c.acknowledge(packet.MessageID, packet)
+		case *packets.PubrecPacket:
+			c.acknowledge(packet.MessageID, packet)
+		case *packets.PubcompPacket:
+			c.acknowledge(packet.MessageID, packet)
+		case *packets.SubackPacket:
+			c.acknowledge(packet.MessageID, packet)
+		case *packets.UnsubackPacket:
+			c.acknowledge(packet.MessageID, packet)
+		case *packets.PingrespPacket:
+			select {
+			case c.pingresp <- struct{}{}:
+			default:
+			}
+		case *packets.DisconnectPacket:
+			c.setError(ReasonCodeError{Packet: "DISCONNECT", ReasonCode: packet.ReasonCode})
+			return
+		default:
+			c.setError(errUnexpectedPacket)
+			return
+		}
+	}
+}
+
+// deliverRoutine calls OnPublish for the received messages and acknowledges them
+// Messages are delivered outside the receive routine, so that OnPublish can wait for acknowledgements.
+func (c *Client) deliverRoutine() {
+	for {
+		select {
+		case <-c.deliverCh:
+		case <-c.done:
+			return
+		}
+		for {
+			c.deliverMu.Lock()
+			if len(c.deliver) == 0 {
+				c.deliverMu.Unlock()
+				break
+			}
+			msg := c.deliver[0]
+			c.deliver = c.deliver[1:]
+			c.deliverMu.Unlock()
+			if c.config.OnPublish != nil {
+				c.config.OnPublish(msg)
+			}
+			switch msg.Qos {
+			case 1:
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = msg.MessageID
+				c.write(puback)
+			case 2:
+				pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				pubrec.MessageID = msg.MessageID
+				c.write(pubrec)
+			}
+		}
+	}
+}
+
+// pingRoutine sends a PINGREQ every keep-alive, and closes the connection if the server does not respond within the
+// keep-alive and PingrespMargin. No new PINGREQ is sent while the server did not respond to the previous one.
+func (c *Client) pingRoutine(keepAlive time.Duration) {
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	timeout := time.NewTimer(keepAlive + PingrespMargin)
+	timeout.Stop()
+	defer timeout.Stop()
+	var waiting bool
+	for {
+		select {
+		case <-ticker.C:
+			if waiting {
+				continue
+			}
+			waiting = true
+			timeout.Reset(keepAlive + PingrespMargin)
+			c.write(packets.NewControlPacket(packets.Pingreq))
+		case <-c.pingresp:
+			if waiting && !timeout.Stop() {
+				<-timeout.C
+			}
+			waiting = false
+		case <-timeout.C:
+			c.setError(errPingTimeout)
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClient(t *testing.T) {
+	Convey(`Given an in-process Server`, t, func() {
+		s := server.NewServer()
+		go s.Route()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		connect := func(config Config) (*Client, error) {
+			clientConn, serverConn := net.Pipe()
+			go s.ServeConn(serverConn, server.ListenerConfig{Name: "pipe"})
+			return Connect(ctx, clientConn, config)
+		}
+
+		for _, version := range []byte{packets.Version311, packets.Version5} {
+			version := version
+			Convey(`When connecting with protocol version `+string('0'+version), func() {
+				received := make(chan *packets.PublishPacket, 10)
+				sub, err := connect(Config{Version: version, ClientID: "sub", CleanSession: true, OnPublish: func(msg *packets.PublishPacket) {
+					received <- msg
+				}})
+				So(err, ShouldBeNil)
+				defer sub.Disconnect()
+
+				pub, err := connect(Config{Version: version, ClientID: "pub", CleanSession: true, KeepAlive: time.Minute})
+				So(err, ShouldBeNil)
+				defer pub.Disconnect()
+
+				Convey(`When subscribing`, func() {
+					subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+					subscribe.Topics, subscribe.Qoss = []string{"foo/#"}, []byte{2}
+					suback, err := sub.Subscribe(ctx, subscribe)
+					So(err, ShouldBeNil)
+					So(suback.ReturnCodes, ShouldResemble, []byte{2})
+
+					for _, qos := range []byte{0, 1, 2} {
+						qos := qos
+						Convey(`When publishing with QoS `+string('0'+qos), func() {
+							publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+							publish.TopicName, publish.Qos, publish.Payload = "foo/bar", qos, []byte("baz")
+							So(pub.Publish(ctx, publish), ShouldBeNil)
+							Convey(`Then the subscriber should receive the message`, func() {
+								select {
+								case msg := <-received:
+									So(msg.TopicName, ShouldEqual, "foo/bar")
+									So(msg.Qos, ShouldEqual, qos)
+									So(string(msg.Payload), ShouldEqual, "baz")
+								case <-time.After(time.Second):
+									So("timeout", ShouldBeEmpty)
+								}
+							})
+						})
+					}
+
+					Convey(`When unsubscribing`, func() {
+						unsubscribe := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+						unsubscribe.Topics = []string{"foo/#"}
+						_, err := sub.Unsubscribe(ctx, unsubscribe)
+						So(err, ShouldBeNil)
+						Convey(`Then the subscriber should not receive messages`, func() {
+							publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+							publish.TopicName, publish.Qos = "foo/bar", 1
+							So(pub.Publish(ctx, publish), ShouldBeNil)
+							time.Sleep(10 * time.Millisecond)
+							So(received, ShouldBeEmpty)
+						})
+					})
+				})
+
+				Convey(`When disconnecting`, func() {
+					So(pub.Disconnect(), ShouldBeNil)
+					Convey(`Then the client should be done`, func() {
+						<-pub.Done()
+						So(pub.Err(), ShouldEqual, ErrClosed)
+						So(pub.Publish(ctx, packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)), ShouldEqual, ErrClosed)
+					})
+				})
+			})
+		}
+
+		Convey(`When the server does not accept the client`, func() {
+			s.SetAuth(func(clientIdentifier string, username string, password []byte) (auth.Interface, error) {
+				return nil, auth.ErrNotAuthorized
+			})
+			_, err := connect(Config{ClientID: "foo", Username: "foo", Password: []byte("bar")})
+			Convey(`Then an error should be returned`, func() {
+				So(err, ShouldHaveSameTypeAs, ReasonCodeError{})
+			})
+		})
+
+		Convey(`When the server kicks the client`, func() {
+			c, err := connect(Config{ClientID: "foo", CleanSession: true})
+			So(err, ShouldBeNil)
+			time.Sleep(10 * time.Millisecond)
+			So(s.Kick("foo", packets.AdministrativeAction), ShouldBeNil)
+			Convey(`Then the client should get the reason code`, func() {
+				<-c.Done()
+				So(c.Err(), ShouldResemble, ReasonCodeError{Packet: "DISCONNECT", ReasonCode: packets.AdministrativeAction})
+			})
+		})
+	})
+}
+
+func TestPingTimeout(t *testing.T) {
+	Convey(`Given a server that stops responding after CONNACK`, t, func() {
+		defer func(margin time.Duration) { PingrespMargin = margin }(PingrespMargin)
+		PingrespMargin = 10 * time.Millisecond
+
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+		go func() {
+			if _, err := packets.ReadPacket(serverConn, packets.Version5); err != nil {
+				return
+			}
+			connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			connack.Properties.ServerKeepAlive = packets.Uint16(1)
+			if err := connack.Write(serverConn, packets.Version5); err != nil {
+				return
+			}
+			for {
+				if _, err := packets.ReadPacket(serverConn, packets.Version5); err != nil { // the PINGREQ is not answered
+					return
+				}
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c, err := Connect(ctx, clientConn, Config{ClientID: "foo", CleanSession: true, KeepAlive: time.Second})
+		So(err, ShouldBeNil)
+
+		Convey(`Then the client should close the connection after the keep-alive and margin`, func() {
+			select {
+			case <-c.Done():
+			case <-time.After(5 * time.Second):
+			}
+			So(c.Err(), ShouldEqual, errPingTimeout)
+		})
+	})
+}
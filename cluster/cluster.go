@@ -0,0 +1,268 @@
+// Package cluster connects servers into a cluster
+//
+// Nodes of a cluster know each other from a static list of peers, every node must list all other nodes. Each node
+// sends its peers the topic filters that its clients subscribed to, the messages that match the topic filters of the
+// peer, its retained messages and the client identifiers of clients that connect, so that a peer can take over the
+// session of a client that moved to another node.
+//
+// Forwarding is at-most-once: messages are dropped while the connection to a peer is down or when the peer cannot
+// keep up. Only the subscriptions of a session are moved to the new node, queued messages are not. When nodes
+// (re)connect, they send each other their retained messages and deletions of retained messages, and the newest
+// change of each topic is kept.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/server"
+	"github.com/htdvisser/squatt/topic"
+	"go.uber.org/zap"
+)
+
+// Peer is another node of the cluster
+type Peer struct {
+	Name    string
+	Address string
+}
+
+// Config of a node
+type Config struct {
+	// Name of the node, which must be unique in the cluster
+	Name string
+	// Peers are the other nodes of the cluster
+	Peers []Peer
+	// Secret that nodes use to authenticate each other, which is required if the node has peers
+	// Nodes prove that they know the secret with a challenge-response, the secret itself is not sent. The frames
+	// between nodes are not encrypted.
+	Secret string
+	// ReconnectMin and ReconnectMax limit the exponential backoff between connection attempts
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+	// QueueSize is the number of frames that can be queued for a peer before frames are dropped
+	QueueSize int
+}
+
+// DefaultConfig returns the config with defaults for the node with the given name
+func DefaultConfig(name string) Config {
+	return Config{
+		Name:         name,
+		ReconnectMin: time.Second,
+		ReconnectMax: time.Minute,
+		QueueSize:    1024,
+	}
+}
+
+// Node connects a server to the other nodes of a cluster
+type Node struct {
+	server *server.Server
+	config Config
+	log    *zap.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	peers map[string]*peer
+
+	// BEGIN mu protected
+	mu       sync.Mutex
+	interest map[string]struct{} // topic filters with subscriptions on this node
+	inbound  map[*link]struct{}
+	// END mu protected
+
+	dropped uint64
+}
+
+type peer struct {
+	Peer
+	queue chan *frame
+
+	// BEGIN node.mu protected
+	connected bool
+	// END node.mu protected
+
+	// BEGIN mu protected
+	mu       sync.Mutex
+	inbound  *link
+	interest map[string]struct{} // topic filters with subscriptions on the peer
+	// END mu protected
+}
+
+var errNoSecret = errors.New("cluster with peers requires a secret")
+
+// New returns a new node for the server and sets the hooks of the server
+// An error is returned if the node has peers but no secret, because peers could then not be authenticated.
+func New(s *server.Server, config Config) (*Node, error) {
+	if len(config.Peers) > 0 && config.Secret == "" {
+		return nil, errNoSecret
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Node{
+		server:   s,
+		config:   config,
+		log:      zap.NewNop(),
+		ctx:      ctx,
+		cancel:   cancel,
+		peers:    make(map[string]*peer),
+		interest: make(map[string]struct{}),
+		inbound:  make(map[*link]struct{}),
+	}
+	for _, p := range config.Peers {
+		n.peers[p.Name] = &peer{
+			Peer:     p,
+			queue:    make(chan *frame, config.QueueSize),
+			interest: make(map[string]struct{}),
+		}
+	}
+	s.SetHooks(server.Hooks{
+		Publish:     n.publish,
+		Subscribe:   n.subscribe,
+		Unsubscribe: n.unsubscribe,
+		Connect:     n.connect,
+	})
+	return n, nil
+}
+
+// SetLogger sets the logger
+func (n *Node) SetLogger(log *zap.Logger) {
+	n.log = log.With(zap.String("node", n.config.Name))
+}
+
+// Config returns the config of the node
+func (n *Node) Config() Config {
+	return n.config
+}
+
+// Start starts connecting to the peers
+func (n *Node) Start() {
+	for _, p := range n.peers {
+		n.wg.Add(1)
+		go func(p *peer) {
+			defer n.wg.Done()
+			n.run(p)
+		}(p)
+	}
+}
+
+// Stop disconnects from the peers
+func (n *Node) Stop() {
+	n.cancel()
+	n.mu.Lock()
+	for l := range n.inbound {
+		l.Close()
+	}
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+// Connected returns the number of peers that this node is connected to
+func (n *Node) Connected() (connected int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, p := range n.peers {
+		if p.connected {
+			connected++
+		}
+	}
+	return
+}
+
+// Dropped returns the number of frames that were dropped because a peer could not keep up
+func (n *Node) Dropped() uint64 {
+	return atomic.LoadUint64(&n.dropped)
+}
+
+// enqueue queues the frame for the peer, this must be called while holding n.mu
+func (n *Node) enqueue(p *peer, f *frame) {
+	if !p.connected {
+		return
+	}
+	select {
+	case p.queue <- f:
+	default:
+		atomic.AddUint64(&n.dropped, 1)
+		n.log.Warn("drop frame for slow peer", zap.String("peer", p.Name), zap.Stringer("type", f.Type))
+	}
+}
+
+// interested returns true if the peer has subscriptions that match the topic
+func (p *peer) interested(topicName string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for filter := range p.interest {
+		if topic.Match(filter, topicName) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish forwards a message that was published on this node to the peers with matching subscriptions
+// Retained messages are forwarded to all peers, so that they can store them.
+func (n *Node) publish(msg *packets.PublishPacket) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var f *frame
+	for _, p := range n.peers {
+		if !p.connected || (!msg.Retain && !p.interested(msg.TopicName)) {
+			continue
+		}
+		if f == nil {
+			data, err := encodePublish(msg)
+			if err != nil {
+				n.log.Warn("could not encode message", zap.String("topic", msg.TopicName), zap.Error(err))
+				return
+			}
+			f = &frame{Type: framePublish, Packet: data}
+		}
+		n.enqueue(p, f)
+	}
+}
+
+func (n *Node) subscribe(filter string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.interest[filter] = struct{}{}
+	for _, p := range n.peers {
+		n.enqueue(p, &frame{Type: frameSubscribe, Filters: []string{filter}})
+	}
+}
+
+func (n *Node) unsubscribe(filter string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.interest, filter)
+	for _, p := range n.peers {
+		n.enqueue(p, &frame{Type: frameUnsubscribe, Filters: []string{filter}})
+	}
+}
+
+// connect tells the peers that a client connected to this node, so that they take over its session
+func (n *Node) connect(clientID string, cleanStart bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, p := range n.peers {
+		n.enqueue(p, &frame{Type: frameTakeover, ClientID: clientID, Resume: !cleanStart})
+	}
+}
+
+// takeover takes over the session of a client that connected to the peer
+// If the client resumes its session, its subscriptions are sent to the peer.
+func (n *Node) takeover(p *peer, f *frame) {
+	subscriptions := n.server.TakeOverSession(f.ClientID)
+	if subscriptions == nil {
+		return
+	}
+	n.log.Info("session taken over", zap.String("peer", p.Name), zap.String("client-id", f.ClientID))
+	if !f.Resume || len(subscriptions) == 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.enqueue(p, &frame{Type: frameSession, ClientID: f.ClientID, Subscriptions: subscriptions})
+}
@@ -0,0 +1,285 @@
+package cluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/client"
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func eventually(condition func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestCluster(t *testing.T) {
+	Convey(`Given a cluster of three nodes`, t, func() {
+		names := []string{"a", "b", "c"}
+		servers := make(map[string]*server.Server)
+		listeners := make(map[string]net.Listener)
+		nodes := make(map[string]*Node)
+		for _, name := range names {
+			servers[name] = server.NewServer()
+			go servers[name].Route()
+			lis, err := net.Listen("tcp", "localhost:0")
+			So(err, ShouldBeNil)
+			listeners[name] = lis
+		}
+		for _, name := range names {
+			config := DefaultConfig(name)
+			config.Secret = "secret"
+			config.ReconnectMin, config.ReconnectMax = 10*time.Millisecond, 50*time.Millisecond
+			for _, peer := range names {
+				if peer != name {
+					config.Peers = append(config.Peers, Peer{Name: peer, Address: listeners[peer].Addr().String()})
+				}
+			}
+			node, err := New(servers[name], config)
+			So(err, ShouldBeNil)
+			nodes[name] = node
+		}
+
+		// start starts the node with the given name
+		start := func(name string) {
+			go nodes[name].Serve(listeners[name])
+			nodes[name].Start()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// connect returns a client of the node that subscribes to filter
+		connect := func(name, clientID string, cleanSession bool, filter string) (*client.Client, chan *packets.PublishPacket) {
+			received := make(chan *packets.PublishPacket, 10)
+			clientConn, serverConn := net.Pipe()
+			go servers[name].ServeConn(serverConn, server.ListenerConfig{Name: "test"})
+			c, err := client.Connect(ctx, clientConn, client.Config{ClientID: clientID, CleanSession: cleanSession, OnPublish: func(msg *packets.PublishPacket) {
+				received <- msg
+			}})
+			So(err, ShouldBeNil)
+			if filter != "" {
+				subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+				subscribe.Topics, subscribe.Qoss = []string{filter}, []byte{1}
+				_, err = c.Subscribe(ctx, subscribe)
+				So(err, ShouldBeNil)
+			}
+			return c, received
+		}
+
+		publish := func(c *client.Client, topicName string, retain bool) {
+			msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			msg.TopicName, msg.Qos, msg.Retain, msg.Payload = topicName, 1, retain, []byte(topicName)
+			So(c.Publish(ctx, msg), ShouldBeNil)
+		}
+
+		receive := func(received chan *packets.PublishPacket, timeout time.Duration) string {
+			select {
+			case msg := <-received:
+				return msg.TopicName
+			case <-time.After(timeout):
+				return ""
+			}
+		}
+
+		// interested returns true when the node knows that the peer subscribed to a topic filter that matches
+		interested := func(name, peer, topicName string) func() bool {
+			return func() bool { return nodes[name].peers[peer].interested(topicName) }
+		}
+
+		start("a")
+		start("b")
+
+		Convey(`When a client of one node subscribes`, func() {
+			start("c")
+			So(eventually(func() bool { return nodes["a"].Connected() == 2 }), ShouldBeTrue)
+			subscriber, received := connect("b", "subscriber", true, "foo/#")
+			defer subscriber.Disconnect()
+			other, otherReceived := connect("c", "other", true, "bar/#")
+			defer other.Disconnect()
+
+			Convey(`Then the other nodes should know about the subscription`, func() {
+				So(eventually(interested("a", "b", "foo/bar")), ShouldBeTrue)
+				So(eventually(interested("c", "b", "foo/bar")), ShouldBeTrue)
+				So(nodes["a"].peers["c"].interested("foo/bar"), ShouldBeFalse)
+			})
+
+			Convey(`Then messages that are published on another node should be forwarded`, func() {
+				So(eventually(interested("a", "b", "foo/bar")), ShouldBeTrue)
+				publisher, _ := connect("a", "publisher", true, "")
+				defer publisher.Disconnect()
+				publish(publisher, "foo/bar", false)
+				So(receive(received, time.Second), ShouldEqual, "foo/bar")
+				So(receive(received, 100*time.Millisecond), ShouldBeEmpty)
+				So(receive(otherReceived, 100*time.Millisecond), ShouldBeEmpty)
+			})
+
+			Convey(`Then the subscription should be removed from the other nodes when the client unsubscribes`, func() {
+				So(eventually(interested("a", "b", "foo/bar")), ShouldBeTrue)
+				unsubscribe := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+				unsubscribe.Topics = []string{"foo/#"}
+				_, err := subscriber.Unsubscribe(ctx, unsubscribe)
+				So(err, ShouldBeNil)
+				So(eventually(func() bool { return !nodes["a"].peers["b"].interested("foo/bar") }), ShouldBeTrue)
+			})
+		})
+
+		Convey(`When a retained message is published`, func() {
+			So(eventually(func() bool { return nodes["a"].Connected() == 1 }), ShouldBeTrue)
+			publisher, _ := connect("a", "publisher", true, "")
+			defer publisher.Disconnect()
+			publish(publisher, "status/a", true)
+
+			Convey(`Then it should be retained on the other nodes`, func() {
+				So(eventually(func() bool { return len(servers["b"].RetainedMessagesMatching("status/#")) == 1 }), ShouldBeTrue)
+			})
+
+			Convey(`Then it should be retained on a node that joins later`, func() {
+				So(eventually(func() bool { return len(servers["b"].RetainedMessagesMatching("status/#")) == 1 }), ShouldBeTrue)
+				start("c")
+				So(eventually(func() bool { return len(servers["c"].RetainedMessagesMatching("status/#")) == 1 }), ShouldBeTrue)
+				subscriber, received := connect("c", "subscriber", true, "status/#")
+				defer subscriber.Disconnect()
+				So(receive(received, time.Second), ShouldEqual, "status/a")
+			})
+		})
+
+		Convey(`When a client connects to another node`, func() {
+			start("c")
+			So(eventually(func() bool { return nodes["a"].Connected() == 2 && nodes["b"].Connected() == 2 }), ShouldBeTrue)
+			old, _ := connect("a", "mover", false, "moved/#")
+			defer old.Close()
+			So(eventually(interested("b", "a", "moved/bar")), ShouldBeTrue)
+			moved, received := connect("b", "mover", false, "")
+			defer moved.Disconnect()
+
+			Convey(`Then the old connection should be taken over`, func() {
+				select {
+				case <-old.Done():
+				case <-time.After(time.Second):
+				}
+				So(old.Err(), ShouldResemble, client.ReasonCodeError{Packet: "DISCONNECT", ReasonCode: packets.SessionTakenOver})
+			})
+
+			Convey(`Then the subscriptions should be moved to the new node`, func() {
+				So(eventually(interested("c", "b", "moved/bar")), ShouldBeTrue)
+				So(eventually(func() bool { return !nodes["c"].peers["a"].interested("moved/bar") }), ShouldBeTrue)
+				publisher, _ := connect("c", "publisher", true, "")
+				defer publisher.Disconnect()
+				publish(publisher, "moved/bar", false)
+				So(receive(received, time.Second), ShouldEqual, "moved/bar")
+			})
+		})
+
+		Convey(`When a node connects with the wrong secret`, func() {
+			config := DefaultConfig("c")
+			config.Secret = "wrong"
+			config.Peers = []Peer{{Name: "a", Address: listeners["a"].Addr().String()}}
+			node, err := New(server.NewServer(), config)
+			So(err, ShouldBeNil)
+			_, err = node.dial(&peer{Peer: config.Peers[0]})
+			Convey(`Then the connection should fail`, func() {
+				So(err, ShouldEqual, errInvalidSecret)
+			})
+		})
+
+		Convey(`When a node authenticates with an empty secret`, func() {
+			conn, other := net.Pipe()
+			defer conn.Close()
+			defer other.Close()
+			go func() {
+				l := newLink(other)
+				nonce, _ := newNonce()
+				if err := l.write(&frame{Type: frameHello, Node: "c", Nonce: nonce}); err != nil {
+					return
+				}
+				hello, err := l.read()
+				if err != nil {
+					return
+				}
+				l.write(&frame{Type: frameAuth, MAC: handshakeMAC("", "dial", "c", "a", nonce, hello.Nonce)})
+			}()
+			_, err := nodes["a"].accept(newLink(conn))
+			Convey(`Then the peer should be rejected`, func() {
+				So(err, ShouldEqual, errInvalidSecret)
+			})
+		})
+
+		Convey(`When a node with peers is created without a secret`, func() {
+			config := DefaultConfig("d")
+			config.Peers = []Peer{{Name: "a", Address: listeners["a"].Addr().String()}}
+			_, err := New(server.NewServer(), config)
+			Convey(`Then there should be an error`, func() {
+				So(err, ShouldEqual, errNoSecret)
+			})
+		})
+
+		Convey(`When a listener impersonates a peer without knowing the secret`, func() {
+			impostor, err := net.Listen("tcp", "localhost:0")
+			So(err, ShouldBeNil)
+			defer impostor.Close()
+			go func() {
+				conn, err := impostor.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				l := newLink(conn)
+				if _, err := l.read(); err != nil {
+					return
+				}
+				nonce, _ := newNonce()
+				l.write(&frame{Type: frameHello, Node: "a", Nonce: nonce, MAC: make([]byte, sha256.Size)})
+				l.read()
+			}()
+			_, err = nodes["c"].dial(&peer{Peer: Peer{Name: "a", Address: impostor.Addr().String()}})
+			Convey(`Then the connection should fail`, func() {
+				So(err, ShouldEqual, errInvalidSecret)
+			})
+		})
+
+		Reset(func() {
+			for _, name := range names {
+				nodes[name].Stop()
+				listeners[name].Close()
+			}
+		})
+	})
+}
+
+func TestLink(t *testing.T) {
+	Convey(`Given a link`, t, func() {
+		conn, other := net.Pipe()
+		defer conn.Close()
+		defer other.Close()
+		l := newLink(conn)
+
+		Convey(`When the peer sends a frame`, func() {
+			go newLink(other).write(&frame{Type: frameInterest, Filters: []string{"foo/#"}})
+			f, err := l.read()
+			Convey(`Then it should be decoded`, func() {
+				So(err, ShouldBeNil)
+				So(f.Type, ShouldEqual, frameInterest)
+				So(f.Filters, ShouldResemble, []string{"foo/#"})
+			})
+		})
+
+		Convey(`When the peer declares a frame that is larger than the limit before the handshake`, func() {
+			go other.Write([]byte{0x7f, 0xff, 0xff, 0xff})
+			_, err := l.read()
+			Convey(`Then it should not be read`, func() {
+				So(err, ShouldEqual, errFrameTooLarge)
+			})
+		})
+	})
+}
@@ -0,0 +1,452 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/server"
+	"go.uber.org/zap"
+)
+
+type frameType byte
+
+const (
+	frameHello frameType = iota
+	frameInterest
+	frameSubscribe
+	frameUnsubscribe
+	framePublish
+	frameRetain
+	frameTakeover
+	frameSession
+	frameAuth
+)
+
+var frameTypeNames = map[frameType]string{
+	frameHello:       "hello",
+	frameInterest:    "interest",
+	frameSubscribe:   "subscribe",
+	frameUnsubscribe: "unsubscribe",
+	framePublish:     "publish",
+	frameRetain:      "retain",
+	frameTakeover:    "takeover",
+	frameSession:     "session",
+	frameAuth:        "auth",
+}
+
+func (t frameType) String() string {
+	return frameTypeNames[t]
+}
+
+// frame is sent between nodes
+type frame struct {
+	Type          frameType
+	Node          string
+	Nonce         []byte // random challenge of the handshake
+	MAC           []byte // response to the challenge of the peer
+	Filters       []string
+	Packet        []byte    // encoded PUBLISH packet
+	Topic         string    // topic of a retained message
+	Changed       time.Time // time of the change of a retained message
+	ClientID      string
+	Resume        bool
+	Subscriptions []server.SubscriptionState
+}
+
+var (
+	errUnknownPeer   = errors.New("unknown peer")
+	errInvalidSecret = errors.New("invalid secret")
+	errNotPublish    = errors.New("not a PUBLISH packet")
+	errFrameTooLarge = errors.New("frame too large")
+)
+
+// handshakeTimeout is the time that nodes have for the hello frames
+var handshakeTimeout = 10 * time.Second
+
+// MaxFrameSize is the maximum size of the frames that nodes send each other
+var MaxFrameSize = 16 << 20
+
+// maxHandshakeFrameSize is the maximum size of frames before the peer is authenticated
+const maxHandshakeFrameSize = 1024
+
+const nonceSize = 32
+
+// link is a connection between two nodes
+// The node that dialed the connection only sends frames, the node that accepted it only receives frames.
+// Frames are prefixed by their size, so that the size is checked before a frame is decoded.
+type link struct {
+	net.Conn
+	maxSize int // only used by read
+
+	writeMu sync.Mutex
+}
+
+func newLink(conn net.Conn) *link {
+	return &link{Conn: conn, maxSize: maxHandshakeFrameSize}
+}
+
+func (l *link) write(f *frame) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&buf).Encode(f); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if len(data)-4 > MaxFrameSize {
+		return errFrameTooLarge
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	_, err := l.Conn.Write(data)
+	return err
+}
+
+func (l *link) read() (*frame, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(l.Conn, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if uint64(size) > uint64(l.maxSize) {
+		return nil, errFrameTooLarge
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(l.Conn, data); err != nil {
+		return nil, err
+	}
+	f := new(frame)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// handshakeMAC proves that a node knows the secret without sending it
+// The role is "dial" or "accept", so that a node can not reflect the challenge of its peer.
+func handshakeMAC(secret, role, dialer, acceptor string, dialerNonce, acceptorNonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, field := range [][]byte{[]byte(role), []byte(dialer), []byte(acceptor), dialerNonce, acceptorNonce} {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+		mac.Write(length[:])
+		mac.Write(field)
+	}
+	return mac.Sum(nil)
+}
+
+func encodePublish(msg *packets.PublishPacket) ([]byte, error) {
+	encoded := msg.Copy()
+	encoded.Qos, encoded.Retain, encoded.MessageID = msg.Qos, msg.Retain, 1
+	var buf bytes.Buffer
+	if err := encoded.Write(&buf, packets.Version5); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodePublish(data []byte) (*packets.PublishPacket, error) {
+	packet, err := packets.ReadPacket(bytes.NewReader(data), packets.Version5)
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := packet.(*packets.PublishPacket)
+	if !ok {
+		return nil, errNotPublish
+	}
+	msg.MessageID = 0
+	return msg, nil
+}
+
+// run keeps the node connected to the peer, with exponential backoff between attempts
+func (n *Node) run(p *peer) {
+	backoff := n.config.ReconnectMin
+	for {
+		l, err := n.dial(p)
+		if err == nil {
+			n.log.Info("connected to peer", zap.String("peer", p.Name), zap.String("address", p.Address))
+			backoff = n.config.ReconnectMin
+			err = n.send(p, l)
+		}
+		if n.ctx.Err() != nil {
+			return
+		}
+		n.log.Warn("disconnected from peer", zap.String("peer", p.Name), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-n.ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > n.config.ReconnectMax {
+			backoff = n.config.ReconnectMax
+		}
+	}
+}
+
+func (n *Node) dial(p *peer) (*link, error) {
+	dialer := net.Dialer{Timeout: handshakeTimeout}
+	conn, err := dialer.DialContext(n.ctx, "tcp", p.Address)
+	if err != nil {
+		return nil, err
+	}
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-n.ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+	l := newLink(conn)
+	l.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err = n.dialHandshake(p, l); err != nil {
+		l.Close()
+		return nil, err
+	}
+	l.SetDeadline(time.Time{})
+	return l, nil
+}
+
+// dialHandshake authenticates the peer and then authenticates this node to the peer
+func (n *Node) dialHandshake(p *peer, l *link) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	if err = l.write(&frame{Type: frameHello, Node: n.config.Name, Nonce: nonce}); err != nil {
+		return err
+	}
+	hello, err := l.read()
+	if err != nil {
+		return err
+	}
+	if hello.Type != frameHello || hello.Node != p.Name || len(hello.Nonce) != nonceSize {
+		return fmt.Errorf("expected hello from %s", p.Name)
+	}
+	expected := handshakeMAC(n.config.Secret, "accept", n.config.Name, p.Name, nonce, hello.Nonce)
+	if !hmac.Equal(hello.MAC, expected) {
+		return errInvalidSecret
+	}
+	mac := handshakeMAC(n.config.Secret, "dial", n.config.Name, p.Name, nonce, hello.Nonce)
+	return l.write(&frame{Type: frameAuth, MAC: mac})
+}
+
+// send sends the state of the node and then the queued frames to the peer until the link is closed
+func (n *Node) send(p *peer, l *link) error {
+	n.mu.Lock()
+drain:
+	for {
+		select {
+		case <-p.queue:
+		default:
+			break drain
+		}
+	}
+	p.connected = true
+	filters := make([]string, 0, len(n.interest))
+	for filter := range n.interest {
+		filters = append(filters, filter)
+	}
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		p.connected = false
+		n.mu.Unlock()
+		l.Close()
+	}()
+
+	closed := make(chan error, 1)
+	go func() {
+		_, err := l.read()
+		closed <- err
+	}()
+
+	if err := l.write(&frame{Type: frameInterest, Filters: filters}); err != nil {
+		return err
+	}
+	for _, state := range n.server.RetainedMessageStates() {
+		f := &frame{Type: frameRetain, Topic: state.Topic, Changed: state.Changed}
+		if state.Message != nil {
+			data, err := encodePublish(state.Message)
+			if err != nil {
+				continue
+			}
+			f.Packet = data
+		}
+		if err := l.write(f); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case f := <-p.queue:
+			if err := l.write(f); err != nil {
+				return err
+			}
+		case err := <-closed:
+			return err
+		case <-n.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Serve accepts connections of peers on the listener
+func (n *Node) Serve(lis net.Listener) error {
+	go func() {
+		<-n.ctx.Done()
+		lis.Close()
+	}()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if n.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			l := newLink(conn)
+			n.mu.Lock()
+			if n.ctx.Err() != nil { // stopped before the link could be closed by Stop
+				n.mu.Unlock()
+				l.Close()
+				return
+			}
+			n.inbound[l] = struct{}{}
+			n.mu.Unlock()
+			err := n.receive(l)
+			n.mu.Lock()
+			delete(n.inbound, l)
+			n.mu.Unlock()
+			l.Close()
+			if err != nil && n.ctx.Err() == nil {
+				n.log.Warn("peer connection closed", zap.String("address", conn.RemoteAddr().String()), zap.Error(err))
+			}
+		}()
+	}
+}
+
+func (n *Node) accept(l *link) (*peer, error) {
+	l.SetDeadline(time.Now().Add(handshakeTimeout))
+	hello, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	p, ok := n.peers[hello.Node]
+	if hello.Type != frameHello || !ok || len(hello.Nonce) != nonceSize {
+		return nil, errUnknownPeer
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	mac := handshakeMAC(n.config.Secret, "accept", p.Name, n.config.Name, hello.Nonce, nonce)
+	if err = l.write(&frame{Type: frameHello, Node: n.config.Name, Nonce: nonce, MAC: mac}); err != nil {
+		return nil, err
+	}
+	auth, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	expected := handshakeMAC(n.config.Secret, "dial", p.Name, n.config.Name, hello.Nonce, nonce)
+	if auth.Type != frameAuth || !hmac.Equal(auth.MAC, expected) {
+		return nil, errInvalidSecret
+	}
+	l.SetDeadline(time.Time{})
+	l.maxSize = MaxFrameSize
+	return p, nil
+}
+
+// receive handles the frames of a peer until the link is closed
+func (n *Node) receive(l *link) error {
+	p, err := n.accept(l)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if p.inbound != nil {
+		p.inbound.Close()
+	}
+	p.inbound = l
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		if p.inbound == l {
+			p.inbound = nil
+			p.interest = make(map[string]struct{})
+		}
+		p.mu.Unlock()
+	}()
+	for {
+		f, err := l.read()
+		if err != nil {
+			return err
+		}
+		if err = n.handle(p, f); err != nil {
+			n.log.Warn("invalid frame from peer", zap.String("peer", p.Name), zap.Stringer("type", f.Type), zap.Error(err))
+		}
+	}
+}
+
+func (n *Node) handle(p *peer, f *frame) error {
+	switch f.Type {
+	case frameInterest, frameSubscribe, frameUnsubscribe:
+		p.mu.Lock()
+		if f.Type == frameInterest {
+			p.interest = make(map[string]struct{})
+		}
+		for _, filter := range f.Filters {
+			if f.Type == frameUnsubscribe {
+				delete(p.interest, filter)
+			} else {
+				p.interest[filter] = struct{}{}
+			}
+		}
+		p.mu.Unlock()
+	case framePublish:
+		msg, err := decodePublish(f.Packet)
+		if err != nil {
+			return err
+		}
+		n.server.DeliverLocal(msg)
+	case frameRetain:
+		var msg *packets.PublishPacket
+		if f.Packet != nil {
+			var err error
+			if msg, err = decodePublish(f.Packet); err != nil {
+				return err
+			}
+		}
+		n.server.RetainLocal(f.Topic, msg, f.Changed)
+	case frameTakeover:
+		n.takeover(p, f)
+	case frameSession:
+		n.server.RestoreSubscriptions(f.ClientID, f.Subscriptions)
+	default:
+		return fmt.Errorf("unexpected frame type %d", f.Type)
+	}
+	return nil
+}
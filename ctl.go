@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/htdvisser/pkg/config"
+	"github.com/htdvisser/squatt/admin"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var ctlCfg *config.Config
+
+// flags of the ctl subcommands
+var (
+	ctlKickReason string
+	ctlSubsClient string
+	ctlSubsFilter string
+)
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Control a running server",
+	Long:  "Control a running server over its control socket.",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if err := ctlCfg.ReadInConfig(); err != nil {
+			log.Debug("not using config file", zap.Error(err))
+		}
+	},
+}
+
+// ctlRequest does a request on the control socket and decodes the JSON response into v
+// In JSON format, the response is written to stdout instead.
+func ctlRequest(method, path string, query url.Values, v interface{}) error {
+	socket := ctlCfg.GetString("listen.control")
+	if socket == "" {
+		return errors.New("no control socket")
+	}
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+		Timeout: ctlCfg.GetDuration("timeout"),
+	}
+	u := url.URL{Scheme: "http", Host: "squatt", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 400 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		return errors.New(res.Status)
+	}
+	if ctlCfg.GetString("format") == "json" {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+	if v == nil || len(body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+// ctlRun returns a cobra Run func that runs f and exits on errors
+func ctlRun(args int, f func(args []string, w io.Writer) error) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, argv []string) {
+		if len(argv) != args {
+			cmd.Usage()
+			os.Exit(2)
+		}
+		switch format := ctlCfg.GetString("format"); format {
+		case "table", "json":
+		default:
+			log.Fatal("invalid format", zap.String("format", format))
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		if err := f(argv, w); err != nil {
+			log.Fatal("request failed", zap.Error(err))
+		}
+		w.Flush()
+	}
+}
+
+func ctlTable() bool {
+	return ctlCfg.GetString("format") == "table"
+}
+
+func protocolVersion(version byte) string {
+	switch version {
+	case 3:
+		return "3.1"
+	case 4:
+		return "3.1.1"
+	default:
+		return fmt.Sprint(version)
+	}
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatPayload(message admin.Message) string {
+	if message.Payload != nil {
+		return *message.Payload
+	}
+	return "base64:" + base64.StdEncoding.EncodeToString(message.PayloadBase64)
+}
+
+var ctlClientsCmd = &cobra.Command{
+	Use:   "clients",
+	Short: "Connected clients",
+}
+
+var ctlClientsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List connected clients",
+	Run: ctlRun(0, func(args []string, w io.Writer) error {
+		var clients []admin.Client
+		if err := ctlRequest(http.MethodGet, "/clients", nil, &clients); err != nil || !ctlTable() {
+			return err
+		}
+		fmt.Fprintln(w, "CLIENT ID\tREMOTE ADDRESS\tLISTENER\tUSERNAME\tVERSION\tKEEP-ALIVE\tCONNECTED\tIN-FLIGHT\tQUEUED")
+		for _, c := range clients {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+				c.ClientID, c.RemoteAddr, c.Listener, c.Username, protocolVersion(c.Version),
+				time.Duration(c.KeepAlive)*time.Second, formatTime(&c.ConnectedAt), c.InFlight, c.Queued,
+			)
+		}
+		return nil
+	}),
+}
+
+var ctlClientsKickCmd = &cobra.Command{
+	Use:   "kick <client-id>",
+	Short: "Disconnect a client",
+	Run: ctlRun(1, func(args []string, w io.Writer) error {
+		query := url.Values{}
+		if ctlKickReason != "" {
+			query.Set("reason", ctlKickReason)
+		}
+		return ctlRequest(http.MethodDelete, "/clients/"+args[0], query, nil)
+	}),
+}
+
+var ctlSessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "Sessions",
+}
+
+var ctlSessionsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List sessions",
+	Run: ctlRun(0, func(args []string, w io.Writer) error {
+		var sessions []admin.Session
+		if err := ctlRequest(http.MethodGet, "/sessions", nil, &sessions); err != nil || !ctlTable() {
+			return err
+		}
+		fmt.Fprintln(w, "CLIENT ID\tCONNECTED\tPERSISTENT\tEXPIRY\tDISCONNECTED\tIN-FLIGHT\tQUEUED")
+		for _, s := range sessions {
+			fmt.Fprintf(w, "%s\t%t\t%t\t%s\t%s\t%d\t%d\n",
+				s.ClientID, s.Connected, s.Persistent, time.Duration(s.Expiry)*time.Second,
+				formatTime(s.Disconnected), s.InFlight, s.Queued,
+			)
+		}
+		return nil
+	}),
+}
+
+var ctlSessionsDeleteCmd = &cobra.Command{
+	Use:   "delete <client-id>",
+	Short: "Disconnect a client and delete its session",
+	Run: ctlRun(1, func(args []string, w io.Writer) error {
+		return ctlRequest(http.MethodDelete, "/sessions/"+args[0], nil, nil)
+	}),
+}
+
+var ctlSubsCmd = &cobra.Command{
+	Use:   "subs",
+	Short: "Subscriptions",
+}
+
+var ctlSubsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List subscriptions",
+	Run: ctlRun(0, func(args []string, w io.Writer) error {
+		query := url.Values{}
+		if ctlSubsClient != "" {
+			query.Set("client", ctlSubsClient)
+		}
+		if ctlSubsFilter != "" {
+			query.Set("filter", ctlSubsFilter)
+		}
+		var subscriptions []admin.Subscription
+		if err := ctlRequest(http.MethodGet, "/subscriptions", query, &subscriptions); err != nil || !ctlTable() {
+			return err
+		}
+		fmt.Fprintln(w, "CLIENT ID\tFILTER\tQOS\tOPTIONS\tIDENTIFIER")
+		for _, s := range subscriptions {
+			var options []string
+			if s.NoLocal {
+				options = append(options, "no-local")
+			}
+			if s.RetainAsPublished {
+				options = append(options, "retain-as-published")
+			}
+			if s.RetainHandling != 0 {
+				options = append(options, fmt.Sprintf("retain-handling=%d", s.RetainHandling))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\n", s.ClientID, s.Filter, s.QoS, strings.Join(options, ","), s.Identifier)
+		}
+		return nil
+	}),
+}
+
+var ctlRetainedCmd = &cobra.Command{
+	Use:   "retained",
+	Short: "Retained messages",
+}
+
+var ctlRetainedGetCmd = &cobra.Command{
+	Use:   "get <topic>",
+	Short: "Get the retained message of a topic",
+	Run: ctlRun(1, func(args []string, w io.Writer) error {
+		var message admin.Message
+		if err := ctlRequest(http.MethodGet, "/retained/"+args[0], nil, &message); err != nil || !ctlTable() {
+			return err
+		}
+		fmt.Fprintln(w, "TOPIC\tQOS\tCONTENT TYPE\tEXPIRES\tPAYLOAD")
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", message.Topic, message.QoS, message.ContentType, formatTime(message.Expires), formatPayload(message))
+		return nil
+	}),
+}
+
+var ctlRetainedDeleteCmd = &cobra.Command{
+	Use:   "delete <topic>",
+	Short: "Delete the retained message of a topic",
+	Run: ctlRun(1, func(args []string, w io.Writer) error {
+		return ctlRequest(http.MethodDelete, "/retained/"+args[0], nil, nil)
+	}),
+}
+
+var ctlStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the stats of the server",
+	Run: ctlRun(0, func(args []string, w io.Writer) error {
+		var stats admin.Stats
+		if err := ctlRequest(http.MethodGet, "/stats", nil, &stats); err != nil || !ctlTable() {
+			return err
+		}
+		fmt.Fprintf(w, "connections\t%d\n", stats.Connections)
+		fmt.Fprintf(w, "clients\t%d\n", stats.Clients)
+		fmt.Fprintf(w, "sessions\t%d\n", stats.Sessions)
+		fmt.Fprintf(w, "subscriptions\t%d\n", stats.Subscriptions)
+		fmt.Fprintf(w, "retained messages\t%d\n", stats.RetainedMessages)
+		for _, counters := range []struct {
+			name   string
+			counts map[string]int64
+		}{
+			{"listener connections", stats.ListenerConnections},
+			{"rejected connections", stats.RejectedConnections},
+			{"exceeded quotas", stats.ExceededQuotas},
+		} {
+			keys := make([]string, 0, len(counters.counts))
+			for key := range counters.counts {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Fprintf(w, "%s (%s)\t%d\n", counters.name, key, counters.counts[key])
+			}
+		}
+		return nil
+	}),
+}
+
+type ctlConfig struct {
+	Listen struct {
+		Control string `name:"control" description:"Control socket of the server"`
+	} `name:"listen"`
+	Format  string        `name:"format" description:"Output format (table or json)"`
+	Timeout time.Duration `name:"timeout" description:"Timeout of requests"`
+}
+
+func ctlDefaults() (defaults ctlConfig) {
+	defaults.Format = "table"
+	defaults.Timeout = 10 * time.Second
+	return
+}
+
+func init() {
+	ctlCfg = config.Initialize("squatt", ctlDefaults())
+	ctlCmd.PersistentFlags().AddFlagSet(ctlCfg.Flags())
+	ctlClientsKickCmd.Flags().StringVar(&ctlKickReason, "reason", "", "Reason code for MQTT 5 clients (default 0x98, Administrative Action)")
+	ctlSubsListCmd.Flags().StringVar(&ctlSubsClient, "client", "", "Only list the subscriptions of the client")
+	ctlSubsListCmd.Flags().StringVar(&ctlSubsFilter, "filter", "", "Only list the subscriptions to the topic filter")
+	ctlClientsCmd.AddCommand(ctlClientsListCmd, ctlClientsKickCmd)
+	ctlSessionsCmd.AddCommand(ctlSessionsListCmd, ctlSessionsDeleteCmd)
+	ctlSubsCmd.AddCommand(ctlSubsListCmd)
+	ctlRetainedCmd.AddCommand(ctlRetainedGetCmd, ctlRetainedDeleteCmd)
+	ctlCmd.AddCommand(ctlClientsCmd, ctlSessionsCmd, ctlSubsCmd, ctlRetainedCmd, ctlStatsCmd)
+	cmd.AddCommand(ctlCmd)
+}
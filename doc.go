@@ -2,17 +2,84 @@
 
 // The SQuaTT MQTT Server
 //
+// On SIGHUP, the config file and the password file are reloaded. Changes to the log level, the users in the password
+// file, TLS settings, connection limits, quotas, queue limits, bridges, listeners and listen addresses are applied while
+// clients stay connected, other changes require a restart, including enabling or disabling the password file. Changed
+// TLS certificate files are also reloaded without SIGHUP.
+//
+// Additional listeners (tcp, tls, ws, wss or unix) and bridges to remote brokers are configured in the listeners
+// and bridges lists of the config file.
+//
 // Usage:
 //   squatt [flags]
+//   squatt [command]
+//
+// Available Commands:
+//   bench       Benchmark a broker
+//   ctl         Control a running server
+//   help        Help about any command
+//   pub         Publish a message
+//   sub         Subscribe to topics and print the messages
 //
 // Flags:
-//       --config string            Config file (default "$HOME/.squatt.yml")
-//       --data string              Data folder (default "$HOME/.squatt")
-//       --debug                    Debug mode
-//   -h, --help                     help for squatt
-//       --listen.debug string      Debug server listen address (default "127.0.0.1:6060")
-//       --listen.tcp string        MQTT server TCP listen address (default ":1883")
-//       --listen.tls string        MQTT server TLS listen address
-//       --tls.certificate string   Path to certificate for TLS (default "cert.pem")
-//       --tls.key string           Path to private key for TLS (default "key.pem")
+//       --admin.token string                         Token for the admin HTTP API
+//       --auth.password-file string                  Path to file with SCRAM-SHA-256 secrets of users (username:secret [option=value ...])
+//       --cluster.listen string                      Cluster listen address (required for a cluster)
+//       --cluster.name string                        Name of this node in the cluster (default hostname)
+//       --cluster.peers stringSlice                  Other nodes of the cluster (name=address)
+//       --cluster.secret string                      Secret that nodes of the cluster use to authenticate each other (required for a cluster)
+//       --config string                              Config file (default "$HOME/.squatt.yml")
+//       --data string                                Data folder (default "$HOME/.squatt")
+//       --debug                                      Debug mode
+//   -h, --help                                       help for squatt
+//       --inject.client-id string                    User property for the client identifier of publishers
+//       --inject.listener string                     User property for the listener of publishers
+//       --inject.timestamp string                    User property for the time at which messages are received
+//       --inject.username string                     User property for the username of publishers
+//       --keepalive.max duration                     Maximum keep-alive of MQTT 5 clients (0 for no maximum)
+//       --keepalive.min duration                     Minimum keep-alive of clients (0 for no minimum)
+//       --keepalive.override duration                Keep-alive of all MQTT 5 clients (0 to use the keep-alive of the client)
+//       --limit.connect-burst int                    Maximum burst of new connections (at least 1 with a connect rate) (default 100)
+//       --limit.connect-burst-per-ip int             Maximum burst of new connections from an IP address (at least 1 with a connect rate) (default 10)
+//       --limit.connect-rate int                     Maximum number of new connections per second (0 for no limit)
+//       --limit.connect-rate-per-ip int              Maximum number of new connections per second from an IP address (0 for no limit)
+//       --limit.connect-timeout duration             Time in which clients must send their CONNECT packet (0 for no limit) (default 10s)
+//       --limit.connections int                      Maximum number of connections (0 for no limit)
+//       --limit.connections-in-network stringSlice   Maximum number of connections from IP addresses in a network (cidr=connections)
+//       --limit.connections-per-ip int               Maximum number of connections from an IP address (0 for no limit)
+//       --limit.in-flight int                        Maximum number of unacknowledged messages of a session (default 32)
+//       --limit.packet-size int                      Maximum size of packets that clients can send (default 1048576)
+//       --limit.publish-queue int                    Maximum number of messages that are queued for a session (0 for no limit) (default 32)
+//       --limit.topic-length int                     Maximum length of topics (0 for no limit) (default 65535)
+//       --limit.topic-levels int                     Maximum number of topic levels (0 for no limit) (default 64)
+//       --listen.admin string                        Admin HTTP API listen address
+//       --listen.control string                      Control socket path
+//       --listen.debug string                        Debug server listen address (default "127.0.0.1:6060")
+//       --listen.tcp string                          MQTT server TCP listen address (default ":1883")
+//       --listen.tls string                          MQTT server TLS listen address
+//       --log.level string                           Log level (debug, info, warn or error, default info or debug in debug mode)
+//       --message.expiry stringSlice                 Expiry of messages without Message Expiry Interval per topic filter (filter=duration)
+//       --quota.bytes int                            Maximum number of payload bytes per second that clients can publish (0 for no limit)
+//       --quota.bytes-action string                  Action when clients exceed the byte quota (throttle, drop or disconnect) (default "throttle")
+//       --quota.messages int                         Maximum number of messages per second that clients can publish (0 for no limit)
+//       --quota.messages-action string               Action when clients exceed the message quota (throttle, drop or disconnect) (default "throttle")
+//       --quota.per-user                             Share the message and byte quotas between all clients of a user
+//       --quota.subscriptions int                    Maximum number of subscriptions of a session (0 for no limit)
+//       --quota.subscriptions-action string          Action when clients exceed the subscription quota (drop or disconnect) (default "drop")
+//       --response.prefix string                     Prefix of response topics for MQTT 5 clients that request response information (<prefix><username>/<client-id>)
+//       --session.expiry duration                    Expiry of persistent sessions after their client disconnects (0 for no expiry)
+//       --subscription.no-local                      Do not send messages of MQTT 3.1.1 clients to their own subscriptions
+//       --subscription.retain-as-published           Keep the retain flag on messages to subscriptions of MQTT 3.1.1 clients
+//       --subscription.retain-handling int           Sending of retained messages to subscriptions of MQTT 3.1.1 clients (0: on subscribe, 1: on new subscription, 2: never)
+//       --tls.alpn stringSlice                       Application protocols for ALPN
+//       --tls.certificate stringSlice                Paths to certificates for TLS, selected by server name (SNI), the first is the default (default [cert.pem])
+//       --tls.cipher-suites stringSlice              Cipher suites for TLS 1.2 and below (default Go defaults)
+//       --tls.client-ca-file string                  Path to CA certificates for verifying client certificates
+//       --tls.key stringSlice                        Paths to the private keys of the certificates (default [key.pem])
+//       --tls.min-version string                     Minimum TLS version (1.0, 1.1, 1.2 or 1.3) (default "1.2")
+//       --tls.require-client-certificate             Reject clients without certificate (requires client CA)
+//       --tls.watch-interval duration                Interval for checking certificate files for changes (0 to disable) (default 1m0s)
+//       --will.delay duration                        Default delay for publishing wills of MQTT 3.1.1 clients
+//
+// Use "squatt [command] --help" for more information about a command.
 package main
@@ -0,0 +1,199 @@
+// Package listener configures the listeners of the MQTT server
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/htdvisser/squatt/tlsconfig"
+)
+
+// Protocols of listeners
+const (
+	TCP       = "tcp"
+	TLS       = "tls"
+	WebSocket = "ws"
+	// SecureWebSocket is WebSocket over TLS
+	SecureWebSocket = "wss"
+	Unix            = "unix"
+)
+
+var protocols = []string{TCP, TLS, WebSocket, SecureWebSocket, Unix}
+
+// Config of a listener
+type Config struct {
+	// Name of the listener, which is used in logs, metrics and auth
+	Name string
+	// Protocol is tcp, tls, ws, wss or unix
+	Protocol string
+	// Address is the listen address, or the path of the socket for unix listeners
+	Address string
+	// Path is the HTTP path for WebSocket listeners, any path is accepted if it is empty
+	Path string
+	// TLS is the TLS config of tls and wss listeners, the TLS config of the server is used if it has no certificates
+	TLS tlsconfig.Config
+	// Auth are the names of the auth plugins of the listener (anonymous, password or peer), which are tried in order
+	// The auth of the server is used if it is empty. Anonymous clients have no username.
+	Auth []string
+	// MaxConnections is the maximum number of connections to the listener, zero means no limit
+	MaxConnections int
+	// MaxPacketSize is the maximum size of packets that clients can send, the limit of the server is used if zero
+	MaxPacketSize int
+	// Mountpoint is the prefix of the topics of the clients of the listener
+	Mountpoint string
+	// SocketMode is the file mode of the socket of unix listeners, DefaultSocketMode is used if it is zero
+	SocketMode os.FileMode
+	// PeerUsers are the names or uids of the Unix users that the peer auth plugin authorizes
+	// All users that can connect to the socket are authorized if it is empty.
+	PeerUsers []string
+}
+
+// Secure returns true if the listener uses TLS
+func (c Config) Secure() bool {
+	return c.Protocol == TLS || c.Protocol == SecureWebSocket
+}
+
+// OwnTLS returns true if the listener uses TLS with its own certificates instead of those of the server
+func (c Config) OwnTLS() bool {
+	return c.Secure() && len(c.TLS.Certificates) > 0
+}
+
+func (c Config) hasTLSSettings() bool {
+	return len(c.TLS.Certificates) > 0 || c.TLS.MinVersion != "" || len(c.TLS.CipherSuites) > 0 ||
+		len(c.TLS.ALPN) > 0 || c.TLS.ClientCAFile != "" || c.TLS.RequireClientCertificate
+}
+
+func (c Config) validate() error {
+	var known bool
+	for _, protocol := range protocols {
+		if c.Protocol == protocol {
+			known = true
+		}
+	}
+	switch {
+	case c.Protocol == "":
+		return errors.New("no protocol")
+	case !known:
+		return fmt.Errorf("unknown protocol %s", c.Protocol)
+	case c.Address == "":
+		return errors.New("no address")
+	case c.Path != "" && c.Protocol != WebSocket && c.Protocol != SecureWebSocket:
+		return errors.New("path requires protocol ws or wss")
+	case !c.Secure() && c.hasTLSSettings():
+		return errors.New("TLS settings require protocol tls or wss")
+	case c.Secure() && len(c.TLS.Certificates) == 0 && c.hasTLSSettings():
+		return errors.New("TLS settings require a certificate")
+	case c.MaxConnections < 0:
+		return errors.New("invalid max connections")
+	case c.MaxPacketSize < 0:
+		return errors.New("invalid max packet size")
+	case strings.ContainsAny(c.Mountpoint, "+#"):
+		return errors.New("mountpoint can not contain wildcards")
+	case c.SocketMode&^os.ModePerm != 0:
+		return errors.New("invalid socket mode")
+	case (c.SocketMode != 0 || len(c.PeerUsers) > 0) && c.Protocol != Unix:
+		return errors.New("socket-mode and peer-users require protocol unix")
+	}
+	return nil
+}
+
+// Settings of a listener in the config of the server
+// The TLS settings are the same as those of the server, the certificates and keys are lists of the same length.
+type Settings struct {
+	Name                     string      `mapstructure:"name"`
+	Protocol                 string      `mapstructure:"protocol"`
+	Address                  string      `mapstructure:"address"`
+	Path                     string      `mapstructure:"path"`
+	Certificate              []string    `mapstructure:"certificate"`
+	Key                      []string    `mapstructure:"key"`
+	MinVersion               string      `mapstructure:"min-version"`
+	CipherSuites             []string    `mapstructure:"cipher-suites"`
+	ALPN                     []string    `mapstructure:"alpn"`
+	ClientCAFile             string      `mapstructure:"client-ca-file"`
+	RequireClientCertificate bool        `mapstructure:"require-client-certificate"`
+	Auth                     []string    `mapstructure:"auth"`
+	MaxConnections           int         `mapstructure:"max-connections"`
+	MaxPacketSize            int         `mapstructure:"max-packet-size"`
+	Mountpoint               string      `mapstructure:"mountpoint"`
+	SocketMode               os.FileMode `mapstructure:"socket-mode"`
+	PeerUsers                []string    `mapstructure:"peer-users"`
+}
+
+// Configs returns the configs of the listeners with the given settings
+// The settings are typically read from the listeners list in the config file of the server:
+//
+//	listeners:
+//	- name: internal
+//	  protocol: tcp
+//	  address: 127.0.0.1:1885
+//	  auth: [anonymous]
+//	- name: web
+//	  protocol: wss
+//	  address: :8084
+//	  path: /mqtt
+//	  certificate: [web.crt]
+//	  key: [web.key]
+//	  min-version: "1.2"
+//	  auth: [password]
+//	  max-connections: 1000
+//	  max-packet-size: 65536
+//	  mountpoint: web/
+//	- name: local
+//	  protocol: unix
+//	  address: /run/squatt/mqtt.sock
+//	  socket-mode: 0660
+//	  auth: [peer]
+//	  peer-users: [sidecar, "1001"]
+func Configs(settings []Settings) ([]Config, error) {
+	configs := make([]Config, 0, len(settings))
+	names := make(map[string]bool)
+	for _, s := range settings {
+		if s.Name == "" {
+			return nil, errors.New("listener without name")
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("duplicate listener %s", s.Name)
+		}
+		names[s.Name] = true
+		config, err := s.config()
+		if err == nil {
+			err = config.validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %s", s.Name, err)
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func (s Settings) config() (Config, error) {
+	if len(s.Certificate) != len(s.Key) {
+		return Config{}, errors.New("number of certificates and keys differ")
+	}
+	c := Config{
+		Name:     s.Name,
+		Protocol: s.Protocol,
+		Address:  s.Address,
+		Path:     s.Path,
+		TLS: tlsconfig.Config{
+			MinVersion:               s.MinVersion,
+			CipherSuites:             s.CipherSuites,
+			ALPN:                     s.ALPN,
+			ClientCAFile:             s.ClientCAFile,
+			RequireClientCertificate: s.RequireClientCertificate,
+		},
+		Auth:           s.Auth,
+		MaxConnections: s.MaxConnections,
+		MaxPacketSize:  s.MaxPacketSize,
+		Mountpoint:     s.Mountpoint,
+		SocketMode:     s.SocketMode,
+		PeerUsers:      s.PeerUsers,
+	}
+	for i, certificate := range s.Certificate {
+		c.TLS.Certificates = append(c.TLS.Certificates, tlsconfig.Pair{CertificateFile: certificate, KeyFile: s.Key[i]})
+	}
+	return c, nil
+}
@@ -0,0 +1,143 @@
+package listener
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/htdvisser/squatt/tlsconfig"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigs(t *testing.T) {
+	Convey(`Given listener settings`, t, func() {
+		configs, err := Configs([]Settings{
+			{Name: "internal", Protocol: TCP, Address: "127.0.0.1:1885", Auth: []string{"anonymous"}},
+			{
+				Name:           "web",
+				Protocol:       SecureWebSocket,
+				Address:        ":8084",
+				Path:           "/mqtt",
+				Certificate:    []string{"web.crt", "other.crt"},
+				Key:            []string{"web.key", "other.key"},
+				MinVersion:     "1.2",
+				ALPN:           []string{"http/1.1"},
+				Auth:           []string{"password", "anonymous"},
+				MaxConnections: 1000,
+				MaxPacketSize:  65536,
+				Mountpoint:     "web/",
+			},
+			{
+				Name:       "local",
+				Protocol:   Unix,
+				Address:    "/run/squatt/mqtt.sock",
+				SocketMode: 0660,
+				Auth:       []string{"peer"},
+				PeerUsers:  []string{"sidecar", "1001"},
+			},
+		})
+		Convey(`Then they should be converted to configs`, func() {
+			So(err, ShouldBeNil)
+			So(configs, ShouldResemble, []Config{
+				{Name: "internal", Protocol: TCP, Address: "127.0.0.1:1885", Auth: []string{"anonymous"}},
+				{
+					Name:     "web",
+					Protocol: SecureWebSocket,
+					Address:  ":8084",
+					Path:     "/mqtt",
+					TLS: tlsconfig.Config{
+						Certificates: []tlsconfig.Pair{
+							{CertificateFile: "web.crt", KeyFile: "web.key"},
+							{CertificateFile: "other.crt", KeyFile: "other.key"},
+						},
+						MinVersion: "1.2",
+						ALPN:       []string{"http/1.1"},
+					},
+					Auth:           []string{"password", "anonymous"},
+					MaxConnections: 1000,
+					MaxPacketSize:  65536,
+					Mountpoint:     "web/",
+				},
+				{
+					Name:       "local",
+					Protocol:   Unix,
+					Address:    "/run/squatt/mqtt.sock",
+					Auth:       []string{"peer"},
+					SocketMode: 0660,
+					PeerUsers:  []string{"sidecar", "1001"},
+				},
+			})
+			So(configs[0].OwnTLS(), ShouldBeFalse)
+			So(configs[1].OwnTLS(), ShouldBeTrue)
+		})
+	})
+
+	Convey(`Given invalid listener settings`, t, func() {
+		for _, settings := range [][]Settings{
+			{{Protocol: TCP, Address: ":1883"}},
+			{{Name: "foo", Address: ":1883"}},
+			{{Name: "foo", Protocol: "udp", Address: ":1883"}},
+			{{Name: "foo", Protocol: TCP}},
+			{{Name: "foo", Protocol: TCP, Address: ":1883", Path: "/mqtt"}},
+			{{Name: "foo", Protocol: TCP, Address: ":1883", Certificate: []string{"cert.pem"}, Key: []string{"key.pem"}}},
+			{{Name: "foo", Protocol: TLS, Address: ":8883", MinVersion: "1.2"}},
+			{{Name: "foo", Protocol: TLS, Address: ":8883", Certificate: []string{"cert.pem"}}},
+			{{Name: "foo", Protocol: TCP, Address: ":1883", MaxConnections: -1}},
+			{{Name: "foo", Protocol: TCP, Address: ":1883", Mountpoint: "tenant/+/"}},
+			{{Name: "foo", Protocol: TCP, Address: ":1883", SocketMode: 0660}},
+			{{Name: "foo", Protocol: TCP, Address: ":1883", PeerUsers: []string{"sidecar"}}},
+			{{Name: "foo", Protocol: Unix, Address: "foo.sock", SocketMode: 017777}},
+			{{Name: "foo", Protocol: TCP, Address: ":1883"}, {Name: "foo", Protocol: TCP, Address: ":1884"}},
+		} {
+			_, err := Configs(settings)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestListen(t *testing.T) {
+	Convey(`Given listener configs`, t, func() {
+		for _, protocol := range []string{TCP, WebSocket} {
+			Convey(`When listening with protocol `+protocol, func() {
+				lis, err := Listen(Config{Protocol: protocol, Address: "localhost:0"}, nil)
+				So(err, ShouldBeNil)
+				defer lis.Close()
+				Convey(`Then clients should be able to connect`, func() {
+					conn, err := net.Dial("tcp", lis.Addr().String())
+					So(err, ShouldBeNil)
+					conn.Close()
+				})
+			})
+		}
+	})
+}
+
+func TestListenUnix(t *testing.T) {
+	Convey(`Given a unix listener with a socket mode`, t, func() {
+		path := filepath.Join(os.TempDir(), "squatt-listen-test.sock")
+		os.Remove(path)
+		lis, err := Listen(Config{Protocol: Unix, Address: path, SocketMode: 0660}, nil)
+		So(err, ShouldBeNil)
+		defer lis.Close()
+
+		Convey(`Then the socket should have the mode`, func() {
+			info, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0660))
+		})
+
+		Convey(`Then clients should be able to connect`, func() {
+			conn, err := net.Dial("unix", path)
+			So(err, ShouldBeNil)
+			conn.Close()
+		})
+
+		Convey(`When another listener uses the same path`, func() {
+			_, err := ListenUnix(path, 0)
+			Convey(`Then it should fail`, func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
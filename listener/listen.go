@@ -0,0 +1,60 @@
+package listener
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/htdvisser/squatt/websocket"
+)
+
+// Listen starts listening on the address of the listener
+// Listeners with protocol tls and wss use the TLS config.
+func Listen(config Config, tlsConfig *tls.Config) (net.Listener, error) {
+	switch config.Protocol {
+	case TCP:
+		return net.Listen("tcp", config.Address)
+	case TLS:
+		return tls.Listen("tcp", config.Address, tlsConfig)
+	case WebSocket, SecureWebSocket:
+		lis, err := net.Listen("tcp", config.Address)
+		if err != nil {
+			return nil, err
+		}
+		if config.Protocol == SecureWebSocket {
+			lis = tls.NewListener(lis, tlsConfig)
+		}
+		return websocket.NewListener(lis, config.Path), nil
+	case Unix:
+		return ListenUnix(config.Address, config.SocketMode)
+	}
+	return nil, fmt.Errorf("unknown protocol %s", config.Protocol)
+}
+
+// DefaultSocketMode is the file mode of Unix sockets that have no socket mode in their config
+var DefaultSocketMode os.FileMode = 0600
+
+// ListenUnix listens on a Unix socket with the file mode, or DefaultSocketMode if it is zero
+// A socket that is left behind by a previous process is removed, but a socket that is in use is not.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("socket %s is in use", path)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+	lis, err := listenUnix(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return lis, nil
+}
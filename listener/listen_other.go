@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package listener
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnix creates the socket, it gets its file mode after it is created
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
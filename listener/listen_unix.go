@@ -0,0 +1,23 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package listener
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes changes of the umask of the process
+var umaskMu sync.Mutex
+
+// listenUnix creates the socket with the umask set to the file mode, so that it can not be used before it has its mode
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	umask := syscall.Umask(int(^mode.Perm() & 0777))
+	defer syscall.Umask(umask)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,28 @@
+package listener
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/htdvisser/squatt/auth"
+)
+
+// PeerCredentials returns the credentials of the process on the other end of a Unix socket connection
+func PeerCredentials(conn net.Conn) *auth.PeerCredentials {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var ucred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || ucred == nil {
+		return nil
+	}
+	return &auth.PeerCredentials{UID: ucred.Uid, GID: ucred.Gid, PID: ucred.Pid}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package listener
+
+import (
+	"net"
+
+	"github.com/htdvisser/squatt/auth"
+)
+
+// PeerCredentials is only supported on Linux, it returns nil on other platforms
+func PeerCredentials(conn net.Conn) *auth.PeerCredentials {
+	return nil
+}
@@ -1,57 +1,140 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/htdvisser/pkg/config"
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/cluster"
+	"github.com/htdvisser/squatt/packets"
 	"github.com/htdvisser/squatt/server"
+	"github.com/htdvisser/squatt/session"
+	"github.com/htdvisser/squatt/topic"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
 
-var log, _ = zap.NewProduction()
+var log = newLogger(zap.NewProductionConfig())
 
 var cfg *config.Config
 
 var cmd = &cobra.Command{
 	Use:   "squatt",
 	Short: "The SQuaTT MQTT Server",
+	Long: `The SQuaTT MQTT Server
+
+On SIGHUP, the config file and the password file are reloaded. Changes to the log level, the users in the password
+file, TLS settings, connection limits, quotas, queue limits, bridges, listeners and listen addresses are applied while
+clients stay connected, other changes require a restart, including enabling or disabling the password file. Changed
+TLS certificate files are also reloaded without SIGHUP.
+
+Additional listeners (tcp, tls, ws, wss or unix) and bridges to remote brokers are configured in the listeners
+and bridges lists of the config file.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		defer func() { log.Info("server stopped") }()
+		if err := applyLogLevel(); err != nil {
+			log.Fatal("invalid log level", zap.Error(err))
+		}
 		log.Info("server starting")
 
+		server.MaxPacketSize = cfg.GetInt("limit.packet-size")
+		topic.MaxLength = cfg.GetInt("limit.topic-length")
+		topic.MaxLevels = cfg.GetInt("limit.topic-levels")
+
 		s := server.NewServer()
 		s.SetLogger(log)
+		s.SetSessionExpiry(cfg.GetDuration("session.expiry"))
+		s.SetWillDelay(cfg.GetDuration("will.delay"))
+		s.SetKeepAlivePolicy(server.KeepAlivePolicy{
+			Min:      cfg.GetDuration("keepalive.min"),
+			Max:      cfg.GetDuration("keepalive.max"),
+			Override: cfg.GetDuration("keepalive.override"),
+		})
+		s.SetResponseTopicPrefix(cfg.GetString("response.prefix"))
+		s.SetInjectedProperties(server.InjectedProperties{
+			ClientID:  cfg.GetString("inject.client-id"),
+			Username:  cfg.GetString("inject.username"),
+			Timestamp: cfg.GetString("inject.timestamp"),
+			Listener:  cfg.GetString("inject.listener"),
+		})
+		for _, messageExpiry := range cfg.GetStringSlice("message.expiry") {
+			sep := strings.LastIndex(messageExpiry, "=")
+			if sep == -1 {
+				log.Fatal("invalid message expiry, expected filter=duration", zap.String("expiry", messageExpiry))
+			}
+			filter := messageExpiry[:sep]
+			expiry, err := time.ParseDuration(messageExpiry[sep+1:])
+			if err == nil {
+				err = s.SetMessageExpiry(filter, expiry)
+			}
+			if err != nil {
+				log.Fatal("invalid message expiry", zap.String("filter", filter), zap.Error(err))
+			}
+		}
 
-		go s.Route()
-
-		if listen := cfg.GetString("listen.tcp"); listen != "" {
-			log.Info("starting tcp server", zap.String("address", listen))
-			go func() {
-				if err := s.ListenAndServe(listen); err != nil {
-					log.Fatal("could not start tcp server", zap.Error(err))
+		var node *cluster.Node
+		if peers := cfg.GetStringSlice("cluster.peers"); len(peers) > 0 {
+			name := cfg.GetString("cluster.name")
+			if name == "" {
+				name, _ = os.Hostname()
+			}
+			config := cluster.DefaultConfig(name)
+			config.Secret = cfg.GetString("cluster.secret")
+			for _, peer := range peers {
+				sep := strings.Index(peer, "=")
+				if sep == -1 {
+					log.Fatal("invalid cluster peer, expected name=address", zap.String("peer", peer))
 				}
-			}()
+				config.Peers = append(config.Peers, cluster.Peer{Name: peer[:sep], Address: peer[sep+1:]})
+			}
+			if cfg.GetString("cluster.listen") == "" {
+				log.Fatal("cluster requires a listen address")
+			}
+			var err error
+			if node, err = cluster.New(s, config); err != nil {
+				log.Fatal("could not create cluster node", zap.Error(err))
+			}
+			node.SetLogger(log)
 		}
 
-		if listen := cfg.GetString("listen.tls"); listen != "" {
-			var tlsConfig tls.Config
-			certificate, err := tls.LoadX509KeyPair(cfg.GetString("tls.certificate"), cfg.GetString("tls.key"))
+		go s.Route()
+		go s.Reap()
+
+		if node != nil {
+			listen := cfg.GetString("cluster.listen")
+			lis, err := net.Listen("tcp", listen)
 			if err != nil {
-				log.Fatal("could not load tls certificate and key", zap.Error(err))
+				log.Fatal("could not start cluster server", zap.Error(err))
 			}
-			tlsConfig.Certificates = append(tlsConfig.Certificates, certificate)
-			log.Info("starting tls server", zap.String("address", listen))
+			log.Info("starting cluster node", zap.String("node", node.Config().Name), zap.String("address", listen))
 			go func() {
-				if err := s.ListenAndServeTLS(listen, &tlsConfig); err != nil {
-					log.Fatal("could not start tls server", zap.Error(err))
+				if err := node.Serve(lis); err != nil {
+					log.Fatal("cluster server stopped", zap.Error(err))
 				}
 			}()
+			node.Start()
+		}
+
+		subscriptionOptions := packets.SubscriptionOptions{
+			NoLocal:           cfg.GetBool("subscription.no-local"),
+			RetainAsPublished: cfg.GetBool("subscription.retain-as-published"),
+			RetainHandling:    byte(cfg.GetInt("subscription.retain-handling")),
+		}
+		if subscriptionOptions.RetainHandling > packets.DoNotSendRetained {
+			log.Fatal("invalid retain handling", zap.Uint8("retain-handling", subscriptionOptions.RetainHandling))
+		}
+
+		r := newRuntime(s, subscriptionOptions)
+		if err := r.start(); err != nil {
+			log.Fatal("could not start server", zap.Error(err))
 		}
 
 		if cfg.GetBool("debug") {
@@ -63,30 +146,134 @@ var cmd = &cobra.Command{
 		}
 
 		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-		signal := (<-sigChan).String()
-		log.Info("signal received", zap.String("signal", signal))
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range sigChan {
+			log.Info("signal received", zap.String("signal", sig.String()))
+			if sig != syscall.SIGHUP {
+				break
+			}
+			r.reload()
+		}
+
+		r.stop()
+		if node != nil {
+			node.Stop()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Warn("connections not closed", zap.Error(err))
+		}
 	},
 }
 
 type squattConfig struct {
 	Listen struct {
-		TCP   string `name:"tcp" description:"MQTT server TCP listen address"`
-		TLS   string `name:"tls" description:"MQTT server TLS listen address"`
-		Debug string `name:"debug" description:"Debug server listen address"`
+		TCP     string `name:"tcp" description:"MQTT server TCP listen address"`
+		TLS     string `name:"tls" description:"MQTT server TLS listen address"`
+		Admin   string `name:"admin" description:"Admin HTTP API listen address"`
+		Control string `name:"control" description:"Control socket path"`
+		Debug   string `name:"debug" description:"Debug server listen address"`
 	} `name:"listen"`
+	Admin struct {
+		Token string `name:"token" description:"Token for the admin HTTP API"`
+	} `name:"admin"`
+	Cluster struct {
+		Name   string   `name:"name" description:"Name of this node in the cluster (default hostname)"`
+		Listen string   `name:"listen" description:"Cluster listen address (required for a cluster)"`
+		Peers  []string `name:"peers" description:"Other nodes of the cluster (name=address)"`
+		Secret string   `name:"secret" description:"Secret that nodes of the cluster use to authenticate each other (required for a cluster)"`
+	} `name:"cluster"`
+	Auth struct {
+		PasswordFile string `name:"password-file" description:"Path to file with SCRAM-SHA-256 secrets of users (username:secret [option=value ...])"`
+	} `name:"auth"`
 	TLS struct {
-		Certificate string `name:"certificate" description:"Path to certificate for TLS"`
-		Key         string `name:"key" description:"Path to private key for TLS"`
+		Certificate              []string      `name:"certificate" description:"Paths to certificates for TLS, selected by server name (SNI), the first is the default"`
+		Key                      []string      `name:"key" description:"Paths to the private keys of the certificates"`
+		MinVersion               string        `name:"min-version" description:"Minimum TLS version (1.0, 1.1, 1.2 or 1.3)"`
+		CipherSuites             []string      `name:"cipher-suites" description:"Cipher suites for TLS 1.2 and below (default Go defaults)"`
+		ALPN                     []string      `name:"alpn" description:"Application protocols for ALPN"`
+		ClientCAFile             string        `name:"client-ca-file" description:"Path to CA certificates for verifying client certificates"`
+		RequireClientCertificate bool          `name:"require-client-certificate" description:"Reject clients without certificate (requires client CA)"`
+		WatchInterval            time.Duration `name:"watch-interval" description:"Interval for checking certificate files for changes (0 to disable)"`
 	}
+	Inject struct {
+		ClientID  string `name:"client-id" description:"User property for the client identifier of publishers"`
+		Username  string `name:"username" description:"User property for the username of publishers"`
+		Timestamp string `name:"timestamp" description:"User property for the time at which messages are received"`
+		Listener  string `name:"listener" description:"User property for the listener of publishers"`
+	} `name:"inject"`
+	KeepAlive struct {
+		Min      time.Duration `name:"min" description:"Minimum keep-alive of clients (0 for no minimum)"`
+		Max      time.Duration `name:"max" description:"Maximum keep-alive of MQTT 5 clients (0 for no maximum)"`
+		Override time.Duration `name:"override" description:"Keep-alive of all MQTT 5 clients (0 to use the keep-alive of the client)"`
+	} `name:"keepalive"`
+	Limit struct {
+		PacketSize           int           `name:"packet-size" description:"Maximum size of packets that clients can send"`
+		TopicLength          int           `name:"topic-length" description:"Maximum length of topics (0 for no limit)"`
+		TopicLevels          int           `name:"topic-levels" description:"Maximum number of topic levels (0 for no limit)"`
+		Connections          int           `name:"connections" description:"Maximum number of connections (0 for no limit)"`
+		ConnectionsPerIP     int           `name:"connections-per-ip" description:"Maximum number of connections from an IP address (0 for no limit)"`
+		ConnectionsInNetwork []string      `name:"connections-in-network" description:"Maximum number of connections from IP addresses in a network (cidr=connections)"`
+		ConnectRate          int           `name:"connect-rate" description:"Maximum number of new connections per second (0 for no limit)"`
+		ConnectBurst         int           `name:"connect-burst" description:"Maximum burst of new connections (at least 1 with a connect rate)"`
+		ConnectRatePerIP     int           `name:"connect-rate-per-ip" description:"Maximum number of new connections per second from an IP address (0 for no limit)"`
+		ConnectBurstPerIP    int           `name:"connect-burst-per-ip" description:"Maximum burst of new connections from an IP address (at least 1 with a connect rate)"`
+		ConnectTimeout       time.Duration `name:"connect-timeout" description:"Time in which clients must send their CONNECT packet (0 for no limit)"`
+		PublishQueue         int           `name:"publish-queue" description:"Maximum number of messages that are queued for a session (0 for no limit)"`
+		InFlight             int           `name:"in-flight" description:"Maximum number of unacknowledged messages of a session"`
+	} `name:"limit"`
+	Quota struct {
+		Messages            int    `name:"messages" description:"Maximum number of messages per second that clients can publish (0 for no limit)"`
+		MessagesAction      string `name:"messages-action" description:"Action when clients exceed the message quota (throttle, drop or disconnect)"`
+		Bytes               int    `name:"bytes" description:"Maximum number of payload bytes per second that clients can publish (0 for no limit)"`
+		BytesAction         string `name:"bytes-action" description:"Action when clients exceed the byte quota (throttle, drop or disconnect)"`
+		Subscriptions       int    `name:"subscriptions" description:"Maximum number of subscriptions of a session (0 for no limit)"`
+		SubscriptionsAction string `name:"subscriptions-action" description:"Action when clients exceed the subscription quota (drop or disconnect)"`
+		PerUser             bool   `name:"per-user" description:"Share the message and byte quotas between all clients of a user"`
+	} `name:"quota"`
+	Message struct {
+		Expiry []string `name:"expiry" description:"Expiry of messages without Message Expiry Interval per topic filter (filter=duration)"`
+	} `name:"message"`
+	Response struct {
+		Prefix string `name:"prefix" description:"Prefix of response topics for MQTT 5 clients that request response information (<prefix><username>/<client-id>)"`
+	} `name:"response"`
+	Session struct {
+		Expiry time.Duration `name:"expiry" description:"Expiry of persistent sessions after their client disconnects (0 for no expiry)"`
+	} `name:"session"`
+	Subscription struct {
+		NoLocal           bool `name:"no-local" description:"Do not send messages of MQTT 3.1.1 clients to their own subscriptions"`
+		RetainAsPublished bool `name:"retain-as-published" description:"Keep the retain flag on messages to subscriptions of MQTT 3.1.1 clients"`
+		RetainHandling    int  `name:"retain-handling" description:"Sending of retained messages to subscriptions of MQTT 3.1.1 clients (0: on subscribe, 1: on new subscription, 2: never)"`
+	} `name:"subscription"`
+	Will struct {
+		Delay time.Duration `name:"delay" description:"Default delay for publishing wills of MQTT 3.1.1 clients"`
+	} `name:"will"`
+	Log struct {
+		Level string `name:"level" description:"Log level (debug, info, warn or error, default info or debug in debug mode)"`
+	} `name:"log"`
 	Debug bool `name:"debug" description:"Debug mode"`
 }
 
 func defaults() (defaults squattConfig) {
 	defaults.Listen.TCP = ":1883"
 	defaults.Listen.Debug = "127.0.0.1:6060"
-	defaults.TLS.Certificate = "cert.pem"
-	defaults.TLS.Key = "key.pem"
+	defaults.TLS.Certificate = []string{"cert.pem"}
+	defaults.TLS.Key = []string{"key.pem"}
+	defaults.TLS.MinVersion = "1.2"
+	defaults.TLS.WatchInterval = time.Minute
+	defaults.Limit.PacketSize = server.MaxPacketSize
+	defaults.Limit.TopicLength = topic.MaxLength
+	defaults.Limit.TopicLevels = topic.MaxLevels
+	defaults.Limit.ConnectBurst = 100
+	defaults.Limit.ConnectBurstPerIP = 10
+	defaults.Limit.ConnectTimeout = 10 * time.Second
+	defaults.Limit.PublishQueue = session.PublishQueueLimit
+	defaults.Limit.InFlight = session.InFlightLimit
+	defaults.Quota.MessagesAction = auth.Throttle.String()
+	defaults.Quota.BytesAction = auth.Throttle.String()
+	defaults.Quota.SubscriptionsAction = auth.Drop.String()
 	return
 }
 
@@ -95,7 +282,7 @@ func init() {
 	cmd.Flags().AddFlagSet(cfg.Flags())
 	cobra.OnInitialize(func() {
 		if cfg.GetBool("debug") {
-			log, _ = zap.NewDevelopment()
+			log = newLogger(zap.NewDevelopmentConfig())
 		}
 		if err := cfg.ReadInConfig(); err != nil {
 			log.Info("not using config file", zap.Error(err))
@@ -0,0 +1,33 @@
+package packets
+
+// writeAck encodes the variable header of PUBACK, PUBREC, PUBREL and PUBCOMP packets
+// In MQTT 5, the Reason Code and Properties are omitted if the Reason Code is 0x00 and there are no Properties.
+func writeAck(body *encoder, version byte, messageID uint16, reasonCode byte, properties *Properties) {
+	body.uint16(messageID)
+	if version < Version5 {
+		return
+	}
+	var props encoder
+	properties.encode(&props)
+	if reasonCode == Success && props.Len() == 1 {
+		return
+	}
+	body.WriteByte(reasonCode)
+	if props.Len() > 1 {
+		body.append(&props)
+	}
+}
+
+// readAck decodes the variable header of PUBACK, PUBREC, PUBREL and PUBCOMP packets
+func readAck(d *decoder, version byte, packetType byte, remainingLength int) (messageID uint16, reasonCode byte, properties Properties) {
+	messageID = d.uint16()
+	if version < Version5 || remainingLength < 3 {
+		return
+	}
+	reasonCode = d.byte()
+	if remainingLength < 4 {
+		return
+	}
+	properties.decode(d, packetType)
+	return
+}
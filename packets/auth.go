@@ -0,0 +1,50 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// AuthPacket is an MQTT 5 AUTH packet
+type AuthPacket struct {
+	FixedHeader
+	ReasonCode byte
+	Properties Properties
+}
+
+func (a *AuthPacket) String() string {
+	return fmt.Sprintf("%s reasoncode: %d", a.FixedHeader, a.ReasonCode)
+}
+
+// Write the packet to w
+func (a *AuthPacket) Write(w io.Writer, version byte) error {
+	if version < Version5 {
+		return errUnsupportedVersion
+	}
+	var body encoder
+	var props encoder
+	a.Properties.encode(&props)
+	if a.ReasonCode != Success || props.Len() > 1 {
+		body.WriteByte(a.ReasonCode)
+		body.append(&props)
+	}
+	return a.FixedHeader.write(w, Auth, &body)
+}
+
+// Unpack the packet from r
+func (a *AuthPacket) Unpack(r io.Reader, version byte) error {
+	if version < Version5 {
+		return errUnsupportedVersion
+	}
+	d := newDecoder(r)
+	if a.RemainingLength > 0 {
+		a.ReasonCode = d.byte()
+		a.Properties.decode(d, Auth)
+	}
+	return d.done(a.RemainingLength)
+}
+
+// Details of the packet
+func (a *AuthPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
@@ -0,0 +1,50 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// ConnackPacket is an MQTT CONNACK packet
+// The ReturnCode can be an MQTT 3.1.1 return code or an MQTT 5 reason code,
+// it is converted when encoding the packet for the other protocol version.
+type ConnackPacket struct {
+	FixedHeader
+	SessionPresent bool
+	ReturnCode     byte
+	Properties     Properties
+}
+
+func (c *ConnackPacket) String() string {
+	return fmt.Sprintf("%s sessionpresent: %t returncode: %d", c.FixedHeader, c.SessionPresent, c.ReturnCode)
+}
+
+// Write the packet to w
+func (c *ConnackPacket) Write(w io.Writer, version byte) error {
+	var body encoder
+	body.WriteByte(boolToByte(c.SessionPresent))
+	if version >= Version5 {
+		body.WriteByte(connackReasonCode(c.ReturnCode))
+		c.Properties.encode(&body)
+	} else {
+		body.WriteByte(connackReturnCode(c.ReturnCode))
+	}
+	return c.FixedHeader.write(w, Connack, &body)
+}
+
+// Unpack the packet from r
+func (c *ConnackPacket) Unpack(r io.Reader, version byte) error {
+	d := newDecoder(r)
+	flags := d.byte()
+	c.SessionPresent = 1&flags > 0
+	c.ReturnCode = d.byte()
+	if version >= Version5 {
+		c.Properties.decode(d, Connack)
+	}
+	return d.done(c.RemainingLength)
+}
+
+// Details of the packet
+func (c *ConnackPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
@@ -0,0 +1,134 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// ConnectPacket is an MQTT CONNECT packet
+// In MQTT 5, CleanSession is the Clean Start flag.
+type ConnectPacket struct {
+	FixedHeader
+	ProtocolName    string
+	ProtocolVersion byte
+	CleanSession    bool
+	WillFlag        bool
+	WillQos         byte
+	WillRetain      bool
+	UsernameFlag    bool
+	PasswordFlag    bool
+	ReservedBit     byte
+	Keepalive       uint16
+	Properties      Properties
+
+	ClientIdentifier string
+	WillProperties   Properties
+	WillTopic        string
+	WillMessage      []byte
+	Username         string
+	Password         []byte
+}
+
+func (c *ConnectPacket) String() string {
+	return fmt.Sprintf("%s protocolversion: %d protocolname: %s cleansession: %t willflag: %t WillQos: %d WillRetain: %t Usernameflag: %t Passwordflag: %t keepalive: %d clientId: %s willtopic: %s Username: %s", c.FixedHeader, c.ProtocolVersion, c.ProtocolName, c.CleanSession, c.WillFlag, c.WillQos, c.WillRetain, c.UsernameFlag, c.PasswordFlag, c.Keepalive, c.ClientIdentifier, c.WillTopic, c.Username)
+}
+
+// Write the packet to w
+// The packet is always encoded according to its own ProtocolVersion.
+func (c *ConnectPacket) Write(w io.Writer, _ byte) error {
+	var body encoder
+	body.string(c.ProtocolName)
+	body.WriteByte(c.ProtocolVersion)
+	body.WriteByte(boolToByte(c.CleanSession)<<1 | boolToByte(c.WillFlag)<<2 | c.WillQos<<3 | boolToByte(c.WillRetain)<<5 | boolToByte(c.PasswordFlag)<<6 | boolToByte(c.UsernameFlag)<<7)
+	body.uint16(c.Keepalive)
+	if c.ProtocolVersion >= Version5 {
+		c.Properties.encode(&body)
+	}
+	body.string(c.ClientIdentifier)
+	if c.WillFlag {
+		if c.ProtocolVersion >= Version5 {
+			c.WillProperties.encode(&body)
+		}
+		body.string(c.WillTopic)
+		body.binary(c.WillMessage)
+	}
+	if c.UsernameFlag {
+		body.string(c.Username)
+	}
+	if c.PasswordFlag {
+		body.binary(c.Password)
+	}
+	return c.FixedHeader.write(w, Connect, &body)
+}
+
+// Unpack the packet from r
+// The packet is always decoded according to the protocol version it contains.
+func (c *ConnectPacket) Unpack(r io.Reader, _ byte) error {
+	d := newDecoder(r)
+	c.ProtocolName = d.string()
+	c.ProtocolVersion = d.byte()
+	options := d.byte()
+	c.ReservedBit = 1 & options
+	c.CleanSession = 1&(options>>1) > 0
+	c.WillFlag = 1&(options>>2) > 0
+	c.WillQos = 3 & (options >> 3)
+	c.WillRetain = 1&(options>>5) > 0
+	c.PasswordFlag = 1&(options>>6) > 0
+	c.UsernameFlag = 1&(options>>7) > 0
+	c.Keepalive = d.uint16()
+	if d.err != nil {
+		return d.err
+	}
+	if c.ProtocolVersion >= Version5 {
+		c.Properties.decode(d, Connect)
+	}
+	c.ClientIdentifier = d.string()
+	if c.WillFlag {
+		if c.ProtocolVersion >= Version5 {
+			c.WillProperties.decode(d, willProperties)
+		}
+		c.WillTopic = d.string()
+		c.WillMessage = d.binary()
+	}
+	if c.UsernameFlag {
+		c.Username = d.string()
+	}
+	if c.PasswordFlag {
+		c.Password = d.binary()
+	}
+	return d.done(c.RemainingLength)
+}
+
+// Validate the CONNECT packet and return the CONNACK return code
+func (c *ConnectPacket) Validate() byte {
+	if c.PasswordFlag && !c.UsernameFlag && c.ProtocolVersion < Version5 {
+		return ErrRefusedBadUsernameOrPassword
+	}
+	if c.ReservedBit != 0 {
+		return ErrProtocolViolation
+	}
+	if (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != Version31) || (c.ProtocolName == "MQTT" && c.ProtocolVersion != Version311 && c.ProtocolVersion != Version5) {
+		return ErrRefusedBadProtocolVersion
+	}
+	if c.ProtocolName != "MQIsdp" && c.ProtocolName != "MQTT" {
+		return ErrProtocolViolation
+	}
+	if !c.WillFlag && (c.WillQos != 0 || c.WillRetain) {
+		return ErrProtocolViolation
+	}
+	if c.WillQos > 2 {
+		return ErrProtocolViolation
+	}
+	if len(c.ClientIdentifier) > 65535 || len(c.Username) > 65535 || len(c.Password) > 65535 {
+		return ErrProtocolViolation
+	}
+	if len(c.ClientIdentifier) == 0 && !c.CleanSession && c.ProtocolVersion < Version5 {
+		return ErrRefusedIDRejected
+	}
+	return Accepted
+}
+
+// Details of the packet
+func (c *ConnectPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
@@ -0,0 +1,53 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// DisconnectPacket is an MQTT DISCONNECT packet
+// The ReasonCode and Properties are only encoded for MQTT 5.
+type DisconnectPacket struct {
+	FixedHeader
+	ReasonCode byte
+	Properties Properties
+}
+
+func (d *DisconnectPacket) String() string {
+	return fmt.Sprintf("%s reasoncode: %d", d.FixedHeader, d.ReasonCode)
+}
+
+// Write the packet to w
+func (d *DisconnectPacket) Write(w io.Writer, version byte) error {
+	var body encoder
+	if version >= Version5 {
+		var props encoder
+		d.Properties.encode(&props)
+		if d.ReasonCode != NormalDisconnection || props.Len() > 1 {
+			body.WriteByte(d.ReasonCode)
+		}
+		if props.Len() > 1 {
+			body.append(&props)
+		}
+	}
+	return d.FixedHeader.write(w, Disconnect, &body)
+}
+
+// Unpack the packet from r
+func (d *DisconnectPacket) Unpack(r io.Reader, version byte) error {
+	dec := newDecoder(r)
+	if version >= Version5 {
+		if d.RemainingLength > 0 {
+			d.ReasonCode = dec.byte()
+		}
+		if d.RemainingLength > 1 {
+			d.Properties.decode(dec, Disconnect)
+		}
+	}
+	return dec.done(d.RemainingLength)
+}
+
+// Details of the packet
+func (d *DisconnectPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
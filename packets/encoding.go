@@ -0,0 +1,218 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"unicode/utf8"
+)
+
+// maxRemainingLength is the maximum value that can be encoded as a Variable Byte Integer
+const maxRemainingLength = 268435455
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// decoder reads the fields of a packet and keeps track of the number of bytes it consumed
+type decoder struct {
+	r   io.Reader
+	n   int
+	err error
+}
+
+func newDecoder(r io.Reader) *decoder {
+	return &decoder{r: r}
+}
+
+// readChunkSize is the size up to which a field is read at once from readers that do not know their length
+const readChunkSize = 4096
+
+// read reads a field of n bytes
+// The length of a field is read from the wire, so it is checked against the bytes that are left before allocating.
+func (d *decoder) read(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if l, ok := d.r.(interface{ Len() int }); (ok && n > l.Len()) || n < 0 {
+		d.err = errMalformed
+		return nil
+	}
+	if n <= readChunkSize {
+		buf := make([]byte, n)
+		read, err := io.ReadFull(d.r, buf)
+		d.n += read
+		if err != nil {
+			d.err = errMalformed
+			return nil
+		}
+		return buf
+	}
+	var buf bytes.Buffer
+	read, err := io.CopyN(&buf, d.r, int64(n))
+	d.n += int(read)
+	if err != nil {
+		d.err = errMalformed
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func (d *decoder) byte() byte {
+	if buf := d.read(1); buf != nil {
+		return buf[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if buf := d.read(2); buf != nil {
+		return binary.BigEndian.Uint16(buf)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if buf := d.read(4); buf != nil {
+		return binary.BigEndian.Uint32(buf)
+	}
+	return 0
+}
+
+func (d *decoder) varint() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	var value uint32
+	for i := uint(0); i < 4; i++ {
+		b := d.byte()
+		if d.err != nil {
+			return 0
+		}
+		value |= uint32(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return value
+		}
+	}
+	d.err = errMalformed
+	return 0
+}
+
+func (d *decoder) binary() []byte {
+	length := d.uint16()
+	if d.err != nil {
+		return nil
+	}
+	return d.read(int(length))
+}
+
+func (d *decoder) string() string {
+	buf := d.binary()
+	if d.err != nil {
+		return ""
+	}
+	if !utf8.Valid(buf) {
+		d.err = errMalformed // The character data in a UTF-8 encoded string MUST be well-formed UTF-8 [MQTT-1.5.3-1]
+		return ""
+	}
+	return string(buf)
+}
+
+// rest reads the remaining bytes of a packet with the given remaining length
+func (d *decoder) rest(remainingLength int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if remainingLength < d.n {
+		d.err = errMalformed
+		return nil
+	}
+	return d.read(remainingLength - d.n)
+}
+
+// done returns the decoding error, or an error if the packet has unexpected trailing bytes
+func (d *decoder) done(remainingLength int) error {
+	if d.err == nil && d.n != remainingLength {
+		d.err = errMalformed
+	}
+	return d.err
+}
+
+// encoder writes the fields of a packet to a buffer and keeps the first error
+type encoder struct {
+	bytes.Buffer
+	err error
+}
+
+// maxFieldLength is the maximum length of strings and binary data, which are prefixed by a two byte length
+const maxFieldLength = 65535
+
+// append writes the fields of another encoder, such as the properties of a packet
+func (e *encoder) append(other *encoder) {
+	if other.err != nil && e.err == nil {
+		e.err = other.err
+	}
+	e.Write(other.Bytes())
+}
+
+func (e *encoder) uint16(v uint16) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	e.Write(buf[:])
+}
+
+func (e *encoder) uint32(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	e.Write(buf[:])
+}
+
+func (e *encoder) varint(v uint32) {
+	e.Write(encodeLength(int(v)))
+}
+
+func (e *encoder) binary(v []byte) {
+	if len(v) > maxFieldLength {
+		e.err = errFieldTooLong
+		return
+	}
+	e.uint16(uint16(len(v)))
+	e.Write(v)
+}
+
+func (e *encoder) string(v string) {
+	if len(v) > maxFieldLength {
+		e.err = errFieldTooLong
+		return
+	}
+	e.uint16(uint16(len(v)))
+	e.WriteString(v)
+}
+
+func encodeLength(length int) []byte {
+	var encLength []byte
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		encLength = append(encLength, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return encLength
+}
+
+func decodeLength(r io.Reader) (int, error) {
+	d := newDecoder(r)
+	length := d.varint()
+	if d.err != nil {
+		return 0, d.err
+	}
+	return int(length), nil
+}
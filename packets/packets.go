@@ -0,0 +1,250 @@
+// Package packets implements the MQTT 3.1.1 and MQTT 5 control packets
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Protocol versions
+const (
+	Version31  = 0x03
+	Version311 = 0x04
+	Version5   = 0x05
+)
+
+// ControlPacket is an MQTT control packet
+type ControlPacket interface {
+	// Write the packet to w, encoded for the given protocol version
+	Write(w io.Writer, version byte) error
+	// Unpack the variable header and payload from r, encoded for the given protocol version
+	Unpack(r io.Reader, version byte) error
+	String() string
+	Details() Details
+}
+
+// PacketNames maps the packet types to their names
+var PacketNames = map[uint8]string{
+	1:  "CONNECT",
+	2:  "CONNACK",
+	3:  "PUBLISH",
+	4:  "PUBACK",
+	5:  "PUBREC",
+	6:  "PUBREL",
+	7:  "PUBCOMP",
+	8:  "SUBSCRIBE",
+	9:  "SUBACK",
+	10: "UNSUBSCRIBE",
+	11: "UNSUBACK",
+	12: "PINGREQ",
+	13: "PINGRESP",
+	14: "DISCONNECT",
+	15: "AUTH",
+}
+
+// Packet types
+const (
+	Connect     = 1
+	Connack     = 2
+	Publish     = 3
+	Puback      = 4
+	Pubrec      = 5
+	Pubrel      = 6
+	Pubcomp     = 7
+	Subscribe   = 8
+	Suback      = 9
+	Unsubscribe = 10
+	Unsuback    = 11
+	Pingreq     = 12
+	Pingresp    = 13
+	Disconnect  = 14
+	Auth        = 15
+)
+
+var (
+	errMalformed          = errors.New("malformed packet")
+	errInvalidFlags       = errors.New("invalid fixed header flags")
+	errUnsupportedVersion = errors.New("packet not supported by protocol version")
+	errFieldTooLong       = errors.New("string or binary data longer than 65535 bytes")
+)
+
+// Details of the QoS and MessageID of a ControlPacket
+type Details struct {
+	Qos       byte
+	MessageID uint16
+}
+
+// FixedHeader of an MQTT ControlPacket
+type FixedHeader struct {
+	MessageType     byte
+	Dup             bool
+	Qos             byte
+	Retain          bool
+	RemainingLength int
+}
+
+func (fh FixedHeader) String() string {
+	return fmt.Sprintf("%s: dup: %t qos: %d retain: %t rLength: %d", PacketNames[fh.MessageType], fh.Dup, fh.Qos, fh.Retain, fh.RemainingLength)
+}
+
+// flags returns the flags of the fixed header
+// For packets other than PUBLISH the flags are fixed by the specification [MQTT-2.2.2-1]
+func (fh FixedHeader) flags() byte {
+	switch fh.MessageType {
+	case Publish:
+		return boolToByte(fh.Dup)<<3 | fh.Qos<<1 | boolToByte(fh.Retain)
+	case Pubrel, Subscribe, Unsubscribe:
+		return 0x02
+	}
+	return 0x00
+}
+
+// validateFlags returns an error if the raw flags are invalid for the packet type [MQTT-2.2.2-2]
+func (fh FixedHeader) validateFlags(flags byte) error {
+	if fh.MessageType == Publish {
+		if fh.Qos > 2 {
+			return errInvalidFlags
+		}
+		if fh.Qos == 0 && fh.Dup {
+			return errInvalidFlags // The DUP flag MUST be set to 0 for all QoS 0 messages [MQTT-3.3.1-2]
+		}
+		return nil
+	}
+	if flags != fh.flags() {
+		return errInvalidFlags
+	}
+	return nil
+}
+
+// write the fixed header of the given packet type and the body to w
+func (fh *FixedHeader) write(w io.Writer, packetType byte, encoded *encoder) error {
+	var body []byte
+	if encoded != nil {
+		if encoded.err != nil {
+			return encoded.err
+		}
+		body = encoded.Bytes()
+	}
+	if len(body) > maxRemainingLength {
+		return ErrPacketTooLarge
+	}
+	fh.MessageType = packetType
+	fh.RemainingLength = len(body)
+	var packet bytes.Buffer
+	packet.Grow(5 + len(body))
+	packet.WriteByte(fh.MessageType<<4 | fh.flags())
+	packet.Write(encodeLength(fh.RemainingLength))
+	packet.Write(body)
+	_, err := packet.WriteTo(w)
+	return err
+}
+
+// NewControlPacket returns a new ControlPacket of the given type
+func NewControlPacket(packetType byte) ControlPacket {
+	cp, _ := NewControlPacketWithHeader(FixedHeader{MessageType: packetType, Qos: FixedHeader{MessageType: packetType}.flags() >> 1})
+	return cp
+}
+
+// NewControlPacketWithHeader returns a new ControlPacket with the given FixedHeader
+func NewControlPacketWithHeader(fh FixedHeader) (ControlPacket, error) {
+	switch fh.MessageType {
+	case Connect:
+		return &ConnectPacket{FixedHeader: fh}, nil
+	case Connack:
+		return &ConnackPacket{FixedHeader: fh}, nil
+	case Publish:
+		return &PublishPacket{FixedHeader: fh}, nil
+	case Puback:
+		return &PubackPacket{FixedHeader: fh}, nil
+	case Pubrec:
+		return &PubrecPacket{FixedHeader: fh}, nil
+	case Pubrel:
+		return &PubrelPacket{FixedHeader: fh}, nil
+	case Pubcomp:
+		return &PubcompPacket{FixedHeader: fh}, nil
+	case Subscribe:
+		return &SubscribePacket{FixedHeader: fh}, nil
+	case Suback:
+		return &SubackPacket{FixedHeader: fh}, nil
+	case Unsubscribe:
+		return &UnsubscribePacket{FixedHeader: fh}, nil
+	case Unsuback:
+		return &UnsubackPacket{FixedHeader: fh}, nil
+	case Pingreq:
+		return &PingreqPacket{FixedHeader: fh}, nil
+	case Pingresp:
+		return &PingrespPacket{FixedHeader: fh}, nil
+	case Disconnect:
+		return &DisconnectPacket{FixedHeader: fh}, nil
+	case Auth:
+		return &AuthPacket{FixedHeader: fh}, nil
+	}
+	return nil, fmt.Errorf("unsupported packet type 0x%x", fh.MessageType)
+}
+
+// ErrPacketTooLarge is returned when a packet exceeds the maximum packet size
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// ReadPacket reads a ControlPacket from r, encoded for the given protocol version
+// A CONNECT packet is always decoded according to the protocol version it contains
+func ReadPacket(r io.Reader, version byte) (ControlPacket, error) {
+	return ReadPacketLimit(r, version, 0)
+}
+
+// ReadPacketLimit is similar to ReadPacket, except that packets larger than maxSize bytes are not read
+// The size of a packet is checked before its body is read, and includes the fixed header.
+// A maxSize of zero means no limit.
+func ReadPacketLimit(r io.Reader, version byte, maxSize int) (ControlPacket, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	fh := FixedHeader{
+		MessageType: b[0] >> 4,
+		Dup:         (b[0]>>3)&0x01 > 0,
+		Qos:         (b[0] >> 1) & 0x03,
+		Retain:      b[0]&0x01 > 0,
+	}
+	var err error
+	if fh.RemainingLength, err = decodeLength(r); err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && 1+len(encodeLength(fh.RemainingLength))+fh.RemainingLength > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+	if err = fh.validateFlags(b[0] & 0x0f); err != nil {
+		return nil, err
+	}
+	cp, err := NewControlPacketWithHeader(fh)
+	if err != nil {
+		return nil, err
+	}
+	// The body is read as it arrives, so that a large remaining length does not allocate memory up front
+	var body bytes.Buffer
+	if n, err := io.CopyN(&body, r, int64(fh.RemainingLength)); err != nil {
+		if n > 0 && err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if err = cp.Unpack(bytes.NewReader(body.Bytes()), version); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+type countingWriter int
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// Size returns the size of the packet in bytes when it is encoded for the given protocol version
+func Size(packet ControlPacket, version byte) (int, error) {
+	var w countingWriter
+	err := packet.Write(&w, version)
+	return int(w), err
+}
@@ -0,0 +1,359 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func roundTrip(packet ControlPacket, version byte) (ControlPacket, error) {
+	var buf bytes.Buffer
+	if err := packet.Write(&buf, version); err != nil {
+		return nil, err
+	}
+	return ReadPacket(&buf, version)
+}
+
+func TestPackets(t *testing.T) {
+	for _, version := range []byte{Version311, Version5} {
+		Convey(`Given MQTT protocol version `+string('0'+version), t, func() {
+			Convey(`When writing and reading a CONNECT packet`, func() {
+				connect := NewControlPacket(Connect).(*ConnectPacket)
+				connect.ProtocolName = "MQTT"
+				connect.ProtocolVersion = version
+				connect.CleanSession = true
+				connect.Keepalive = 30
+				connect.ClientIdentifier = "foo"
+				connect.WillFlag, connect.WillQos, connect.WillRetain = true, 1, true
+				connect.WillTopic, connect.WillMessage = "will", []byte("bye")
+				connect.UsernameFlag, connect.Username = true, "user"
+				connect.PasswordFlag, connect.Password = true, []byte("pass")
+				if version >= Version5 {
+					connect.Properties.SessionExpiryInterval = Uint32(60)
+					connect.WillProperties.WillDelayInterval = Uint32(10)
+				}
+				res, err := roundTrip(connect, Version311) // CONNECT is decoded with its own version
+				So(err, ShouldBeNil)
+				So(res, ShouldResemble, connect)
+				So(res.(*ConnectPacket).Validate(), ShouldEqual, Accepted)
+			})
+
+			Convey(`When writing and reading a CONNACK packet`, func() {
+				connack := NewControlPacket(Connack).(*ConnackPacket)
+				connack.SessionPresent = true
+				connack.ReturnCode = ErrRefusedNotAuthorised
+				res, err := roundTrip(connack, version)
+				So(err, ShouldBeNil)
+				if version >= Version5 {
+					So(res.(*ConnackPacket).ReturnCode, ShouldEqual, NotAuthorized)
+				} else {
+					So(res.(*ConnackPacket).ReturnCode, ShouldEqual, ErrRefusedNotAuthorised)
+				}
+				So(res.(*ConnackPacket).SessionPresent, ShouldBeTrue)
+			})
+
+			Convey(`When writing and reading a PUBLISH packet`, func() {
+				publish := NewControlPacket(Publish).(*PublishPacket)
+				publish.Qos, publish.Retain, publish.Dup = 1, true, true
+				publish.TopicName = "foo/bar"
+				publish.MessageID = 42
+				publish.Payload = []byte("payload")
+				if version >= Version5 {
+					publish.Properties.MessageExpiryInterval = Uint32(3600)
+					publish.Properties.UserProperties = []UserProperty{{Key: "k", Value: "v"}, {Key: "k", Value: "w"}}
+				}
+				res, err := roundTrip(publish, version)
+				So(err, ShouldBeNil)
+				So(res, ShouldResemble, publish)
+			})
+
+			Convey(`When writing and reading a PUBLISH packet that expires`, func() {
+				publish := NewControlPacket(Publish).(*PublishPacket)
+				publish.TopicName = "foo"
+				publish.Expires = time.Now().Add(90 * time.Second)
+				So(publish.Expired(time.Now()), ShouldBeFalse)
+				So(publish.Expired(publish.Expires), ShouldBeTrue)
+				res, err := roundTrip(publish, version)
+				So(err, ShouldBeNil)
+				So(publish.Properties.MessageExpiryInterval, ShouldBeNil)
+				if version >= Version5 {
+					So(res.(*PublishPacket).Properties.MessageExpiryInterval, ShouldNotBeNil)
+					So(*res.(*PublishPacket).Properties.MessageExpiryInterval, ShouldEqual, 90)
+				} else {
+					So(res.(*PublishPacket).Properties.MessageExpiryInterval, ShouldBeNil)
+				}
+			})
+
+			Convey(`When writing and reading a PUBLISH packet without payload`, func() {
+				publish := NewControlPacket(Publish).(*PublishPacket)
+				publish.TopicName = "foo"
+				res, err := roundTrip(publish, version)
+				So(err, ShouldBeNil)
+				So(res.(*PublishPacket).Payload, ShouldBeEmpty)
+			})
+
+			Convey(`When writing and reading acknowledgement packets`, func() {
+				for _, packet := range []ControlPacket{
+					&PubackPacket{MessageID: 1},
+					&PubrecPacket{MessageID: 2},
+					&PubrelPacket{MessageID: 3},
+					&PubcompPacket{MessageID: 4},
+				} {
+					res, err := roundTrip(packet, version)
+					So(err, ShouldBeNil)
+					So(res.Details().MessageID, ShouldEqual, packet.Details().MessageID)
+				}
+				if version >= Version5 {
+					res, err := roundTrip(&PubackPacket{MessageID: 1, ReasonCode: NoMatchingSubscribers}, version)
+					So(err, ShouldBeNil)
+					So(res.(*PubackPacket).ReasonCode, ShouldEqual, NoMatchingSubscribers)
+					res, err = roundTrip(&PubrelPacket{MessageID: 1, ReasonCode: PacketIdentifierNotFound, Properties: Properties{ReasonString: "oops"}}, version)
+					So(err, ShouldBeNil)
+					So(res.(*PubrelPacket).ReasonCode, ShouldEqual, PacketIdentifierNotFound)
+					So(res.(*PubrelPacket).Properties.ReasonString, ShouldEqual, "oops")
+				}
+			})
+
+			Convey(`When writing and reading a SUBSCRIBE packet`, func() {
+				subscribe := NewControlPacket(Subscribe).(*SubscribePacket)
+				subscribe.MessageID = 7
+				subscribe.Topics = []string{"foo", "bar/#"}
+				subscribe.Qoss = []byte{0, 2}
+				subscribe.Options = []SubscriptionOptions{{}, {}}
+				if version >= Version5 {
+					subscribe.Options[1] = SubscriptionOptions{NoLocal: true, RetainAsPublished: true, RetainHandling: DoNotSendRetained}
+					subscribe.Properties.SubscriptionIdentifiers = []uint32{268435455}
+				}
+				res, err := roundTrip(subscribe, version)
+				So(err, ShouldBeNil)
+				So(res, ShouldResemble, subscribe)
+			})
+
+			Convey(`When writing and reading a SUBACK packet`, func() {
+				suback := NewControlPacket(Suback).(*SubackPacket)
+				suback.MessageID = 7
+				suback.ReturnCodes = []byte{0, 2, NotAuthorized}
+				res, err := roundTrip(suback, version)
+				So(err, ShouldBeNil)
+				if version >= Version5 {
+					So(res.(*SubackPacket).ReturnCodes, ShouldResemble, []byte{0, 2, NotAuthorized})
+				} else {
+					So(res.(*SubackPacket).ReturnCodes, ShouldResemble, []byte{0, 2, 0x80})
+				}
+			})
+
+			Convey(`When writing and reading an UNSUBSCRIBE packet`, func() {
+				unsubscribe := NewControlPacket(Unsubscribe).(*UnsubscribePacket)
+				unsubscribe.MessageID = 8
+				unsubscribe.Topics = []string{"foo", "bar/#"}
+				res, err := roundTrip(unsubscribe, version)
+				So(err, ShouldBeNil)
+				So(res, ShouldResemble, unsubscribe)
+			})
+
+			Convey(`When writing and reading an UNSUBACK packet`, func() {
+				unsuback := NewControlPacket(Unsuback).(*UnsubackPacket)
+				unsuback.MessageID = 8
+				if version >= Version5 {
+					unsuback.ReasonCodes = []byte{Success, NoSubscriptionExisted}
+				}
+				res, err := roundTrip(unsuback, version)
+				So(err, ShouldBeNil)
+				So(res, ShouldResemble, unsuback)
+			})
+
+			Convey(`When writing and reading PINGREQ, PINGRESP and DISCONNECT packets`, func() {
+				for _, packetType := range []byte{Pingreq, Pingresp, Disconnect} {
+					res, err := roundTrip(NewControlPacket(packetType), version)
+					So(err, ShouldBeNil)
+					So(res, ShouldResemble, NewControlPacket(packetType))
+				}
+			})
+		})
+	}
+
+	Convey(`Given MQTT protocol version 5`, t, func() {
+		Convey(`When writing and reading a DISCONNECT packet with a reason code`, func() {
+			disconnect := NewControlPacket(Disconnect).(*DisconnectPacket)
+			disconnect.ReasonCode = SessionTakenOver
+			disconnect.Properties.ReasonString = "bye"
+			res, err := roundTrip(disconnect, Version5)
+			So(err, ShouldBeNil)
+			So(res, ShouldResemble, disconnect)
+		})
+		Convey(`When writing and reading an AUTH packet`, func() {
+			auth := NewControlPacket(Auth).(*AuthPacket)
+			auth.ReasonCode = ContinueAuthentication
+			auth.Properties.AuthenticationMethod = "SCRAM-SHA-256"
+			auth.Properties.AuthenticationData = []byte("data")
+			res, err := roundTrip(auth, Version5)
+			So(err, ShouldBeNil)
+			So(res, ShouldResemble, auth)
+		})
+		Convey(`When writing a PUBLISH packet with a topic longer than 65535 bytes`, func() {
+			publish := NewControlPacket(Publish).(*PublishPacket)
+			publish.TopicName = string(make([]byte, 65536))
+			err := publish.Write(new(bytes.Buffer), Version5)
+			So(err, ShouldEqual, errFieldTooLong)
+		})
+		Convey(`When writing a PUBLISH packet with user properties longer than 65535 bytes`, func() {
+			publish := NewControlPacket(Publish).(*PublishPacket)
+			publish.TopicName = "foo"
+			publish.Properties.UserProperties = []UserProperty{{Key: "k", Value: string(make([]byte, 65536))}}
+			err := publish.Write(new(bytes.Buffer), Version5)
+			So(err, ShouldEqual, errFieldTooLong)
+		})
+		Convey(`When writing an AUTH packet for MQTT 3.1.1`, func() {
+			err := NewControlPacket(Auth).Write(new(bytes.Buffer), Version311)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey(`When reading invalid packets`, t, func() {
+		for _, data := range [][]byte{
+			{0x60, 0x02, 0x00, 0x01},                        // PUBREL with invalid flags
+			{0x80, 0x03, 0x00, 0x01, 0x00},                  // SUBSCRIBE with invalid flags
+			{0x36, 0x05, 0x00, 0x01, 'a', 0x00, 0x01},       // PUBLISH with QoS 3
+			{0x38, 0x05, 0x00, 0x01, 'a', 0x00, 0x01},       // PUBLISH with QoS 0 and DUP
+			{0x40, 0x03, 0x00, 0x01, 0x00},                  // PUBACK with trailing bytes
+			{0x30, 0x05, 0x00, 0x09, 'a', 'b', 'c'},         // PUBLISH with truncated topic
+			{0x30, 0x04, 0x00, 0x02, 0xc3, 0x28},            // PUBLISH with invalid UTF-8
+			{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x04}, // SUBSCRIBE with reserved options
+			{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x03}, // SUBSCRIBE with QoS 3
+			{0x30, 0xff, 0xff, 0xff, 0xff, 0x01},            // Remaining length too long
+		} {
+			_, err := ReadPacket(bytes.NewReader(data), Version311)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestConnectValidate(t *testing.T) {
+	Convey(`Given a valid CONNECT packet`, t, func() {
+		connect := NewControlPacket(Connect).(*ConnectPacket)
+		connect.ProtocolName = "MQTT"
+		connect.ProtocolVersion = Version311
+		connect.ClientIdentifier = "foo"
+		So(connect.Validate(), ShouldEqual, Accepted)
+
+		Convey(`When the protocol version is not supported`, func() {
+			connect.ProtocolVersion = 6
+			So(connect.Validate(), ShouldEqual, ErrRefusedBadProtocolVersion)
+		})
+		Convey(`When the protocol name is invalid`, func() {
+			connect.ProtocolName = "invalid"
+			So(connect.Validate(), ShouldEqual, ErrProtocolViolation)
+		})
+		Convey(`When the reserved bit is set`, func() {
+			connect.ReservedBit = 1
+			So(connect.Validate(), ShouldEqual, ErrProtocolViolation)
+		})
+		Convey(`When the client identifier is empty for a persistent session`, func() {
+			connect.ClientIdentifier = ""
+			So(connect.Validate(), ShouldEqual, ErrRefusedIDRejected)
+			Convey(`When the protocol version is 5`, func() {
+				connect.ProtocolVersion = Version5
+				So(connect.Validate(), ShouldEqual, Accepted)
+			})
+		})
+		Convey(`When the will QoS is set without a will`, func() {
+			connect.WillQos = 1
+			So(connect.Validate(), ShouldEqual, ErrProtocolViolation)
+		})
+	})
+}
+
+func TestReadPacketLimit(t *testing.T) {
+	Convey(`Given an encoded PUBLISH packet`, t, func() {
+		publish := NewControlPacket(Publish).(*PublishPacket)
+		publish.TopicName, publish.Payload = "foo", make([]byte, 100)
+		var buf bytes.Buffer
+		So(publish.Write(&buf, Version311), ShouldBeNil)
+		size, err := Size(publish, Version311)
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, buf.Len())
+
+		Convey(`When reading it with a limit of its size`, func() {
+			_, err := ReadPacketLimit(&buf, Version311, size)
+			Convey(`Then there should be no error`, func() { So(err, ShouldBeNil) })
+		})
+
+		Convey(`When reading it with a smaller limit`, func() {
+			_, err := ReadPacketLimit(&buf, Version311, size-1)
+			Convey(`Then the packet should be too large`, func() { So(err, ShouldEqual, ErrPacketTooLarge) })
+			Convey(`Then the body should not have been read`, func() { So(buf.Len(), ShouldEqual, 100+5) })
+		})
+	})
+
+	Convey(`When reading a packet that declares the maximum remaining length`, t, func() {
+		_, err := ReadPacketLimit(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F}), Version311, 1024)
+		Convey(`Then the packet should be too large`, func() { So(err, ShouldEqual, ErrPacketTooLarge) })
+	})
+}
+
+func TestDeliverySize(t *testing.T) {
+	Convey(`Given a PUBLISH packet with properties`, t, func() {
+		publish := NewControlPacket(Publish).(*PublishPacket)
+		publish.TopicName, publish.Payload = "foo", make([]byte, 120)
+		publish.Properties.ContentType = "text/plain"
+		publish.Expires = time.Now().Add(time.Hour)
+		size := NewDeliverySize(publish)
+
+		for _, qos := range []byte{0, 1, 2} {
+			for _, identifiers := range [][]uint32{nil, {1}, {1, 200, 268435455}} {
+				qos, identifiers := qos, identifiers
+				Convey(fmt.Sprintf(`Then the size of a delivery with QoS %d and identifiers %v should be its encoded size`, qos, identifiers), func() {
+					delivery := publish.Copy()
+					delivery.Qos, delivery.MessageID = qos, 1
+					delivery.Properties.SubscriptionIdentifiers = identifiers
+					expected, err := Size(delivery, Version5)
+					So(err, ShouldBeNil)
+					actual, err := size.Size(qos, identifiers)
+					So(err, ShouldBeNil)
+					So(actual, ShouldEqual, expected)
+				})
+			}
+		}
+	})
+
+	Convey(`Given a PUBLISH packet with a topic that can not be encoded`, t, func() {
+		publish := NewControlPacket(Publish).(*PublishPacket)
+		publish.TopicName = strings.Repeat("a", 65536)
+		Convey(`Then the size of its deliveries should be an error`, func() {
+			_, err := NewDeliverySize(publish).Size(0, nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestDeclaredLengths(t *testing.T) {
+	Convey(`When reading a PUBLISH packet that declares a property length larger than the packet`, t, func() {
+		data := []byte{0x30, 7, 0, 1, 'a', 0xff, 0xff, 0xff, 0x7f}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := ReadPacket(bytes.NewReader(data), Version5)
+		runtime.ReadMemStats(&after)
+		Convey(`Then it should be malformed`, func() {
+			So(err, ShouldEqual, errMalformed)
+		})
+		Convey(`Then it should not allocate memory for the declared length`, func() {
+			So(after.TotalAlloc-before.TotalAlloc, ShouldBeLessThan, 1<<20)
+		})
+	})
+
+	Convey(`When reading a packet that declares a remaining length larger than the data`, t, func() {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := ReadPacket(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0x7f, 0, 1, 'a'}), Version311)
+		runtime.ReadMemStats(&after)
+		Convey(`Then it should fail without allocating memory for the declared length`, func() {
+			So(err, ShouldNotBeNil)
+			So(after.TotalAlloc-before.TotalAlloc, ShouldBeLessThan, 1<<20)
+		})
+	})
+}
@@ -0,0 +1,30 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PingreqPacket is an MQTT PINGREQ packet
+type PingreqPacket struct {
+	FixedHeader
+}
+
+func (p *PingreqPacket) String() string {
+	return fmt.Sprintf("%s", p.FixedHeader)
+}
+
+// Write the packet to w
+func (p *PingreqPacket) Write(w io.Writer, version byte) error {
+	return p.FixedHeader.write(w, Pingreq, nil)
+}
+
+// Unpack the packet from r
+func (p *PingreqPacket) Unpack(r io.Reader, version byte) error {
+	return newDecoder(r).done(p.RemainingLength)
+}
+
+// Details of the packet
+func (p *PingreqPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
@@ -0,0 +1,30 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PingrespPacket is an MQTT PINGRESP packet
+type PingrespPacket struct {
+	FixedHeader
+}
+
+func (p *PingrespPacket) String() string {
+	return fmt.Sprintf("%s", p.FixedHeader)
+}
+
+// Write the packet to w
+func (p *PingrespPacket) Write(w io.Writer, version byte) error {
+	return p.FixedHeader.write(w, Pingresp, nil)
+}
+
+// Unpack the packet from r
+func (p *PingrespPacket) Unpack(r io.Reader, version byte) error {
+	return newDecoder(r).done(p.RemainingLength)
+}
+
+// Details of the packet
+func (p *PingrespPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
@@ -0,0 +1,371 @@
+package packets
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Property identifiers
+const (
+	propPayloadFormatIndicator          = 0x01
+	propMessageExpiryInterval           = 0x02
+	propContentType                     = 0x03
+	propResponseTopic                   = 0x08
+	propCorrelationData                 = 0x09
+	propSubscriptionIdentifier          = 0x0B
+	propSessionExpiryInterval           = 0x11
+	propAssignedClientIdentifier        = 0x12
+	propServerKeepAlive                 = 0x13
+	propAuthenticationMethod            = 0x15
+	propAuthenticationData              = 0x16
+	propRequestProblemInformation       = 0x17
+	propWillDelayInterval               = 0x18
+	propRequestResponseInformation      = 0x19
+	propResponseInformation             = 0x1A
+	propServerReference                 = 0x1C
+	propReasonString                    = 0x1F
+	propReceiveMaximum                  = 0x21
+	propTopicAliasMaximum               = 0x22
+	propTopicAlias                      = 0x23
+	propMaximumQoS                      = 0x24
+	propRetainAvailable                 = 0x25
+	propUserProperty                    = 0x26
+	propMaximumPacketSize               = 0x27
+	propWildcardSubscriptionAvailable   = 0x28
+	propSubscriptionIdentifierAvailable = 0x29
+	propSharedSubscriptionAvailable     = 0x2A
+)
+
+// willProperties is the pseudo packet type that is used for the Will Properties in the CONNECT payload
+const willProperties = 0xff
+
+// allowedProperties lists the properties that are allowed per packet type
+var allowedProperties = map[byte]map[byte]bool{
+	Connect: {
+		propSessionExpiryInterval: true, propAuthenticationMethod: true, propAuthenticationData: true,
+		propRequestProblemInformation: true, propRequestResponseInformation: true, propReceiveMaximum: true,
+		propTopicAliasMaximum: true, propUserProperty: true, propMaximumPacketSize: true,
+	},
+	Connack: {
+		propSessionExpiryInterval: true, propAssignedClientIdentifier: true, propServerKeepAlive: true,
+		propAuthenticationMethod: true, propAuthenticationData: true, propResponseInformation: true,
+		propServerReference: true, propReasonString: true, propReceiveMaximum: true, propTopicAliasMaximum: true,
+		propMaximumQoS: true, propRetainAvailable: true, propUserProperty: true, propMaximumPacketSize: true,
+		propWildcardSubscriptionAvailable: true, propSubscriptionIdentifierAvailable: true, propSharedSubscriptionAvailable: true,
+	},
+	Publish: {
+		propPayloadFormatIndicator: true, propMessageExpiryInterval: true, propContentType: true,
+		propResponseTopic: true, propCorrelationData: true, propSubscriptionIdentifier: true,
+		propTopicAlias: true, propUserProperty: true,
+	},
+	willProperties: {
+		propPayloadFormatIndicator: true, propMessageExpiryInterval: true, propContentType: true,
+		propResponseTopic: true, propCorrelationData: true, propWillDelayInterval: true, propUserProperty: true,
+	},
+	Puback:      {propReasonString: true, propUserProperty: true},
+	Pubrec:      {propReasonString: true, propUserProperty: true},
+	Pubrel:      {propReasonString: true, propUserProperty: true},
+	Pubcomp:     {propReasonString: true, propUserProperty: true},
+	Subscribe:   {propSubscriptionIdentifier: true, propUserProperty: true},
+	Suback:      {propReasonString: true, propUserProperty: true},
+	Unsubscribe: {propUserProperty: true},
+	Unsuback:    {propReasonString: true, propUserProperty: true},
+	Disconnect: {
+		propSessionExpiryInterval: true, propServerReference: true, propReasonString: true, propUserProperty: true,
+	},
+	Auth: {
+		propAuthenticationMethod: true, propAuthenticationData: true, propReasonString: true, propUserProperty: true,
+	},
+}
+
+var (
+	errPropertyNotAllowed = errors.New("property not allowed in packet")
+	errPropertyDuplicate  = errors.New("property included more than once")
+	errPropertyInvalid    = errors.New("invalid property value")
+)
+
+// UserProperty is a name-value pair
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties of MQTT 5 packets
+// Properties that are not set are nil or empty.
+type Properties struct {
+	PayloadFormatIndicator          *byte
+	MessageExpiryInterval           *uint32
+	ContentType                     string
+	ResponseTopic                   string
+	CorrelationData                 []byte
+	SubscriptionIdentifiers         []uint32
+	SessionExpiryInterval           *uint32
+	AssignedClientIdentifier        string
+	ServerKeepAlive                 *uint16
+	AuthenticationMethod            string
+	AuthenticationData              []byte
+	RequestProblemInformation       *byte
+	WillDelayInterval               *uint32
+	RequestResponseInformation      *byte
+	ResponseInformation             string
+	ServerReference                 string
+	ReasonString                    string
+	ReceiveMaximum                  *uint16
+	TopicAliasMaximum               *uint16
+	TopicAlias                      *uint16
+	MaximumQoS                      *byte
+	RetainAvailable                 *byte
+	UserProperties                  []UserProperty
+	MaximumPacketSize               *uint32
+	WildcardSubscriptionAvailable   *byte
+	SubscriptionIdentifierAvailable *byte
+	SharedSubscriptionAvailable     *byte
+}
+
+// Byte returns a pointer to v, for use in Properties
+func Byte(v byte) *byte { return &v }
+
+// Uint16 returns a pointer to v, for use in Properties
+func Uint16(v uint16) *uint16 { return &v }
+
+// Uint32 returns a pointer to v, for use in Properties
+func Uint32(v uint32) *uint32 { return &v }
+
+// Copy returns a copy of the properties that does not share slices with p
+func (p Properties) Copy() Properties {
+	if p.CorrelationData != nil {
+		p.CorrelationData = append([]byte(nil), p.CorrelationData...)
+	}
+	if p.SubscriptionIdentifiers != nil {
+		p.SubscriptionIdentifiers = append([]uint32(nil), p.SubscriptionIdentifiers...)
+	}
+	if p.AuthenticationData != nil {
+		p.AuthenticationData = append([]byte(nil), p.AuthenticationData...)
+	}
+	if p.UserProperties != nil {
+		p.UserProperties = append([]UserProperty(nil), p.UserProperties...)
+	}
+	return p
+}
+
+// encode the properties, prefixed by their length
+func (p *Properties) encode(e *encoder) {
+	var props encoder
+	p.encodeFields(&props)
+	e.varint(uint32(props.Len()))
+	e.append(&props)
+}
+
+// encodeFields encodes the properties without their length
+func (p *Properties) encodeFields(props *encoder) {
+	if p.PayloadFormatIndicator != nil {
+		props.WriteByte(propPayloadFormatIndicator)
+		props.WriteByte(*p.PayloadFormatIndicator)
+	}
+	if p.MessageExpiryInterval != nil {
+		props.WriteByte(propMessageExpiryInterval)
+		props.uint32(*p.MessageExpiryInterval)
+	}
+	if p.ContentType != "" {
+		props.WriteByte(propContentType)
+		props.string(p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		props.WriteByte(propResponseTopic)
+		props.string(p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		props.WriteByte(propCorrelationData)
+		props.binary(p.CorrelationData)
+	}
+	for _, id := range p.SubscriptionIdentifiers {
+		props.WriteByte(propSubscriptionIdentifier)
+		props.varint(id)
+	}
+	if p.SessionExpiryInterval != nil {
+		props.WriteByte(propSessionExpiryInterval)
+		props.uint32(*p.SessionExpiryInterval)
+	}
+	if p.AssignedClientIdentifier != "" {
+		props.WriteByte(propAssignedClientIdentifier)
+		props.string(p.AssignedClientIdentifier)
+	}
+	if p.ServerKeepAlive != nil {
+		props.WriteByte(propServerKeepAlive)
+		props.uint16(*p.ServerKeepAlive)
+	}
+	if p.AuthenticationMethod != "" {
+		props.WriteByte(propAuthenticationMethod)
+		props.string(p.AuthenticationMethod)
+	}
+	if p.AuthenticationData != nil {
+		props.WriteByte(propAuthenticationData)
+		props.binary(p.AuthenticationData)
+	}
+	if p.RequestProblemInformation != nil {
+		props.WriteByte(propRequestProblemInformation)
+		props.WriteByte(*p.RequestProblemInformation)
+	}
+	if p.WillDelayInterval != nil {
+		props.WriteByte(propWillDelayInterval)
+		props.uint32(*p.WillDelayInterval)
+	}
+	if p.RequestResponseInformation != nil {
+		props.WriteByte(propRequestResponseInformation)
+		props.WriteByte(*p.RequestResponseInformation)
+	}
+	if p.ResponseInformation != "" {
+		props.WriteByte(propResponseInformation)
+		props.string(p.ResponseInformation)
+	}
+	if p.ServerReference != "" {
+		props.WriteByte(propServerReference)
+		props.string(p.ServerReference)
+	}
+	if p.ReasonString != "" {
+		props.WriteByte(propReasonString)
+		props.string(p.ReasonString)
+	}
+	if p.ReceiveMaximum != nil {
+		props.WriteByte(propReceiveMaximum)
+		props.uint16(*p.ReceiveMaximum)
+	}
+	if p.TopicAliasMaximum != nil {
+		props.WriteByte(propTopicAliasMaximum)
+		props.uint16(*p.TopicAliasMaximum)
+	}
+	if p.TopicAlias != nil {
+		props.WriteByte(propTopicAlias)
+		props.uint16(*p.TopicAlias)
+	}
+	if p.MaximumQoS != nil {
+		props.WriteByte(propMaximumQoS)
+		props.WriteByte(*p.MaximumQoS)
+	}
+	if p.RetainAvailable != nil {
+		props.WriteByte(propRetainAvailable)
+		props.WriteByte(*p.RetainAvailable)
+	}
+	for _, prop := range p.UserProperties {
+		props.WriteByte(propUserProperty)
+		props.string(prop.Key)
+		props.string(prop.Value)
+	}
+	if p.MaximumPacketSize != nil {
+		props.WriteByte(propMaximumPacketSize)
+		props.uint32(*p.MaximumPacketSize)
+	}
+	if p.WildcardSubscriptionAvailable != nil {
+		props.WriteByte(propWildcardSubscriptionAvailable)
+		props.WriteByte(*p.WildcardSubscriptionAvailable)
+	}
+	if p.SubscriptionIdentifierAvailable != nil {
+		props.WriteByte(propSubscriptionIdentifierAvailable)
+		props.WriteByte(*p.SubscriptionIdentifierAvailable)
+	}
+	if p.SharedSubscriptionAvailable != nil {
+		props.WriteByte(propSharedSubscriptionAvailable)
+		props.WriteByte(*p.SharedSubscriptionAvailable)
+	}
+}
+
+// decode the properties of the given packet type, prefixed by their length
+func (p *Properties) decode(d *decoder, packetType byte) {
+	length := d.varint()
+	buf := d.read(int(length))
+	if d.err != nil {
+		return
+	}
+	allowed := allowedProperties[packetType]
+	seen := make(map[byte]bool)
+	props := newDecoder(bytes.NewReader(buf))
+	for props.n < len(buf) && props.err == nil {
+		id := byte(props.varint())
+		if props.err != nil {
+			break
+		}
+		if !allowed[id] {
+			d.err = errPropertyNotAllowed
+			return
+		}
+		if seen[id] && id != propUserProperty && id != propSubscriptionIdentifier {
+			d.err = errPropertyDuplicate // It is a Protocol Error to include a property more than once
+			return
+		}
+		seen[id] = true
+		switch id {
+		case propPayloadFormatIndicator:
+			p.PayloadFormatIndicator = Byte(props.byte())
+		case propMessageExpiryInterval:
+			p.MessageExpiryInterval = Uint32(props.uint32())
+		case propContentType:
+			p.ContentType = props.string()
+		case propResponseTopic:
+			p.ResponseTopic = props.string()
+		case propCorrelationData:
+			p.CorrelationData = props.binary()
+		case propSubscriptionIdentifier:
+			subscriptionIdentifier := props.varint()
+			if subscriptionIdentifier == 0 {
+				d.err = errPropertyInvalid // It is a Protocol Error if the Subscription Identifier has a value of 0
+				return
+			}
+			p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, subscriptionIdentifier)
+		case propSessionExpiryInterval:
+			p.SessionExpiryInterval = Uint32(props.uint32())
+		case propAssignedClientIdentifier:
+			p.AssignedClientIdentifier = props.string()
+		case propServerKeepAlive:
+			p.ServerKeepAlive = Uint16(props.uint16())
+		case propAuthenticationMethod:
+			p.AuthenticationMethod = props.string()
+		case propAuthenticationData:
+			p.AuthenticationData = props.binary()
+		case propRequestProblemInformation:
+			p.RequestProblemInformation = Byte(props.byte())
+		case propWillDelayInterval:
+			p.WillDelayInterval = Uint32(props.uint32())
+		case propRequestResponseInformation:
+			p.RequestResponseInformation = Byte(props.byte())
+		case propResponseInformation:
+			p.ResponseInformation = props.string()
+		case propServerReference:
+			p.ServerReference = props.string()
+		case propReasonString:
+			p.ReasonString = props.string()
+		case propReceiveMaximum:
+			p.ReceiveMaximum = Uint16(props.uint16())
+			if *p.ReceiveMaximum == 0 {
+				d.err = errPropertyInvalid // It is a Protocol Error to include the Receive Maximum value more than once or for it to have the value 0
+				return
+			}
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum = Uint16(props.uint16())
+		case propTopicAlias:
+			p.TopicAlias = Uint16(props.uint16())
+		case propMaximumQoS:
+			p.MaximumQoS = Byte(props.byte())
+		case propRetainAvailable:
+			p.RetainAvailable = Byte(props.byte())
+		case propUserProperty:
+			key := props.string()
+			value := props.string()
+			p.UserProperties = append(p.UserProperties, UserProperty{Key: key, Value: value})
+		case propMaximumPacketSize:
+			p.MaximumPacketSize = Uint32(props.uint32())
+			if *p.MaximumPacketSize == 0 {
+				d.err = errPropertyInvalid // It is a Protocol Error to include the Maximum Packet Size more than once, or for the value to be set to zero
+				return
+			}
+		case propWildcardSubscriptionAvailable:
+			p.WildcardSubscriptionAvailable = Byte(props.byte())
+		case propSubscriptionIdentifierAvailable:
+			p.SubscriptionIdentifierAvailable = Byte(props.byte())
+		case propSharedSubscriptionAvailable:
+			p.SharedSubscriptionAvailable = Byte(props.byte())
+		}
+	}
+	if props.err != nil {
+		d.err = props.err
+	}
+}
@@ -0,0 +1,96 @@
+package packets
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProperties(t *testing.T) {
+	Convey(`Given Properties with all fields set`, t, func() {
+		props := Properties{
+			PayloadFormatIndicator:          Byte(1),
+			MessageExpiryInterval:           Uint32(2),
+			ContentType:                     "text/plain",
+			ResponseTopic:                   "reply",
+			CorrelationData:                 []byte("correlation"),
+			SubscriptionIdentifiers:         []uint32{1, 128, 16384},
+			SessionExpiryInterval:           Uint32(3),
+			AssignedClientIdentifier:        "client",
+			ServerKeepAlive:                 Uint16(4),
+			AuthenticationMethod:            "method",
+			AuthenticationData:              []byte("data"),
+			RequestProblemInformation:       Byte(0),
+			WillDelayInterval:               Uint32(5),
+			RequestResponseInformation:      Byte(1),
+			ResponseInformation:             "info",
+			ServerReference:                 "server",
+			ReasonString:                    "reason",
+			ReceiveMaximum:                  Uint16(6),
+			TopicAliasMaximum:               Uint16(7),
+			TopicAlias:                      Uint16(8),
+			MaximumQoS:                      Byte(1),
+			RetainAvailable:                 Byte(1),
+			UserProperties:                  []UserProperty{{Key: "foo", Value: "bar"}},
+			MaximumPacketSize:               Uint32(9),
+			WildcardSubscriptionAvailable:   Byte(1),
+			SubscriptionIdentifierAvailable: Byte(1),
+			SharedSubscriptionAvailable:     Byte(0),
+		}
+
+		Convey(`When encoding and decoding them without restrictions`, func() {
+			var e encoder
+			props.encode(&e)
+			all := make(map[byte]bool)
+			for _, allowed := range allowedProperties {
+				for id := range allowed {
+					all[id] = true
+				}
+			}
+			allowedProperties[0] = all
+			defer delete(allowedProperties, 0)
+			var decoded Properties
+			d := newDecoder(bytes.NewReader(e.Bytes()))
+			decoded.decode(d, 0)
+			So(d.err, ShouldBeNil)
+			So(decoded, ShouldResemble, props)
+		})
+
+		Convey(`When decoding them for a PUBLISH packet`, func() {
+			var e encoder
+			props.encode(&e)
+			var decoded Properties
+			d := newDecoder(bytes.NewReader(e.Bytes()))
+			decoded.decode(d, Publish)
+			Convey(`Then there should be an error`, func() { So(d.err, ShouldEqual, errPropertyNotAllowed) })
+		})
+
+		Convey(`When copying them`, func() {
+			copied := props.Copy()
+			copied.UserProperties[0].Value = "baz"
+			Convey(`Then the original should not change`, func() { So(props.UserProperties[0].Value, ShouldEqual, "bar") })
+		})
+	})
+
+	Convey(`When decoding duplicate properties`, t, func() {
+		d := newDecoder(bytes.NewReader([]byte{10, propMessageExpiryInterval, 0, 0, 0, 1, propMessageExpiryInterval, 0, 0, 0, 2}))
+		var decoded Properties
+		decoded.decode(d, Publish)
+		Convey(`Then there should be an error`, func() { So(d.err, ShouldEqual, errPropertyDuplicate) })
+	})
+
+	Convey(`When decoding a Subscription Identifier of 0`, t, func() {
+		d := newDecoder(bytes.NewReader([]byte{2, propSubscriptionIdentifier, 0}))
+		var decoded Properties
+		decoded.decode(d, Subscribe)
+		Convey(`Then there should be an error`, func() { So(d.err, ShouldEqual, errPropertyInvalid) })
+	})
+
+	Convey(`When decoding truncated properties`, t, func() {
+		d := newDecoder(bytes.NewReader([]byte{3, propMessageExpiryInterval, 0, 0}))
+		var decoded Properties
+		decoded.decode(d, Publish)
+		Convey(`Then there should be an error`, func() { So(d.err, ShouldNotBeNil) })
+	})
+}
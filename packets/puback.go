@@ -0,0 +1,37 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PubackPacket is an MQTT PUBACK packet
+type PubackPacket struct {
+	FixedHeader
+	MessageID  uint16
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *PubackPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", p.FixedHeader, p.MessageID, p.ReasonCode)
+}
+
+// Write the packet to w
+func (p *PubackPacket) Write(w io.Writer, version byte) error {
+	var body encoder
+	writeAck(&body, version, p.MessageID, p.ReasonCode, &p.Properties)
+	return p.FixedHeader.write(w, Puback, &body)
+}
+
+// Unpack the packet from r
+func (p *PubackPacket) Unpack(r io.Reader, version byte) error {
+	d := newDecoder(r)
+	p.MessageID, p.ReasonCode, p.Properties = readAck(d, version, Puback, p.RemainingLength)
+	return d.done(p.RemainingLength)
+}
+
+// Details of the packet
+func (p *PubackPacket) Details() Details {
+	return Details{Qos: p.Qos, MessageID: p.MessageID}
+}
@@ -0,0 +1,37 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PubcompPacket is an MQTT PUBCOMP packet
+type PubcompPacket struct {
+	FixedHeader
+	MessageID  uint16
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *PubcompPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", p.FixedHeader, p.MessageID, p.ReasonCode)
+}
+
+// Write the packet to w
+func (p *PubcompPacket) Write(w io.Writer, version byte) error {
+	var body encoder
+	writeAck(&body, version, p.MessageID, p.ReasonCode, &p.Properties)
+	return p.FixedHeader.write(w, Pubcomp, &body)
+}
+
+// Unpack the packet from r
+func (p *PubcompPacket) Unpack(r io.Reader, version byte) error {
+	d := newDecoder(r)
+	p.MessageID, p.ReasonCode, p.Properties = readAck(d, version, Pubcomp, p.RemainingLength)
+	return d.done(p.RemainingLength)
+}
+
+// Details of the packet
+func (p *PubcompPacket) Details() Details {
+	return Details{Qos: p.Qos, MessageID: p.MessageID}
+}
@@ -0,0 +1,144 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// PublishPacket is an MQTT PUBLISH packet
+type PublishPacket struct {
+	FixedHeader
+	TopicName  string
+	MessageID  uint16
+	Properties Properties
+	Payload    []byte
+
+	// Expires is the time at which the message expires, it is not encoded
+	// The Message Expiry Interval is set to the remaining lifetime when the message is written
+	Expires time.Time
+
+	// Origin is the client identifier of the publisher, it is not encoded
+	Origin string
+
+	// Size is the size of the packet in bytes when it is encoded for MQTT 5, it is not encoded
+	// It is set by the server on deliveries to subscribers, zero means that it is not known.
+	Size int
+}
+
+func (p *PublishPacket) String() string {
+	return fmt.Sprintf("%s topicName: %s MessageID: %d payload: %s", p.FixedHeader, p.TopicName, p.MessageID, string(p.Payload))
+}
+
+// Write the packet to w
+func (p *PublishPacket) Write(w io.Writer, version byte) error {
+	var body encoder
+	body.Grow(len(p.TopicName) + len(p.Payload) + 16)
+	body.string(p.TopicName)
+	if p.Qos > 0 {
+		body.uint16(p.MessageID)
+	}
+	if version >= Version5 {
+		// The packet can be shared between subscribers, so the remaining lifetime is set on a copy of the properties
+		properties := p.Properties
+		if !p.Expires.IsZero() {
+			properties.MessageExpiryInterval = Uint32(p.remainingLifetime(time.Now()))
+		}
+		properties.encode(&body)
+	}
+	body.Write(p.Payload)
+	return p.FixedHeader.write(w, Publish, &body)
+}
+
+// Unpack the packet from r
+func (p *PublishPacket) Unpack(r io.Reader, version byte) error {
+	d := newDecoder(r)
+	p.TopicName = d.string()
+	if p.Qos > 0 {
+		p.MessageID = d.uint16()
+	}
+	if version >= Version5 {
+		p.Properties.decode(d, Publish)
+	}
+	p.Payload = d.rest(p.RemainingLength)
+	return d.done(p.RemainingLength)
+}
+
+// Copy returns a new PUBLISH packet with the same topic, properties and payload
+func (p *PublishPacket) Copy() *PublishPacket {
+	newP := NewControlPacket(Publish).(*PublishPacket)
+	newP.TopicName = p.TopicName
+	newP.Properties = p.Properties.Copy()
+	newP.Payload = p.Payload
+	newP.Expires = p.Expires
+	newP.Origin = p.Origin
+	return newP
+}
+
+// DeliverySize is the size of deliveries of a PUBLISH packet to MQTT 5 clients
+// Deliveries of a message only differ in their QoS and subscription identifiers, so their size can be computed
+// without encoding each delivery.
+type DeliverySize struct {
+	rest       int // remaining length without the packet identifier and the properties
+	properties int // length of the properties without subscription identifiers
+	err        error
+}
+
+// NewDeliverySize returns the DeliverySize of the message
+func NewDeliverySize(p *PublishPacket) DeliverySize {
+	properties := p.Properties
+	properties.SubscriptionIdentifiers = nil
+	if !p.Expires.IsZero() {
+		properties.MessageExpiryInterval = Uint32(0) // the remaining lifetime always has the same size
+	}
+	var topic, props encoder
+	topic.string(p.TopicName)
+	properties.encodeFields(&props)
+	if topic.err != nil {
+		return DeliverySize{err: topic.err}
+	}
+	if props.err != nil {
+		return DeliverySize{err: props.err}
+	}
+	return DeliverySize{rest: topic.Len() + len(p.Payload), properties: props.Len()}
+}
+
+// Size returns the size in bytes of a delivery with the QoS and subscription identifiers
+// An error is returned if the message can not be encoded.
+func (s DeliverySize) Size(qos byte, subscriptionIdentifiers []uint32) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	properties := s.properties
+	for _, id := range subscriptionIdentifiers {
+		properties += 1 + len(encodeLength(int(id)))
+	}
+	remainingLength := s.rest + len(encodeLength(properties)) + properties
+	if qos > 0 {
+		remainingLength += 2
+	}
+	if remainingLength > maxRemainingLength {
+		return 0, ErrPacketTooLarge
+	}
+	return 1 + len(encodeLength(remainingLength)) + remainingLength, nil
+}
+
+// Expired returns true if the message expires before the given time
+func (p *PublishPacket) Expired(now time.Time) bool {
+	return !p.Expires.IsZero() && !now.Before(p.Expires)
+}
+
+// remainingLifetime returns the remaining lifetime of the message in seconds, rounded up
+// Messages that are already in flight when they expire are still delivered, with the minimum lifetime of 1 second.
+func (p *PublishPacket) remainingLifetime(now time.Time) uint32 {
+	remaining := p.Expires.Sub(now)
+	if remaining <= time.Second {
+		return 1
+	}
+	return uint32((remaining + time.Second - 1) / time.Second)
+}
+
+// Details of the packet
+func (p *PublishPacket) Details() Details {
+	return Details{Qos: p.Qos, MessageID: p.MessageID}
+}
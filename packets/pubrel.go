@@ -0,0 +1,37 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PubrelPacket is an MQTT PUBREL packet
+type PubrelPacket struct {
+	FixedHeader
+	MessageID  uint16
+	ReasonCode byte
+	Properties Properties
+}
+
+func (p *PubrelPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", p.FixedHeader, p.MessageID, p.ReasonCode)
+}
+
+// Write the packet to w
+func (p *PubrelPacket) Write(w io.Writer, version byte) error {
+	var body encoder
+	writeAck(&body, version, p.MessageID, p.ReasonCode, &p.Properties)
+	return p.FixedHeader.write(w, Pubrel, &body)
+}
+
+// Unpack the packet from r
+func (p *PubrelPacket) Unpack(r io.Reader, version byte) error {
+	d := newDecoder(r)
+	p.MessageID, p.ReasonCode, p.Properties = readAck(d, version, Pubrel, p.RemainingLength)
+	return d.done(p.RemainingLength)
+}
+
+// Details of the packet
+func (p *PubrelPacket) Details() Details {
+	return Details{Qos: p.Qos, MessageID: p.MessageID}
+}
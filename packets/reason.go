@@ -0,0 +1,133 @@
+package packets
+
+import "errors"
+
+// MQTT 3.1.1 CONNACK return codes
+const (
+	Accepted                        = 0x00
+	ErrRefusedBadProtocolVersion    = 0x01
+	ErrRefusedIDRejected            = 0x02
+	ErrRefusedServerUnavailable     = 0x03
+	ErrRefusedBadUsernameOrPassword = 0x04
+	ErrRefusedNotAuthorised         = 0x05
+	ErrNetworkError                 = 0xFE
+	ErrProtocolViolation            = 0xFF
+)
+
+// ConnackReturnCodes maps the CONNACK return codes to their description
+var ConnackReturnCodes = map[uint8]string{
+	0:   "Connection Accepted",
+	1:   "Connection Refused: Bad Protocol Version",
+	2:   "Connection Refused: Client Identifier Rejected",
+	3:   "Connection Refused: Server Unavailable",
+	4:   "Connection Refused: Username or Password in unknown format",
+	5:   "Connection Refused: Not Authorised",
+	140: "Connection Refused: Bad Authentication Method",
+	254: "Connection Error",
+	255: "Connection Refused: Protocol Violation",
+}
+
+// ConnErrors maps the CONNACK return codes to errors
+var ConnErrors = map[byte]error{
+	Accepted:                        nil,
+	ErrRefusedBadProtocolVersion:    errors.New("Unnacceptable protocol version"),
+	ErrRefusedIDRejected:            errors.New("Identifier rejected"),
+	ErrRefusedServerUnavailable:     errors.New("Server Unavailable"),
+	ErrRefusedBadUsernameOrPassword: errors.New("Bad user name or password"),
+	ErrRefusedNotAuthorised:         errors.New("Not Authorized"),
+	BadAuthenticationMethod:         errors.New("Bad authentication method"),
+	ErrNetworkError:                 errors.New("Network Error"),
+	ErrProtocolViolation:            errors.New("Protocol Violation"),
+}
+
+// MQTT 5 reason codes
+const (
+	Success                             = 0x00
+	NormalDisconnection                 = 0x00
+	GrantedQoS0                         = 0x00
+	GrantedQoS1                         = 0x01
+	GrantedQoS2                         = 0x02
+	DisconnectWithWillMessage           = 0x04
+	NoMatchingSubscribers               = 0x10
+	NoSubscriptionExisted               = 0x11
+	ContinueAuthentication              = 0x18
+	ReAuthenticate                      = 0x19
+	UnspecifiedError                    = 0x80
+	MalformedPacket                     = 0x81
+	ProtocolError                       = 0x82
+	ImplementationSpecificError         = 0x83
+	UnsupportedProtocolVersion          = 0x84
+	ClientIdentifierNotValid            = 0x85
+	BadUserNameOrPassword               = 0x86
+	NotAuthorized                       = 0x87
+	ServerUnavailable                   = 0x88
+	ServerBusy                          = 0x89
+	Banned                              = 0x8A
+	ServerShuttingDown                  = 0x8B
+	BadAuthenticationMethod             = 0x8C
+	KeepAliveTimeout                    = 0x8D
+	SessionTakenOver                    = 0x8E
+	TopicFilterInvalid                  = 0x8F
+	TopicNameInvalid                    = 0x90
+	PacketIdentifierInUse               = 0x91
+	PacketIdentifierNotFound            = 0x92
+	ReceiveMaximumExceeded              = 0x93
+	TopicAliasInvalid                   = 0x94
+	PacketTooLarge                      = 0x95
+	MessageRateTooHigh                  = 0x96
+	QuotaExceeded                       = 0x97
+	AdministrativeAction                = 0x98
+	PayloadFormatInvalid                = 0x99
+	RetainNotSupported                  = 0x9A
+	QoSNotSupported                     = 0x9B
+	UseAnotherServer                    = 0x9C
+	ServerMoved                         = 0x9D
+	SharedSubscriptionsNotSupported     = 0x9E
+	ConnectionRateExceeded              = 0x9F
+	MaximumConnectTime                  = 0xA0
+	SubscriptionIdentifiersNotSupported = 0xA1
+	WildcardSubscriptionsNotSupported   = 0xA2
+)
+
+// connackReasonCode converts an MQTT 3.1.1 CONNACK return code to an MQTT 5 reason code
+// MQTT 5 reason codes are returned unchanged.
+func connackReasonCode(returnCode byte) byte {
+	switch returnCode {
+	case ErrRefusedBadProtocolVersion:
+		return UnsupportedProtocolVersion
+	case ErrRefusedIDRejected:
+		return ClientIdentifierNotValid
+	case ErrRefusedServerUnavailable:
+		return ServerUnavailable
+	case ErrRefusedBadUsernameOrPassword:
+		return BadUserNameOrPassword
+	case ErrRefusedNotAuthorised:
+		return NotAuthorized
+	case ErrNetworkError:
+		return UnspecifiedError
+	case ErrProtocolViolation:
+		return ProtocolError
+	}
+	return returnCode
+}
+
+// connackReturnCode converts an MQTT 5 CONNACK reason code to an MQTT 3.1.1 return code
+// MQTT 3.1.1 return codes are returned unchanged.
+func connackReturnCode(reasonCode byte) byte {
+	switch reasonCode {
+	case UnsupportedProtocolVersion:
+		return ErrRefusedBadProtocolVersion
+	case ClientIdentifierNotValid:
+		return ErrRefusedIDRejected
+	case BadUserNameOrPassword, BadAuthenticationMethod:
+		return ErrRefusedBadUsernameOrPassword
+	case NotAuthorized, Banned:
+		return ErrRefusedNotAuthorised
+	case MalformedPacket, ProtocolError:
+		return ErrProtocolViolation
+	}
+	if reasonCode >= UnspecifiedError && reasonCode < ErrNetworkError {
+		return ErrRefusedServerUnavailable
+	}
+	return reasonCode
+}
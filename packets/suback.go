@@ -0,0 +1,52 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// SubackPacket is an MQTT SUBACK packet
+type SubackPacket struct {
+	FixedHeader
+	MessageID   uint16
+	Properties  Properties
+	ReturnCodes []byte
+}
+
+func (s *SubackPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d", s.FixedHeader, s.MessageID)
+}
+
+// Write the packet to w
+func (s *SubackPacket) Write(w io.Writer, version byte) error {
+	var body encoder
+	body.uint16(s.MessageID)
+	if version >= Version5 {
+		s.Properties.encode(&body)
+		body.Write(s.ReturnCodes)
+	} else {
+		for _, returnCode := range s.ReturnCodes {
+			if returnCode >= UnspecifiedError {
+				returnCode = 0x80 // MQTT 3.1.1 only has a single failure return code
+			}
+			body.WriteByte(returnCode)
+		}
+	}
+	return s.FixedHeader.write(w, Suback, &body)
+}
+
+// Unpack the packet from r
+func (s *SubackPacket) Unpack(r io.Reader, version byte) error {
+	d := newDecoder(r)
+	s.MessageID = d.uint16()
+	if version >= Version5 {
+		s.Properties.decode(d, Suback)
+	}
+	s.ReturnCodes = d.rest(s.RemainingLength)
+	return d.done(s.RemainingLength)
+}
+
+// Details of the packet
+func (s *SubackPacket) Details() Details {
+	return Details{Qos: 0, MessageID: s.MessageID}
+}
@@ -0,0 +1,96 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// Retain Handling options of MQTT 5 subscriptions
+const (
+	SendRetainedOnSubscribe    = 0
+	SendRetainedOnNewSubscribe = 1
+	DoNotSendRetained          = 2
+)
+
+// SubscriptionOptions of an MQTT 5 subscription, in addition to the QoS
+type SubscriptionOptions struct {
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
+func (o SubscriptionOptions) encode(qos byte) byte {
+	return qos | boolToByte(o.NoLocal)<<2 | boolToByte(o.RetainAsPublished)<<3 | o.RetainHandling<<4
+}
+
+// SubscribePacket is an MQTT SUBSCRIBE packet
+// For MQTT 3.1.1 packets, the Options are all zero.
+type SubscribePacket struct {
+	FixedHeader
+	MessageID  uint16
+	Properties Properties
+	Topics     []string
+	Qoss       []byte
+	Options    []SubscriptionOptions
+}
+
+func (s *SubscribePacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d topics: %s", s.FixedHeader, s.MessageID, s.Topics)
+}
+
+// Write the packet to w
+func (s *SubscribePacket) Write(w io.Writer, version byte) error {
+	var body encoder
+	body.uint16(s.MessageID)
+	if version >= Version5 {
+		s.Properties.encode(&body)
+	}
+	for i, topic := range s.Topics {
+		body.string(topic)
+		var options SubscriptionOptions
+		if version >= Version5 && i < len(s.Options) {
+			options = s.Options[i]
+		}
+		body.WriteByte(options.encode(s.Qoss[i]))
+	}
+	return s.FixedHeader.write(w, Subscribe, &body)
+}
+
+// Unpack the packet from r
+func (s *SubscribePacket) Unpack(r io.Reader, version byte) error {
+	d := newDecoder(r)
+	s.MessageID = d.uint16()
+	if version >= Version5 {
+		s.Properties.decode(d, Subscribe)
+	}
+	for d.err == nil && d.n < s.RemainingLength {
+		topic := d.string()
+		options := d.byte()
+		if d.err != nil {
+			break
+		}
+		if version >= Version5 {
+			if options&0xc0 != 0 || options>>4&0x03 == 0x03 {
+				return errMalformed // It is a Protocol Error if the Retain Handling is set to 3 or the reserved bits are non-zero
+			}
+		} else if options&0xfc != 0 {
+			return errMalformed // The Server MUST treat a SUBSCRIBE packet as malformed if any of Reserved bits in the payload are non-zero [MQTT-3-8.3-4]
+		}
+		if options&0x03 == 0x03 {
+			return errMalformed // The Server MUST treat a SUBSCRIBE packet as malformed if the QoS is 3 [MQTT-3.8.3-4]
+		}
+		s.Topics = append(s.Topics, topic)
+		s.Qoss = append(s.Qoss, options&0x03)
+		s.Options = append(s.Options, SubscriptionOptions{
+			NoLocal:           options&0x04 != 0,
+			RetainAsPublished: options&0x08 != 0,
+			RetainHandling:    options >> 4 & 0x03,
+		})
+	}
+	return d.done(s.RemainingLength)
+}
+
+// Details of the packet
+func (s *SubscribePacket) Details() Details {
+	return Details{Qos: 1, MessageID: s.MessageID}
+}
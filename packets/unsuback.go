@@ -0,0 +1,46 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// UnsubackPacket is an MQTT UNSUBACK packet
+// The ReasonCodes are only encoded for MQTT 5.
+type UnsubackPacket struct {
+	FixedHeader
+	MessageID   uint16
+	Properties  Properties
+	ReasonCodes []byte
+}
+
+func (u *UnsubackPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d", u.FixedHeader, u.MessageID)
+}
+
+// Write the packet to w
+func (u *UnsubackPacket) Write(w io.Writer, version byte) error {
+	var body encoder
+	body.uint16(u.MessageID)
+	if version >= Version5 {
+		u.Properties.encode(&body)
+		body.Write(u.ReasonCodes)
+	}
+	return u.FixedHeader.write(w, Unsuback, &body)
+}
+
+// Unpack the packet from r
+func (u *UnsubackPacket) Unpack(r io.Reader, version byte) error {
+	d := newDecoder(r)
+	u.MessageID = d.uint16()
+	if version >= Version5 {
+		u.Properties.decode(d, Unsuback)
+		u.ReasonCodes = d.rest(u.RemainingLength)
+	}
+	return d.done(u.RemainingLength)
+}
+
+// Details of the packet
+func (u *UnsubackPacket) Details() Details {
+	return Details{Qos: 0, MessageID: u.MessageID}
+}
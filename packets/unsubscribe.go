@@ -0,0 +1,51 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// UnsubscribePacket is an MQTT UNSUBSCRIBE packet
+type UnsubscribePacket struct {
+	FixedHeader
+	MessageID  uint16
+	Properties Properties
+	Topics     []string
+}
+
+func (u *UnsubscribePacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d topics: %s", u.FixedHeader, u.MessageID, u.Topics)
+}
+
+// Write the packet to w
+func (u *UnsubscribePacket) Write(w io.Writer, version byte) error {
+	var body encoder
+	body.uint16(u.MessageID)
+	if version >= Version5 {
+		u.Properties.encode(&body)
+	}
+	for _, topic := range u.Topics {
+		body.string(topic)
+	}
+	return u.FixedHeader.write(w, Unsubscribe, &body)
+}
+
+// Unpack the packet from r
+func (u *UnsubscribePacket) Unpack(r io.Reader, version byte) error {
+	d := newDecoder(r)
+	u.MessageID = d.uint16()
+	if version >= Version5 {
+		u.Properties.decode(d, Unsubscribe)
+	}
+	for d.err == nil && d.n < u.RemainingLength {
+		if topic := d.string(); d.err == nil {
+			u.Topics = append(u.Topics, topic)
+		}
+	}
+	return d.done(u.RemainingLength)
+}
+
+// Details of the packet
+func (u *UnsubscribePacket) Details() Details {
+	return Details{Qos: 1, MessageID: u.MessageID}
+}
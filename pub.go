@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/htdvisser/pkg/config"
+	"github.com/htdvisser/squatt/client"
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/topic"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var pubCfg *config.Config
+
+var pubCmd = &cobra.Command{
+	Use:   "pub",
+	Short: "Publish a message",
+	Long:  "Publish a message from --message, --file or stdin. With --lines, each line is published as a message.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := pubCfg.ReadInConfig(); err != nil {
+			log.Debug("not using config file", zap.Error(err))
+		}
+		topicName := pubCfg.GetString("topic")
+		if err := topic.Validate(topicName, false); err != nil {
+			log.Fatal("invalid topic", zap.String("topic", topicName), zap.Error(err))
+		}
+		qos := byte(pubCfg.GetInt("qos"))
+		if qos > 2 {
+			log.Fatal("invalid QoS", zap.Uint8("qos", qos))
+		}
+
+		var payload io.Reader = os.Stdin
+		if pubCfg.GetBool("null") {
+			payload = nil
+		} else if message := pubCfg.GetString("message"); message != "" {
+			payload = strings.NewReader(message)
+		} else if file := pubCfg.GetString("file"); file != "" && file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				log.Fatal("could not open file", zap.Error(err))
+			}
+			defer f.Close()
+			payload = f
+		}
+
+		c, err := dialBroker(pubCfg, nil)
+		if err != nil {
+			log.Fatal("could not connect to broker", zap.Error(err))
+		}
+		defer c.Disconnect()
+
+		publish := func(data []byte) {
+			msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			msg.TopicName, msg.Qos, msg.Retain, msg.Payload = topicName, qos, pubCfg.GetBool("retain"), data
+			if err := publishWithTimeout(c, msg); err != nil {
+				log.Fatal("could not publish message", zap.Error(err))
+			}
+		}
+
+		switch {
+		case payload == nil:
+			publish(nil)
+		case pubCfg.GetBool("lines"):
+			scanner := bufio.NewScanner(payload)
+			for scanner.Scan() {
+				publish(append([]byte(nil), scanner.Bytes()...))
+			}
+			if err := scanner.Err(); err != nil {
+				log.Fatal("could not read payload", zap.Error(err))
+			}
+		default:
+			data, err := ioutil.ReadAll(payload)
+			if err != nil {
+				log.Fatal("could not read payload", zap.Error(err))
+			}
+			publish(data)
+		}
+	},
+}
+
+func publishWithTimeout(c *client.Client, msg *packets.PublishPacket) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pubCfg.GetDuration("broker.timeout"))
+	defer cancel()
+	return c.Publish(ctx, msg)
+}
+
+type pubConfig struct {
+	Broker  brokerConfig `name:"broker"`
+	Topic   string       `name:"topic" description:"Topic of the message"`
+	QoS     int          `name:"qos" description:"QoS of the message (0, 1 or 2)"`
+	Retain  bool         `name:"retain" description:"Retain the message"`
+	Message string       `name:"message" description:"Payload of the message"`
+	File    string       `name:"file" description:"File with the payload of the message (- for stdin)"`
+	Lines   bool         `name:"lines" description:"Publish each line of the payload as a message"`
+	Null    bool         `name:"null" description:"Publish a message without payload, to delete a retained message"`
+}
+
+func pubDefaults() (defaults pubConfig) {
+	defaults.Broker = defaultBrokerConfig()
+	defaults.File = "-"
+	return
+}
+
+func init() {
+	pubCfg = config.Initialize("squatt", pubDefaults())
+	pubCmd.Flags().AddFlagSet(pubCfg.Flags())
+	cmd.AddCommand(pubCmd)
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/htdvisser/squatt/admin"
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/bridge"
+	"github.com/htdvisser/squatt/listener"
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/server"
+	"github.com/htdvisser/squatt/tlsconfig"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var errRestartRequired = errors.New("restart required")
+
+// logLevel is the level of log, it is set by applyLogLevel
+var logLevel = zap.NewAtomicLevel()
+
+func newLogger(config zap.Config) *zap.Logger {
+	config.Level = logLevel
+	log, _ := config.Build()
+	return log
+}
+
+func applyLogLevel() error {
+	level := zapcore.InfoLevel
+	if cfg.GetBool("debug") {
+		level = zapcore.DebugLevel
+	}
+	if text := cfg.GetString("log.level"); text != "" {
+		if err := level.UnmarshalText([]byte(text)); err != nil {
+			return err
+		}
+	}
+	logLevel.SetLevel(level)
+	return nil
+}
+
+// runtime is the part of the running server that can be changed by reloading the config
+type runtime struct {
+	server              *server.Server
+	subscriptionOptions packets.SubscriptionOptions
+	passwords           *auth.PasswordStore
+	tls                 *tlsconfig.Provider
+	bridges             map[string]*bridge.Bridge
+	listeners           []*movableListener
+	configListeners     map[string]*configListener // listeners of the listeners list of the config, by name
+
+	running bool              // settings that can not be reloaded are applied when not running
+	values  map[string]string // applied config values by key
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func newRuntime(s *server.Server, subscriptionOptions packets.SubscriptionOptions) *runtime {
+	r := &runtime{
+		server:              s,
+		subscriptionOptions: subscriptionOptions,
+		tls:                 tlsconfig.NewProvider(),
+		bridges:             make(map[string]*bridge.Bridge),
+		configListeners:     make(map[string]*configListener),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.tls.SetLogger(log)
+	r.listeners = []*movableListener{
+		{
+			name:   "tcp",
+			listen: func(address string) (net.Listener, error) { return net.Listen("tcp", address) },
+			serve:  r.serveMQTT("tcp"),
+			close:  s.CloseListener,
+		},
+		{
+			name: "tls",
+			listen: func(address string) (net.Listener, error) {
+				if !r.tls.Configured() {
+					return nil, errors.New("no tls config")
+				}
+				return tls.Listen("tcp", address, r.tls.TLSConfig())
+			},
+			serve: r.serveMQTT("tls"),
+			close: s.CloseListener,
+		},
+		{
+			name: "admin",
+			listen: func(address string) (net.Listener, error) {
+				token := cfg.GetString("admin.token")
+				if token == "" {
+					return nil, errors.New("admin server requires admin token")
+				}
+				return net.Listen("tcp", address)
+			},
+			serve: func(lis net.Listener) error {
+				api := admin.New(s, cfg.GetString("admin.token"))
+				api.SetLogger(log)
+				return api.Serve(lis)
+			},
+			close: net.Listener.Close,
+		},
+		{
+			name:   "control",
+			listen: admin.ListenControl,
+			serve: func(lis net.Listener) error {
+				api := admin.NewControl(s)
+				api.SetLogger(log)
+				return api.Serve(lis)
+			},
+			close: net.Listener.Close,
+		},
+	}
+	return r
+}
+
+func (r *runtime) serveMQTT(name string) func(net.Listener) error {
+	return func(lis net.Listener) error {
+		return r.server.ServeListener(lis, server.ListenerConfig{Name: name, SubscriptionOptions: r.subscriptionOptions})
+	}
+}
+
+// movableListener is a listener of the config, that can be moved to another address
+type movableListener struct {
+	name   string
+	listen func(address string) (net.Listener, error)
+	serve  func(net.Listener) error
+	close  func(net.Listener) error
+
+	mu  sync.Mutex
+	lis net.Listener
+}
+
+// set starts listening on the address and closes the previous listener, an empty address only closes it
+// Clients that connected on the previous listener stay connected.
+func (l *movableListener) set(address string) error {
+	var lis net.Listener
+	if address != "" {
+		var err error
+		if lis, err = l.listen(address); err != nil {
+			return err
+		}
+		log.Info("start listener", zap.String("listener", l.name), zap.String("address", address))
+	}
+	l.mu.Lock()
+	old := l.lis
+	l.lis = lis
+	l.mu.Unlock()
+	if old != nil {
+		log.Info("stop listener", zap.String("listener", l.name), zap.String("address", old.Addr().String()))
+		l.close(old)
+	}
+	if lis != nil {
+		go l.run(lis)
+	}
+	return nil
+}
+
+func (l *movableListener) run(lis net.Listener) {
+	err := l.serve(lis)
+	l.mu.Lock()
+	current := l.lis == lis
+	l.mu.Unlock()
+	if err != nil && current {
+		log.Fatal("listener stopped", zap.String("listener", l.name), zap.Error(err))
+	}
+}
+
+// setting is a part of the config that can be reloaded
+type setting struct {
+	name  string
+	keys  []string
+	files bool // the setting is applied on every reload, because its files or lists may have changed
+	apply func() error
+}
+
+func (r *runtime) settings() []setting {
+	settings := []setting{
+		{name: "log", keys: []string{"log.level"}, apply: applyLogLevel},
+		{name: "auth", keys: []string{"auth.password-file"}, files: true, apply: r.applyAuth},
+		{name: "connection limits", keys: []string{
+			"limit.connections", "limit.connections-per-ip", "limit.connections-in-network",
+			"limit.connect-rate", "limit.connect-burst", "limit.connect-rate-per-ip", "limit.connect-burst-per-ip",
+			"limit.connect-timeout",
+		}, apply: r.applyConnectionLimits},
+		{name: "quotas", keys: []string{
+			"quota.messages", "quota.messages-action", "quota.bytes", "quota.bytes-action",
+			"quota.subscriptions", "quota.subscriptions-action", "quota.per-user",
+		}, apply: r.applyQuotas},
+		{name: "queue limits", keys: []string{"limit.publish-queue", "limit.in-flight"}, apply: r.applyQueueLimits},
+		{name: "tls", keys: []string{
+			"tls.certificate", "tls.key", "tls.min-version", "tls.cipher-suites", "tls.alpn",
+			"tls.client-ca-file", "tls.require-client-certificate",
+		}, files: true, apply: r.applyTLS},
+		{name: "bridges", files: true, apply: r.applyBridges},
+		{name: "listeners", files: true, apply: r.applyListeners},
+	}
+	for _, l := range r.listeners {
+		l, key := l, "listen."+l.name
+		settings = append(settings, setting{name: key, keys: []string{key}, apply: func() error {
+			return l.set(cfg.GetString(key))
+		}})
+	}
+	return settings
+}
+
+// start applies all settings
+func (r *runtime) start() error {
+	for _, setting := range r.settings() {
+		if err := setting.apply(); err != nil {
+			return fmt.Errorf("%s: %s", setting.name, err)
+		}
+	}
+	r.values = configValues()
+	r.running = true
+	if interval := cfg.GetDuration("tls.watch-interval"); interval > 0 {
+		go r.tls.Watch(r.ctx, interval)
+	}
+	return nil
+}
+
+// reload reads the config file and applies the changed settings
+// Changes to settings that can not be reloaded are rejected, they are applied after a restart.
+func (r *runtime) reload() {
+	if err := cfg.ReadInConfig(); err != nil {
+		log.Warn("could not reload config file", zap.Error(err))
+		return
+	}
+	values := configValues()
+	changed := make(map[string]bool)
+	for key, value := range values {
+		if value != r.values[key] {
+			changed[key] = true
+		}
+	}
+	for _, setting := range r.settings() {
+		var changes []string
+		for _, key := range setting.keys {
+			if changed[key] {
+				changes = append(changes, change(key, r.values[key], values[key]))
+				delete(changed, key)
+			}
+		}
+		if len(changes) == 0 && !setting.files {
+			continue
+		}
+		if err := setting.apply(); err != nil {
+			log.Warn("reject config change", zap.String("setting", setting.name), zap.Strings("changes", changes), zap.Error(err))
+			continue
+		}
+		for _, key := range setting.keys {
+			r.values[key] = values[key]
+		}
+		if len(changes) == 0 {
+			log.Debug("reload config files", zap.String("setting", setting.name))
+			continue
+		}
+		log.Info("apply config change", zap.String("setting", setting.name), zap.Strings("changes", changes))
+	}
+	rejected := make([]string, 0, len(changed))
+	for key := range changed {
+		rejected = append(rejected, key)
+	}
+	sort.Strings(rejected)
+	for _, key := range rejected {
+		log.Warn("reject config change", zap.String("setting", key), zap.Strings("changes", []string{change(key, r.values[key], values[key])}), zap.Error(errRestartRequired))
+	}
+}
+
+// stop stops watching TLS certificates, the bridges and the listeners
+func (r *runtime) stop() {
+	r.cancel()
+	for _, b := range r.bridges {
+		b.Stop()
+	}
+	for _, l := range r.listeners {
+		l.set("")
+	}
+	for _, l := range r.configListeners {
+		l.stop()
+	}
+}
+
+// configValues returns the config values by key
+func configValues() map[string]string {
+	values := make(map[string]string)
+	cfg.Flags().VisitAll(func(flag *pflag.Flag) {
+		values[flag.Name] = fmt.Sprint(cfg.Get(flag.Name))
+	})
+	return values
+}
+
+// change formats the change of a config value for logging, without secrets
+func change(key, old, new string) string {
+	for _, secret := range []string{".token", ".secret", ".password"} {
+		if strings.HasSuffix(key, secret) {
+			old, new = "<redacted>", "<redacted>"
+		}
+	}
+	return fmt.Sprintf("%s: %q -> %q", key, old, new)
+}
+
+// applyAuth loads the password file, or reloads its users if it was already loaded
+// Topic permissions come from the authorize plugin, there are no ACL files to reload.
+func (r *runtime) applyAuth() error {
+	passwordFile := cfg.GetString("auth.password-file")
+	switch {
+	case r.passwords != nil && passwordFile != "":
+		return r.passwords.Reload(passwordFile)
+	case r.running && (r.passwords != nil || passwordFile != ""):
+		return errRestartRequired // authentication can not be enabled or disabled while clients are connected
+	case passwordFile == "":
+		return nil
+	}
+	passwords, err := auth.LoadPasswordFile(passwordFile)
+	if err != nil {
+		return err
+	}
+	r.passwords = passwords
+	r.server.SetAuth(passwords.Plugin(auth.NoAuth))
+	r.server.AddAuthMethod(auth.NewSCRAMSHA256(passwords, auth.NoAuth))
+	return nil
+}
+
+func (r *runtime) applyConnectionLimits() error {
+	connectionLimits := server.ConnectionLimits{
+		MaxConnections:      cfg.GetInt("limit.connections"),
+		MaxConnectionsPerIP: cfg.GetInt("limit.connections-per-ip"),
+		ConnectRate:         float64(cfg.GetInt("limit.connect-rate")),
+		ConnectBurst:        cfg.GetInt("limit.connect-burst"),
+		ConnectRatePerIP:    float64(cfg.GetInt("limit.connect-rate-per-ip")),
+		ConnectBurstPerIP:   cfg.GetInt("limit.connect-burst-per-ip"),
+		ConnectTimeout:      cfg.GetDuration("limit.connect-timeout"),
+	}
+	for _, networkLimit := range cfg.GetStringSlice("limit.connections-in-network") {
+		sep := strings.LastIndex(networkLimit, "=")
+		if sep == -1 {
+			return fmt.Errorf("invalid network limit %s, expected cidr=connections", networkLimit)
+		}
+		_, network, err := net.ParseCIDR(networkLimit[:sep])
+		if err != nil {
+			return fmt.Errorf("invalid network limit %s: %s", networkLimit, err)
+		}
+		maxConnections, err := strconv.Atoi(networkLimit[sep+1:])
+		if err != nil {
+			return fmt.Errorf("invalid network limit %s: %s", networkLimit, err)
+		}
+		connectionLimits.Networks = append(connectionLimits.Networks, server.NetworkLimit{Network: network, MaxConnections: maxConnections})
+	}
+	return r.server.SetConnectionLimits(connectionLimits)
+}
+
+func (r *runtime) applyQuotas() error {
+	quotas := auth.Quotas{PerUser: cfg.GetBool("quota.per-user")}
+	for _, quota := range []struct {
+		name  string
+		quota *auth.Quota
+	}{
+		{"messages", &quotas.MessagesPerSecond},
+		{"bytes", &quotas.BytesPerSecond},
+		{"subscriptions", &quotas.Subscriptions},
+	} {
+		action, err := auth.ParseQuotaAction(cfg.GetString("quota." + quota.name + "-action"))
+		if err != nil {
+			return fmt.Errorf("invalid %s quota action: %s", quota.name, err)
+		}
+		*quota.quota = auth.Quota{Limit: cfg.GetInt("quota." + quota.name), Action: action}
+	}
+	r.server.SetQuotas(quotas)
+	return nil
+}
+
+func (r *runtime) applyQueueLimits() error {
+	publishQueue, inFlight := cfg.GetInt("limit.publish-queue"), cfg.GetInt("limit.in-flight")
+	if publishQueue < 0 {
+		return errors.New("invalid publish queue limit")
+	}
+	if inFlight < 1 || inFlight > 65535 {
+		return errors.New("invalid in-flight limit")
+	}
+	r.server.SetQueueLimits(publishQueue, inFlight)
+	return nil
+}
+
+// applyTLS loads the server certificate, which is used by the tls listener and by the tls and wss listeners of the
+// listeners list of the config that have no certificate of their own
+func (r *runtime) applyTLS() error {
+	certificates, keys := cfg.GetStringSlice("tls.certificate"), cfg.GetStringSlice("tls.key")
+	if len(certificates) == 0 && cfg.GetString("listen.tls") == "" {
+		return nil
+	}
+	if len(certificates) != len(keys) {
+		return errors.New("expected a key for each certificate")
+	}
+	config := tlsconfig.Config{
+		MinVersion:               cfg.GetString("tls.min-version"),
+		CipherSuites:             cfg.GetStringSlice("tls.cipher-suites"),
+		ALPN:                     cfg.GetStringSlice("tls.alpn"),
+		ClientCAFile:             cfg.GetString("tls.client-ca-file"),
+		RequireClientCertificate: cfg.GetBool("tls.require-client-certificate"),
+	}
+	for i, certificate := range certificates {
+		config.Certificates = append(config.Certificates, tlsconfig.Pair{CertificateFile: certificate, KeyFile: keys[i]})
+	}
+	return r.tls.Configure(config)
+}
+
+// applyBridges starts the bridges in the bridges list of the config, and stops the bridges that are no longer in it
+// Bridges with a changed config are restarted.
+func (r *runtime) applyBridges() error {
+	var settings []bridge.Settings
+	if err := cfg.UnmarshalKey("bridges", &settings); err != nil {
+		return err
+	}
+	configs, err := bridge.Configs(settings)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]bridge.Config, len(configs))
+	for _, config := range configs {
+		byName[config.Name] = config
+	}
+	for name, b := range r.bridges {
+		if config, ok := byName[name]; ok && sameBridgeConfig(config, b.Config()) {
+			continue
+		}
+		log.Info("stopping bridge", zap.String("bridge", name))
+		b.Stop()
+		delete(r.bridges, name)
+	}
+	for _, config := range configs {
+		if _, ok := r.bridges[config.Name]; ok {
+			continue
+		}
+		b := bridge.New(r.server, config)
+		b.SetLogger(log)
+		if startErr := b.Start(); startErr != nil {
+			if err == nil {
+				err = fmt.Errorf("could not start bridge %s: %s", config.Name, startErr)
+			}
+			continue
+		}
+		log.Info("starting bridge", zap.String("bridge", config.Name), zap.String("address", config.Address))
+		r.bridges[config.Name] = b
+	}
+	return err
+}
+
+// sameBridgeConfig returns true if the bridge configs are equal
+// The root CAs of TLS configs are compared by their subjects.
+func sameBridgeConfig(a, b bridge.Config) bool {
+	if (a.TLS == nil) != (b.TLS == nil) {
+		return false
+	}
+	if a.TLS != nil {
+		if a.TLS.InsecureSkipVerify != b.TLS.InsecureSkipVerify || (a.TLS.RootCAs == nil) != (b.TLS.RootCAs == nil) {
+			return false
+		}
+		if a.TLS.RootCAs != nil && !reflect.DeepEqual(a.TLS.RootCAs.Subjects(), b.TLS.RootCAs.Subjects()) {
+			return false
+		}
+	}
+	a.TLS, b.TLS = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// configListener is a listener of the listeners list of the config
+type configListener struct {
+	config listener.Config
+	tls    *tlsconfig.Provider // nil if the listener uses the TLS config of the server
+	lis    *movableListener
+	cancel context.CancelFunc // stops watching the TLS certificates of the listener
+}
+
+func (l *configListener) start() error {
+	return l.lis.set(l.config.Address)
+}
+
+func (l *configListener) stop() {
+	l.cancel()
+	l.lis.set("")
+}
+
+// newConfigListener prepares a listener of the listeners list of the config, without starting it
+func (r *runtime) newConfigListener(config listener.Config) (*configListener, error) {
+	for _, l := range r.listeners {
+		if config.Name == l.name {
+			return nil, fmt.Errorf("name %s is used by listen.%s", config.Name, l.name)
+		}
+	}
+	plugin, methods, err := r.listenerAuth(config)
+	if err != nil {
+		return nil, err
+	}
+	l := &configListener{config: config}
+	provider := r.tls
+	if config.OwnTLS() {
+		l.tls = tlsconfig.NewProvider()
+		l.tls.SetLogger(log.With(zap.String("listener", config.Name)))
+		if err := l.tls.Configure(config.TLS); err != nil {
+			return nil, err
+		}
+		provider = l.tls
+	}
+	serverConfig := server.ListenerConfig{
+		Name:                config.Name,
+		SubscriptionOptions: r.subscriptionOptions,
+		MaxPacketSize:       config.MaxPacketSize,
+		MaxConnections:      config.MaxConnections,
+		Auth:                plugin,
+		AuthMethods:         methods,
+		Mountpoint:          config.Mountpoint,
+	}
+	l.lis = &movableListener{
+		name: config.Name,
+		listen: func(string) (net.Listener, error) {
+			if config.Secure() && !provider.Configured() {
+				return nil, errors.New("no tls config")
+			}
+			return listener.Listen(config, provider.TLSConfig())
+		},
+		serve: func(lis net.Listener) error {
+			return r.server.ServeListener(lis, serverConfig)
+		},
+		close: r.server.CloseListener,
+	}
+	var ctx context.Context
+	ctx, l.cancel = context.WithCancel(r.ctx)
+	if interval := cfg.GetDuration("tls.watch-interval"); l.tls != nil && interval > 0 {
+		go l.tls.Watch(ctx, interval)
+	}
+	return l, nil
+}
+
+// listenerAuth returns the auth chain and enhanced authentication methods of a listener, or nil if the listener
+// uses the auth of the server
+// Clients that authenticate with SCRAM-SHA-256 are authorized by the same plugin as clients with a password.
+func (r *runtime) listenerAuth(config listener.Config) (auth.ConnectionPlugin, []auth.Method, error) {
+	if len(config.Auth) == 0 {
+		return nil, nil, nil
+	}
+	authorize := auth.Plugin(auth.NoAuth)
+	plugins := make([]auth.ConnectionPlugin, len(config.Auth))
+	methods := []auth.Method{}
+	for i, name := range config.Auth {
+		switch name {
+		case "anonymous":
+			plugins[i] = auth.Anonymous(authorize)
+		case "password":
+			if r.passwords == nil {
+				return nil, nil, errors.New("auth password requires a password file")
+			}
+			plugins[i] = r.passwords.Plugin(authorize).WithConnection()
+			methods = append(methods, auth.NewSCRAMSHA256(r.passwords, authorize))
+		case "peer":
+			if config.Protocol != listener.Unix {
+				return nil, nil, errors.New("auth peer requires protocol unix")
+			}
+			plugins[i] = auth.PeerPlugin(config.PeerUsers, authorize)
+		default:
+			return nil, nil, fmt.Errorf("unknown auth %s", name)
+		}
+	}
+	return auth.Chain(plugins...), methods, nil
+}
+
+// applyListeners starts the listeners in the listeners list of the config, and stops the listeners that are no longer in it
+// Listeners with a changed config are restarted, clients that are connected to them stay connected. If a listener
+// in the list is invalid, no listeners are changed.
+func (r *runtime) applyListeners() error {
+	var settings []listener.Settings
+	if err := cfg.UnmarshalKey("listeners", &settings); err != nil {
+		return err
+	}
+	configs, err := listener.Configs(settings)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]*configListener, len(configs))
+	for _, config := range configs {
+		if l, ok := r.configListeners[config.Name]; ok && reflect.DeepEqual(config, l.config) {
+			byName[config.Name] = l
+			continue
+		}
+		l, err := r.newConfigListener(config)
+		if err != nil {
+			for _, l := range byName {
+				if r.configListeners[l.config.Name] != l {
+					l.cancel()
+				}
+			}
+			return fmt.Errorf("listener %s: %s", config.Name, err)
+		}
+		byName[config.Name] = l
+	}
+	for name, l := range r.configListeners {
+		if byName[name] != l {
+			l.stop()
+			delete(r.configListeners, name)
+		}
+	}
+	for _, config := range configs {
+		l := byName[config.Name]
+		if r.configListeners[config.Name] == l {
+			continue
+		}
+		if startErr := l.start(); startErr != nil {
+			l.cancel()
+			if err == nil {
+				err = fmt.Errorf("could not start listener %s: %s", config.Name, startErr)
+			}
+			continue
+		}
+		r.configListeners[config.Name] = l
+	}
+	return err
+}
@@ -5,8 +5,11 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/listener"
+	"github.com/htdvisser/squatt/packets"
 	"github.com/htdvisser/squatt/session"
 	"go.uber.org/zap"
 )
@@ -18,20 +21,43 @@ var (
 
 // Client connection
 type Client struct {
-	server     *Server
-	log        *zap.Logger
-	remoteAddr string
+	server            *Server
+	log               *zap.Logger
+	remoteAddr        string
+	peer              *auth.PeerCredentials // credentials of the process of the client on a Unix socket
+	listener          ListenerConfig
+	version           byte      // protocol version, set by CONNECT
+	username          string    // username, set by CONNECT
+	authMethod        string    // enhanced authentication method, set by CONNECT
+	keepAliveInterval uint16    // keep-alive in seconds, set by CONNECT
+	connectedAt       time.Time // set by CONNECT
 
-	session   *session.Session
-	keepAlive *watchdog
+	maxPacketSize     int // only used by the receive routine
+	topicAliasMaximum uint16
+	topicAliases      map[uint16]string // inbound topic aliases, only used by the receive routine
+
+	quotas      auth.Quotas
+	messageRate *rateLimit // only used by the receive routine
+	byteRate    *rateLimit // only used by the receive routine
+
+	authExchange auth.Exchange          // authentication exchange in progress, only used by the receive routine
+	connect      *packets.ConnectPacket // CONNECT that waits for the authentication exchange
+	connack      *packets.ConnackPacket
+
+	session      *session.Session
+	keepAlive    *watchdog
+	connectTimer timer
+	clientID     string // set when the client is connected, protected by server.clientsMu
 
 	sendCh chan packets.ControlPacket
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	errMu sync.Mutex
-	err   error
+	errMu         sync.Mutex
+	err           error
+	sessionCh     chan<- packets.ControlPacket // channel of the session to the client, protected by errMu
+	releaseQuotas func()                       // releases quotas that are shared with other clients, protected by errMu
 }
 
 type wrappedErr struct {
@@ -46,9 +72,12 @@ func (c *Client) setError(err error) {
 	if c.err == nil {
 		c.err = err
 	}
+	sessionCh := c.sessionCh
 	c.errMu.Unlock()
 	c.cancel()
-	c.session.Disconnect()
+	if sessionCh != nil {
+		c.session.DisconnectFrom(sessionCh)
+	}
 }
 
 func (c *Client) getError() error {
@@ -60,9 +89,10 @@ func (c *Client) getError() error {
 // NewClient creates a new MQTT Client
 func (s *Server) NewClient() *Client {
 	c := &Client{
-		server: s,
-		log:    s.log,
-		sendCh: make(chan packets.ControlPacket),
+		server:  s,
+		log:     s.log,
+		version: packets.Version311,
+		sendCh:  make(chan packets.ControlPacket),
 	}
 	c.ctx, c.cancel = context.WithCancel(context.Background())
 	return c
@@ -71,10 +101,19 @@ func (s *Server) NewClient() *Client {
 // Handle the client connection
 func (c *Client) Handle(conn net.Conn) error {
 	c.remoteAddr = conn.RemoteAddr().String()
+	c.peer = listener.PeerCredentials(conn)
+	go func() {
+		<-c.ctx.Done()
+		conn.SetWriteDeadline(time.Now().Add(DisconnectTimeout)) // the last packet must not block the send routine
+	}()
 	return c.handle(conn)
 }
 
 func (c *Client) handle(rw io.ReadWriter) error {
+	c.server.addClient(c)
+	defer c.server.removeClient(c)
+	c.startConnectTimeout()
+	defer c.stopConnectTimeout()
 	waitSend := make(chan struct{})
 	go func() {
 		c.sendRoutine(rw)
@@ -87,6 +126,11 @@ func (c *Client) handle(rw io.ReadWriter) error {
 	}
 	close(c.sendCh)
 	c.keepAlive.Stop()
+	c.errMu.Lock()
+	if c.releaseQuotas != nil {
+		c.releaseQuotas()
+	}
+	c.errMu.Unlock()
 	<-waitSend
 	return c.getError().(error)
 }
@@ -0,0 +1,49 @@
+package server
+
+func (s *Server) addClient(c *Client) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.clients[c] = struct{}{}
+}
+
+func (s *Server) removeClient(c *Client) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	delete(s.clients, c)
+}
+
+// setClientID marks the client as connected with the given client identifier
+func (s *Server) setClientID(c *Client, clientID string) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	c.clientID = clientID
+}
+
+func (s *Server) clientConnected(c *Client) bool {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	return c.clientID != ""
+}
+
+// connectedClients returns the connected clients with the given client identifier
+// During a session takeover, there can be more than one.
+func (s *Server) connectedClients(clientID string) (clients []*Client) {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	for c := range s.clients {
+		if c.clientID == clientID {
+			clients = append(clients, c)
+		}
+	}
+	return
+}
+
+// allClients returns all clients, including clients that are not connected yet
+func (s *Server) allClients() (clients []*Client) {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	return
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errConnectTimeout = errors.New("connect timeout")
+	errConnectBurst   = errors.New("connect rate requires a connect burst of at least 1")
+)
+
+// Reasons for rejecting connections
+const (
+	RejectMaxConnections          = "max-connections"
+	RejectMaxConnectionsPerIP     = "max-connections-per-ip"
+	RejectMaxConnectionsInNetwork = "max-connections-in-network"
+	RejectConnectRate             = "connect-rate"
+	RejectConnectRatePerIP        = "connect-rate-per-ip"
+	RejectConnectTimeout          = "connect-timeout"
+)
+
+// ConnectionLimits limits the connections that the server accepts
+// Zero values mean no limit.
+type ConnectionLimits struct {
+	// MaxConnections is the maximum number of connections
+	MaxConnections int
+	// MaxConnectionsPerIP is the maximum number of connections from a single IP address
+	MaxConnectionsPerIP int
+	// Networks limit the number of connections from IP addresses in a network
+	Networks []NetworkLimit
+
+	// ConnectRate is the number of new connections per second, with bursts of ConnectBurst
+	ConnectRate  float64
+	ConnectBurst int
+	// ConnectRatePerIP is the number of new connections per second from a single IP address, with bursts of ConnectBurstPerIP
+	ConnectRatePerIP  float64
+	ConnectBurstPerIP int
+
+	// ConnectTimeout is the time in which clients must send their CONNECT packet
+	ConnectTimeout time.Duration
+}
+
+// NetworkLimit limits the number of connections from the IP addresses in a network
+// A MaxConnections of zero means no limit.
+type NetworkLimit struct {
+	Network        *net.IPNet
+	MaxConnections int
+}
+
+// SetConnectionLimits sets the limits for new connections
+// An error is returned if a connect rate is set without a burst, because all connections would then be rejected.
+func (s *Server) SetConnectionLimits(limits ConnectionLimits) error {
+	if (limits.ConnectRate > 0 && limits.ConnectBurst < 1) || (limits.ConnectRatePerIP > 0 && limits.ConnectBurstPerIP < 1) {
+		return errConnectBurst
+	}
+	s.connectionLimiter.setLimits(limits)
+	return nil
+}
+
+// RejectedConnections returns the number of rejected connections for each reason
+func (s *Server) RejectedConnections() map[string]int64 {
+	rejected := make(map[string]int64, len(s.stats.rejected))
+	for reason, count := range s.stats.rejected {
+		rejected[reason] = atomic.LoadInt64(count)
+	}
+	return rejected
+}
+
+func (s *Server) rejectConnection(conn net.Conn, reason string) {
+	atomic.AddInt64(s.stats.rejected[reason], 1)
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0) // reset the connection instead of waiting for the client
+	}
+	conn.Close()
+}
+
+// startConnectTimeout closes the connection of the client if it does not send a CONNECT in time
+func (c *Client) startConnectTimeout() {
+	timeout := c.server.connectionLimiter.connectTimeout()
+	if timeout == 0 {
+		return
+	}
+	c.connectTimer = c.server.clock.AfterFunc(timeout, func() {
+		atomic.AddInt64(c.server.stats.rejected[RejectConnectTimeout], 1)
+		c.setError(errConnectTimeout)
+	})
+}
+
+func (c *Client) stopConnectTimeout() {
+	if c.connectTimer != nil {
+		c.connectTimer.Stop()
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take a token from the bucket, after adding tokens at the rate since the last time
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	return b.takeN(now, 1, rate, burst)
+}
+
+// takeN takes n tokens from the bucket if it has them
+func (b *tokenBucket) takeN(now time.Time, n int, rate float64, burst int) bool {
+	b.refill(now, rate, burst)
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// debit takes n tokens from the bucket, even if it does not have them,
+// and returns how long it takes until the bucket is no longer in debt
+func (b *tokenBucket) debit(now time.Time, n int, rate float64, burst int) time.Duration {
+	b.refill(now, rate, burst)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rate
+	}
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
+
+type connectionLimiter struct {
+	mu                 sync.Mutex
+	limits             ConnectionLimits
+	connections        int
+	ipConnections      map[string]int
+	networkConnections map[string]int // by network
+	connectRate        tokenBucket
+	ipConnectRate      map[string]*tokenBucket
+}
+
+func newConnectionLimiter() *connectionLimiter {
+	return &connectionLimiter{
+		ipConnections:      make(map[string]int),
+		networkConnections: make(map[string]int),
+		ipConnectRate:      make(map[string]*tokenBucket),
+	}
+}
+
+func (l *connectionLimiter) setLimits(limits ConnectionLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	networkConnections := make(map[string]int, len(limits.Networks))
+	for _, network := range limits.Networks {
+		for ip, connections := range l.ipConnections {
+			if network.Network.Contains(net.ParseIP(ip)) {
+				networkConnections[network.Network.String()] += connections
+			}
+		}
+	}
+	l.limits, l.networkConnections = limits, networkConnections
+}
+
+func (l *connectionLimiter) connectTimeout() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits.ConnectTimeout
+}
+
+// admit returns the reason for rejecting a connection from addr, or a func that releases the admitted connection
+func (l *connectionLimiter) admit(addr net.Addr, now time.Time) (release func(), reject string) {
+	ip := addrIP(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limits := l.limits
+	if limits.MaxConnections > 0 && l.connections >= limits.MaxConnections {
+		return nil, RejectMaxConnections
+	}
+	if ip != nil {
+		if limits.MaxConnectionsPerIP > 0 && l.ipConnections[ip.String()] >= limits.MaxConnectionsPerIP {
+			return nil, RejectMaxConnectionsPerIP
+		}
+		for _, network := range limits.Networks {
+			if network.MaxConnections > 0 && network.Network.Contains(ip) &&
+				l.networkConnections[network.Network.String()] >= network.MaxConnections {
+				return nil, RejectMaxConnectionsInNetwork
+			}
+		}
+	}
+	if limits.ConnectRate > 0 && !l.connectRate.take(now, limits.ConnectRate, limits.ConnectBurst) {
+		return nil, RejectConnectRate
+	}
+	if ip != nil && limits.ConnectRatePerIP > 0 {
+		bucket, ok := l.ipConnectRate[ip.String()]
+		if !ok {
+			bucket = new(tokenBucket)
+			l.ipConnectRate[ip.String()] = bucket
+		}
+		if !bucket.take(now, limits.ConnectRatePerIP, limits.ConnectBurstPerIP) {
+			return nil, RejectConnectRatePerIP
+		}
+	}
+
+	l.connections++
+	l.count(ip, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.connections--
+			l.count(ip, -1)
+		})
+	}, ""
+}
+
+// count adds delta to the number of connections of the IP address and its networks
+func (l *connectionLimiter) count(ip net.IP, delta int) {
+	if ip == nil {
+		return
+	}
+	if l.ipConnections[ip.String()] += delta; l.ipConnections[ip.String()] <= 0 {
+		delete(l.ipConnections, ip.String())
+	}
+	for _, network := range l.limits.Networks {
+		if network.Network.Contains(ip) {
+			l.networkConnections[network.Network.String()] += delta
+		}
+	}
+}
+
+// cleanup deletes the connect rate buckets of IP addresses that are full again
+func (l *connectionLimiter) cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, bucket := range l.ipConnectRate {
+		bucket.refill(now, l.limits.ConnectRatePerIP, l.limits.ConnectBurstPerIP)
+		if bucket.tokens >= float64(l.limits.ConnectBurstPerIP) {
+			delete(l.ipConnectRate, ip)
+		}
+	}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
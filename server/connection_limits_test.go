@@ -0,0 +1,195 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenBucket(t *testing.T) {
+	Convey(`Given a token bucket with a rate of 2 per second and bursts of 2`, t, func() {
+		var b tokenBucket
+		now := time.Now()
+		Convey(`Then a burst of 2 should be allowed`, func() {
+			So(b.take(now, 2, 2), ShouldBeTrue)
+			So(b.take(now, 2, 2), ShouldBeTrue)
+			So(b.take(now, 2, 2), ShouldBeFalse)
+			Convey(`Then a token should be added every 500ms`, func() {
+				So(b.take(now.Add(499*time.Millisecond), 2, 2), ShouldBeFalse)
+				So(b.take(now.Add(500*time.Millisecond), 2, 2), ShouldBeTrue)
+			})
+			Convey(`Then the bucket should not exceed the burst`, func() {
+				So(b.take(now.Add(time.Hour), 2, 2), ShouldBeTrue)
+				So(b.take(now.Add(time.Hour), 2, 2), ShouldBeTrue)
+				So(b.take(now.Add(time.Hour), 2, 2), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestConnectionLimiter(t *testing.T) {
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234} }
+	now := time.Now()
+
+	Convey(`Given a connection limiter`, t, func() {
+		l := newConnectionLimiter()
+		_, network, _ := net.ParseCIDR("10.0.0.0/8")
+		l.setLimits(ConnectionLimits{
+			MaxConnections:      4,
+			MaxConnectionsPerIP: 2,
+			Networks:            []NetworkLimit{{Network: network, MaxConnections: 3}},
+		})
+
+		Convey(`When an IP address reaches its maximum`, func() {
+			release, reject := l.admit(addr("192.168.0.1"), now)
+			So(reject, ShouldBeEmpty)
+			_, reject = l.admit(addr("192.168.0.1"), now)
+			So(reject, ShouldBeEmpty)
+			_, reject = l.admit(addr("192.168.0.1"), now)
+			Convey(`Then the connection should be rejected`, func() { So(reject, ShouldEqual, RejectMaxConnectionsPerIP) })
+			Convey(`When a connection is released`, func() {
+				release()
+				release() // releasing twice has no effect
+				_, reject := l.admit(addr("192.168.0.1"), now)
+				Convey(`Then the connection should be accepted`, func() { So(reject, ShouldBeEmpty) })
+			})
+		})
+
+		Convey(`When a network reaches its maximum`, func() {
+			for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+				_, reject := l.admit(addr(ip), now)
+				So(reject, ShouldBeEmpty)
+			}
+			_, reject := l.admit(addr("10.0.0.4"), now)
+			Convey(`Then the connection should be rejected`, func() { So(reject, ShouldEqual, RejectMaxConnectionsInNetwork) })
+			Convey(`Then connections from other networks should be accepted`, func() {
+				_, reject := l.admit(addr("192.168.0.1"), now)
+				So(reject, ShouldBeEmpty)
+				Convey(`Until the server reaches its maximum`, func() {
+					_, reject := l.admit(addr("192.168.0.2"), now)
+					So(reject, ShouldEqual, RejectMaxConnections)
+				})
+			})
+		})
+
+		Convey(`When a network has no maximum`, func() {
+			_, unlimited, _ := net.ParseCIDR("172.16.0.0/12")
+			l.setLimits(ConnectionLimits{Networks: []NetworkLimit{{Network: unlimited}}})
+			_, reject := l.admit(addr("172.16.0.1"), now)
+			Convey(`Then connections from the network should be accepted`, func() { So(reject, ShouldBeEmpty) })
+		})
+
+		Convey(`When the connect rate is limited`, func() {
+			l.setLimits(ConnectionLimits{ConnectRatePerIP: 1, ConnectBurstPerIP: 1, ConnectRate: 1, ConnectBurst: 2})
+			_, reject := l.admit(addr("192.168.0.1"), now)
+			So(reject, ShouldBeEmpty)
+			Convey(`Then an IP address should be rate limited`, func() {
+				_, reject := l.admit(addr("192.168.0.1"), now)
+				So(reject, ShouldEqual, RejectConnectRatePerIP)
+			})
+			Convey(`Then the server should be rate limited`, func() {
+				_, reject := l.admit(addr("192.168.0.2"), now)
+				So(reject, ShouldBeEmpty)
+				_, reject = l.admit(addr("192.168.0.3"), now)
+				So(reject, ShouldEqual, RejectConnectRate)
+			})
+			Convey(`Then the full buckets should be cleaned up`, func() {
+				l.cleanup(now.Add(time.Second))
+				So(l.ipConnectRate, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestConnectionLimits(t *testing.T) {
+	Convey(`Given a Server with connection limits`, t, func() {
+		s := NewServer()
+		s.SetConnectionLimits(ConnectionLimits{MaxConnections: 1, ConnectTimeout: 20 * time.Millisecond})
+		lis, err := net.Listen("tcp", "localhost:0")
+		So(err, ShouldBeNil)
+		go s.Serve(lis)
+
+		Convey(`When a connect rate is set without a burst`, func() {
+			errs := []error{
+				s.SetConnectionLimits(ConnectionLimits{ConnectRate: 10}),
+				s.SetConnectionLimits(ConnectionLimits{ConnectRatePerIP: 1}),
+			}
+			Convey(`Then the limits should be rejected`, func() {
+				So(errs, ShouldResemble, []error{errConnectBurst, errConnectBurst})
+				So(s.connectionLimiter.limits.MaxConnections, ShouldEqual, 1)
+			})
+		})
+
+		Convey(`When a client does not send a CONNECT`, func() {
+			conn, err := net.Dial("tcp", lis.Addr().String())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			Convey(`Then a second connection should be rejected`, func() {
+				other, err := net.Dial("tcp", lis.Addr().String())
+				So(err, ShouldBeNil)
+				defer other.Close()
+				other.SetReadDeadline(time.Now().Add(time.Second))
+				_, err = other.Read(make([]byte, 1))
+				So(err, ShouldNotBeNil)
+				So(s.RejectedConnections()[RejectMaxConnections], ShouldEqual, 1)
+			})
+
+			Convey(`Then the connection should be closed after the timeout`, func() {
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				_, err := conn.Read(make([]byte, 1))
+				So(err, ShouldEqual, io.EOF)
+				So(s.RejectedConnections()[RejectConnectTimeout], ShouldEqual, 1)
+			})
+		})
+
+		Reset(func() {
+			lis.Close()
+		})
+	})
+}
+
+func TestConnectTimeoutDuringAuth(t *testing.T) {
+	Convey(`Given a Server with a connect timeout, an authentication method and a mock clock`, t, func() {
+		s := NewServer()
+		clock := newMockClock()
+		s.clock = clock
+		s.SetConnectionLimits(ConnectionLimits{ConnectTimeout: 5 * time.Second})
+		s.AddAuthMethod(testAuthMethod{})
+		go s.Route()
+
+		c := newMockClient(packets.Version5)
+		resCh := make(chan error, 1)
+		go func() { resCh <- s.NewClient().handle(c) }()
+
+		Convey(`When a client starts the authentication exchange and does not continue it`, func() {
+			connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			connect.ProtocolName, connect.ProtocolVersion = "MQTT", packets.Version5
+			connect.ClientIdentifier, connect.CleanSession = "foo", true
+			connect.Properties.AuthenticationMethod = "test"
+			connect.Properties.AuthenticationData = []byte("hello")
+			c.Send(connect)
+			time.Sleep(10 * time.Millisecond)
+			So(c.Responses(), ShouldHaveLength, 1)
+			clock.Advance(5 * time.Second)
+
+			Convey(`Then the connection should be closed after the connect timeout`, func() {
+				select {
+				case err := <-resCh:
+					So(err, ShouldEqual, errConnectTimeout)
+				case <-time.After(time.Second):
+					So(resCh, ShouldNotBeEmpty)
+				}
+				So(s.RejectedConnections()[RejectConnectTimeout], ShouldEqual, 1)
+			})
+		})
+
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	"go.uber.org/zap"
+)
+
+var (
+	errKicked             = errors.New("kicked")
+	errServerShuttingDown = errors.New("server shutting down")
+	errClientNotConnected = errors.New("client not connected")
+)
+
+// disconnectReasonCodes maps the errors of handling packets to the reason code of the DISCONNECT
+var disconnectReasonCodes = map[error]byte{
+	errProtocolViolation: packets.ProtocolError,
+	errTopicAliasInvalid: packets.TopicAliasInvalid,
+	errNotAuthorized:     packets.NotAuthorized,
+	errQuotaExceeded:     packets.QuotaExceeded,
+
+	packets.ErrPacketTooLarge: packets.PacketTooLarge,
+}
+
+// DisconnectTimeout is the time in which the DISCONNECT to a client that is disconnected by the server must be sent
+// Clients that do not read their connection are disconnected without DISCONNECT after this time.
+var DisconnectTimeout = time.Second
+
+// disconnect closes the connection with err
+// Connected MQTT 5 clients get a DISCONNECT with the reason code first, unless that takes longer than
+// DisconnectTimeout.
+func (c *Client) disconnect(reasonCode byte, err error) {
+	if c.server.clientConnected(c) {
+		disconnect := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+		disconnect.ReasonCode = reasonCode
+		timeout := time.NewTimer(DisconnectTimeout)
+		c.sendBefore(disconnect, timeout.C)
+		timeout.Stop()
+	}
+	c.setError(err)
+}
+
+// Kick disconnects the client with the given client identifier
+// MQTT 5 clients get a DISCONNECT with the reason code, such as packets.AdministrativeAction.
+func (s *Server) Kick(clientID string, reasonCode byte) error {
+	clients := s.connectedClients(clientID)
+	if len(clients) == 0 {
+		return errClientNotConnected
+	}
+	for _, c := range clients {
+		s.log.Info("kick client", zap.String("id", clientID), zap.Uint8("reason", reasonCode))
+		c.disconnect(reasonCode, errKicked)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServerDisconnect(t *testing.T) {
+	Convey(`Given a Server listening on a TCP port`, t, func() {
+		s := NewServer()
+		lis, err := net.Listen("tcp", "localhost:0")
+		So(err, ShouldBeNil)
+		serveErr := make(chan error, 1)
+		go func() { serveErr <- s.Serve(lis) }()
+		go s.Route()
+
+		connect := func(clientID string, version byte) net.Conn {
+			conn, err := net.Dial("tcp", lis.Addr().String())
+			So(err, ShouldBeNil)
+			packet := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			packet.ProtocolName, packet.ProtocolVersion = "MQTT", version
+			packet.ClientIdentifier, packet.CleanSession = clientID, true
+			So(packet.Write(conn, version), ShouldBeNil)
+			connack, err := packets.ReadPacket(conn, version)
+			So(err, ShouldBeNil)
+			So(connack, ShouldHaveSameTypeAs, new(packets.ConnackPacket))
+			return conn
+		}
+
+		readDisconnect := func(conn net.Conn, version byte) (*packets.DisconnectPacket, error) {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			packet, err := packets.ReadPacket(conn, version)
+			if err != nil {
+				return nil, err
+			}
+			So(packet, ShouldHaveSameTypeAs, new(packets.DisconnectPacket))
+			_, err = packets.ReadPacket(conn, version)
+			So(err, ShouldEqual, io.EOF)
+			return packet.(*packets.DisconnectPacket), nil
+		}
+
+		Convey(`When kicking an MQTT 5 client`, func() {
+			conn := connect("foo", packets.Version5)
+			defer conn.Close()
+			err := s.Kick("foo", packets.AdministrativeAction)
+			Convey(`Then there should be no error`, func() { So(err, ShouldBeNil) })
+			Convey(`Then the client should get a DISCONNECT with the reason code`, func() {
+				disconnect, err := readDisconnect(conn, packets.Version5)
+				So(err, ShouldBeNil)
+				So(disconnect.ReasonCode, ShouldEqual, packets.AdministrativeAction)
+			})
+		})
+
+		Convey(`When kicking an MQTT 3.1.1 client`, func() {
+			conn := connect("foo", packets.Version311)
+			defer conn.Close()
+			So(s.Kick("foo", packets.AdministrativeAction), ShouldBeNil)
+			Convey(`Then the connection should be closed without DISCONNECT`, func() {
+				_, err := readDisconnect(conn, packets.Version311)
+				So(err, ShouldEqual, io.EOF)
+			})
+		})
+
+		Convey(`When kicking a client that is not connected`, func() {
+			err := s.Kick("foo", packets.AdministrativeAction)
+			Convey(`Then there should be an error`, func() { So(err, ShouldEqual, errClientNotConnected) })
+		})
+
+		Convey(`When another client takes over the session`, func() {
+			conn := connect("foo", packets.Version5)
+			defer conn.Close()
+			other := connect("foo", packets.Version5)
+			defer other.Close()
+			Convey(`Then the client should get a DISCONNECT with reason Session Taken Over`, func() {
+				disconnect, err := readDisconnect(conn, packets.Version5)
+				So(err, ShouldBeNil)
+				So(disconnect.ReasonCode, ShouldEqual, packets.SessionTakenOver)
+			})
+			Convey(`Then the other client should stay connected`, func() {
+				time.Sleep(10 * time.Millisecond)
+				So(s.connectedClients("foo"), ShouldHaveLength, 1)
+			})
+		})
+
+		Convey(`When shutting down the server`, func() {
+			conn := connect("foo", packets.Version5)
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			shutdownErr := make(chan error, 1)
+			go func() { shutdownErr <- s.Shutdown(ctx) }()
+			Convey(`Then the client should get a DISCONNECT with reason Server Shutting Down`, func() {
+				disconnect, err := readDisconnect(conn, packets.Version5)
+				So(err, ShouldBeNil)
+				So(disconnect.ReasonCode, ShouldEqual, packets.ServerShuttingDown)
+				conn.Close()
+				So(<-shutdownErr, ShouldBeNil)
+				So(<-serveErr, ShouldBeNil)
+			})
+		})
+
+		Convey(`When shutting down the server while a client does not read its connection`, func() {
+			defer func(timeout time.Duration) { DisconnectTimeout = timeout }(DisconnectTimeout)
+			DisconnectTimeout = 50 * time.Millisecond
+			conn := connect("foo", packets.Version5)
+			defer conn.Close()
+			stalled, serverConn := net.Pipe()
+			defer stalled.Close()
+			go s.ServeConn(serverConn, ListenerConfig{Name: "pipe"})
+			packet := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			packet.ProtocolName, packet.ProtocolVersion = "MQTT", packets.Version5
+			packet.ClientIdentifier, packet.CleanSession = "stalled", true
+			So(packet.Write(stalled, packets.Version5), ShouldBeNil)
+			_, err := packets.ReadPacket(stalled, packets.Version5)
+			So(err, ShouldBeNil)
+			So(packets.NewControlPacket(packets.Pingreq).Write(stalled, packets.Version5), ShouldBeNil) // the PINGRESP is never read
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			shutdownErr := make(chan error, 1)
+			go func() { shutdownErr <- s.Shutdown(ctx) }()
+			Convey(`Then the other client should still get a DISCONNECT`, func() {
+				disconnect, err := readDisconnect(conn, packets.Version5)
+				So(err, ShouldBeNil)
+				So(disconnect.ReasonCode, ShouldEqual, packets.ServerShuttingDown)
+				conn.Close()
+				Convey(`Then the shutdown should finish before its deadline`, func() {
+					So(<-shutdownErr, ShouldBeNil)
+				})
+			})
+		})
+
+		Convey(`When closing the listener`, func() {
+			conn := connect("foo", packets.Version5)
+			defer conn.Close()
+			So(s.CloseListener(lis), ShouldBeNil)
+			Convey(`Then the listener should stop without error`, func() {
+				So(<-serveErr, ShouldBeNil)
+			})
+			Convey(`Then the client should stay connected`, func() {
+				time.Sleep(10 * time.Millisecond)
+				So(s.connectedClients("foo"), ShouldHaveLength, 1)
+			})
+		})
+
+		Reset(func() {
+			lis.Close()
+		})
+	})
+}
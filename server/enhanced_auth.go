@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
+	"go.uber.org/zap"
+)
+
+var errNotAuthorized = errors.New("not authorized")
+
+// SetAuth sets the authentication plugin that checks the username and password of CONNECT packets
+func (s *Server) SetAuth(plugin auth.Plugin) {
+	s.auth = plugin
+}
+
+// authenticate checks the username and password of a CONNECT packet with the auth plugin of the listener or the server
+func (c *Client) authenticate(packet *packets.ConnectPacket) (auth.Interface, error) {
+	if c.listener.Auth != nil {
+		conn := auth.Connection{Listener: c.listener.Name, RemoteAddr: c.remoteAddr, Peer: c.peer}
+		return c.listener.Auth(conn, packet.ClientIdentifier, packet.Username, packet.Password)
+	}
+	return c.server.auth(packet.ClientIdentifier, packet.Username, packet.Password)
+}
+
+// AddAuthMethod adds an enhanced authentication method that MQTT 5 clients can use
+// Clients that connect with an authentication method re-authenticate with the same method.
+func (s *Server) AddAuthMethod(method auth.Method) {
+	s.authMethods[method.Name()] = method
+}
+
+// allowedAuthMethod returns the enhanced authentication method of the listener with the name, or nil if it is not allowed
+func (c *Client) allowedAuthMethod(name string) auth.Method {
+	if c.listener.Auth == nil && c.listener.AuthMethods == nil {
+		return c.server.authMethods[name]
+	}
+	for _, method := range c.listener.AuthMethods {
+		if method.Name() == name {
+			return method
+		}
+	}
+	return nil
+}
+
+// startAuth starts the authentication exchange of a CONNECT with an authentication method
+// The CONNACK is sent when the exchange is done.
+func (c *Client) startAuth(packet *packets.ConnectPacket, connack *packets.ConnackPacket) error {
+	method := c.allowedAuthMethod(packet.Properties.AuthenticationMethod)
+	c.authMethod = method.Name()
+	c.authExchange = method.Start(packet.ClientIdentifier, packet.Username)
+	c.connect, c.connack = packet, connack
+	return c.continueAuth(packet.Properties.AuthenticationData)
+}
+
+func (c *Client) handleAuth(packet *packets.AuthPacket) error {
+	if c.authMethod == "" || packet.Properties.AuthenticationMethod != c.authMethod {
+		return errProtocolViolation
+	}
+	switch packet.ReasonCode {
+	case packets.ContinueAuthentication:
+		if c.authExchange == nil {
+			return errProtocolViolation
+		}
+	case packets.ReAuthenticate:
+		if c.session == nil || c.authExchange != nil {
+			return errProtocolViolation
+		}
+		c.authExchange = c.allowedAuthMethod(c.authMethod).Start(c.session.Name(), c.username)
+	default:
+		return errProtocolViolation
+	}
+	return c.continueAuth(packet.Properties.AuthenticationData)
+}
+
+// continueAuth continues the authentication exchange with the authentication data of the client
+func (c *Client) continueAuth(data []byte) error {
+	response, result, err := c.authExchange.Respond(data)
+	if err == nil && result != nil && !result.CanConnect() {
+		err = errNotAuthorized
+	}
+	if err != nil {
+		c.log.Info(
+			"reject authentication",
+			zap.String("addr", c.remoteAddr),
+			zap.String("method", c.authMethod),
+			zap.Error(err),
+		)
+		return c.rejectAuth()
+	}
+	if result == nil {
+		challenge := packets.NewControlPacket(packets.Auth).(*packets.AuthPacket)
+		challenge.ReasonCode = packets.ContinueAuthentication
+		challenge.Properties.AuthenticationMethod = c.authMethod
+		challenge.Properties.AuthenticationData = response
+		return c.send(challenge)
+	}
+	c.authExchange = nil
+	if c.session == nil {
+		connect, connack := c.connect, c.connack
+		c.connect, c.connack = nil, nil
+		connack.Properties.AuthenticationMethod = c.authMethod
+		connack.Properties.AuthenticationData = response
+		return c.accept(connect, result, connack)
+	}
+	c.log.Info(
+		"accept re-authentication",
+		zap.String("addr", c.remoteAddr),
+		zap.String("id", c.session.Name()),
+		zap.String("username", result.Username()),
+	)
+	c.username = result.Username()
+	c.session.SetAuth(result)
+	success := packets.NewControlPacket(packets.Auth).(*packets.AuthPacket)
+	success.ReasonCode = packets.Success
+	success.Properties.AuthenticationMethod = c.authMethod
+	success.Properties.AuthenticationData = response
+	return c.send(success)
+}
+
+// rejectAuth rejects the client after a failed authentication exchange
+// A connecting client gets a CONNACK, a connected client gets a DISCONNECT from the receive routine.
+func (c *Client) rejectAuth() error {
+	c.authExchange = nil
+	if c.session == nil {
+		connack := c.connack
+		c.connect, c.connack = nil, nil
+		connack.ReturnCode = packets.NotAuthorized
+		c.send(connack)
+	}
+	return errNotAuthorized
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/htdvisser/squatt/auth"
+)
+
+// testAuthMethod accepts clients that respond to the challenge
+type testAuthMethod struct{}
+
+func (testAuthMethod) Name() string { return "test" }
+
+func (testAuthMethod) Start(clientIdentifier string, username string) auth.Exchange {
+	return &testAuthExchange{clientIdentifier: clientIdentifier, username: username}
+}
+
+type testAuthExchange struct {
+	clientIdentifier string
+	username         string
+	challenged       bool
+}
+
+func (e *testAuthExchange) Respond(data []byte) ([]byte, auth.Interface, error) {
+	if !e.challenged && string(data) == "hello" {
+		e.challenged = true
+		return []byte("challenge"), nil, nil
+	}
+	if e.challenged && string(data) == "response" {
+		result, err := auth.NoAuth(e.clientIdentifier, e.username, nil)
+		return []byte("ok"), result, err
+	}
+	return nil, nil, auth.ErrNotAuthorized
+}
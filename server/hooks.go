@@ -0,0 +1,48 @@
+package server
+
+import (
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+)
+
+// Hooks are called by the server for events that other nodes of a cluster need to know about
+// Hooks are called synchronously, some while the server holds a lock, so they must not block or call the server.
+type Hooks struct {
+	// Publish is called for messages that are published by clients of the server
+	Publish func(msg *packets.PublishPacket)
+	// Subscribe is called when a topic filter gets its first subscription
+	Subscribe func(filter string)
+	// Unsubscribe is called when a topic filter loses its last subscription
+	Unsubscribe func(filter string)
+	// Connect is called when a client connected, cleanStart is false if the client wants to resume its session
+	Connect func(clientID string, cleanStart bool)
+}
+
+// SetHooks sets the hooks of the server, this must be done before the server is started
+func (s *Server) SetHooks(hooks Hooks) {
+	s.hooks = hooks
+}
+
+// DeliverLocal delivers a message that was published on another node to the subscriptions of this server
+// Retained messages are stored. The Publish hook is not called.
+func (s *Server) DeliverLocal(msg *packets.PublishPacket) {
+	s.route(msg)
+}
+
+// RetainLocal stores a retained message that was changed on another node at the given time, without delivering it
+// A nil message deletes the retained message of the topic. The change is ignored if the retained message of the
+// topic changed later on this server, it returns true if the change was applied.
+func (s *Server) RetainLocal(topicName string, msg *packets.PublishPacket, changed time.Time) bool {
+	if msg != nil {
+		s.setMessageExpiry(msg, time.Now())
+	}
+	topic := s.topics.Get(topicName)
+	s.retainedMessagesMu.Lock()
+	defer s.retainedMessagesMu.Unlock()
+	if last, ok := s.retainedChanged[topic]; ok && !changed.After(last) {
+		return false
+	}
+	s.setRetainedMessage(topic, msg, changed)
+	return true
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+)
+
+// InjectedProperties are the keys of the user properties that the server adds to PUBLISH packets of clients
+// Empty keys are not injected. User properties of the client with the same keys are removed, so that subscribers can trust them.
+type InjectedProperties struct {
+	ClientID  string // client identifier of the publisher
+	Username  string // username of the publisher
+	Timestamp string // time at which the server received the message, in RFC 3339 format
+	Listener  string // listener that the publisher is connected to
+}
+
+// SetInjectedProperties sets the user properties that the server adds to PUBLISH packets of clients
+func (s *Server) SetInjectedProperties(properties InjectedProperties) {
+	s.injectedProperties = properties
+}
+
+// injectProperties adds the injected user properties to a PUBLISH packet that was received at the given time
+func (c *Client) injectProperties(msg *packets.PublishPacket, now time.Time) {
+	inject := c.server.injectedProperties
+	if inject == (InjectedProperties{}) {
+		return
+	}
+	userProperties := make([]packets.UserProperty, 0, len(msg.Properties.UserProperties)+4)
+	for _, property := range msg.Properties.UserProperties {
+		switch property.Key {
+		case inject.ClientID, inject.Username, inject.Timestamp, inject.Listener:
+			continue
+		}
+		userProperties = append(userProperties, property)
+	}
+	for _, property := range []packets.UserProperty{
+		{Key: inject.ClientID, Value: c.session.Name()},
+		{Key: inject.Username, Value: c.username},
+		{Key: inject.Timestamp, Value: now.UTC().Format(time.RFC3339Nano)},
+		{Key: inject.Listener, Value: c.listener.Name},
+	} {
+		if property.Key != "" {
+			userProperties = append(userProperties, property)
+		}
+	}
+	msg.Properties.UserProperties = userProperties
+}
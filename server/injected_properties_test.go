@@ -0,0 +1,44 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/session"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInjectedProperties(t *testing.T) {
+	Convey(`Given a connected Client`, t, func() {
+		s := NewServer()
+		c := s.NewClient()
+		c.session = session.NewSession("foo")
+		c.username, c.listener.Name = "user", "tcp"
+
+		msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		msg.Properties.UserProperties = []packets.UserProperty{{Key: "client-id", Value: "spoofed"}, {Key: "foo", Value: "bar"}}
+		now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		Convey(`When the server does not inject properties`, func() {
+			c.injectProperties(msg, now)
+			Convey(`Then the user properties should not change`, func() {
+				So(msg.Properties.UserProperties, ShouldResemble, []packets.UserProperty{{Key: "client-id", Value: "spoofed"}, {Key: "foo", Value: "bar"}})
+			})
+		})
+
+		Convey(`When the server injects properties`, func() {
+			s.SetInjectedProperties(InjectedProperties{ClientID: "client-id", Username: "username", Timestamp: "timestamp", Listener: "listener"})
+			c.injectProperties(msg, now)
+			Convey(`Then the user properties of the client should be replaced by those of the server`, func() {
+				So(msg.Properties.UserProperties, ShouldResemble, []packets.UserProperty{
+					{Key: "foo", Value: "bar"},
+					{Key: "client-id", Value: "foo"},
+					{Key: "username", Value: "user"},
+					{Key: "timestamp", Value: "2018-01-02T03:04:05Z"},
+					{Key: "listener", Value: "tcp"},
+				})
+			})
+		})
+	})
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/session"
+)
+
+// ClientInfo describes a connected client
+type ClientInfo struct {
+	ClientID    string
+	RemoteAddr  string
+	Listener    string
+	Username    string
+	Version     byte
+	KeepAlive   time.Duration
+	ConnectedAt time.Time
+	InFlight    int
+	Queued      int
+}
+
+// SessionInfo describes a session
+type SessionInfo struct {
+	ClientID string
+	session.Stats
+	Subscriptions []SubscriptionState
+}
+
+// SubscriptionInfo describes a subscription of a session
+type SubscriptionInfo struct {
+	ClientID string
+	SubscriptionState
+}
+
+// connectedClientInfo returns the info of connected clients, sorted by client identifier
+func (s *Server) connectedClientInfo(clientID string) (infos []ClientInfo) {
+	s.clientsMu.RLock()
+	for c := range s.clients {
+		if c.clientID == "" || (clientID != "" && c.clientID != clientID) {
+			continue
+		}
+		infos = append(infos, ClientInfo{
+			ClientID:    c.clientID,
+			RemoteAddr:  c.remoteAddr,
+			Listener:    c.listener.Name,
+			Username:    c.username,
+			Version:     c.version,
+			KeepAlive:   time.Duration(c.keepAliveInterval) * time.Second,
+			ConnectedAt: c.connectedAt,
+		})
+	}
+	s.clientsMu.RUnlock()
+	for i, info := range infos {
+		if session, ok := s.sessions.Get(info.ClientID); ok {
+			stats := session.Stats()
+			infos[i].InFlight, infos[i].Queued = stats.InFlight, stats.Queued
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ClientID < infos[j].ClientID })
+	return infos
+}
+
+// Clients returns the connected clients, sorted by client identifier
+func (s *Server) Clients() []ClientInfo {
+	return s.connectedClientInfo("")
+}
+
+// Client returns the connected client with the given client identifier
+func (s *Server) Client(clientID string) (ClientInfo, bool) {
+	if clientID == "" {
+		return ClientInfo{}, false
+	}
+	infos := s.connectedClientInfo(clientID)
+	if len(infos) == 0 {
+		return ClientInfo{}, false
+	}
+	return infos[len(infos)-1], true
+}
+
+func (s *Server) sessionInfo(session *session.Session) SessionInfo {
+	info := SessionInfo{ClientID: session.Name(), Stats: session.Stats()}
+	for _, sub := range s.SessionSubscriptions(session) {
+		info.Subscriptions = append(info.Subscriptions, subscriptionState(sub))
+	}
+	return info
+}
+
+// Sessions returns the sessions, sorted by client identifier
+func (s *Server) Sessions() (infos []SessionInfo) {
+	for _, session := range s.sessions.All() {
+		infos = append(infos, s.sessionInfo(session))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ClientID < infos[j].ClientID })
+	return
+}
+
+// Session returns the session of the client with the given client identifier
+func (s *Server) Session(clientID string) (SessionInfo, bool) {
+	session, ok := s.sessions.Get(clientID)
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return s.sessionInfo(session), true
+}
+
+// DeleteSession disconnects the client with the given client identifier and deletes its session
+// MQTT 5 clients get a DISCONNECT with reason Administrative Action.
+func (s *Server) DeleteSession(clientID string) bool {
+	session, ok := s.sessions.Get(clientID)
+	if !ok {
+		return false
+	}
+	session.DisconnectWithReason(packets.AdministrativeAction)
+	s.sessions.Delete(clientID)
+	return true
+}
+
+// Subscriptions returns the subscriptions to the topic filter, or all subscriptions if the filter is empty
+// Subscriptions are sorted by topic filter and client identifier.
+func (s *Server) Subscriptions(filter string) (infos []SubscriptionInfo) {
+	s.subscriptionsMu.RLock()
+	for topic, subs := range s.topicSubscriptions {
+		if filter != "" && topic.Name() != filter {
+			continue
+		}
+		for _, sub := range subs {
+			infos = append(infos, SubscriptionInfo{ClientID: sub.session.Name(), SubscriptionState: subscriptionState(sub)})
+		}
+	}
+	s.subscriptionsMu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Filter != infos[j].Filter {
+			return infos[i].Filter < infos[j].Filter
+		}
+		return infos[i].ClientID < infos[j].ClientID
+	})
+	return
+}
+
+// DeleteRetainedMessage deletes the retained message of the topic
+func (s *Server) DeleteRetainedMessage(topicName string) bool {
+	topic := s.topics.Get(topicName)
+	s.retainedMessagesMu.Lock()
+	defer s.retainedMessagesMu.Unlock()
+	_, ok := s.retainedMessages[topic]
+	if ok {
+		s.setRetainedMessage(topic, nil, time.Now())
+	}
+	return ok
+}
+
+// Stats of the server
+type Stats struct {
+	Connections         int64 // open connections, including connections of clients that did not send CONNECT yet
+	Clients             int   // connected clients
+	Sessions            int
+	Subscriptions       int
+	RetainedMessages    int
+	ListenerConnections map[string]int64 // open connections by listener
+	RejectedConnections map[string]int64
+	ExceededQuotas      map[string]int64
+}
+
+// Stats returns the stats of the server
+func (s *Server) Stats() Stats {
+	stats := Stats{
+		Connections:         atomic.LoadInt64(&s.stats.sockets),
+		Sessions:            len(s.sessions.All()),
+		ListenerConnections: s.ListenerConnections(),
+		RejectedConnections: s.RejectedConnections(),
+		ExceededQuotas:      s.ExceededQuotas(),
+	}
+	s.clientsMu.RLock()
+	for c := range s.clients {
+		if c.clientID != "" {
+			stats.Clients++
+		}
+	}
+	s.clientsMu.RUnlock()
+	s.subscriptionsMu.RLock()
+	for _, subs := range s.topicSubscriptions {
+		stats.Subscriptions += len(subs)
+	}
+	s.subscriptionsMu.RUnlock()
+	s.retainedMessagesMu.RLock()
+	stats.RetainedMessages = len(s.retainedMessages)
+	s.retainedMessagesMu.RUnlock()
+	return stats
+}
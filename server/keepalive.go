@@ -3,17 +3,85 @@ package server
 import (
 	"errors"
 	"time"
+
+	"github.com/htdvisser/squatt/packets"
 )
 
 var errKeepAliveTimeout = errors.New("keep-alive timeout")
 
+// maxKeepAlive is the maximum keep-alive in the CONNECT and CONNACK packets
+const maxKeepAlive = 0xFFFF
+
+// KeepAlivePolicy limits the keep-alive of clients
+// The server tells MQTT 5 clients about a different keep-alive with the Server Keep Alive in the CONNACK.
+// MQTT 3.1.1 clients can not be told, so their keep-alive is only raised to Min.
+type KeepAlivePolicy struct {
+	// Min is the minimum keep-alive, shorter keep-alives are raised to Min
+	Min time.Duration
+	// Max is the maximum keep-alive, longer keep-alives and clients without keep-alive get Max
+	Max time.Duration
+	// Override is the keep-alive of all clients, if non-zero
+	Override time.Duration
+}
+
+// SetKeepAlivePolicy sets the keep-alive policy for clients
+func (s *Server) SetKeepAlivePolicy(policy KeepAlivePolicy) {
+	s.keepAlivePolicy = policy
+}
+
+// keepAliveSeconds rounds up to whole seconds
+func keepAliveSeconds(d time.Duration) uint16 {
+	seconds := (d + time.Second - 1) / time.Second
+	if seconds > maxKeepAlive {
+		return maxKeepAlive
+	}
+	return uint16(seconds)
+}
+
+// keepAlive returns the keep-alive in seconds for a client that requested the given keep-alive
+func (p KeepAlivePolicy) keepAlive(requested uint16, version byte) uint16 {
+	if version < packets.Version5 {
+		if min := keepAliveSeconds(p.Min); requested != 0 && requested < min {
+			return min
+		}
+		return requested
+	}
+	if p.Override != 0 {
+		return keepAliveSeconds(p.Override)
+	}
+	keepAlive := requested
+	if max := keepAliveSeconds(p.Max); max != 0 && (keepAlive == 0 || keepAlive > max) {
+		keepAlive = max
+	}
+	if min := keepAliveSeconds(p.Min); keepAlive != 0 && keepAlive < min {
+		keepAlive = min
+	}
+	return keepAlive
+}
+
+// setKeepAlive applies the keep-alive policy to the client and starts the watchdog
+// The client is disconnected if it sends nothing for one and a half times the keep-alive.
+func (c *Client) setKeepAlive(connect *packets.ConnectPacket, connack *packets.ConnackPacket) {
+	keepAlive := c.server.keepAlivePolicy.keepAlive(connect.Keepalive, c.version)
+	c.keepAliveInterval = keepAlive
+	if keepAlive != connect.Keepalive && c.version >= packets.Version5 {
+		connack.Properties.ServerKeepAlive = packets.Uint16(keepAlive)
+	}
+	if keepAlive == 0 {
+		return
+	}
+	c.keepAlive = newWatchdog(c.server.clock, time.Duration(keepAlive)*time.Second*3/2, func() {
+		c.disconnect(packets.KeepAliveTimeout, errKeepAliveTimeout)
+	})
+}
+
 type watchdog struct {
 	expire time.Duration
-	*time.Timer
+	timer
 }
 
-func newWatchdog(expire time.Duration, callback func()) *watchdog {
-	return &watchdog{expire: expire, Timer: time.AfterFunc(expire, callback)}
+func newWatchdog(clock clock, expire time.Duration, callback func()) *watchdog {
+	return &watchdog{expire: expire, timer: clock.AfterFunc(expire, callback)}
 }
 
 func (w *watchdog) Kick() {
@@ -29,5 +97,5 @@ func (w *watchdog) Stop() bool {
 	if w == nil {
 		return false
 	}
-	return w.Timer.Stop()
+	return w.timer.Stop()
 }
@@ -1,50 +1,199 @@
 package server
 
 import (
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/htdvisser/squatt/packets"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
-var (
-	testTimer = 50 * time.Millisecond
-	testDelta = 10 * time.Millisecond
-)
+// mockClock is a clock that only advances when Advance is called
+type mockClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*mockTimer
+}
+
+func newMockClock() *mockClock {
+	return &mockClock{now: time.Now()}
+}
+
+type mockTimer struct {
+	clock  *mockClock
+	expire time.Time
+	active bool
+	f      func()
+}
+
+func (c *mockClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *mockClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &mockTimer{clock: c, expire: c.now.Add(d), active: true, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance the clock and call the funcs of the timers that expire
+func (c *mockClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var expired []func()
+	for _, t := range c.timers {
+		if t.active && !t.expire.After(c.now) {
+			t.active = false
+			expired = append(expired, t.f)
+		}
+	}
+	c.mu.Unlock()
+	for _, f := range expired {
+		f()
+	}
+}
+
+func (t *mockTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *mockTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.active, t.expire = true, t.clock.now.Add(d)
+	return active
+}
 
 func TestKeepAlive(t *testing.T) {
-	Convey(`Given a watchdog`, t, func() {
+	Convey(`Given a watchdog of 50ms`, t, func() {
+		clock := newMockClock()
 		var called bool
-		w := newWatchdog(testTimer, func() { called = true })
-		Reset(func() {
-			w.Kick()
-			called = false
-		})
-		Convey(`When waiting for less than the timer`, func() {
-			time.Sleep(testTimer - testDelta)
+		w := newWatchdog(clock, 50*time.Millisecond, func() { called = true })
+		Convey(`When less time passes`, func() {
+			clock.Advance(40 * time.Millisecond)
 			Convey(`Then the timer should not have expired`, func() { So(called, ShouldBeFalse) })
 			Convey(`When kicking the timer`, func() {
 				w.Kick()
-				Convey(`When waiting for more than the timer`, func() {
-					time.Sleep(testTimer + testDelta)
+				Convey(`When more time passes`, func() {
+					clock.Advance(60 * time.Millisecond)
 					Convey(`Then the timer should have expired`, func() { So(called, ShouldBeTrue) })
 				})
-				Convey(`When waiting for less than the timer`, func() {
-					time.Sleep(testTimer - testDelta)
+				Convey(`When less time passes`, func() {
+					clock.Advance(40 * time.Millisecond)
 					Convey(`Then the timer should not have expired`, func() { So(called, ShouldBeFalse) })
 				})
 			})
 			Convey(`When stopping the timer`, func() {
 				w.Stop()
-				Convey(`When waiting for more than the timer`, func() {
-					time.Sleep(testTimer + testDelta)
+				Convey(`When more time passes`, func() {
+					clock.Advance(60 * time.Millisecond)
 					Convey(`Then the timer should not have expired`, func() { So(called, ShouldBeFalse) })
 				})
 			})
 		})
-		Convey(`When waiting for more than the timer`, func() {
-			time.Sleep(testTimer + testDelta)
+		Convey(`When more time passes`, func() {
+			clock.Advance(60 * time.Millisecond)
 			Convey(`Then the timer should have expired`, func() { So(called, ShouldBeTrue) })
 		})
 	})
+
+	Convey(`Given a keep-alive policy`, t, func() {
+		policy := KeepAlivePolicy{Min: 10 * time.Second, Max: time.Minute}
+		Convey(`Then keep-alives within the limits should not be changed`, func() {
+			So(policy.keepAlive(30, packets.Version5), ShouldEqual, 30)
+		})
+		Convey(`Then keep-alives of MQTT 5 clients should be limited`, func() {
+			So(policy.keepAlive(5, packets.Version5), ShouldEqual, 10)
+			So(policy.keepAlive(120, packets.Version5), ShouldEqual, 60)
+			So(policy.keepAlive(0, packets.Version5), ShouldEqual, 60)
+		})
+		Convey(`Then keep-alives of MQTT 3.1.1 clients should only be raised`, func() {
+			So(policy.keepAlive(5, packets.Version311), ShouldEqual, 10)
+			So(policy.keepAlive(120, packets.Version311), ShouldEqual, 120)
+			So(policy.keepAlive(0, packets.Version311), ShouldEqual, 0)
+		})
+		Convey(`Then the override should be used for MQTT 5 clients`, func() {
+			policy.Override = 20 * time.Second
+			So(policy.keepAlive(30, packets.Version5), ShouldEqual, 20)
+			So(policy.keepAlive(0, packets.Version5), ShouldEqual, 20)
+			So(policy.keepAlive(30, packets.Version311), ShouldEqual, 30)
+		})
+	})
+
+	Convey(`Given a Server with a keep-alive policy and a mock clock`, t, func() {
+		s := NewServer()
+		clock := newMockClock()
+		s.clock = clock
+		s.SetKeepAlivePolicy(KeepAlivePolicy{Max: 10 * time.Second})
+		s.SetConnectionLimits(ConnectionLimits{ConnectTimeout: 5 * time.Second})
+		go s.Route()
+
+		connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		connect.ProtocolName, connect.ProtocolVersion = "MQTT", packets.Version5
+		connect.ClientIdentifier, connect.CleanSession = "foo", true
+		connect.Keepalive = 60
+
+		pingreq := packets.NewControlPacket(packets.Pingreq)
+
+		c := newMockClient(packets.Version5)
+		resCh := make(chan error, 1)
+		go func() { resCh <- s.NewClient().handle(c) }()
+
+		// advance waits for the client to handle the packets that were sent before advancing the clock
+		advance := func(d time.Duration) {
+			time.Sleep(10 * time.Millisecond)
+			clock.Advance(d)
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		Convey(`When the client connects`, func() {
+			c.Send(connect)
+			advance(0)
+			Convey(`Then the Server Keep Alive should be in the CONNACK`, func() {
+				responses := c.Responses()
+				So(responses, ShouldHaveLength, 1)
+				So(*responses[0].(*packets.ConnackPacket).Properties.ServerKeepAlive, ShouldEqual, 10)
+			})
+			Convey(`When the client sends packets within the keep-alive`, func() {
+				for i := 0; i < 3; i++ {
+					advance(14 * time.Second)
+					c.Send(pingreq)
+				}
+				advance(14 * time.Second)
+				Convey(`Then the client should stay connected`, func() {
+					So(resCh, ShouldBeEmpty)
+				})
+			})
+			Convey(`When the client sends nothing for 1.5 times the keep-alive`, func() {
+				advance(15 * time.Second)
+				Convey(`Then the client should be disconnected`, func() {
+					So(<-resCh, ShouldEqual, errKeepAliveTimeout)
+					responses := c.Responses()
+					So(responses[len(responses)-1].(*packets.DisconnectPacket).ReasonCode, ShouldEqual, packets.KeepAliveTimeout)
+				})
+			})
+		})
+
+		Convey(`When the client does not send a CONNECT in time`, func() {
+			advance(5 * time.Second)
+			Convey(`Then the connection should be closed`, func() {
+				So(<-resCh, ShouldEqual, errConnectTimeout)
+				So(s.RejectedConnections()[RejectConnectTimeout], ShouldEqual, 1)
+			})
+		})
+
+		Reset(func() {
+			c.Close()
+		})
+	})
 }
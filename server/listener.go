@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
+)
+
+// RejectMaxListenerConnections is the reason for rejecting connections to a listener that has its maximum number of connections
+const RejectMaxListenerConnections = "max-listener-connections"
+
+var errInvalidMountpoint = errors.New("mountpoint can not contain wildcards")
+
+// ListenerConfig configures how the server handles the clients of a listener
+type ListenerConfig struct {
+	// Name of the listener
+	Name string
+
+	// SubscriptionOptions are the options for subscriptions of MQTT 3.1.1 clients, which can not set them
+	SubscriptionOptions packets.SubscriptionOptions
+
+	// MaxPacketSize is the maximum size of packets that clients can send, MaxPacketSize is used if zero
+	MaxPacketSize int
+
+	// MaxConnections is the maximum number of connections to the listener, zero means no limit
+	MaxConnections int
+
+	// Auth authenticates the clients of the listener instead of the auth plugin of the server, if not nil
+	Auth auth.ConnectionPlugin
+
+	// AuthMethods are the enhanced authentication methods that clients of the listener can use
+	// The methods of the server are used if AuthMethods and Auth are nil, so that a listener with its own Auth
+	// can only be used with the methods that it allows.
+	AuthMethods []auth.Method
+
+	// Mountpoint is the prefix of the topics of the clients of the listener
+	// Clients publish and subscribe below the mountpoint, and do not see it in the messages they receive.
+	Mountpoint string
+}
+
+// InProcessListener returns the config of a listener for clients in the same process, such as bridges
+// In-process clients are trusted, so they are not authenticated by the auth plugin of the server.
+func InProcessListener(name string) ListenerConfig {
+	return ListenerConfig{Name: name, Auth: auth.Plugin(auth.NoAuth).WithConnection()}
+}
+
+func (config ListenerConfig) validate() error {
+	if strings.ContainsAny(config.Mountpoint, "+#") {
+		return errInvalidMountpoint
+	}
+	return nil
+}
+
+// ListenerConnections returns the number of connections of each listener
+func (s *Server) ListenerConnections() map[string]int64 {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	connections := make(map[string]int64, len(s.listenerConnections))
+	for name, count := range s.listenerConnections {
+		connections[name] = int64(count)
+	}
+	return connections
+}
+
+// addListenerConnection counts a connection of the listener, unless the listener has max connections
+func (s *Server) addListenerConnection(name string, max int) bool {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if max > 0 && s.listenerConnections[name] >= max {
+		return false
+	}
+	s.listenerConnections[name]++
+	return true
+}
+
+func (s *Server) removeListenerConnection(name string) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if s.listenerConnections[name]--; s.listenerConnections[name] <= 0 {
+		delete(s.listenerConnections, name)
+	}
+}
+
+// mount returns the topic on the server for a topic of the client
+func (c *Client) mount(topicName string) string {
+	if topicName == "" {
+		return ""
+	}
+	return c.listener.Mountpoint + topicName
+}
+
+// unmount returns the topic for the client for a topic on the server
+func (c *Client) unmount(topicName string) string {
+	return strings.TrimPrefix(topicName, c.listener.Mountpoint)
+}
+
+// unmountPublish returns a copy of the PUBLISH packet with the topics for the client, if the listener has a mountpoint
+func (c *Client) unmountPublish(packet *packets.PublishPacket) *packets.PublishPacket {
+	if c.listener.Mountpoint == "" {
+		return packet
+	}
+	unmounted := *packet
+	unmounted.TopicName = c.unmount(packet.TopicName)
+	if responseTopic := packet.Properties.ResponseTopic; responseTopic != "" {
+		unmounted.Properties = packet.Properties.Copy()
+		unmounted.Properties.ResponseTopic = c.unmount(responseTopic)
+	}
+	return &unmounted
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestListenerConfig(t *testing.T) {
+	Convey(`Given a Server`, t, func() {
+		s := NewServer()
+		published := make(chan string, 1)
+		s.SetHooks(Hooks{Publish: func(msg *packets.PublishPacket) { published <- msg.TopicName }})
+		go s.Route()
+
+		connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		connect.ProtocolName, connect.ProtocolVersion = "MQTT", packets.Version5
+		connect.ClientIdentifier, connect.CleanSession = "foo", true
+
+		run := func(config ListenerConfig, commands ...packets.ControlPacket) []packets.ControlPacket {
+			c := newMockClient(packets.Version5)
+			done := make(chan struct{})
+			go func() {
+				client := s.NewClient()
+				client.listener = config
+				client.handle(c)
+				close(done)
+			}()
+			for _, command := range commands {
+				c.Send(command)
+			}
+			time.Sleep(50 * time.Millisecond)
+			c.Close()
+			<-done
+			time.Sleep(10 * time.Millisecond)
+			return c.Responses()
+		}
+
+		Convey(`When a listener has an auth plugin`, func() {
+			var conns []auth.Connection
+			config := ListenerConfig{Name: "internal", Auth: func(conn auth.Connection, clientIdentifier string, username string, password []byte) (auth.Interface, error) {
+				conns = append(conns, conn)
+				return nil, auth.ErrNotAuthorized
+			}}
+			responses := run(config, connect)
+			Convey(`Then it should authenticate the clients of the listener`, func() {
+				So(conns, ShouldHaveLength, 1)
+				So(conns[0].Listener, ShouldEqual, "internal")
+				So(responses, ShouldHaveLength, 1)
+				So(responses[0].(*packets.ConnackPacket).ReturnCode, ShouldEqual, packets.NotAuthorized)
+			})
+		})
+
+		Convey(`When a client of a listener that only allows peer credentials connects with SCRAM-SHA-256`, func() {
+			passwords := auth.NewPasswordStore()
+			So(passwords.SetPassword("user", []byte("secret")), ShouldBeNil)
+			s.AddAuthMethod(auth.NewSCRAMSHA256(passwords, auth.NoAuth))
+			scram := *connect
+			scram.Properties.AuthenticationMethod = "SCRAM-SHA-256"
+			scram.Properties.AuthenticationData = []byte("n,,n=user,r=nonce")
+
+			responses := run(ListenerConfig{Name: "local", Auth: auth.PeerPlugin(nil, auth.NoAuth)}, &scram)
+			Convey(`Then the method should be rejected`, func() {
+				So(responses, ShouldHaveLength, 1)
+				So(responses[0].(*packets.ConnackPacket).ReturnCode, ShouldEqual, packets.BadAuthenticationMethod)
+			})
+
+			Convey(`When the listener allows SCRAM-SHA-256`, func() {
+				config := ListenerConfig{
+					Name:        "local",
+					Auth:        auth.PeerPlugin(nil, auth.NoAuth),
+					AuthMethods: []auth.Method{auth.NewSCRAMSHA256(passwords, auth.NoAuth)},
+				}
+				responses := run(config, &scram)
+				Convey(`Then the authentication exchange should start`, func() {
+					So(responses, ShouldHaveLength, 1)
+					So(responses[0].(*packets.AuthPacket).ReasonCode, ShouldEqual, packets.ContinueAuthentication)
+				})
+			})
+		})
+
+		Convey(`When a client of a listener with a mountpoint publishes and subscribes`, func() {
+			subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subscribe.MessageID, subscribe.Topics, subscribe.Qoss = 1, []string{"foo/#"}, []byte{0}
+			subscribe.Options = []packets.SubscriptionOptions{{}}
+			publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			publish.TopicName, publish.Payload = "foo/bar", []byte("baz")
+			publish.Properties.ResponseTopic = "foo/response"
+
+			responses := run(ListenerConfig{Name: "tenant", Mountpoint: "tenant/"}, connect, subscribe, publish)
+
+			Convey(`Then the topics should be below the mountpoint`, func() {
+				So(<-published, ShouldEqual, "tenant/foo/bar")
+			})
+			Convey(`Then the client should not see the mountpoint`, func() {
+				So(responses, ShouldHaveLength, 3)
+				received := responses[2].(*packets.PublishPacket)
+				So(received.TopicName, ShouldEqual, "foo/bar")
+				So(received.Properties.ResponseTopic, ShouldEqual, "foo/response")
+			})
+		})
+
+		Convey(`When serving a listener with a wildcard in its mountpoint`, func() {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			err := s.ServeConn(serverConn, ListenerConfig{Mountpoint: "tenant/+/"})
+			Convey(`Then it should return an error`, func() {
+				So(err, ShouldEqual, errInvalidMountpoint)
+			})
+		})
+	})
+
+	Convey(`Given a Server with a listener with a maximum number of connections`, t, func() {
+		s := NewServer()
+		lis, err := net.Listen("tcp", "localhost:0")
+		So(err, ShouldBeNil)
+		go s.ServeListener(lis, ListenerConfig{Name: "limited", MaxConnections: 1})
+
+		Convey(`When a client connects`, func() {
+			conn, err := net.Dial("tcp", lis.Addr().String())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			time.Sleep(10 * time.Millisecond)
+
+			Convey(`Then it should be counted for the listener`, func() {
+				So(s.ListenerConnections(), ShouldResemble, map[string]int64{"limited": 1})
+			})
+
+			Convey(`Then a second connection should be rejected`, func() {
+				other, err := net.Dial("tcp", lis.Addr().String())
+				So(err, ShouldBeNil)
+				defer other.Close()
+				other.SetReadDeadline(time.Now().Add(time.Second))
+				_, err = other.Read(make([]byte, 1))
+				So(err, ShouldNotBeNil)
+				So(s.RejectedConnections()[RejectMaxListenerConnections], ShouldEqual, 1)
+			})
+		})
+
+		Reset(func() {
+			lis.Close()
+		})
+	})
+}
+
+func TestPeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	Convey(`Given a Server on a Unix socket with a listener that authenticates by peer credentials`, t, func() {
+		s := NewServer()
+		go s.Route()
+		path := filepath.Join(os.TempDir(), "squatt-peer-test.sock")
+		os.Remove(path)
+		lis, err := net.Listen("unix", path)
+		So(err, ShouldBeNil)
+		peers := make(chan *auth.PeerCredentials, 1)
+		go s.ServeListener(lis, ListenerConfig{Name: "local", Auth: func(conn auth.Connection, clientIdentifier string, username string, password []byte) (auth.Interface, error) {
+			peers <- conn.Peer
+			return auth.NoAuth(clientIdentifier, username, password)
+		}})
+
+		Convey(`When a client connects`, func() {
+			conn, err := net.Dial("unix", path)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+			connect.ProtocolName, connect.ProtocolVersion = "MQTT", packets.Version311
+			connect.ClientIdentifier, connect.CleanSession = "foo", true
+			So(connect.Write(conn, packets.Version311), ShouldBeNil)
+
+			Convey(`Then auth should get the credentials of the process`, func() {
+				var peer *auth.PeerCredentials
+				select {
+				case peer = <-peers:
+				case <-time.After(time.Second):
+				}
+				So(peer, ShouldNotBeNil)
+				So(peer.UID, ShouldEqual, os.Getuid())
+				So(peer.GID, ShouldEqual, os.Getgid())
+				So(peer.PID, ShouldEqual, os.Getpid())
+			})
+		})
+
+		Reset(func() {
+			lis.Close()
+		})
+	})
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/topic"
+)
+
+type messageExpiry struct {
+	filter string
+	expiry time.Duration
+}
+
+// SetMessageExpiry sets the expiry of messages without Message Expiry Interval that are published to topics matching the filter
+// If a topic matches multiple filters, the expiry of the filter that was set first is used.
+// An expiry of zero means that matching messages do not expire.
+func (s *Server) SetMessageExpiry(filter string, expiry time.Duration) error {
+	if err := topic.Validate(filter, true); err != nil {
+		return err
+	}
+	s.messageExpiryMu.Lock()
+	defer s.messageExpiryMu.Unlock()
+	for i, e := range s.messageExpiry {
+		if e.filter == filter {
+			s.messageExpiry[i].expiry = expiry
+			return nil
+		}
+	}
+	s.messageExpiry = append(s.messageExpiry, messageExpiry{filter: filter, expiry: expiry})
+	return nil
+}
+
+// setMessageExpiry sets the time at which a message that is received at the given time expires
+func (s *Server) setMessageExpiry(msg *packets.PublishPacket, now time.Time) {
+	if !msg.Expires.IsZero() {
+		return
+	}
+	if interval := msg.Properties.MessageExpiryInterval; interval != nil {
+		msg.Expires = now.Add(time.Duration(*interval) * time.Second)
+		return
+	}
+	s.messageExpiryMu.RLock()
+	defer s.messageExpiryMu.RUnlock()
+	for _, e := range s.messageExpiry {
+		if topic.Match(e.filter, msg.TopicName) {
+			if e.expiry != 0 {
+				msg.Expires = now.Add(e.expiry)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMessageExpiry(t *testing.T) {
+	Convey(`Given a Server with message expiry for topic filters`, t, func() {
+		s := NewServer()
+		So(s.SetMessageExpiry("commands/#", time.Hour), ShouldBeNil)
+		So(s.SetMessageExpiry("#", time.Minute), ShouldBeNil)
+		So(s.SetMessageExpiry("foo/#bar", time.Minute), ShouldNotBeNil)
+
+		now := time.Now()
+		msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+
+		Convey(`When a message is published to a topic matching the first filter`, func() {
+			msg.TopicName = "commands/foo"
+			s.setMessageExpiry(msg, now)
+			Convey(`Then it should expire after the expiry of that filter`, func() { So(msg.Expires, ShouldEqual, now.Add(time.Hour)) })
+		})
+
+		Convey(`When a message is published to a topic matching the second filter`, func() {
+			msg.TopicName = "events/foo"
+			s.setMessageExpiry(msg, now)
+			Convey(`Then it should expire after the expiry of that filter`, func() { So(msg.Expires, ShouldEqual, now.Add(time.Minute)) })
+		})
+
+		Convey(`When a message with Message Expiry Interval is published`, func() {
+			msg.TopicName = "commands/foo"
+			msg.Properties.MessageExpiryInterval = packets.Uint32(10)
+			s.setMessageExpiry(msg, now)
+			Convey(`Then it should expire after that interval`, func() { So(msg.Expires, ShouldEqual, now.Add(10*time.Second)) })
+		})
+
+		Convey(`When changing the expiry of a filter to zero`, func() {
+			So(s.SetMessageExpiry("commands/#", 0), ShouldBeNil)
+			msg.TopicName = "commands/foo"
+			s.setMessageExpiry(msg, now)
+			Convey(`Then the message should not expire`, func() { So(msg.Expires.IsZero(), ShouldBeTrue) })
+		})
+	})
+}
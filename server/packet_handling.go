@@ -4,7 +4,8 @@ import (
 	"io"
 	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
 	"github.com/htdvisser/squatt/topic"
 	"github.com/segmentio/ksuid"
 	"go.uber.org/zap"
@@ -12,28 +13,72 @@ import (
 
 func (c *Client) handleConnect(packet *packets.ConnectPacket) (err error) {
 	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
-	defer func() { err = packets.ConnErrors[connack.ReturnCode] }()
+	defer func() {
+		if connack.ReturnCode != packets.Accepted {
+			err = packets.ConnErrors[connack.ReturnCode]
+		}
+	}()
 	if errCode := packet.Validate(); errCode != 0 {
+		if errCode != packets.ErrRefusedBadProtocolVersion {
+			c.version = packet.ProtocolVersion
+		}
 		connack.ReturnCode = errCode
 		c.send(connack)
 		return
 	}
+	c.version = packet.ProtocolVersion
+	if responseTopic := packet.WillProperties.ResponseTopic; responseTopic != "" && topic.Validate(responseTopic, false) != nil {
+		connack.ReturnCode = packets.ErrProtocolViolation
+		c.send(connack)
+		return
+	}
 	if packet.ClientIdentifier == "" {
 		packet.ClientIdentifier = ksuid.New().String()
+		if c.version >= packets.Version5 {
+			connack.Properties.AssignedClientIdentifier = packet.ClientIdentifier
+		}
 	}
-	auth, err := c.server.auth(packet.ClientIdentifier, packet.Username, packet.Password)
-	if err != nil || !auth.CanConnect() {
+	if method := packet.Properties.AuthenticationMethod; method != "" {
+		if c.allowedAuthMethod(method) == nil {
+			connack.ReturnCode = packets.BadAuthenticationMethod
+			c.send(connack)
+			return
+		}
+		return c.startAuth(packet, connack)
+	}
+	auth, err := c.authenticate(packet)
+	if err != nil {
 		connack.ReturnCode = packets.ErrRefusedNotAuthorised
 		c.send(connack)
 		return
 	}
+	return c.accept(packet, auth, connack)
+}
 
-	c.log.Info(
-		"accept connect",
+// accept the CONNECT of an authenticated client
+// The connect timeout is stopped here, so that it also limits the authentication exchange.
+func (c *Client) accept(packet *packets.ConnectPacket, auth auth.Interface, connack *packets.ConnackPacket) error {
+	c.stopConnectTimeout()
+	if !auth.CanConnect() {
+		connack.ReturnCode = packets.ErrRefusedNotAuthorised
+		c.send(connack)
+		return packets.ConnErrors[connack.ReturnCode]
+	}
+
+	c.username = auth.Username()
+	c.setQuotas(auth)
+
+	fields := []zap.Field{
 		zap.String("addr", c.remoteAddr),
 		zap.String("id", packet.ClientIdentifier),
-		zap.String("username", packet.Username),
-	)
+		zap.String("username", c.username),
+	}
+	if c.peer != nil {
+		fields = append(fields, zap.Uint32("uid", c.peer.UID), zap.Int32("pid", c.peer.PID))
+	}
+	c.log.Info("accept connect", fields...)
+
+	expiry, persistent := c.server.sessionExpiry(packet, auth)
 
 	if packet.CleanSession {
 		c.session = c.server.sessions.New(packet.ClientIdentifier)
@@ -43,10 +88,21 @@ func (c *Client) handleConnect(packet *packets.ConnectPacket) (err error) {
 			if session.Persistent() {
 				connack.SessionPresent = true
 			}
-			session.Disconnect()
+			session.DisconnectWithReason(packets.SessionTakenOver)
 		}
 		c.session = session
+	}
+
+	if persistent {
 		c.session.SetPersistent()
+	} else {
+		c.session.ClearPersistent()
+	}
+	c.session.SetExpiry(expiry)
+	if persistent && c.version >= packets.Version5 {
+		if interval := sessionExpiryInterval(expiry); interval != *packet.Properties.SessionExpiryInterval {
+			connack.Properties.SessionExpiryInterval = packets.Uint32(interval)
+		}
 	}
 
 	c.session.SetAuth(auth)
@@ -62,14 +118,42 @@ func (c *Client) handleConnect(packet *packets.ConnectPacket) (err error) {
 	})
 
 	if packet.WillFlag {
-		c.session.SetWill(packet.WillTopic, packet.WillMessage, packet.WillQos, packet.WillRetain)
+		will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		will.TopicName, will.Payload = c.mount(packet.WillTopic), packet.WillMessage
+		will.Qos, will.Retain = packet.WillQos, packet.WillRetain
+		will.Properties = packet.WillProperties.Copy()
+		will.Properties.WillDelayInterval = nil
+		will.Properties.ResponseTopic = c.mount(will.Properties.ResponseTopic)
+		c.injectProperties(will, time.Now())
+		willDelay := c.server.willDelay
+		if delay := packet.WillProperties.WillDelayInterval; delay != nil {
+			willDelay = time.Duration(*delay) * time.Second
+		}
+		c.session.SetWillMessage(will, willDelay)
+	}
+
+	c.setKeepAlive(packet, connack)
+
+	responseTopicPrefix := c.server.clientResponseTopicPrefix(packet, c.username)
+	if responseTopicPrefix != "" {
+		connack.Properties.ResponseInformation = responseTopicPrefix
 	}
+	c.session.SetResponseTopicPrefix(c.mount(responseTopicPrefix))
 
-	if packet.Keepalive != 0 {
-		c.keepAlive = newWatchdog(time.Duration(packet.Keepalive)*time.Millisecond*1500, func() {
-			c.setError(errKeepAliveTimeout)
-		})
+	var sessionTopicAliasMaximum uint16
+	if c.version >= packets.Version5 {
+		c.topicAliasMaximum = TopicAliasMaximum
+		c.topicAliases = make(map[uint16]string, c.topicAliasMaximum)
+		if c.topicAliasMaximum > 0 {
+			connack.Properties.TopicAliasMaximum = packets.Uint16(c.topicAliasMaximum)
+		}
+		if max := packet.Properties.TopicAliasMaximum; max != nil {
+			sessionTopicAliasMaximum = *max
+		}
 	}
+	c.session.SetTopicAliasMaximum(sessionTopicAliasMaximum)
+
+	c.setMaxPacketSize(packet, auth, connack)
 
 	c.session.DeliverTo(c.server.Publish())
 
@@ -88,16 +172,46 @@ func (c *Client) handleConnect(packet *packets.ConnectPacket) (err error) {
 		c.setError(io.EOF)
 	}()
 
+	c.errMu.Lock()
+	c.sessionCh = sendCh
+	c.errMu.Unlock()
 	c.session.Connect(sendCh)
 	c.session.ResendPending()
+	c.connectedAt = time.Now()
+	c.server.setClientID(c, c.session.Name())
+	if c.server.hooks.Connect != nil {
+		c.server.hooks.Connect(c.session.Name(), packet.CleanSession)
+	}
 
-	return
+	return nil
 }
 
 func (c *Client) handlePublish(packet *packets.PublishPacket) error {
+	if len(packet.Properties.SubscriptionIdentifiers) > 0 {
+		return errProtocolViolation // A PUBLISH packet sent from a Client to a Server MUST NOT contain a Subscription Identifier [MQTT-3.3.4-6]
+	}
+	if err := c.resolveTopicAlias(packet); err != nil {
+		return err
+	}
 	if err := topic.Validate(packet.TopicName, true); err != nil {
 		return err
 	}
+	if responseTopic := packet.Properties.ResponseTopic; responseTopic != "" {
+		if err := topic.Validate(responseTopic, false); err != nil {
+			return err
+		}
+	}
+	packet.TopicName = c.mount(packet.TopicName)
+	packet.Properties.ResponseTopic = c.mount(packet.Properties.ResponseTopic)
+	ok, err := c.checkPublishQuotas(packet)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		c.session.DropPublish(packet, packets.QuotaExceeded)
+		return nil
+	}
+	c.injectProperties(packet, time.Now())
 	c.session.ReceivePublish(packet)
 	return nil
 }
@@ -128,26 +242,62 @@ func (c *Client) handleSubscribe(packet *packets.SubscribePacket) error {
 	}
 	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
 	suback.MessageID = packet.MessageID
+	var identifier uint32
+	switch identifiers := packet.Properties.SubscriptionIdentifiers; len(identifiers) {
+	case 0:
+	case 1:
+		identifier = identifiers[0]
+	default:
+		return errProtocolViolation
+	}
 	suback.ReturnCodes = make([]byte, len(packet.Topics))
+	subscribed := make(map[string]bool)
+	for _, sub := range c.server.SessionSubscriptions(c.session) {
+		subscribed[sub.topic.Name()] = true
+	}
+	var sendRetained []*Subscription
 	for i, topicName := range packet.Topics {
 		if err := topic.Validate(topicName, true); err != nil {
 			return err
 		}
+		topicName = c.mount(topicName)
+		options := c.listener.SubscriptionOptions
+		if c.version >= packets.Version5 && i < len(packet.Options) {
+			options = packet.Options[i]
+		}
+		if !subscribed[topicName] {
+			ok, err := c.checkSubscriptionQuota(len(subscribed))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				suback.ReturnCodes[i] = packets.QuotaExceeded
+				continue
+			}
+		}
 		if c.session.CanSubscribeTo(topicName) {
-			c.server.Subscribe(c.session, c.server.topics.Get(topicName), packet.Qoss[i])
+			subscribed[topicName] = true
+			sub, existed := c.server.SubscribeWithOptions(c.session, c.server.topics.Get(topicName), packet.Qoss[i], options, identifier)
+			if options.RetainHandling == packets.SendRetainedOnSubscribe ||
+				options.RetainHandling == packets.SendRetainedOnNewSubscribe && !existed {
+				sendRetained = append(sendRetained, sub)
+			}
 			suback.ReturnCodes[i] = packet.Qoss[i]
 		} else {
-			suback.ReturnCodes[i] = 0x80
+			suback.ReturnCodes[i] = packets.NotAuthorized
 		}
 	}
 	c.send(suback)
+	for _, sub := range sendRetained {
+		c.server.DeliverRetainedMessages(sub)
+	}
 	return nil
 }
 
 func (c *Client) handleUnsubscribe(packet *packets.UnsubscribePacket) error {
 	topics := make([]*topic.Topic, len(packet.Topics))
 	for i, topic := range packet.Topics {
-		topics[i] = c.server.topics.Get(topic)
+		topics[i] = c.server.topics.Get(c.mount(topic))
 	}
 	c.server.Unsubscribe(c.session, topics...)
 	unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
@@ -162,7 +312,9 @@ func (c *Client) handlePingreq(packet *packets.PingreqPacket) error {
 }
 
 func (c *Client) handleDisconnect(packet *packets.DisconnectPacket) error {
-	c.session.ClearWill()
+	if packet.ReasonCode != packets.DisconnectWithWillMessage {
+		c.session.ClearWill()
+	}
 	c.session.Disconnect()
 	return nil
 }
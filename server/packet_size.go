@@ -0,0 +1,37 @@
+package server
+
+import (
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
+)
+
+// MaxPacketSize is the default maximum size of packets that clients can send
+var MaxPacketSize = 1 << 20
+
+// maxPacketSize returns the maximum size of packets that a client of the listener can send
+// The limit of the user overrides the limit of the listener. The auth can be nil before CONNECT.
+func maxPacketSize(listener ListenerConfig, a auth.Interface) int {
+	size := MaxPacketSize
+	if listener.MaxPacketSize != 0 {
+		size = listener.MaxPacketSize
+	}
+	if limiter, ok := a.(auth.PacketSizeLimiter); ok && limiter.MaxPacketSize() != 0 {
+		size = limiter.MaxPacketSize()
+	}
+	return size
+}
+
+// setMaxPacketSize sets the maximum packet sizes of the client and its session after CONNECT
+func (c *Client) setMaxPacketSize(connect *packets.ConnectPacket, a auth.Interface, connack *packets.ConnackPacket) {
+	c.maxPacketSize = maxPacketSize(c.listener, a)
+	var sessionMaxPacketSize uint32
+	if c.version >= packets.Version5 {
+		if c.maxPacketSize > 0 {
+			connack.Properties.MaximumPacketSize = packets.Uint32(uint32(c.maxPacketSize))
+		}
+		if max := connect.Properties.MaximumPacketSize; max != nil {
+			sessionMaxPacketSize = *max
+		}
+	}
+	c.session.SetMaximumPacketSize(sessionMaxPacketSize)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type packetSizeAuth struct {
+	auth.Interface
+	maxPacketSize int
+}
+
+func (a packetSizeAuth) MaxPacketSize() int { return a.maxPacketSize }
+
+func TestMaxPacketSize(t *testing.T) {
+	Convey(`Given the default maximum packet size`, t, func() {
+		Convey(`Then it should be used for listeners without maximum packet size`, func() {
+			So(maxPacketSize(ListenerConfig{}, nil), ShouldEqual, MaxPacketSize)
+		})
+		Convey(`Then the maximum packet size of the listener should override it`, func() {
+			So(maxPacketSize(ListenerConfig{MaxPacketSize: 1024}, nil), ShouldEqual, 1024)
+		})
+		Convey(`Then the maximum packet size of the user should override the listener`, func() {
+			noAuth, _ := auth.NoAuth("foo", "", nil)
+			So(maxPacketSize(ListenerConfig{MaxPacketSize: 1024}, packetSizeAuth{noAuth, 2048}), ShouldEqual, 2048)
+			So(maxPacketSize(ListenerConfig{MaxPacketSize: 1024}, noAuth), ShouldEqual, 1024)
+		})
+		Convey(`Then the maximum packet size of a user in the password file should override the listener`, func() {
+			a, err := passwordFileUser("max-packet-size=2048")
+			So(err, ShouldBeNil)
+			So(maxPacketSize(ListenerConfig{MaxPacketSize: 1024}, a), ShouldEqual, 2048)
+		})
+	})
+
+	Convey(`Given a Server with a listener with a maximum packet size`, t, func() {
+		s := NewServer()
+		go s.Route()
+
+		connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		connect.ProtocolName, connect.ProtocolVersion = "MQTT", packets.Version5
+		connect.ClientIdentifier, connect.CleanSession = "foo", true
+
+		publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		publish.TopicName = "foo"
+
+		run := func(commands ...packets.ControlPacket) (responses []packets.ControlPacket, err error) {
+			c := newMockClient(packets.Version5)
+			resCh := make(chan error)
+			go func() {
+				client := s.NewClient()
+				client.listener = ListenerConfig{MaxPacketSize: 64}
+				resCh <- client.handle(c)
+			}()
+			for _, command := range commands {
+				c.Send(command)
+			}
+			c.Close()
+			err = <-resCh
+			time.Sleep(10 * time.Millisecond)
+			return c.Responses(), err
+		}
+
+		Convey(`When connecting`, func() {
+			responses, _ := run(connect)
+			Convey(`Then the maximum packet size should be advertised`, func() {
+				So(responses, ShouldHaveLength, 1)
+				So(*responses[0].(*packets.ConnackPacket).Properties.MaximumPacketSize, ShouldEqual, 64)
+			})
+		})
+
+		Convey(`When publishing a message that exceeds the maximum packet size`, func() {
+			publish.Payload = make([]byte, 64)
+			responses, err := run(connect, publish)
+			Convey(`Then the client should be disconnected`, func() {
+				So(err, ShouldEqual, packets.ErrPacketTooLarge)
+				So(responses, ShouldHaveLength, 2)
+				So(responses[1].(*packets.DisconnectPacket).ReasonCode, ShouldEqual, packets.PacketTooLarge)
+			})
+		})
+	})
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
+	"go.uber.org/zap"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Names of quotas
+const (
+	QuotaMessagesPerSecond = "messages-per-second"
+	QuotaBytesPerSecond    = "bytes-per-second"
+	QuotaSubscriptions     = "subscriptions"
+)
+
+// SetQuotas sets the quotas for clients of users that do not have their own quotas
+// The quotas of connected clients do not change.
+func (s *Server) SetQuotas(quotas auth.Quotas) {
+	s.quotasMu.Lock()
+	defer s.quotasMu.Unlock()
+	s.quotas = quotas
+}
+
+// ExceededQuotas returns the number of times that clients exceeded each quota
+func (s *Server) ExceededQuotas() map[string]int64 {
+	exceeded := make(map[string]int64, len(s.stats.exceededQuotas))
+	for quota, count := range s.stats.exceededQuotas {
+		exceeded[quota] = atomic.LoadInt64(count)
+	}
+	return exceeded
+}
+
+// rateLimit is a token bucket that can be shared by the clients of a user
+type rateLimit struct {
+	mu     sync.Mutex
+	bucket tokenBucket
+}
+
+func (r *rateLimit) take(now time.Time, n int, limit int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bucket.takeN(now, n, float64(limit), limit)
+}
+
+func (r *rateLimit) debit(now time.Time, n int, limit int) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bucket.debit(now, n, float64(limit), limit)
+}
+
+type userRateLimits struct {
+	messages rateLimit
+	bytes    rateLimit
+	clients  int
+}
+
+// setQuotas sets the quotas of the client after CONNECT
+// Clients with shared quotas must release them with releaseQuotas.
+func (c *Client) setQuotas(a auth.Interface) {
+	c.server.quotasMu.RLock()
+	c.quotas = c.server.quotas
+	c.server.quotasMu.RUnlock()
+	if limiter, ok := a.(auth.QuotaLimiter); ok {
+		c.quotas = limiter.Quotas(c.quotas)
+	}
+	if !c.quotas.PerUser {
+		c.messageRate, c.byteRate = new(rateLimit), new(rateLimit)
+		return
+	}
+	username := c.username
+	s := c.server
+	s.userRateLimitsMu.Lock()
+	limits, ok := s.userRateLimits[username]
+	if !ok {
+		limits = new(userRateLimits)
+		s.userRateLimits[username] = limits
+	}
+	limits.clients++
+	s.userRateLimitsMu.Unlock()
+	c.messageRate, c.byteRate = &limits.messages, &limits.bytes
+	c.errMu.Lock()
+	c.releaseQuotas = func() {
+		s.userRateLimitsMu.Lock()
+		defer s.userRateLimitsMu.Unlock()
+		if limits.clients--; limits.clients == 0 {
+			delete(s.userRateLimits, username)
+		}
+	}
+	c.errMu.Unlock()
+}
+
+func (c *Client) exceedQuota(quota string, action auth.QuotaAction) {
+	atomic.AddInt64(c.server.stats.exceededQuotas[quota], 1)
+	c.log.Debug(
+		"exceed quota",
+		zap.String("addr", c.remoteAddr),
+		zap.String("quota", quota),
+		zap.Stringer("action", action),
+	)
+}
+
+// checkPublishQuotas returns true if the client can publish the packet
+// Throttled clients wait until they are within their quota. An error is returned if the client exceeded
+// a quota with the Disconnect action, or if the client disconnected while it was throttled.
+func (c *Client) checkPublishQuotas(packet *packets.PublishPacket) (bool, error) {
+	now := time.Now()
+	for _, check := range []struct {
+		name  string
+		quota auth.Quota
+		limit *rateLimit
+		n     int
+	}{
+		{QuotaMessagesPerSecond, c.quotas.MessagesPerSecond, c.messageRate, 1},
+		{QuotaBytesPerSecond, c.quotas.BytesPerSecond, c.byteRate, len(packet.Payload)},
+	} {
+		if check.quota.Limit == 0 {
+			continue
+		}
+		if check.quota.Action == auth.Throttle {
+			if wait := check.limit.debit(now, check.n, check.quota.Limit); wait > 0 {
+				c.exceedQuota(check.name, check.quota.Action)
+				select {
+				case <-time.After(wait):
+				case <-c.ctx.Done():
+					return false, c.ctx.Err()
+				}
+			}
+			continue
+		}
+		if check.limit.take(now, check.n, check.quota.Limit) {
+			continue
+		}
+		c.exceedQuota(check.name, check.quota.Action)
+		if check.quota.Action == auth.Disconnect {
+			return false, errQuotaExceeded
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// checkSubscriptionQuota returns true if the session can have another subscription
+// An error is returned if the client exceeded the quota with the Disconnect action.
+func (c *Client) checkSubscriptionQuota(subscriptions int) (bool, error) {
+	quota := c.quotas.Subscriptions
+	if quota.Limit == 0 || subscriptions < quota.Limit {
+		return true, nil
+	}
+	c.exceedQuota(QuotaSubscriptions, quota.Action)
+	if quota.Action == auth.Disconnect {
+		return false, errQuotaExceeded
+	}
+	return false, nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type quotaAuth struct {
+	auth.Interface
+	quotas auth.Quotas
+}
+
+func (a quotaAuth) Quotas(auth.Quotas) auth.Quotas { return a.quotas }
+
+func TestQuotas(t *testing.T) {
+	Convey(`Given a Server with quotas`, t, func() {
+		s := NewServer()
+		go s.Route()
+
+		var quotas auth.Quotas
+		s.SetAuth(func(clientIdentifier string, username string, password []byte) (auth.Interface, error) {
+			noAuth, err := auth.NoAuth(clientIdentifier, username, password)
+			return quotaAuth{noAuth, quotas}, err
+		})
+
+		connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		connect.ProtocolName, connect.ProtocolVersion = "MQTT", packets.Version5
+		connect.ClientIdentifier, connect.CleanSession = "foo", true
+
+		publish := func(messageID uint16) *packets.PublishPacket {
+			publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			publish.TopicName, publish.Qos, publish.MessageID = "foo", 1, messageID
+			publish.Payload = []byte("bar")
+			return publish
+		}
+
+		subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		subscribe.MessageID = 1
+		subscribe.Topics, subscribe.Qoss = []string{"foo", "bar", "foo"}, []byte{0, 0, 0}
+
+		wait := 10 * time.Millisecond
+		run := func(commands ...packets.ControlPacket) (responses []packets.ControlPacket, err error) {
+			c := newMockClient(packets.Version5)
+			resCh := make(chan error)
+			go func() { resCh <- s.NewClient().handle(c) }()
+			for _, command := range commands {
+				c.Send(command)
+			}
+			time.Sleep(wait)
+			c.Close()
+			err = <-resCh
+			time.Sleep(10 * time.Millisecond)
+			return c.Responses(), err
+		}
+
+		Convey(`When a client exceeds a message quota with the Drop action`, func() {
+			quotas.MessagesPerSecond = auth.Quota{Limit: 1, Action: auth.Drop}
+			responses, _ := run(connect, publish(1), publish(2))
+			Convey(`Then the message should be dropped with reason Quota Exceeded`, func() {
+				So(responses, ShouldHaveLength, 3)
+				So(responses[1].(*packets.PubackPacket).ReasonCode, ShouldEqual, packets.Success)
+				So(responses[2].(*packets.PubackPacket).ReasonCode, ShouldEqual, packets.QuotaExceeded)
+				So(s.ExceededQuotas()[QuotaMessagesPerSecond], ShouldEqual, 1)
+			})
+		})
+
+		Convey(`When a client exceeds a byte quota with the Disconnect action`, func() {
+			quotas.BytesPerSecond = auth.Quota{Limit: 4, Action: auth.Disconnect}
+			responses, err := run(connect, publish(1), publish(2))
+			Convey(`Then the client should be disconnected with reason Quota Exceeded`, func() {
+				So(err, ShouldEqual, errQuotaExceeded)
+				So(responses, ShouldNotBeEmpty)
+				So(responses[len(responses)-1].(*packets.DisconnectPacket).ReasonCode, ShouldEqual, packets.QuotaExceeded)
+			})
+		})
+
+		Convey(`When a client exceeds a message quota with the Throttle action`, func() {
+			quotas.MessagesPerSecond = auth.Quota{Limit: 10, Action: auth.Throttle}
+			wait = 200 * time.Millisecond
+			start := time.Now()
+			responses, _ := run(connect, publish(1), publish(2), publish(3), publish(4), publish(5),
+				publish(6), publish(7), publish(8), publish(9), publish(10), publish(11))
+			Convey(`Then the messages should be delayed`, func() {
+				So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 100*time.Millisecond)
+				So(responses, ShouldHaveLength, 12)
+				So(responses[11].(*packets.PubackPacket).ReasonCode, ShouldEqual, packets.Success)
+			})
+		})
+
+		Convey(`When a client exceeds the subscription quota`, func() {
+			quotas.Subscriptions = auth.Quota{Limit: 1, Action: auth.Drop}
+			responses, _ := run(connect, subscribe)
+			Convey(`Then the subscriptions that exceed the quota should be rejected`, func() {
+				So(responses, ShouldHaveLength, 2)
+				So(responses[1].(*packets.SubackPacket).ReturnCodes, ShouldResemble, []byte{0, packets.QuotaExceeded, 0})
+			})
+		})
+
+		Convey(`When a user with quotas in the password file connects`, func() {
+			s.SetQuotas(auth.Quotas{BytesPerSecond: auth.Quota{Limit: 1024}})
+			a, err := passwordFileUser("messages=1 messages-action=drop per-user=true")
+			So(err, ShouldBeNil)
+			c := s.NewClient()
+			c.username = "user"
+			c.setQuotas(a)
+			defer c.releaseQuotas()
+			Convey(`Then the quotas of the user should override the quotas of the server`, func() {
+				So(c.quotas, ShouldResemble, auth.Quotas{
+					MessagesPerSecond: auth.Quota{Limit: 1, Action: auth.Drop},
+					BytesPerSecond:    auth.Quota{Limit: 1024},
+					PerUser:           true,
+				})
+			})
+		})
+
+		Convey(`When the quotas are shared between the clients of a user`, func() {
+			quotas.MessagesPerSecond = auth.Quota{Limit: 1, Action: auth.Drop}
+			quotas.PerUser = true
+			a, b := s.NewClient(), s.NewClient()
+			a.username, b.username = "user", "user"
+			a.setQuotas(quotaAuth{quotas: quotas})
+			b.setQuotas(quotaAuth{quotas: quotas})
+			Convey(`Then the clients should share the same rate limits`, func() {
+				So(a.messageRate, ShouldEqual, b.messageRate)
+				So(s.userRateLimits, ShouldHaveLength, 1)
+			})
+			Convey(`Then the rate limits should be deleted when all clients released them`, func() {
+				a.releaseQuotas()
+				So(s.userRateLimits, ShouldHaveLength, 1)
+				b.releaseQuotas()
+				So(s.userRateLimits, ShouldBeEmpty)
+			})
+		})
+	})
+}
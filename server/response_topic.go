@@ -0,0 +1,31 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/htdvisser/squatt/packets"
+)
+
+// SetResponseTopicPrefix sets the prefix of the response topics of MQTT 5 clients that request Response Information
+// The authenticated username and the client identifier are appended to the prefix as "<username>/<client-id>", and the
+// client can always subscribe to the resulting topic and the topics below it. Because the username is part of the
+// topic, a client can not get access to the response topics of another user by using its client identifier.
+func (s *Server) SetResponseTopicPrefix(prefix string) {
+	s.responseTopicPrefix = prefix
+}
+
+// clientResponseTopicPrefix returns the prefix of the response topics for the client that sent the CONNECT packet and
+// authenticated with the username. No prefix is returned if the client did not request it, or if the username or the
+// client identifier can not be used in a topic.
+func (s *Server) clientResponseTopicPrefix(connect *packets.ConnectPacket, username string) string {
+	if s.responseTopicPrefix == "" || connect.ProtocolVersion < packets.Version5 {
+		return ""
+	}
+	if request := connect.Properties.RequestResponseInformation; request == nil || *request == 0 {
+		return ""
+	}
+	if strings.ContainsAny(username, "/+#") || strings.ContainsAny(connect.ClientIdentifier, "/+#") {
+		return ""
+	}
+	return s.responseTopicPrefix + username + "/" + connect.ClientIdentifier
+}
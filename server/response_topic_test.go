@@ -0,0 +1,41 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResponseTopicPrefix(t *testing.T) {
+	Convey(`Given a Server with a response topic prefix`, t, func() {
+		s := NewServer()
+		s.SetResponseTopicPrefix("responses/")
+
+		connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		connect.ProtocolVersion = packets.Version5
+		connect.ClientIdentifier = "foo"
+
+		Convey(`When an MQTT 5 client requests response information`, func() {
+			connect.Properties.RequestResponseInformation = packets.Byte(1)
+			Convey(`Then the prefix should contain the username and the client identifier`, func() {
+				So(s.clientResponseTopicPrefix(connect, "alice"), ShouldEqual, "responses/alice/foo")
+			})
+			Convey(`Then the prefix of another user with the same client identifier should be different`, func() {
+				So(s.clientResponseTopicPrefix(connect, "mallory"), ShouldEqual, "responses/mallory/foo")
+				So(s.clientResponseTopicPrefix(connect, ""), ShouldEqual, "responses//foo")
+			})
+			Convey(`When the client identifier contains wildcards`, func() {
+				connect.ClientIdentifier = "+"
+				Convey(`Then there should be no prefix`, func() { So(s.clientResponseTopicPrefix(connect, "alice"), ShouldBeEmpty) })
+			})
+			Convey(`When the username contains a topic separator`, func() {
+				Convey(`Then there should be no prefix`, func() { So(s.clientResponseTopicPrefix(connect, "alice/foo"), ShouldBeEmpty) })
+			})
+		})
+
+		Convey(`When an MQTT 5 client does not request response information`, func() {
+			Convey(`Then there should be no prefix`, func() { So(s.clientResponseTopicPrefix(connect, "alice"), ShouldBeEmpty) })
+		})
+	})
+}
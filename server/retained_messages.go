@@ -1,10 +1,16 @@
 package server
 
 import (
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
 	"github.com/htdvisser/squatt/topic"
 )
 
+// RetainedDeletionExpiry is the time that deletions of retained messages are remembered
+// Nodes of a cluster that were disconnected for a longer time can restore retained messages that were deleted.
+var RetainedDeletionExpiry = 24 * time.Hour
+
 // RetainMessage stores a PUBLISH packet if the RETAIN flag is set to 1
 func (s *Server) RetainMessage(msg *packets.PublishPacket) {
 	if !msg.Retain {
@@ -13,21 +19,84 @@ func (s *Server) RetainMessage(msg *packets.PublishPacket) {
 	topic := s.topics.Get(msg.TopicName)
 	s.retainedMessagesMu.Lock()
 	defer s.retainedMessagesMu.Unlock()
-	if len(msg.Payload) > 0 {
+	s.setRetainedMessage(topic, msg, time.Now())
+}
+
+// setRetainedMessage stores or deletes the retained message of the topic, this must be called while holding
+// retainedMessagesMu
+func (s *Server) setRetainedMessage(topic *topic.Topic, msg *packets.PublishPacket, changed time.Time) {
+	if msg != nil && len(msg.Payload) > 0 {
 		s.retainedMessages[topic] = msg
 	} else {
 		delete(s.retainedMessages, topic)
 	}
+	s.retainedChanged[topic] = changed
+}
+
+// RetainedMessageState is a retained message or the deletion of a retained message
+type RetainedMessageState struct {
+	Topic   string
+	Message *packets.PublishPacket // nil if the retained message was deleted
+	Changed time.Time
+}
+
+// RetainedMessageStates returns the retained messages and the deletions of retained messages that are remembered
+// Nodes of a cluster use the time of the changes to keep the newest retained message of each topic.
+func (s *Server) RetainedMessageStates() (states []RetainedMessageState) {
+	now := time.Now()
+	s.retainedMessagesMu.RLock()
+	defer s.retainedMessagesMu.RUnlock()
+	for topic, changed := range s.retainedChanged {
+		msg, ok := s.retainedMessages[topic]
+		if ok && msg.Expired(now) {
+			continue
+		}
+		states = append(states, RetainedMessageState{Topic: topic.Name(), Message: msg, Changed: changed})
+	}
+	return
 }
 
 // RetainedMessages gets all retained PUBLISH packets for the given topics
+// Retained messages that expired are not returned
 func (s *Server) RetainedMessages(topics ...*topic.Topic) (msgs []*packets.PublishPacket) {
+	now := time.Now()
 	s.retainedMessagesMu.RLock()
 	defer s.retainedMessagesMu.RUnlock()
 	for _, topic := range topics {
-		if msg, ok := s.retainedMessages[topic]; ok {
+		if msg, ok := s.retainedMessages[topic]; ok && !msg.Expired(now) {
 			msgs = append(msgs, msg)
 		}
 	}
 	return
 }
+
+// RetainedMessagesMatching gets the retained PUBLISH packets with topics that match the topic filter
+func (s *Server) RetainedMessagesMatching(filter string) []*packets.PublishPacket {
+	return s.RetainedMessages(s.topics.Match(filter)...)
+}
+
+// DeleteExpiredRetainedMessages deletes the retained PUBLISH packets that expired at the given time
+func (s *Server) DeleteExpiredRetainedMessages(now time.Time) (deleted int) {
+	s.retainedMessagesMu.Lock()
+	defer s.retainedMessagesMu.Unlock()
+	for topic, msg := range s.retainedMessages {
+		if msg.Expired(now) {
+			delete(s.retainedMessages, topic)
+			delete(s.retainedChanged, topic)
+			deleted++
+		}
+	}
+	for topic, changed := range s.retainedChanged {
+		if _, ok := s.retainedMessages[topic]; !ok && now.Sub(changed) > RetainedDeletionExpiry {
+			delete(s.retainedChanged, topic)
+		}
+	}
+	return
+}
+
+// DeliverRetainedMessages delivers the retained PUBLISH packets that match the topic filter of the subscription
+func (s *Server) DeliverRetainedMessages(sub *Subscription) {
+	for _, msg := range s.RetainedMessages(s.topics.Match(sub.topic.Name())...) {
+		sub.DeliverRetained(msg)
+	}
+}
@@ -2,8 +2,9 @@ package server
 
 import (
 	"testing"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/htdvisser/squatt/packets"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -36,6 +37,20 @@ func TestRetainedMessages(t *testing.T) {
 				msgs := s.RetainedMessages(s.topics.Match("#")...)
 				Convey(`Then the retained message should be returned`, func() { So(msgs, ShouldContain, pub) })
 			})
+			Convey(`When the retained message expires`, func() {
+				pub.Expires = time.Now()
+				Convey(`When getting the retained messages`, func() {
+					msgs := s.RetainedMessages(s.topics.Match("#")...)
+					Convey(`Then there should be no messages`, func() { So(msgs, ShouldBeEmpty) })
+				})
+				Convey(`When deleting expired retained messages`, func() {
+					deleted := s.DeleteExpiredRetainedMessages(time.Now())
+					Convey(`Then the retained message should be deleted`, func() {
+						So(deleted, ShouldEqual, 1)
+						So(s.retainedMessages, ShouldBeEmpty)
+					})
+				})
+			})
 			Convey(`When retaining a message without payload`, func() {
 				pub := pub
 				pub.Payload = nil
@@ -48,3 +63,61 @@ func TestRetainedMessages(t *testing.T) {
 		})
 	})
 }
+
+func TestRetainLocal(t *testing.T) {
+	Convey(`Given a Server with a retained message`, t, func() {
+		s := NewServer()
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName, pub.Retain, pub.Payload = "foo", true, []byte("local")
+		s.RetainMessage(pub)
+		states := s.RetainedMessageStates()
+		So(states, ShouldHaveLength, 1)
+		changed := states[0].Changed
+
+		remote := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		remote.TopicName, remote.Retain, remote.Payload = "foo", true, []byte("remote")
+
+		Convey(`When an older message of another node is retained`, func() {
+			applied := s.RetainLocal("foo", remote, changed.Add(-time.Second))
+			Convey(`Then the newer message should be kept`, func() {
+				So(applied, ShouldBeFalse)
+				So(s.RetainedMessagesMatching("foo"), ShouldResemble, []*packets.PublishPacket{pub})
+			})
+		})
+
+		Convey(`When a newer message of another node is retained`, func() {
+			applied := s.RetainLocal("foo", remote, changed.Add(time.Second))
+			Convey(`Then it should replace the message`, func() {
+				So(applied, ShouldBeTrue)
+				So(s.RetainedMessagesMatching("foo"), ShouldResemble, []*packets.PublishPacket{remote})
+			})
+		})
+
+		Convey(`When the retained message is deleted`, func() {
+			So(s.DeleteRetainedMessage("foo"), ShouldBeTrue)
+			Convey(`Then the deletion should be in the states`, func() {
+				states := s.RetainedMessageStates()
+				So(states, ShouldHaveLength, 1)
+				So(states[0].Message, ShouldBeNil)
+			})
+			Convey(`Then an older message of another node should not restore it`, func() {
+				So(s.RetainLocal("foo", remote, changed), ShouldBeFalse)
+				So(s.RetainedMessagesMatching("foo"), ShouldBeEmpty)
+			})
+			Convey(`When the deletion expires`, func() {
+				s.DeleteExpiredRetainedMessages(time.Now().Add(RetainedDeletionExpiry + time.Second))
+				Convey(`Then it should be forgotten`, func() {
+					So(s.RetainedMessageStates(), ShouldBeEmpty)
+				})
+			})
+		})
+
+		Convey(`When a newer deletion of another node is retained`, func() {
+			applied := s.RetainLocal("foo", nil, changed.Add(time.Second))
+			Convey(`Then the retained message should be deleted`, func() {
+				So(applied, ShouldBeTrue)
+				So(s.RetainedMessagesMatching("foo"), ShouldBeEmpty)
+			})
+		})
+	})
+}
@@ -1,10 +1,12 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/htdvisser/squatt/packets"
 	"go.uber.org/zap"
 )
 
@@ -12,14 +14,22 @@ var errProtocolViolation = packets.ConnErrors[packets.ErrProtocolViolation]
 
 func (c *Client) sendRoutine(w io.Writer) {
 	for msg := range c.sendCh {
-		if err := msg.Write(w); err != nil {
+		if err := msg.Write(w, c.version); err != nil {
 			c.setError(err)
 			return
 		}
 	}
 }
 
-func (c *Client) send(packet packets.ControlPacket) (err error) {
+var errSendTimeout = errors.New("send timeout")
+
+func (c *Client) send(packet packets.ControlPacket) error {
+	return c.sendBefore(packet, nil)
+}
+
+// sendBefore is similar to send, except that it gives up if the packet is not sent before the timeout
+// A nil timeout means that it waits until the packet is sent.
+func (c *Client) sendBefore(packet packets.ControlPacket, timeout <-chan time.Time) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			c.log.Error(fmt.Sprintf("unexpected error: %v", r))
@@ -31,6 +41,14 @@ func (c *Client) send(packet packets.ControlPacket) (err error) {
 		return err
 	}
 
+	if _, ok := packet.(*packets.DisconnectPacket); ok && c.version < packets.Version5 {
+		return nil // an MQTT 3.1.1 server does not send DISCONNECT packets
+	}
+
+	if publish, ok := packet.(*packets.PublishPacket); ok {
+		packet = c.unmountPublish(publish)
+	}
+
 	log := c.log.With(zap.String("addr", c.remoteAddr))
 
 	switch packet := packet.(type) {
@@ -81,23 +99,40 @@ func (c *Client) send(packet packets.ControlPacket) (err error) {
 		)
 	case *packets.PingrespPacket:
 		log.Debug("send pingresp")
+	case *packets.DisconnectPacket:
+		log.Debug(
+			"send disconnect",
+			zap.Uint8("reason", packet.ReasonCode),
+		)
+	case *packets.AuthPacket:
+		log.Debug(
+			"send auth",
+			zap.Uint8("reason", packet.ReasonCode),
+		)
 	}
 
-	c.sendCh <- packet
+	select {
+	case c.sendCh <- packet:
+	case <-timeout:
+		return errSendTimeout
+	}
 
 	return
 }
 
 func (c *Client) receiveRoutine(r io.Reader) {
+	c.maxPacketSize = maxPacketSize(c.listener, nil)
 	for {
-		msg, err := packets.ReadPacket(r)
-		if err != nil {
-			c.setError(err)
-			return
+		msg, err := packets.ReadPacketLimit(r, c.version, c.maxPacketSize)
+		if err == nil {
+			err = c.receive(msg)
 		}
-		err = c.receive(msg)
 		if err != nil {
-			c.setError(err)
+			if reasonCode, ok := disconnectReasonCodes[err]; ok {
+				c.disconnect(reasonCode, err)
+			} else {
+				c.setError(err)
+			}
 			return
 		}
 	}
@@ -136,6 +171,8 @@ func packetType(packet packets.ControlPacket) byte {
 		return packet.FixedHeader.MessageType
 	case *packets.DisconnectPacket:
 		return packet.FixedHeader.MessageType
+	case *packets.AuthPacket:
+		return packet.FixedHeader.MessageType
 	}
 	return 0
 }
@@ -156,8 +193,15 @@ func (c *Client) receive(packet packets.ControlPacket) (err error) {
 	if packetType == 0 {
 		return errProtocolViolation
 	}
-	if (packetType == packets.Connect) != (c.session == nil) {
-		return errProtocolViolation
+	switch {
+	case packetType == packets.Connect:
+		if c.session != nil || c.authExchange != nil {
+			return errProtocolViolation
+		}
+	case c.session == nil:
+		if packetType != packets.Auth || c.authExchange == nil {
+			return errProtocolViolation // only AUTH packets are allowed during the authentication exchange of a CONNECT
+		}
 	}
 	if packet.Details().Qos == 0x03 {
 		return errProtocolViolation
@@ -232,6 +276,13 @@ func (c *Client) receive(packet packets.ControlPacket) (err error) {
 	case *packets.DisconnectPacket:
 		log.Debug("receive disconnect")
 		return c.handleDisconnect(packet)
+	case *packets.AuthPacket:
+		log.Debug(
+			"receive auth",
+			zap.Uint8("reason", packet.ReasonCode),
+			zap.String("method", packet.Properties.AuthenticationMethod),
+		)
+		return c.handleAuth(packet)
 	default:
 		return errProtocolViolation
 	}
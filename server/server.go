@@ -2,13 +2,15 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
 	"github.com/htdvisser/squatt/session"
 	"github.com/htdvisser/squatt/topic"
 	"go.uber.org/zap"
@@ -18,16 +20,43 @@ type serverStats struct {
 	// BEGIN sync/atomic aligned
 	sockets int64
 	// END sync/atomic aligned
+
+	rejected       map[string]*int64 // rejected connections by reason, counted with sync/atomic
+	exceededQuotas map[string]*int64 // exceeded quotas by name, counted with sync/atomic
+}
+
+func newServerStats() *serverStats {
+	stats := &serverStats{
+		rejected:       make(map[string]*int64),
+		exceededQuotas: make(map[string]*int64),
+	}
+	for _, reason := range []string{
+		RejectMaxConnections, RejectMaxConnectionsPerIP, RejectMaxConnectionsInNetwork,
+		RejectConnectRate, RejectConnectRatePerIP, RejectConnectTimeout, RejectMaxListenerConnections,
+	} {
+		stats.rejected[reason] = new(int64)
+	}
+	for _, quota := range []string{QuotaMessagesPerSecond, QuotaBytesPerSecond, QuotaSubscriptions} {
+		stats.exceededQuotas[quota] = new(int64)
+	}
+	return stats
 }
 
 // Server implements an MQTT Server
 type Server struct {
 	log   *zap.Logger
 	stats *serverStats
+	clock clock
 
-	auth     auth.Plugin
-	sessions *session.Store
-	topics   *topic.Store
+	auth                 auth.Plugin
+	authMethods          map[string]auth.Method
+	sessions             *session.Store
+	sessionExpiryDefault time.Duration
+	willDelay            time.Duration
+	keepAlivePolicy      KeepAlivePolicy
+	responseTopicPrefix  string
+	injectedProperties   InjectedProperties
+	topics               *topic.Store
 
 	subscriptionsMu      sync.RWMutex
 	sessionSubscriptions map[*session.Session]subscriptionsByTopic
@@ -35,6 +64,28 @@ type Server struct {
 
 	retainedMessagesMu sync.RWMutex
 	retainedMessages   map[*topic.Topic]*packets.PublishPacket
+	retainedChanged    map[*topic.Topic]time.Time // time of the last change of the retained message, also if it was deleted
+
+	messageExpiryMu sync.RWMutex
+	messageExpiry   []messageExpiry
+
+	connectionLimiter *connectionLimiter
+
+	quotasMu sync.RWMutex
+	quotas   auth.Quotas
+
+	userRateLimitsMu sync.Mutex
+	userRateLimits   map[string]*userRateLimits
+
+	clientsMu sync.RWMutex
+	clients   map[*Client]struct{}
+
+	listenersMu         sync.Mutex
+	listeners           map[net.Listener]struct{}
+	listenerConnections map[string]int // by listener name
+	shuttingDown        bool
+
+	hooks Hooks
 
 	publish chan *packets.PublishPacket
 }
@@ -43,16 +94,26 @@ type Server struct {
 func NewServer() *Server {
 	s := &Server{
 		log:   zap.NewNop(),
-		stats: new(serverStats),
+		stats: newServerStats(),
+		clock: realClock{},
 
-		auth:     auth.NoAuth,
-		sessions: session.NewStore(),
-		topics:   topic.NewStore(),
+		auth:        auth.NoAuth,
+		authMethods: make(map[string]auth.Method),
+		sessions:    session.NewStore(),
+		topics:      topic.NewStore(),
 
 		sessionSubscriptions: make(map[*session.Session]subscriptionsByTopic),
 		topicSubscriptions:   make(map[*topic.Topic]subscriptionsBySession),
 
 		retainedMessages: make(map[*topic.Topic]*packets.PublishPacket),
+		retainedChanged:  make(map[*topic.Topic]time.Time),
+
+		connectionLimiter: newConnectionLimiter(),
+		userRateLimits:    make(map[string]*userRateLimits),
+
+		clients:             make(map[*Client]struct{}),
+		listeners:           make(map[net.Listener]struct{}),
+		listenerConnections: make(map[string]int),
 
 		publish: make(chan *packets.PublishPacket, 512),
 	}
@@ -63,20 +124,46 @@ func NewServer() *Server {
 // Route publish messages. Calling this from multiple goroutines increases parallellism
 func (s *Server) Route() {
 	for msg := range s.publish {
-		if msg.Retain {
-			s.RetainMessage(msg)
+		s.route(msg)
+		if s.hooks.Publish != nil {
+			s.hooks.Publish(msg)
 		}
-		topics := s.topics.Match(msg.TopicName)
-		subscriptions := s.TopicSubscriptions(topics...)
-		s.log.Info(
-			"publish",
-			zap.String("topic", msg.TopicName),
-			zap.Int("matching-topics", len(topics)),
-			zap.Int("matching-subscriptions", len(subscriptions)),
-		)
-		for _, sub := range subscriptions {
-			sub.Deliver(msg)
+	}
+}
+
+// route delivers the message to the matching subscriptions, and stores it if it is retained
+func (s *Server) route(msg *packets.PublishPacket) {
+	s.setMessageExpiry(msg, time.Now())
+	if msg.Retain {
+		s.RetainMessage(msg)
+	}
+	topics := s.topics.Match(msg.TopicName)
+	subscriptions := s.TopicSubscriptions(topics...)
+	s.log.Info(
+		"publish",
+		zap.String("topic", msg.TopicName),
+		zap.Int("matching-topics", len(topics)),
+		zap.Int("matching-subscriptions", len(subscriptions)),
+	)
+	size := packets.NewDeliverySize(msg)
+	for _, subs := range groupBySession(subscriptions) {
+		deliverToSession(msg, size, subs)
+	}
+}
+
+// ReapInterval is the interval at which expired sessions, retained messages and connection rate limits are deleted
+var ReapInterval = time.Minute
+
+// Reap deletes expired sessions and retained messages every ReapInterval
+func (s *Server) Reap() {
+	for now := range time.Tick(ReapInterval) {
+		if deleted := s.sessions.DeleteExpired(now); deleted > 0 {
+			s.log.Info("delete expired sessions", zap.Int("sessions", deleted))
 		}
+		if deleted := s.DeleteExpiredRetainedMessages(now); deleted > 0 {
+			s.log.Info("delete expired retained messages", zap.Int("messages", deleted))
+		}
+		s.connectionLimiter.cleanup(now)
 	}
 }
 
@@ -85,6 +172,23 @@ func (s *Server) SetLogger(log *zap.Logger) {
 	s.log = log
 }
 
+// SetSessionExpiry sets the expiry interval of persistent sessions after their client disconnects
+// An expiry of zero means that sessions do not expire.
+func (s *Server) SetSessionExpiry(expiry time.Duration) {
+	s.sessionExpiryDefault = expiry
+}
+
+// SetQueueLimits sets the limits of the publish queue and the in-flight window of new and existing sessions
+// A publish queue limit of zero means that the queue is not limited.
+func (s *Server) SetQueueLimits(publishQueue, inFlight int) {
+	s.sessions.SetQueueLimits(publishQueue, inFlight)
+}
+
+// SetWillDelay sets the delay for publishing wills of clients that do not specify a Will Delay Interval
+func (s *Server) SetWillDelay(delay time.Duration) {
+	s.willDelay = delay
+}
+
 // ListenAndServe on an address
 func (s *Server) ListenAndServe(addr string) error {
 	lis, err := net.Listen("tcp", addr)
@@ -107,18 +211,130 @@ func (s *Server) ListenAndServeTLS(addr string, config *tls.Config) error {
 
 // Serve on the given listener
 func (s *Server) Serve(lis net.Listener) error {
+	return s.ServeListener(lis, ListenerConfig{Name: lis.Addr().String()})
+}
+
+// ServeListener is similar to Serve, except that it uses the given listener config for its clients
+// It returns nil when the server shuts down or when the listener is closed with CloseListener.
+func (s *Server) ServeListener(lis net.Listener, config ListenerConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	s.listenersMu.Lock()
+	if s.shuttingDown {
+		s.listenersMu.Unlock()
+		lis.Close()
+		return nil
+	}
+	s.listeners[lis] = struct{}{}
+	s.listenersMu.Unlock()
+	defer func() {
+		s.listenersMu.Lock()
+		delete(s.listeners, lis)
+		s.listenersMu.Unlock()
+	}()
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
+			s.listenersMu.Lock()
+			_, open := s.listeners[lis]
+			shuttingDown := s.shuttingDown
+			s.listenersMu.Unlock()
+			if shuttingDown || !open {
+				return nil
+			}
 			return err
 		}
+		release, reject := s.connectionLimiter.admit(conn.RemoteAddr(), time.Now())
+		if reject == "" && !s.addListenerConnection(config.Name, config.MaxConnections) {
+			release()
+			reject = RejectMaxListenerConnections
+		}
+		if reject != "" {
+			s.log.Debug("reject connection", zap.String("addr", conn.RemoteAddr().String()), zap.String("listener", config.Name), zap.String("reason", reject))
+			s.rejectConnection(conn, reject)
+			continue
+		}
 		go func() {
-			defer conn.Close()
-			conns := atomic.AddInt64(&s.stats.sockets, 1)
-			s.log.Debug("accept connection", zap.String("addr", conn.RemoteAddr().String()), zap.Int64("conns", conns))
-			s.NewClient().Handle(conn)
-			conns = atomic.AddInt64(&s.stats.sockets, -1)
-			s.log.Debug("release connection", zap.String("addr", conn.RemoteAddr().String()), zap.Int64("conns", conns), zap.Error(err))
+			defer release()
+			defer s.removeListenerConnection(config.Name)
+			s.serveConn(conn, config)
 		}()
 	}
 }
+
+// CloseListener closes a listener that is served by ServeListener
+// Clients that connected on the listener stay connected.
+func (s *Server) CloseListener(lis net.Listener) error {
+	s.listenersMu.Lock()
+	delete(s.listeners, lis)
+	s.listenersMu.Unlock()
+	return lis.Close()
+}
+
+// ServeConn serves a single connection with the given listener config, and closes it when the client disconnects
+// Connections that are served directly, such as in-process connections of bridges, are not subject to
+// the connection limits of the server.
+func (s *Server) ServeConn(conn net.Conn, config ListenerConfig) error {
+	if err := config.validate(); err != nil {
+		conn.Close()
+		return err
+	}
+	s.addListenerConnection(config.Name, 0)
+	defer s.removeListenerConnection(config.Name)
+	return s.serveConn(conn, config)
+}
+
+func (s *Server) serveConn(conn net.Conn, config ListenerConfig) error {
+	defer conn.Close()
+	log := s.log.With(zap.String("listener", config.Name))
+	conns := atomic.AddInt64(&s.stats.sockets, 1)
+	log.Debug("accept connection", zap.String("addr", conn.RemoteAddr().String()), zap.Int64("conns", conns))
+	c := s.NewClient()
+	c.log = log
+	c.listener = config
+	err := c.Handle(conn)
+	conns = atomic.AddInt64(&s.stats.sockets, -1)
+	log.Debug("release connection", zap.String("addr", conn.RemoteAddr().String()), zap.Int64("conns", conns), zap.Error(err))
+	return err
+}
+
+// Shutdown closes the listeners of the server and disconnects all clients
+// MQTT 5 clients get a DISCONNECT with reason Server Shutting Down. Shutdown returns when all connections
+// are closed, or with the error of the context if it is done before that.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.listenersMu.Lock()
+	s.shuttingDown = true
+	for lis := range s.listeners {
+		lis.Close()
+	}
+	s.listenersMu.Unlock()
+	var wg sync.WaitGroup
+	for _, c := range s.allClients() {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.disconnect(packets.ServerShuttingDown, errServerShuttingDown)
+		}(c)
+	}
+	disconnected := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(disconnected)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-disconnected:
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.stats.sockets) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -6,28 +6,30 @@ import (
 	"testing"
 	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/htdvisser/squatt/packets"
 	. "github.com/smartystreets/goconvey/convey"
 	"go.uber.org/zap"
 )
 
 type mockClient struct {
+	version   byte
 	in        io.Writer
 	queue     chan packets.ControlPacket
 	out       io.Reader
 	responses []packets.ControlPacket
 }
 
-func newMockClient() *mockClient {
+func newMockClient(version byte) *mockClient {
 	c := &mockClient{
-		queue: make(chan packets.ControlPacket),
+		version: version,
+		queue:   make(chan packets.ControlPacket),
 	}
 
 	out, outPipe := io.Pipe()
 	c.out = out
 	go func() {
 		for msg := range c.queue {
-			msg.Write(outPipe)
+			msg.Write(outPipe, c.version)
 		}
 		outPipe.Close()
 	}()
@@ -36,7 +38,7 @@ func newMockClient() *mockClient {
 	c.in = inPipe
 	go func() {
 		for {
-			pkt, err := packets.ReadPacket(in)
+			pkt, err := packets.ReadPacket(in, c.version)
 			if err != nil {
 				return
 			}
@@ -83,11 +85,16 @@ func TestServer(t *testing.T) {
 
 		disconnect := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
 
+		var listener ListenerConfig
+		version := byte(packets.Version311)
+
 		run := func(commands ...packets.ControlPacket) (responses []packets.ControlPacket, err error) {
-			c := newMockClient()
+			c := newMockClient(version)
 			resCh := make(chan error)
 			go func() {
-				resCh <- s.NewClient().handle(c)
+				client := s.NewClient()
+				client.listener = listener
+				resCh <- client.handle(c)
 			}()
 			for _, command := range commands {
 				c.Send(command)
@@ -136,6 +143,167 @@ func TestServer(t *testing.T) {
 			Convey(`Then the connection should be closed`, func() { So(err, ShouldEqual, io.EOF) })
 		})
 
+		Convey(`When sending a CONNECT with a retained will`, func() {
+			go s.Route()
+			connect := newConnect()
+			connect.ClientIdentifier = "will"
+			connect.WillFlag, connect.WillRetain = true, true
+			connect.WillTopic, connect.WillMessage = "foo", []byte("bye")
+
+			Convey(`When the connection closes without DISCONNECT`, func() {
+				run(connect)
+				Convey(`Then the will should have been retained`, func() {
+					retained := s.RetainedMessages(s.topics.Get("foo"))
+					So(retained, ShouldHaveLength, 1)
+					So(string(retained[0].Payload), ShouldEqual, "bye")
+				})
+			})
+
+			Convey(`When the connection closes with DISCONNECT`, func() {
+				run(connect, disconnect)
+				Convey(`Then the will should not have been published`, func() {
+					So(s.RetainedMessages(s.topics.Get("foo")), ShouldBeEmpty)
+				})
+			})
+
+			Convey(`When the server has a will delay and the session is persistent`, func() {
+				s.SetWillDelay(time.Hour)
+				connect.CleanSession = false
+				run(connect)
+				Convey(`Then the will should not have been published yet`, func() {
+					So(s.RetainedMessages(s.topics.Get("foo")), ShouldBeEmpty)
+				})
+			})
+		})
+
+		Convey(`When subscribing to a topic with a retained message`, func() {
+			retained := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			retained.TopicName, retained.Payload, retained.Retain = "foo", []byte("bar"), true
+			s.RetainMessage(retained)
+
+			subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			subscribe.MessageID = 1
+			subscribe.Topics, subscribe.Qoss = []string{"foo"}, []byte{0}
+
+			pingreq := packets.NewControlPacket(packets.Pingreq)
+
+			retainedResponse := func(responses []packets.ControlPacket) (suback, publish int) {
+				suback, publish = -1, -1
+				for i, response := range responses {
+					switch response := response.(type) {
+					case *packets.SubackPacket:
+						suback = i
+					case *packets.PublishPacket:
+						if response.Retain && response.TopicName == "foo" {
+							publish = i
+						}
+					}
+				}
+				return
+			}
+
+			Convey(`When the listener sends retained messages on subscribe`, func() {
+				responses, _ := run(newConnect(), subscribe, pingreq)
+				Convey(`Then the retained message should be sent after the SUBACK`, func() {
+					suback, publish := retainedResponse(responses)
+					So(suback, ShouldBeGreaterThan, 0)
+					So(publish, ShouldBeGreaterThan, suback)
+				})
+			})
+
+			Convey(`When the listener does not send retained messages`, func() {
+				listener.SubscriptionOptions.RetainHandling = packets.DoNotSendRetained
+				responses, _ := run(newConnect(), subscribe, pingreq)
+				Convey(`Then the retained message should not be sent`, func() {
+					_, publish := retainedResponse(responses)
+					So(publish, ShouldEqual, -1)
+				})
+			})
+		})
+
+		Convey(`When connecting with enhanced authentication`, func() {
+			version = packets.Version5
+			s.AddAuthMethod(testAuthMethod{})
+
+			connect := newConnect()
+			connect.ProtocolVersion = packets.Version5
+			connect.Properties.AuthenticationMethod = "test"
+			connect.Properties.AuthenticationData = []byte("hello")
+
+			newAuth := func(reasonCode byte, data string) *packets.AuthPacket {
+				auth := packets.NewControlPacket(packets.Auth).(*packets.AuthPacket)
+				auth.ReasonCode = reasonCode
+				auth.Properties.AuthenticationMethod = "test"
+				auth.Properties.AuthenticationData = []byte(data)
+				return auth
+			}
+
+			Convey(`When the client responds to the challenge`, func() {
+				responses, err := run(connect, newAuth(packets.ContinueAuthentication, "response"), disconnect)
+				Convey(`Then the server should challenge the client and accept the connection`, func() {
+					So(err, ShouldEqual, io.EOF)
+					So(responses, ShouldHaveLength, 2)
+					So(responses[0], ShouldHaveSameTypeAs, new(packets.AuthPacket))
+					So(responses[0].(*packets.AuthPacket).ReasonCode, ShouldEqual, packets.ContinueAuthentication)
+					So(string(responses[0].(*packets.AuthPacket).Properties.AuthenticationData), ShouldEqual, "challenge")
+					So(responses[1], ShouldHaveSameTypeAs, new(packets.ConnackPacket))
+					So(responses[1].(*packets.ConnackPacket).ReturnCode, ShouldEqual, packets.Success)
+					So(string(responses[1].(*packets.ConnackPacket).Properties.AuthenticationData), ShouldEqual, "ok")
+				})
+			})
+
+			Convey(`When the client responds incorrectly`, func() {
+				responses, err := run(connect, newAuth(packets.ContinueAuthentication, "wrong"))
+				Convey(`Then the connection should be refused`, func() {
+					So(err, ShouldEqual, errNotAuthorized)
+					So(responses, ShouldHaveLength, 2)
+					So(responses[1].(*packets.ConnackPacket).ReturnCode, ShouldEqual, packets.NotAuthorized)
+				})
+			})
+
+			Convey(`When the client publishes during the exchange`, func() {
+				publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				publish.TopicName = "foo"
+				_, err := run(connect, publish)
+				Convey(`Then the server should return a protocol violation error`, func() { So(err, ShouldEqual, errProtocolViolation) })
+			})
+
+			Convey(`When the client uses an unknown method`, func() {
+				connect.Properties.AuthenticationMethod = "unknown"
+				responses, _ := run(connect)
+				Convey(`Then the connection should be refused`, func() {
+					So(responses, ShouldHaveLength, 1)
+					So(responses[0].(*packets.ConnackPacket).ReturnCode, ShouldEqual, packets.BadAuthenticationMethod)
+				})
+			})
+
+			Convey(`When the client re-authenticates`, func() {
+				responses, err := run(
+					connect, newAuth(packets.ContinueAuthentication, "response"),
+					newAuth(packets.ReAuthenticate, "hello"), newAuth(packets.ContinueAuthentication, "response"),
+					disconnect,
+				)
+				Convey(`Then the server should accept the re-authentication`, func() {
+					So(err, ShouldEqual, io.EOF)
+					So(responses, ShouldHaveLength, 4)
+					So(responses[2].(*packets.AuthPacket).ReasonCode, ShouldEqual, packets.ContinueAuthentication)
+					So(responses[3].(*packets.AuthPacket).ReasonCode, ShouldEqual, packets.Success)
+				})
+			})
+
+			Convey(`When the re-authentication fails`, func() {
+				responses, err := run(
+					connect, newAuth(packets.ContinueAuthentication, "response"),
+					newAuth(packets.ReAuthenticate, "wrong"),
+				)
+				Convey(`Then the server should disconnect the client`, func() {
+					So(err, ShouldEqual, errNotAuthorized)
+					So(responses, ShouldHaveLength, 3)
+					So(responses[2].(*packets.DisconnectPacket).ReasonCode, ShouldEqual, packets.NotAuthorized)
+				})
+			})
+		})
+
 		// TODO: Test other packet types
 
 	})
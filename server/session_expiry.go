@@ -0,0 +1,44 @@
+package server
+
+import (
+	"time"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
+)
+
+// noSessionExpiry is the MQTT 5 Session Expiry Interval for sessions that do not expire
+const noSessionExpiry = 0xFFFFFFFF
+
+// sessionExpiry returns the expiry interval and persistency for the session of a client
+// The expiry of the server or the user is used for MQTT 3.1.1 clients,
+// MQTT 5 clients can request a shorter expiry with the Session Expiry Interval.
+func (s *Server) sessionExpiry(connect *packets.ConnectPacket, a auth.Interface) (expiry time.Duration, persistent bool) {
+	expiry = s.sessionExpiryDefault
+	if expirer, ok := a.(auth.SessionExpirer); ok {
+		if userExpiry, ok := expirer.SessionExpiry(); ok {
+			expiry = userExpiry
+		}
+	}
+	if connect.ProtocolVersion < packets.Version5 {
+		return expiry, !connect.CleanSession
+	}
+	requested := connect.Properties.SessionExpiryInterval
+	if requested == nil || *requested == 0 {
+		return 0, false
+	}
+	if *requested != noSessionExpiry {
+		if d := time.Duration(*requested) * time.Second; expiry == 0 || d < expiry {
+			expiry = d
+		}
+	}
+	return expiry, true
+}
+
+// sessionExpiryInterval returns the MQTT 5 Session Expiry Interval for the given expiry
+func sessionExpiryInterval(expiry time.Duration) uint32 {
+	if expiry == 0 || expiry/time.Second >= noSessionExpiry {
+		return noSessionExpiry
+	}
+	return uint32(expiry / time.Second)
+}
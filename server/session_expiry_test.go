@@ -0,0 +1,103 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type userExpiry struct {
+	auth.Interface
+	expiry time.Duration
+}
+
+func (u userExpiry) SessionExpiry() (time.Duration, bool) { return u.expiry, true }
+
+// passwordFileUser returns the auth of a user with the given options in a password file
+func passwordFileUser(options string) (auth.Interface, error) {
+	dir, err := ioutil.TempDir("", "squatt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	secret, err := auth.SCRAMSecret([]byte("pencil"))
+	if err != nil {
+		return nil, err
+	}
+	passwordFile := filepath.Join(dir, "passwords")
+	if err = ioutil.WriteFile(passwordFile, []byte("user:"+secret+" "+options+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	passwords, err := auth.LoadPasswordFile(passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	return passwords.Plugin(auth.NoAuth)("foo", "user", []byte("pencil"))
+}
+
+func TestSessionExpiry(t *testing.T) {
+	Convey(`Given a Server with a session expiry`, t, func() {
+		s := NewServer()
+		s.SetSessionExpiry(time.Hour)
+		a, _ := auth.NoAuth("foo", "", nil)
+		connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		connect.ProtocolVersion = packets.Version311
+
+		Convey(`When an MQTT 3.1.1 client connects with a persistent session`, func() {
+			expiry, persistent := s.sessionExpiry(connect, a)
+			Convey(`Then the session should use the expiry of the server`, func() {
+				So(persistent, ShouldBeTrue)
+				So(expiry, ShouldEqual, time.Hour)
+			})
+		})
+
+		Convey(`When an MQTT 3.1.1 client connects with a clean session`, func() {
+			connect.CleanSession = true
+			_, persistent := s.sessionExpiry(connect, a)
+			Convey(`Then the session should not be persistent`, func() { So(persistent, ShouldBeFalse) })
+		})
+
+		Convey(`When a user with an expiry override connects`, func() {
+			expiry, _ := s.sessionExpiry(connect, userExpiry{a, time.Minute})
+			Convey(`Then the session should use the expiry of the user`, func() { So(expiry, ShouldEqual, time.Minute) })
+		})
+
+		Convey(`When a user with a session expiry in the password file connects`, func() {
+			a, err := passwordFileUser("session-expiry=1m")
+			So(err, ShouldBeNil)
+			expiry, _ := s.sessionExpiry(connect, a)
+			Convey(`Then the session should use the expiry of the user`, func() { So(expiry, ShouldEqual, time.Minute) })
+		})
+
+		Convey(`When an MQTT 5 client connects`, func() {
+			connect.ProtocolVersion = packets.Version5
+			Convey(`Without Session Expiry Interval`, func() {
+				_, persistent := s.sessionExpiry(connect, a)
+				Convey(`Then the session should not be persistent`, func() { So(persistent, ShouldBeFalse) })
+			})
+			Convey(`With a short Session Expiry Interval`, func() {
+				connect.Properties.SessionExpiryInterval = packets.Uint32(60)
+				expiry, persistent := s.sessionExpiry(connect, a)
+				Convey(`Then the session should use the requested expiry`, func() {
+					So(persistent, ShouldBeTrue)
+					So(expiry, ShouldEqual, time.Minute)
+				})
+			})
+			Convey(`With a Session Expiry Interval that does not expire`, func() {
+				connect.Properties.SessionExpiryInterval = packets.Uint32(noSessionExpiry)
+				expiry, persistent := s.sessionExpiry(connect, a)
+				Convey(`Then the session should use the expiry of the server`, func() {
+					So(persistent, ShouldBeTrue)
+					So(expiry, ShouldEqual, time.Hour)
+					So(sessionExpiryInterval(expiry), ShouldEqual, 3600)
+				})
+			})
+		})
+	})
+}
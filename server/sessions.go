@@ -0,0 +1,57 @@
+package server
+
+import "github.com/htdvisser/squatt/packets"
+
+// SubscriptionState is the state of a subscription that can be moved to another server
+type SubscriptionState struct {
+	Filter     string
+	QoS        byte
+	Options    packets.SubscriptionOptions
+	Identifier uint32
+}
+
+func subscriptionState(sub *Subscription) SubscriptionState {
+	return SubscriptionState{
+		Filter:     sub.topic.Name(),
+		QoS:        sub.qos.Load().(byte),
+		Options:    sub.Options(),
+		Identifier: sub.Identifier(),
+	}
+}
+
+// TakeOverSession disconnects the client with the given identifier with reason Session Taken Over, deletes its
+// session and returns the subscriptions of the session
+// This is used when the client connected to another node of a cluster.
+func (s *Server) TakeOverSession(clientID string) []SubscriptionState {
+	session, ok := s.sessions.Get(clientID)
+	if !ok {
+		return nil
+	}
+	subs := s.SessionSubscriptions(session)
+	states := make([]SubscriptionState, 0, len(subs))
+	for _, sub := range subs {
+		states = append(states, subscriptionState(sub))
+	}
+	session.DisconnectWithReason(packets.SessionTakenOver)
+	s.sessions.Delete(clientID)
+	return states
+}
+
+// RestoreSubscriptions adds the subscriptions to the session of the client with the given identifier
+// Subscriptions to topic filters that the session already subscribed to are not changed.
+func (s *Server) RestoreSubscriptions(clientID string, states []SubscriptionState) {
+	session, ok := s.sessions.Get(clientID)
+	if !ok {
+		return
+	}
+	subscribed := make(map[string]bool)
+	for _, sub := range s.SessionSubscriptions(session) {
+		subscribed[sub.topic.Name()] = true
+	}
+	for _, state := range states {
+		if subscribed[state.Filter] {
+			continue
+		}
+		s.SubscribeWithOptions(session, s.topics.Get(state.Filter), state.QoS, state.Options, state.Identifier)
+	}
+}
@@ -3,16 +3,18 @@ package server
 import (
 	"sync/atomic"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/htdvisser/squatt/packets"
 	"github.com/htdvisser/squatt/session"
 	"github.com/htdvisser/squatt/topic"
 )
 
-// Subscription of session->topic with a qos
+// Subscription of session->topic with a qos, options and identifier
 type Subscription struct {
-	topic   *topic.Topic
-	session *session.Session
-	qos     atomic.Value
+	topic      *topic.Topic
+	session    *session.Session
+	qos        atomic.Value
+	options    atomic.Value // packets.SubscriptionOptions
+	identifier atomic.Value // uint32, zero if the subscription has no identifier
 }
 
 // NewSubscription returns a new Subscription
@@ -20,17 +22,77 @@ type Subscription struct {
 func NewSubscription(session *session.Session, topic *topic.Topic, qos byte) *Subscription {
 	sub := &Subscription{session: session, topic: topic}
 	sub.qos.Store(qos)
+	sub.options.Store(packets.SubscriptionOptions{})
+	sub.identifier.Store(uint32(0))
 	return sub
 }
 
+// Options of the subscription
+func (s *Subscription) Options() packets.SubscriptionOptions {
+	return s.options.Load().(packets.SubscriptionOptions)
+}
+
+// Identifier of the subscription
+func (s *Subscription) Identifier() uint32 {
+	return s.identifier.Load().(uint32)
+}
+
 // Deliver a copy of msg to the subscription
+// Messages of the session itself are not delivered if the subscription has the No Local option.
 func (s *Subscription) Deliver(msg *packets.PublishPacket) {
-	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
-	publish.TopicName = msg.TopicName
-	publish.Payload = msg.Payload
+	deliverToSession(msg, packets.NewDeliverySize(msg), []*Subscription{s})
+}
+
+// DeliverRetained delivers a copy of retained msg to the subscription, with the RETAIN flag set
+func (s *Subscription) DeliverRetained(msg *packets.PublishPacket) {
+	var identifiers []uint32
+	if identifier := s.Identifier(); identifier != 0 {
+		identifiers = append(identifiers, identifier)
+	}
+	s.session.SendPublish(newDelivery(msg, packets.NewDeliverySize(msg), s.qos.Load().(byte), true, identifiers))
+}
+
+// deliverToSession delivers a copy of msg once to the session of the given subscriptions
+// The subscriptions must all be of the same session. The copy gets the highest QoS of the subscriptions,
+// and the identifiers of all subscriptions. The size of the deliveries of msg is computed once by the caller.
+func deliverToSession(msg *packets.PublishPacket, size packets.DeliverySize, subs []*Subscription) {
+	var (
+		session     *session.Session
+		qos         byte
+		retain      bool
+		identifiers []uint32
+	)
+	for _, sub := range subs {
+		options := sub.Options()
+		if options.NoLocal && msg.Origin == sub.session.Name() {
+			continue
+		}
+		session = sub.session
+		if subQos := sub.qos.Load().(byte); subQos > qos {
+			qos = subQos
+		}
+		if options.RetainAsPublished && msg.Retain {
+			retain = true
+		}
+		if identifier := sub.Identifier(); identifier != 0 {
+			identifiers = append(identifiers, identifier)
+		}
+	}
+	if session == nil {
+		return
+	}
+	session.SendPublish(newDelivery(msg, size, qos, retain, identifiers))
+}
+
+// newDelivery returns a copy of msg for delivery with at most the given QoS
+func newDelivery(msg *packets.PublishPacket, size packets.DeliverySize, qos byte, retain bool, identifiers []uint32) *packets.PublishPacket {
+	publish := msg.Copy()
 	publish.Qos = msg.Qos
-	if qos := s.qos.Load().(byte); qos < publish.Qos {
+	if qos < publish.Qos {
 		publish.Qos = qos
 	}
-	s.session.SendPublish(publish)
+	publish.Retain = retain
+	publish.Properties.SubscriptionIdentifiers = identifiers
+	publish.Size, _ = size.Size(publish.Qos, identifiers) // zero if msg can not be encoded
+	return publish
 }
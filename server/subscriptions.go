@@ -3,8 +3,8 @@ package server
 import (
 	"sort"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/htdvisser/pkg/sortutil"
+	"github.com/htdvisser/squatt/packets"
 	"github.com/htdvisser/squatt/session"
 	"github.com/htdvisser/squatt/topic"
 )
@@ -70,6 +70,13 @@ func (l subscriptionsByTopic) Remove(s *Subscription) subscriptionsByTopic {
 
 // Subscribe a session to a topic and return the subscription
 func (s *Server) Subscribe(session *session.Session, topic *topic.Topic, qos byte) (subscription *Subscription) {
+	subscription, _ = s.SubscribeWithOptions(session, topic, qos, packets.SubscriptionOptions{}, 0)
+	return
+}
+
+// SubscribeWithOptions subscribes a session to a topic with the given options and subscription identifier
+// It returns the subscription, and whether the subscription already existed
+func (s *Server) SubscribeWithOptions(session *session.Session, topic *topic.Topic, qos byte, options packets.SubscriptionOptions, identifier uint32) (subscription *Subscription, existed bool) {
 	s.subscriptionsMu.Lock()
 	defer s.subscriptionsMu.Unlock()
 
@@ -77,11 +84,18 @@ func (s *Server) Subscribe(session *session.Session, topic *topic.Topic, qos byt
 	if ok {
 		if subscription, ok = sessionSubscriptions.Load(topic); ok {
 			subscription.qos.Store(qos)
-			return
+			subscription.options.Store(options)
+			subscription.identifier.Store(identifier)
+			return subscription, true
 		}
 	}
 	topicSubscriptions, _ := s.topicSubscriptions[topic]
+	if len(topicSubscriptions) == 0 && s.hooks.Subscribe != nil {
+		s.hooks.Subscribe(topic.Name())
+	}
 	subscription = NewSubscription(session, topic, qos)
+	subscription.options.Store(options)
+	subscription.identifier.Store(identifier)
 
 	s.sessionSubscriptions[session] = sessionSubscriptions.Insert(subscription)
 	s.topicSubscriptions[topic] = topicSubscriptions.Insert(subscription)
@@ -122,6 +136,9 @@ func (s *Server) Unsubscribe(session *session.Session, topic ...*topic.Topic) {
 			s.topicSubscriptions[topic] = topicSubscriptions
 		} else {
 			delete(s.topicSubscriptions, topic)
+			if s.hooks.Unsubscribe != nil {
+				s.hooks.Unsubscribe(topic.Name())
+			}
 		}
 	}
 
@@ -148,6 +165,32 @@ func (s *Server) TopicSubscriptions(topic ...*topic.Topic) (subs []*Subscription
 	return
 }
 
+// SubscribedFilters returns the topic filters that have subscriptions
+func (s *Server) SubscribedFilters() (filters []string) {
+	s.subscriptionsMu.RLock()
+	defer s.subscriptionsMu.RUnlock()
+	for topic := range s.topicSubscriptions {
+		filters = append(filters, topic.Name())
+	}
+	return
+}
+
+// groupBySession groups the subscriptions by session, in order of their first subscription
+func groupBySession(subs []*Subscription) [][]*Subscription {
+	index := make(map[*session.Session]int, len(subs))
+	var grouped [][]*Subscription
+	for _, sub := range subs {
+		i, ok := index[sub.session]
+		if !ok {
+			i = len(grouped)
+			index[sub.session] = i
+			grouped = append(grouped, nil)
+		}
+		grouped[i] = append(grouped[i], sub)
+	}
+	return grouped
+}
+
 // Publish returns the publish channel
 func (s *Server) Publish() chan<- *packets.PublishPacket {
 	return s.publish
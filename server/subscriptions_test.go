@@ -3,7 +3,7 @@ package server
 import (
 	"testing"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/htdvisser/squatt/packets"
 	"github.com/htdvisser/squatt/session"
 	"github.com/htdvisser/squatt/topic"
 	. "github.com/smartystreets/goconvey/convey"
@@ -24,6 +24,67 @@ func TestSubscription(t *testing.T) {
 			Convey(`Then the message should be delivered to the session`, func() { So(ch, ShouldNotBeEmpty) })
 			Convey(`Then the QoS should be downgraded to 1`, func() { So((<-ch).(*packets.PublishPacket).Qos, ShouldEqual, 1) })
 		})
+
+		Convey(`When delivering a retained message`, func() {
+			msg := new(packets.PublishPacket)
+			msg.Retain = true
+			s.Deliver(msg)
+			Convey(`Then the retain flag should not be set`, func() { So((<-ch).(*packets.PublishPacket).Retain, ShouldBeFalse) })
+			Convey(`When the subscription has the Retain As Published option`, func() {
+				<-ch
+				s.options.Store(packets.SubscriptionOptions{RetainAsPublished: true})
+				s.Deliver(msg)
+				Convey(`Then the retain flag should be set`, func() { So((<-ch).(*packets.PublishPacket).Retain, ShouldBeTrue) })
+			})
+		})
+
+		Convey(`When delivering a retained message because of a new subscription`, func() {
+			msg := new(packets.PublishPacket)
+			msg.Retain = true
+			s.DeliverRetained(msg)
+			Convey(`Then the retain flag should be set`, func() { So((<-ch).(*packets.PublishPacket).Retain, ShouldBeTrue) })
+		})
+
+		Convey(`When delivering a message of the session itself`, func() {
+			msg := new(packets.PublishPacket)
+			msg.Origin = "foo"
+			Convey(`When the subscription has the No Local option`, func() {
+				s.options.Store(packets.SubscriptionOptions{NoLocal: true})
+				s.Deliver(msg)
+				Convey(`Then the message should not be delivered`, func() { So(ch, ShouldBeEmpty) })
+			})
+			Convey(`When the subscription does not have the No Local option`, func() {
+				s.Deliver(msg)
+				Convey(`Then the message should be delivered`, func() { So(ch, ShouldNotBeEmpty) })
+			})
+		})
+
+		Convey(`When delivering a request message`, func() {
+			msg := new(packets.PublishPacket)
+			msg.Properties.ResponseTopic = "reply"
+			msg.Properties.CorrelationData = []byte("correlation")
+			s.Deliver(msg)
+			Convey(`Then the response topic and correlation data should be delivered`, func() {
+				delivered := (<-ch).(*packets.PublishPacket)
+				So(delivered, ShouldNotEqual, msg)
+				So(delivered.Properties.ResponseTopic, ShouldEqual, "reply")
+				So(delivered.Properties.CorrelationData, ShouldResemble, []byte("correlation"))
+			})
+		})
+
+		Convey(`When delivering a message with user properties and content type`, func() {
+			msg := new(packets.PublishPacket)
+			msg.Properties.UserProperties = []packets.UserProperty{{Key: "foo", Value: "bar"}}
+			msg.Properties.ContentType = "application/json"
+			msg.Properties.PayloadFormatIndicator = packets.Byte(1)
+			s.Deliver(msg)
+			Convey(`Then the properties should be delivered`, func() {
+				delivered := (<-ch).(*packets.PublishPacket)
+				So(delivered.Properties.UserProperties, ShouldResemble, msg.Properties.UserProperties)
+				So(delivered.Properties.ContentType, ShouldEqual, "application/json")
+				So(*delivered.Properties.PayloadFormatIndicator, ShouldEqual, 1)
+			})
+		})
 	})
 
 	Convey(`Testing server subscriptions`, t, func() {
@@ -59,3 +120,43 @@ func TestSubscription(t *testing.T) {
 		s.Unsubscribe(fooSession, barTopic)
 	})
 }
+
+func TestDeliverToSession(t *testing.T) {
+	Convey(`Given a Server with overlapping subscriptions of a session`, t, func() {
+		s := NewServer()
+		fooSession := session.NewSession("foo")
+		ch := make(chan packets.ControlPacket, 2)
+		fooSession.Connect(ch)
+		barSession := session.NewSession("bar")
+
+		s.SubscribeWithOptions(fooSession, s.topics.Get("foo/#"), 0, packets.SubscriptionOptions{}, 1)
+		s.SubscribeWithOptions(barSession, s.topics.Get("foo/+"), 1, packets.SubscriptionOptions{}, 0)
+		s.SubscribeWithOptions(fooSession, s.topics.Get("foo/bar"), 1, packets.SubscriptionOptions{}, 2)
+
+		Convey(`When grouping the matching subscriptions by session`, func() {
+			grouped := groupBySession(s.TopicSubscriptions(s.topics.Match("foo/bar")...))
+			Convey(`Then there should be a group for each session`, func() {
+				So(grouped, ShouldHaveLength, 2)
+				for _, subs := range grouped {
+					for _, sub := range subs {
+						So(sub.session, ShouldEqual, subs[0].session)
+					}
+				}
+			})
+		})
+
+		Convey(`When delivering a message to the matching subscriptions of the session`, func() {
+			msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			msg.TopicName, msg.Qos = "foo/bar", 2
+			deliverToSession(msg, packets.NewDeliverySize(msg), s.SessionSubscriptions(fooSession))
+			Convey(`Then the message should be delivered once`, func() { So(ch, ShouldHaveLength, 1) })
+			Convey(`Then it should have the highest QoS and all subscription identifiers`, func() {
+				delivered := (<-ch).(*packets.PublishPacket)
+				So(delivered.Qos, ShouldEqual, 1)
+				So(delivered.Properties.SubscriptionIdentifiers, ShouldHaveLength, 2)
+				So(delivered.Properties.SubscriptionIdentifiers, ShouldContain, uint32(1))
+				So(delivered.Properties.SubscriptionIdentifiers, ShouldContain, uint32(2))
+			})
+		})
+	})
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/htdvisser/squatt/packets"
+)
+
+// TopicAliasMaximum is the number of topic aliases that MQTT 5 clients can use when publishing
+var TopicAliasMaximum uint16 = 16
+
+var errTopicAliasInvalid = errors.New("topic alias invalid")
+
+// resolveTopicAlias sets the topic name of a PUBLISH packet that uses a topic alias
+// The topic alias is removed from the packet, so that it is not forwarded to subscribers.
+func (c *Client) resolveTopicAlias(packet *packets.PublishPacket) error {
+	alias := packet.Properties.TopicAlias
+	if alias == nil {
+		return nil
+	}
+	packet.Properties.TopicAlias = nil
+	if *alias == 0 || *alias > c.topicAliasMaximum {
+		return errTopicAliasInvalid
+	}
+	if packet.TopicName == "" {
+		topicName, ok := c.topicAliases[*alias]
+		if !ok {
+			return errTopicAliasInvalid
+		}
+		packet.TopicName = topicName
+		return nil
+	}
+	c.topicAliases[*alias] = packet.TopicName
+	return nil
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResolveTopicAlias(t *testing.T) {
+	Convey(`Given a Client that accepts 2 topic aliases`, t, func() {
+		c := &Client{topicAliasMaximum: 2, topicAliases: make(map[uint16]string)}
+
+		publish := func(topic string, alias uint16) (*packets.PublishPacket, error) {
+			msg := &packets.PublishPacket{TopicName: topic}
+			msg.Properties.TopicAlias = packets.Uint16(alias)
+			return msg, c.resolveTopicAlias(msg)
+		}
+
+		Convey(`When publishing with a topic name and alias`, func() {
+			msg, err := publish("foo", 1)
+			So(err, ShouldBeNil)
+			Convey(`Then the alias should be removed from the message`, func() { So(msg.Properties.TopicAlias, ShouldBeNil) })
+			Convey(`When publishing with only the alias`, func() {
+				msg, err := publish("", 1)
+				Convey(`Then the topic name should be set`, func() {
+					So(err, ShouldBeNil)
+					So(msg.TopicName, ShouldEqual, "foo")
+				})
+			})
+		})
+
+		Convey(`When publishing with an unknown alias`, func() {
+			_, err := publish("", 2)
+			Convey(`Then there should be an error`, func() { So(err, ShouldEqual, errTopicAliasInvalid) })
+		})
+
+		Convey(`When publishing with an alias above the maximum`, func() {
+			_, err := publish("foo", 3)
+			Convey(`Then there should be an error`, func() { So(err, ShouldEqual, errTopicAliasInvalid) })
+		})
+	})
+}
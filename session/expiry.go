@@ -0,0 +1,38 @@
+package session
+
+import "time"
+
+// SetExpiry sets the interval after which a persistent session expires when its client is disconnected
+// An expiry of zero means that the session does not expire.
+func (s *Session) SetExpiry(expiry time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiry = expiry
+}
+
+// Expiry returns the session expiry interval
+func (s *Session) Expiry() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiry
+}
+
+// Expired returns true if the session was disconnected for longer than its expiry interval at the given time
+func (s *Session) Expired(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.outCh != nil || s.expiry == 0 || s.disconnected.IsZero() {
+		return false
+	}
+	return now.Sub(s.disconnected) >= s.expiry
+}
+
+// claim restarts the expiry of a disconnected session that is taken by a new connection, so that it does not expire
+// before the client is connected. If the client never connects, the session still expires.
+func (s *Session) claim() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.outCh == nil && !s.disconnected.IsZero() {
+		s.disconnected = time.Now()
+	}
+}
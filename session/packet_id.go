@@ -0,0 +1,25 @@
+package session
+
+// packetIDInUse returns true if the packet identifier is used by an in-flight message to the client.
+// The caller must hold pendingMu
+func (s *Session) packetIDInUse(packetID uint16) bool {
+	return s.pendingAck.Index(packetID) != -1 ||
+		s.pendingRec.Index(packetID) != -1 ||
+		s.pendingComp.Index(packetID) != -1
+}
+
+// nextPacketID returns the next packet identifier that is not in use by an in-flight message.
+// The reserved packet identifier 0 is never returned. If all packet identifiers are in use, ok is false.
+// The caller must hold pendingMu
+func (s *Session) nextPacketID() (packetID uint16, ok bool) {
+	for i := 0; i < 1<<16; i++ {
+		s.lastPacketID++
+		if s.lastPacketID == 0 {
+			continue // Packet Identifier 0 is reserved [MQTT-2.3.1-1]
+		}
+		if !s.packetIDInUse(s.lastPacketID) {
+			return s.lastPacketID, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,146 @@
+package session
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"testing/quick"
+
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNextPacketID(t *testing.T) {
+	Convey(`Given a Session`, t, func() {
+		s := NewSession("foo")
+
+		Convey(`Then the next packet ID should be the first free non-zero ID after the last one`, func() {
+			property := func(last uint16, inUse []uint16) bool {
+				s.initialize()
+				s.lastPacketID = last
+				used := make(map[uint16]bool)
+				for _, id := range inUse {
+					if !used[id] {
+						used[id] = true
+						s.pendingAck = s.pendingAck.Insert(&packets.PublishPacket{MessageID: id})
+					}
+				}
+				packetID, ok := s.nextPacketID()
+				if !ok || packetID == 0 || used[packetID] {
+					return false
+				}
+				for id := last + 1; id != packetID; id++ {
+					if id != 0 && !used[id] {
+						return false // skipped a free ID
+					}
+				}
+				return s.lastPacketID == packetID
+			}
+			So(quick.Check(property, nil), ShouldBeNil)
+		})
+
+		Convey(`When the last packet ID is the maximum`, func() {
+			s.lastPacketID = 0xffff
+			Convey(`Then the next packet ID should wrap around to 1`, func() {
+				packetID, ok := s.nextPacketID()
+				So(ok, ShouldBeTrue)
+				So(packetID, ShouldEqual, 1)
+			})
+		})
+
+		Convey(`When all packet IDs are in use`, func() {
+			for id := 1; id < 1<<16; id++ {
+				s.pendingAck = append(s.pendingAck, &packets.PublishPacket{MessageID: uint16(id)})
+			}
+			Convey(`Then no packet ID should be returned`, func() {
+				_, ok := s.nextPacketID()
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestPacketIDWraparound(t *testing.T) {
+	Convey(`Given a connected Session`, t, func() {
+		s := NewSession("foo")
+		ch := make(chan packets.ControlPacket, InFlightLimit*4)
+		s.Connect(ch)
+
+		Convey(`When sending and acknowledging messages in random order through packet ID wraparound`, func() {
+			rnd := rand.New(rand.NewSource(1))
+			inFlight := make(map[uint16]byte) // packet ID -> QoS of the message the client has not completed
+			var published, zeroIDs, collisions, unsorted int
+
+			isValid := func(p pendingMessages) bool {
+				if !sort.IsSorted(p) {
+					return false
+				}
+				for i := 1; i < p.Len(); i++ {
+					if p[i].Details().MessageID == p[i-1].Details().MessageID {
+						return false
+					}
+				}
+				return true
+			}
+
+			for published < 3<<16 {
+				if rnd.Intn(3) > 0 {
+					msg := &packets.PublishPacket{TopicName: "foo"}
+					msg.Qos = byte(1 + rnd.Intn(2))
+					s.SendPublish(msg)
+				}
+			drain:
+				for {
+					select {
+					case pkt := <-ch:
+						publish, ok := pkt.(*packets.PublishPacket)
+						if !ok || publish.Dup {
+							continue
+						}
+						published++
+						if publish.MessageID == 0 {
+							zeroIDs++
+						}
+						if _, ok := inFlight[publish.MessageID]; ok {
+							collisions++
+						}
+						inFlight[publish.MessageID] = publish.Qos
+					default:
+						break drain
+					}
+				}
+				if len(inFlight) > 0 && rnd.Intn(2) == 0 {
+					ids := make([]uint16, 0, len(inFlight))
+					for id := range inFlight {
+						ids = append(ids, id)
+					}
+					sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+					id := ids[rnd.Intn(len(ids))]
+					switch inFlight[id] {
+					case 1:
+						delete(inFlight, id)
+						s.ReceivePuback(&packets.PubackPacket{MessageID: id})
+					case 2:
+						inFlight[id] = 3 // waiting for PUBREL/PUBCOMP
+						s.ReceivePubrec(&packets.PubrecPacket{MessageID: id})
+					case 3:
+						delete(inFlight, id)
+						s.ReceivePubcomp(&packets.PubcompPacket{MessageID: id})
+					}
+				}
+				s.pendingMu.Lock()
+				if !isValid(s.pendingAck) || !isValid(s.pendingRec) || !isValid(s.pendingComp) {
+					unsorted++
+				}
+				s.pendingMu.Unlock()
+			}
+
+			Convey(`Then the packet IDs and pending queues should stay valid`, func() {
+				So(zeroIDs, ShouldEqual, 0)                                // no message should have packet ID 0
+				So(collisions, ShouldEqual, 0)                             // no message should reuse a packet ID that is still in flight
+				So(unsorted, ShouldEqual, 0)                               // the pending queues should stay sorted without duplicates
+				So(s.inFlight(), ShouldBeLessThanOrEqualTo, InFlightLimit) // the in-flight window should not be exceeded
+			})
+		})
+	})
+}
@@ -2,9 +2,10 @@ package session
 
 import (
 	"sort"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/htdvisser/pkg/sortutil"
+	"github.com/htdvisser/squatt/packets"
 )
 
 type pendingMessages []packets.ControlPacket
@@ -39,6 +40,18 @@ func (p pendingMessages) Remove(messageID uint16) pendingMessages {
 	return p
 }
 
+// removeExpired removes the PUBLISH packets that expired at the given time
+func (p pendingMessages) removeExpired(now time.Time) pendingMessages {
+	updated := p[:0]
+	for _, msg := range p {
+		if publish, ok := msg.(*packets.PublishPacket); ok && publish.Expired(now) {
+			continue
+		}
+		updated = append(updated, msg)
+	}
+	return updated
+}
+
 func (s *Session) inFlight() int {
 	return s.pendingAck.Len() + s.pendingRec.Len() + s.pendingRel.Len() + s.pendingComp.Len()
 }
@@ -3,7 +3,7 @@ package session
 import (
 	"testing"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/htdvisser/squatt/packets"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -1,39 +1,92 @@
 package session
 
 import (
-	"sync/atomic"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/htdvisser/squatt/packets"
 	"go.uber.org/zap"
 )
 
-func (s *Session) pubCounter() uint64 {
-	return atomic.AddUint64(&s._pubCounter, 1)
-}
-
 // SendPublish sends the msg to the client
+// Messages with QoS > 0 are queued and get a packet identifier when they enter the in-flight window
 func (s *Session) SendPublish(msg *packets.PublishPacket) {
-	if msg.Qos > 0 {
-		msg.MessageID = uint16(s.pubCounter())
+	if !s.CanSubscribeTo(msg.TopicName) {
+		return
+	}
+	if msg.Expired(time.Now()) {
+		return
+	}
+	if s.exceedsMaximumPacketSize(msg) {
+		s.log.Debug("drop message that exceeds maximum packet size", zap.String("topic", msg.TopicName))
+		return
+	}
+	if msg.Qos == 0 {
 		s.pendingMu.Lock()
-		s.pendingPub = s.pendingPub.Insert(msg)
-		if PublishQueueLimit != 0 && s.pendingPub.Len() > PublishQueueLimit {
-			s.pendingPub = s.pendingPub[s.pendingPub.Len()-PublishQueueLimit:]
-		}
+		room := s.inFlight() < s.inFlightLimit
 		s.pendingMu.Unlock()
+		if room {
+			s.send(msg)
+		}
+		return
+	}
+	s.pendingMu.Lock()
+	msg.MessageID = 0
+	s.pendingPub = append(s.pendingPub, msg)
+	s.limitPublishQueue()
+	s.pendingMu.Unlock()
+	s.sendPending()
+}
+
+// limitPublishQueue drops messages from the publish queue while it exceeds its limit, oldest first
+// Expired messages are dropped first. The caller must hold pendingMu.
+func (s *Session) limitPublishQueue() {
+	if s.publishQueueLimit == 0 || s.pendingPub.Len() <= s.publishQueueLimit {
+		return
 	}
-	if s.CanSubscribeTo(msg.TopicName) && s.inFlight() < InFlightLimit && s.send(msg) {
+	s.pendingPub = s.pendingPub.removeExpired(time.Now())
+	if s.pendingPub.Len() > s.publishQueueLimit {
+		s.pendingPub = s.pendingPub[s.pendingPub.Len()-s.publishQueueLimit:]
+	}
+}
+
+// SetQueueLimits sets the limits of the publish queue and the in-flight window of the session
+// A publish queue limit of zero means that the queue is not limited. Messages that are in flight stay in flight.
+func (s *Session) SetQueueLimits(publishQueue, inFlight int) {
+	s.pendingMu.Lock()
+	s.publishQueueLimit, s.inFlightLimit = publishQueue, inFlight
+	s.limitPublishQueue()
+	s.pendingMu.Unlock()
+	s.sendPending() // the in-flight window may have grown
+}
+
+// sendPending moves queued messages into the in-flight window while there is room for them
+// Queued messages that expired are dropped
+func (s *Session) sendPending() {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	now := time.Now()
+	for s.pendingPub.Len() > 0 && s.inFlight() < s.inFlightLimit {
+		msg := s.pendingPub[0].(*packets.PublishPacket)
+		if msg.Expired(now) {
+			s.log.Debug("drop expired message", zap.String("topic", msg.TopicName))
+			s.pendingPub = s.pendingPub[1:]
+			continue
+		}
+		packetID, ok := s.nextPacketID()
+		if !ok {
+			return
+		}
+		msg.MessageID = packetID
+		if !s.send(msg) {
+			msg.MessageID = 0
+			return
+		}
+		s.pendingPub = s.pendingPub[1:]
 		switch msg.Qos {
 		case 1:
-			s.pendingMu.Lock()
-			s.pendingPub = s.pendingPub.Remove(msg.MessageID)
 			s.pendingAck = s.pendingAck.Insert(msg)
-			s.pendingMu.Unlock()
 		case 2:
-			s.pendingMu.Lock()
-			s.pendingPub = s.pendingPub.Remove(msg.MessageID)
 			s.pendingRec = s.pendingRec.Insert(msg)
-			s.pendingMu.Unlock()
 		}
 	}
 }
@@ -50,6 +103,7 @@ func (s *Session) ReceivePublish(msg *packets.PublishPacket) {
 	}
 	if !dup && s.CanPublishTo(msg.TopicName) {
 		s.log.Debug("publish", zap.String("topic", msg.TopicName), zap.Int("size", len(msg.Payload)))
+		msg.Origin = s.name
 		s.deliver(msg)
 	}
 	switch msg.Qos {
@@ -61,6 +115,22 @@ func (s *Session) ReceivePublish(msg *packets.PublishPacket) {
 	}
 }
 
+// DropPublish acknowledges the msg from the client without publishing it
+// MQTT 5 clients get the reason code in the PUBACK or PUBREC, which ends the QoS 2 flow.
+func (s *Session) DropPublish(msg *packets.PublishPacket, reasonCode byte) {
+	s.log.Debug("drop publish", zap.String("topic", msg.TopicName), zap.Uint8("reason", reasonCode))
+	switch msg.Qos {
+	case 1:
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID, puback.ReasonCode = msg.MessageID, reasonCode
+		s.send(puback)
+	case 2:
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID, pubrec.ReasonCode = msg.MessageID, reasonCode
+		s.send(pubrec)
+	}
+}
+
 // SendPuback sends a Puback to the client
 func (s *Session) SendPuback(msgID uint16) {
 	puback := packets.NewControlPacket(packets.Puback)
@@ -73,6 +143,7 @@ func (s *Session) ReceivePuback(msg *packets.PubackPacket) {
 	s.pendingMu.Lock()
 	s.pendingAck = s.pendingAck.Remove(msg.MessageID)
 	s.pendingMu.Unlock()
+	s.sendPending()
 }
 
 // SendPubrec sends a Pubrec to the client
@@ -121,14 +192,14 @@ func (s *Session) SendPubcomp(msgID uint16) {
 // ReceivePubcomp receives the msg from the client
 func (s *Session) ReceivePubcomp(msg *packets.PubcompPacket) {
 	s.pendingMu.Lock()
-	defer s.pendingMu.Unlock()
 	s.pendingComp = s.pendingComp.Remove(msg.MessageID)
+	s.pendingMu.Unlock()
+	s.sendPending()
 }
 
 // ResendPending re-sends all pending messages
 func (s *Session) ResendPending() {
 	s.pendingMu.Lock()
-	defer s.pendingMu.Unlock()
 	for _, msg := range s.pendingComp { // re-send all PUBREL packets that have not been PUBCOMPed
 		msg.(*packets.PubrelPacket).Dup = true
 		s.send(msg)
@@ -141,7 +212,6 @@ func (s *Session) ResendPending() {
 		msg.(*packets.PublishPacket).Dup = true
 		s.send(msg)
 	}
-	for _, msg := range s.pendingPub { // send all PUBLISH packets that have not been sent before
-		s.send(msg)
-	}
+	s.pendingMu.Unlock()
+	s.sendPending() // send all PUBLISH packets that have not been sent before
 }
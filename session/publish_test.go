@@ -2,8 +2,9 @@ package session
 
 import (
 	"testing"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/htdvisser/squatt/packets"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -20,14 +21,14 @@ func TestPublish(t *testing.T) {
 			msg := msg
 			msg.Qos = 1
 			s.SendPublish(&msg)
-			Convey(`Then it should have a message ID`, func() { So(msg.MessageID, ShouldNotEqual, 0) })
+			Convey(`Then it should not have a message ID yet`, func() { So(msg.MessageID, ShouldEqual, 0) })
 			Convey(`Then it should be in the publish queue`, func() { So(s.pendingPub, ShouldNotBeEmpty) })
 		})
 		Convey(`When sending a QoS 2 Publish Message`, func() {
 			msg := msg
 			msg.Qos = 2
 			s.SendPublish(&msg)
-			Convey(`Then it should have a message ID`, func() { So(msg.MessageID, ShouldNotEqual, 0) })
+			Convey(`Then it should not have a message ID yet`, func() { So(msg.MessageID, ShouldEqual, 0) })
 			Convey(`Then it should be in the publish queue`, func() { So(s.pendingPub, ShouldNotBeEmpty) })
 		})
 		Convey(`When the session has a client channel`, func() {
@@ -76,6 +77,78 @@ func TestPublish(t *testing.T) {
 					})
 				})
 			})
+			Convey(`When the in-flight window is full`, func() {
+				for i := 0; i < InFlightLimit; i++ {
+					s.pendingAck = s.pendingAck.Insert(&packets.PublishPacket{MessageID: uint16(i + 1)})
+				}
+				msg := msg
+				msg.Qos = 1
+				s.SendPublish(&msg)
+				Convey(`Then it should not have a message ID yet`, func() { So(msg.MessageID, ShouldEqual, 0) })
+				Convey(`Then it should be in the publish queue`, func() { So(s.pendingPub, ShouldNotBeEmpty) })
+				Convey(`Then it should not be in the client channel`, func() { So(ch, ShouldBeEmpty) })
+				Convey(`When receiving a Puback Message`, func() {
+					s.ReceivePuback(&packets.PubackPacket{MessageID: 1})
+					Convey(`Then it should be sent with the freed message ID`, func() {
+						So(ch, ShouldNotBeEmpty)
+						So(<-ch, ShouldEqual, &msg)
+						So(msg.MessageID, ShouldEqual, 1)
+					})
+					Convey(`Then it should no longer be in the publish queue`, func() { So(s.pendingPub, ShouldBeEmpty) })
+				})
+				Convey(`When the in-flight limit is raised`, func() {
+					s.SetQueueLimits(PublishQueueLimit, InFlightLimit+1)
+					Convey(`Then the queued message should be sent`, func() {
+						So(ch, ShouldNotBeEmpty)
+						So(<-ch, ShouldEqual, &msg)
+					})
+				})
+				Convey(`When the publish queue limit is lowered`, func() {
+					newer := msg
+					s.SendPublish(&newer)
+					s.SetQueueLimits(1, InFlightLimit)
+					Convey(`Then the oldest message should be dropped`, func() {
+						So(s.pendingPub, ShouldHaveLength, 1)
+						So(s.pendingPub[0], ShouldEqual, &newer)
+					})
+				})
+				Convey(`When the queued message expires before receiving a Puback Message`, func() {
+					msg.Expires = time.Now()
+					s.ReceivePuback(&packets.PubackPacket{MessageID: 1})
+					Convey(`Then it should not be sent`, func() { So(ch, ShouldBeEmpty) })
+					Convey(`Then it should no longer be in the publish queue`, func() { So(s.pendingPub, ShouldBeEmpty) })
+				})
+			})
+			Convey(`When sending an expired Publish Message`, func() {
+				msg := msg
+				msg.Qos = 1
+				msg.Expires = time.Now()
+				s.SendPublish(&msg)
+				Convey(`Then it should not be in the publish queue`, func() { So(s.pendingPub, ShouldBeEmpty) })
+				Convey(`Then it should not be in the client channel`, func() { So(ch, ShouldBeEmpty) })
+			})
+			Convey(`When the client has a maximum packet size`, func() {
+				s.SetMaximumPacketSize(16)
+				Convey(`When sending a Publish Message that fits`, func() {
+					msg := msg
+					s.SendPublish(&msg)
+					Convey(`Then it should be in the client channel`, func() { So(ch, ShouldNotBeEmpty) })
+				})
+				Convey(`When sending a Publish Message that exceeds it`, func() {
+					msg := msg
+					msg.Qos = 1
+					msg.Payload = make([]byte, 16)
+					s.SendPublish(&msg)
+					Convey(`Then it should not be in the publish queue`, func() { So(s.pendingPub, ShouldBeEmpty) })
+					Convey(`Then it should not be in the client channel`, func() { So(ch, ShouldBeEmpty) })
+				})
+				Convey(`When sending a Publish Message with a known size that exceeds it`, func() {
+					msg := msg
+					msg.Size = 17
+					s.SendPublish(&msg)
+					Convey(`Then it should not be in the client channel`, func() { So(ch, ShouldBeEmpty) })
+				})
+			})
 			Convey(`When receiving a QoS 0 Publish Message`, func() {
 				msg := msg
 				s.ReceivePublish(&msg)
@@ -93,6 +166,22 @@ func TestPublish(t *testing.T) {
 					So(puback.Details().MessageID, ShouldEqual, msg.MessageID)
 				})
 			})
+			Convey(`When dropping a received QoS 2 Publish Message`, func() {
+				publishCh := make(chan *packets.PublishPacket, 1)
+				s.DeliverTo(publishCh)
+				msg := msg
+				msg.Qos = 2
+				msg.MessageID = 1
+				s.DropPublish(&msg, packets.QuotaExceeded)
+				Convey(`Then it should not be published`, func() { So(publishCh, ShouldBeEmpty) })
+				Convey(`Then a pubrec with the reason code should be in the client channel`, func() {
+					So(ch, ShouldNotBeEmpty)
+					pubrec := (<-ch).(*packets.PubrecPacket)
+					So(pubrec.MessageID, ShouldEqual, msg.MessageID)
+					So(pubrec.ReasonCode, ShouldEqual, packets.QuotaExceeded)
+				})
+				Convey(`Then it should not wait for a pubrel`, func() { So(s.pendingRel, ShouldBeEmpty) })
+			})
 			Convey(`When receiving a QoS 2 Publish Message`, func() {
 				msg := msg
 				msg.Qos = 2
@@ -1,63 +1,77 @@
 package session
 
 import (
+	"container/list"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/htdvisser/squatt/auth"
+	"github.com/htdvisser/squatt/packets"
 	"go.uber.org/zap"
 )
 
 var (
 	// PublishQueueLimit limits the amount of messages that can be queued for publishing to a client
 	// If this limit is exceeded, old messages are dropped
+	// Sessions get this limit when they are created, it can be changed with SetQueueLimits.
 	PublishQueueLimit = 32
 
 	// InFlightLimit limits the amount of messages that can be unacknowledged by a client.
 	// While this limit is exceeded, no more publish messages are sent to this client
+	// Sessions get this limit when they are created, it can be changed with SetQueueLimits.
 	InFlightLimit = 32
 )
 
 // NewSession returns a new session with the given name
 func NewSession(name string) *Session {
-	s := &Session{name: name}
+	s := &Session{name: name, publishQueueLimit: PublishQueueLimit, inFlightLimit: InFlightLimit}
 	s.initialize()
 	return s
 }
 
 // Session for MQTT Client
 type Session struct {
-	// BEGIN sync/atomic aligned
-	_pubCounter uint64 // access with pubCounter()
-	// END sync/atomic aligned
-
 	// BEGIN unprotected - must not be changed after initialization
 	name         string
-	auth         auth.Interface
 	onDisconnect func()
 	onDelete     func()
 	log          *zap.Logger
-	persistent   bool
-	deliveryCh   chan<- *packets.PublishPacket
 	// END unprotected
 
 	// BEGIN mu protected
-	mu    sync.Mutex
-	will  *packets.PublishPacket
-	outCh chan<- packets.ControlPacket
+	mu                  sync.Mutex
+	auth                auth.Interface
+	persistent          bool
+	responseTopicPrefix string // the session can always subscribe to its response topics
+	deliveryCh          chan<- *packets.PublishPacket
+	will                *packets.PublishPacket
+	willDelay           time.Duration
+	delayedWill         *packets.PublishPacket // will that is published when willTimer fires
+	willTimer           *time.Timer
+	outCh               chan<- packets.ControlPacket
+	expiry              time.Duration // zero means the session does not expire
+	disconnected        time.Time
+	topicAliasMaximum   uint16
+	topicAliases        map[string]*list.Element // topic name to element of topicAliasLRU
+	topicAliasLRU       *list.List               // *topicAlias, most recently used first
+	maximumPacketSize   uint32                   // zero means no limit
 	// END mu protected
 
 	// BEGIN pendingMu protected
-	pendingMu   sync.Mutex
-	pendingPub  pendingMessages // []*PublishPacket
-	pendingAck  pendingMessages // []*PublishPacket
-	pendingRec  pendingMessages // []*PublishPacket
-	pendingRel  pendingMessages // []*PubrecPacket
-	pendingComp pendingMessages // []*PubrelPacket
+	pendingMu         sync.Mutex
+	publishQueueLimit int // zero means no limit
+	inFlightLimit     int
+	lastPacketID      uint16
+	pendingPub        pendingMessages // []*PublishPacket in order of arrival, without packet identifier
+	pendingAck        pendingMessages // []*PublishPacket
+	pendingRec        pendingMessages // []*PublishPacket
+	pendingRel        pendingMessages // []*PubrecPacket
+	pendingComp       pendingMessages // []*PubrelPacket
 	// END pendingMu protected
 }
 
-// initialize all fields to their zero value
+// initialize all fields to their zero value, except for the queue limits
 func (s *Session) initialize() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -65,20 +79,28 @@ func (s *Session) initialize() {
 	s.pendingMu.Lock()
 	defer s.pendingMu.Unlock()
 
-	s._pubCounter = 0
+	s.lastPacketID = 0
 	s.auth, _ = auth.NoAuth(s.name, "", nil)
+	s.responseTopicPrefix = ""
 	s.onDisconnect = func() {}
 	s.onDelete = func() {}
 	s.log = zap.NewNop()
 	s.persistent = false
 	s.deliveryCh = nil
 	s.will = nil
+	s.willDelay = 0
+	s.cancelDelayedWill()
 	s.outCh = nil
-	s.pendingPub = make(pendingMessages, 0, PublishQueueLimit)
-	s.pendingAck = make(pendingMessages, 0, InFlightLimit)
-	s.pendingRec = make(pendingMessages, 0, InFlightLimit)
-	s.pendingRel = make(pendingMessages, 0, InFlightLimit)
-	s.pendingComp = make(pendingMessages, 0, InFlightLimit)
+	s.expiry = 0
+	s.disconnected = time.Time{}
+	s.topicAliasMaximum = 0
+	s.resetTopicAliases()
+	s.maximumPacketSize = 0
+	s.pendingPub = make(pendingMessages, 0, s.publishQueueLimit)
+	s.pendingAck = make(pendingMessages, 0, s.inFlightLimit)
+	s.pendingRec = make(pendingMessages, 0, s.inFlightLimit)
+	s.pendingRel = make(pendingMessages, 0, s.inFlightLimit)
+	s.pendingComp = make(pendingMessages, 0, s.inFlightLimit)
 }
 
 // Name of the session
@@ -88,17 +110,64 @@ func (s *Session) Name() string {
 
 // SetAuth sets the authentication for this session
 func (s *Session) SetAuth(auth auth.Interface) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.auth = auth
 }
 
+// SetResponseTopicPrefix sets the prefix of the response topics of this session
+// The session can subscribe to the prefix and all topics below it, regardless of its authentication.
+func (s *Session) SetResponseTopicPrefix(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responseTopicPrefix = prefix
+}
+
+func (s *Session) getAuth() (auth.Interface, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.auth, s.responseTopicPrefix
+}
+
 // CanPublishTo returns true if the session can publish to the given topic
 func (s *Session) CanPublishTo(topic string) bool {
-	return s.auth.CanPublishTo(topic)
+	auth, _ := s.getAuth()
+	return auth.CanPublishTo(topic)
 }
 
 // CanSubscribeTo returns true if the session can subscribe to the given topic
 func (s *Session) CanSubscribeTo(topic string) bool {
-	return s.auth.CanSubscribeTo(topic)
+	auth, responseTopicPrefix := s.getAuth()
+	if responseTopicPrefix != "" && (topic == responseTopicPrefix || strings.HasPrefix(topic, responseTopicPrefix+"/")) {
+		return true
+	}
+	return auth.CanSubscribeTo(topic)
+}
+
+// SetMaximumPacketSize sets the maximum size of packets that the client accepts
+// Messages that exceed this size are not sent to the client. A size of zero means no limit.
+func (s *Session) SetMaximumPacketSize(size uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maximumPacketSize = size
+}
+
+// exceedsMaximumPacketSize returns true if the message is larger than the client accepts
+func (s *Session) exceedsMaximumPacketSize(msg *packets.PublishPacket) bool {
+	s.mu.Lock()
+	maximumPacketSize := s.maximumPacketSize
+	s.mu.Unlock()
+	if maximumPacketSize == 0 {
+		return false
+	}
+	size := msg.Size
+	if size == 0 {
+		var err error
+		if size, err = packets.Size(msg, packets.Version5); err != nil { // only MQTT 5 clients have a maximum packet size
+			return true
+		}
+	}
+	return size > int(maximumPacketSize)
 }
 
 // SetOnDisconnect sets the function that is executed on disconnection of the session
@@ -118,100 +187,121 @@ func (s *Session) SetLogger(log *zap.Logger) {
 
 // SetPersistent sets the session persistency
 func (s *Session) SetPersistent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.persistent = true
 }
 
-// Persistent returns the session persistency
-func (s *Session) Persistent() bool {
-	return s.persistent
-}
-
-// SetWill sets the session will
-func (s *Session) SetWill(topic string, payload []byte, qos uint8, retain bool) {
-	if !s.CanPublishTo(topic) {
-		return
-	}
+// ClearPersistent clears the session persistency, so that the session ends when the client disconnects
+func (s *Session) ClearPersistent() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.log.Debug("set will", zap.String("topic", topic))
-	s.will = &packets.PublishPacket{TopicName: topic, Payload: payload}
-	s.will.Qos, s.will.Retain = qos, retain
+	s.persistent = false
 }
 
-// ClearWill clears the session will
-func (s *Session) ClearWill() {
+// Persistent returns the session persistency
+func (s *Session) Persistent() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.will != nil {
-		s.log.Debug("clear will")
-		s.will = nil
-	}
-}
-
-func (s *Session) publishWill() {
-	if s.will == nil {
-		return
-	}
-	s.log.Debug("publish will", zap.String("topic", s.will.TopicName))
-	s.deliver(s.will)
-	s.will = nil
+	return s.persistent
 }
 
 // DeliverTo sets the channel that should be used to publish packets to the server
 func (s *Session) DeliverTo(ch chan<- *packets.PublishPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.deliveryCh = ch
 }
 
 // deliver a message to the application
+// This blocks until the message is accepted for routing
 func (s *Session) deliver(msg *packets.PublishPacket) bool {
-	if s.deliveryCh == nil {
+	s.mu.Lock()
+	deliveryCh := s.deliveryCh
+	s.mu.Unlock()
+	if deliveryCh == nil {
 		return false
 	}
-	select {
-	case s.deliveryCh <- msg:
-		return true
-	default:
-	}
-	return false
+	deliveryCh <- msg
+	return true
 }
 
 // Connect connects the session to a client
+// A delayed will of a previous connection is cancelled
 func (s *Session) Connect(ch chan<- packets.ControlPacket) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	if will := s.cancelDelayedWill(); will != nil {
+		s.log.Debug("cancel will", zap.String("topic", will.TopicName))
+	}
 	if s.outCh != nil {
 		s.log.Debug("disconnect old connection")
-		close(s.outCh)
+		s.closeOutCh(packets.SessionTakenOver)
 		s.outCh = ch
-		s.publishWill()
-
+		s.disconnected = time.Time{}
+		s.resetTopicAliases()
+		will := s.takeWill()
+		s.log.Debug("connect")
 		s.mu.Unlock()
+		s.publishWill(will)
 		s.onDisconnect() // onDisconnect should be called without lock
-		s.mu.Lock()
-	} else {
-		s.outCh = ch
+		return
 	}
+	s.outCh = ch
+	s.disconnected = time.Time{}
+	s.resetTopicAliases()
 	s.log.Debug("connect")
+	s.mu.Unlock()
 }
 
 // Disconnect the session
 func (s *Session) Disconnect() {
+	s.disconnect(nil, nil)
+}
+
+// DisconnectWithReason disconnects the session after sending a DISCONNECT with the reason code to the client
+func (s *Session) DisconnectWithReason(reasonCode byte) {
+	s.disconnect(nil, &reasonCode)
+}
+
+// DisconnectFrom disconnects the session if it is still connected to the given channel
+// Clients use this so that they do not disconnect a client that took over their session.
+func (s *Session) DisconnectFrom(ch chan<- packets.ControlPacket) {
+	s.disconnect(ch, nil)
+}
+
+func (s *Session) disconnect(ch chan<- packets.ControlPacket, reasonCode *byte) {
 	if s == nil {
 		return
 	}
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.outCh == nil {
+	if s.outCh == nil || (ch != nil && ch != s.outCh) {
+		s.mu.Unlock()
 		return
 	}
 	s.log.Debug("disconnect")
-	close(s.outCh)
+	if reasonCode != nil {
+		s.closeOutCh(*reasonCode)
+	} else {
+		close(s.outCh)
+	}
 	s.outCh = nil
-	s.publishWill()
-
+	s.disconnected = time.Now()
+	will := s.takeWill()
 	s.mu.Unlock()
+	s.publishWill(will)
 	s.onDisconnect() // onDisconnect should be called without lock
-	s.mu.Lock()
+}
+
+// closeOutCh closes the channel to the client after sending a DISCONNECT with the reason code
+// The DISCONNECT is dropped if the channel is full.
+func (s *Session) closeOutCh(reasonCode byte) {
+	disconnect := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	disconnect.ReasonCode = reasonCode
+	select {
+	case s.outCh <- disconnect:
+	default:
+	}
+	close(s.outCh)
 }
 
 // send a control packet to the client
@@ -221,8 +311,15 @@ func (s *Session) send(msg packets.ControlPacket) bool {
 	if s.outCh == nil {
 		return false
 	}
+	var alias *topicAlias
+	if publish, ok := msg.(*packets.PublishPacket); ok {
+		msg, alias = s.withTopicAlias(publish)
+	}
 	select {
 	case s.outCh <- msg:
+		if alias != nil {
+			alias.confirmed = true
+		}
 		return true
 	default:
 	}
@@ -235,6 +332,10 @@ func (s *Session) Delete() {
 		return
 	}
 	s.Disconnect()
+	s.mu.Lock()
+	will := s.cancelDelayedWill() // the session ends, so a delayed will is published now
+	s.mu.Unlock()
+	s.publishWill(will)
 	s.log.Debug("delete")
 	s.onDelete()
 	s.initialize() // re-initialize the session for re-use
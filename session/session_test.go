@@ -2,8 +2,9 @@ package session
 
 import (
 	"testing"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/htdvisser/squatt/packets"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -11,10 +12,34 @@ func TestSession(t *testing.T) {
 	Convey(`Given a Session`, t, func() {
 		s := NewSession("foo")
 		Convey(`Then that session should have a name`, func() { So(s.Name(), ShouldEqual, "foo") })
+		Convey(`When setting a response topic prefix`, func() {
+			s.SetAuth(denySubscribe{})
+			s.SetResponseTopicPrefix("responses/foo")
+			Convey(`Then the session should be able to subscribe to its response topics`, func() {
+				So(s.CanSubscribeTo("responses/foo"), ShouldBeTrue)
+				So(s.CanSubscribeTo("responses/foo/#"), ShouldBeTrue)
+			})
+			Convey(`Then the session should not be able to subscribe to other topics`, func() {
+				So(s.CanSubscribeTo("responses/foobar"), ShouldBeFalse)
+				So(s.CanSubscribeTo("responses/#"), ShouldBeFalse)
+			})
+		})
 		Convey(`When setting the session to persistent`, func() {
 			s.SetPersistent()
 			Convey(`Then the session should be persistent`, func() { So(s.Persistent(), ShouldBeTrue) })
 		})
+		Convey(`When changing the persistency while the session is used`, func() {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.ClearPersistent()
+				s.Stats()
+			}()
+			s.SetPersistent()
+			s.Persistent()
+			<-done
+			Convey(`Then the session should still have a persistency`, func() { So(s.Stats().Persistent, ShouldEqual, s.Persistent()) })
+		})
 		Convey(`When sending a control packet`, func() {
 			res := s.send(&packets.PublishPacket{})
 			Convey(`Then the result should be negative (there is no client channel)`, func() { So(res, ShouldBeFalse) })
@@ -24,10 +49,31 @@ func TestSession(t *testing.T) {
 			s.Connect(ch)
 			Convey(`When setting the client channel again`, func() {
 				s.Connect(make(chan packets.ControlPacket))
+				Convey(`Then the old channel should receive a DISCONNECT`, func() {
+					disconnect, ok := (<-ch).(*packets.DisconnectPacket)
+					So(ok, ShouldBeTrue)
+					So(disconnect.ReasonCode, ShouldEqual, packets.SessionTakenOver)
+				})
 				Convey(`Then the old channel should be closed`, func() {
+					<-ch
 					_, ok := <-ch
 					So(ok, ShouldBeFalse)
 				})
+				Convey(`When the old client disconnects from the session`, func() {
+					s.DisconnectFrom(ch)
+					Convey(`Then the session should still be connected`, func() {
+						So(s.outCh, ShouldNotBeNil)
+						So(s.disconnected.IsZero(), ShouldBeTrue)
+					})
+				})
+			})
+			Convey(`When disconnecting the session with a reason code`, func() {
+				s.DisconnectWithReason(packets.ServerShuttingDown)
+				Convey(`Then the client channel should receive a DISCONNECT`, func() {
+					disconnect, ok := (<-ch).(*packets.DisconnectPacket)
+					So(ok, ShouldBeTrue)
+					So(disconnect.ReasonCode, ShouldEqual, packets.ServerShuttingDown)
+				})
 			})
 			Convey(`When sending a control packet`, func() {
 				msg := &packets.PublishPacket{TopicName: "foo"}
@@ -73,8 +119,17 @@ func TestSession(t *testing.T) {
 					So(<-ch, ShouldEqual, msg)
 				})
 				Convey(`When publishing another publish packet`, func() {
-					res := s.deliver(&packets.PublishPacket{})
-					Convey(`Then the result should be negative (the channel is full)`, func() { So(res, ShouldBeFalse) })
+					done := make(chan bool)
+					go func() { done <- s.deliver(&packets.PublishPacket{}) }()
+					Convey(`Then it should block until the publish channel has room`, func() {
+						select {
+						case <-done:
+							t.Error("deliver returned while the channel was full")
+						case <-time.After(10 * time.Millisecond):
+						}
+						<-ch
+						So(<-done, ShouldBeTrue)
+					})
 				})
 			})
 		})
@@ -99,6 +154,49 @@ func TestSession(t *testing.T) {
 				})
 			})
 		})
+		Convey(`When setting a delayed session will on a connected client`, func() {
+			s.Connect(make(chan packets.ControlPacket, 1))
+			ch := make(chan *packets.PublishPacket, 1)
+			s.DeliverTo(ch)
+			will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			will.TopicName, will.Payload, will.Retain = "foo", []byte("bar"), true
+			s.SetWillMessage(will, 20*time.Millisecond)
+			Convey(`When disconnecting`, func() {
+				s.Disconnect()
+				Convey(`Then the will should not have been published yet`, func() {
+					So(ch, ShouldBeEmpty)
+				})
+				Convey(`Then the will should be published after the delay`, func() {
+					select {
+					case msg := <-ch:
+						So(msg.TopicName, ShouldEqual, "foo")
+						So(msg.Retain, ShouldBeTrue)
+					case <-time.After(time.Second):
+						t.Error("will was not published")
+					}
+				})
+				Convey(`When the session reconnects within the delay`, func() {
+					s.Connect(make(chan packets.ControlPacket, 1))
+					time.Sleep(40 * time.Millisecond)
+					Convey(`Then no will has been published`, func() {
+						So(ch, ShouldBeEmpty)
+					})
+				})
+				Convey(`When the session is deleted within the delay`, func() {
+					s.Delete()
+					Convey(`Then the will should have been published`, func() {
+						So(ch, ShouldNotBeEmpty)
+					})
+				})
+				Convey(`When the publish permission is revoked within the delay`, func() {
+					s.SetAuth(denyPublish{})
+					time.Sleep(40 * time.Millisecond)
+					Convey(`Then no will has been published`, func() {
+						So(ch, ShouldBeEmpty)
+					})
+				})
+			})
+		})
 		Convey(`When deleting the session`, func() {
 			var onDeleteCalled bool
 			s.SetOnDelete(func() {
@@ -111,3 +209,17 @@ func TestSession(t *testing.T) {
 		})
 	})
 }
+
+type denyPublish struct{}
+
+func (denyPublish) Username() string           { return "" }
+func (denyPublish) CanConnect() bool           { return true }
+func (denyPublish) CanPublishTo(string) bool   { return false }
+func (denyPublish) CanSubscribeTo(string) bool { return true }
+
+type denySubscribe struct{}
+
+func (denySubscribe) Username() string           { return "" }
+func (denySubscribe) CanConnect() bool           { return true }
+func (denySubscribe) CanPublishTo(string) bool   { return true }
+func (denySubscribe) CanSubscribeTo(string) bool { return false }
@@ -0,0 +1,29 @@
+package session
+
+import "time"
+
+// Stats of a session
+type Stats struct {
+	Connected    bool
+	Persistent   bool
+	Expiry       time.Duration // zero means the session does not expire
+	Disconnected time.Time     // zero while the session is connected
+	InFlight     int           // messages that are not acknowledged by the client
+	Queued       int           // messages that wait for room in the in-flight window
+}
+
+// Stats returns the stats of the session
+func (s *Session) Stats() Stats {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{
+		Connected:    s.outCh != nil,
+		Persistent:   s.persistent,
+		Expiry:       s.expiry,
+		Disconnected: s.disconnected,
+		InFlight:     s.inFlight(),
+		Queued:       s.pendingPub.Len(),
+	}
+}
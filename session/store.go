@@ -1,36 +1,104 @@
 package session
 
 import (
+	"sync"
+	"time"
+
 	"github.com/htdvisser/pkg/store"
 	"github.com/htdvisser/pkg/store/stringmap"
+	"github.com/htdvisser/squatt/packets"
 )
 
 // Store for sessions
 type Store struct {
 	store store.Interface
+
+	// mu serializes creating and taking sessions with deleting expired sessions
+	mu sync.Mutex
+
+	queueLimitsMu     sync.RWMutex
+	publishQueueLimit int
+	inFlightLimit     int
 }
 
 // NewStore returns a new session store
 func NewStore() *Store {
-	return &Store{store: stringmap.New()}
+	return &Store{
+		store:             stringmap.New(),
+		publishQueueLimit: PublishQueueLimit,
+		inFlightLimit:     InFlightLimit,
+	}
+}
+
+// newSession returns a new Session with the queue limits of the store
+// The caller must hold queueLimitsMu.RLock until the session is stored.
+func (s *Store) newSession(name string) *Session {
+	session := NewSession(name)
+	if s.publishQueueLimit != PublishQueueLimit || s.inFlightLimit != InFlightLimit {
+		session.SetQueueLimits(s.publishQueueLimit, s.inFlightLimit)
+	}
+	return session
+}
+
+// SetQueueLimits sets the limits of the publish queue and the in-flight window of new and existing sessions
+func (s *Store) SetQueueLimits(publishQueue, inFlight int) {
+	s.queueLimitsMu.Lock()
+	defer s.queueLimitsMu.Unlock()
+	s.publishQueueLimit, s.inFlightLimit = publishQueue, inFlight
+	for _, session := range s.All() {
+		session.SetQueueLimits(publishQueue, inFlight)
+	}
 }
 
 // New creates a new Session, deleting an old one if existed
 func (s *Store) New(name string) *Session {
-	session := NewSession(name)
+	s.mu.Lock()
+	s.queueLimitsMu.RLock()
+	session := s.newSession(name)
 	oldI, existed := s.store.Store(name, session)
+	s.queueLimitsMu.RUnlock()
+	s.mu.Unlock()
 	if existed {
-		oldI.(*Session).Delete()
+		old := oldI.(*Session)
+		old.DisconnectWithReason(packets.SessionTakenOver)
+		old.Delete()
 	}
 	return session
 }
 
+// Get returns the Session with the given name, if it exists
+func (s *Store) Get(name string) (*Session, bool) {
+	sessionI, ok := s.store.Load(name)
+	if !ok {
+		return nil, false
+	}
+	return sessionI.(*Session), true
+}
+
+// All returns all sessions
+func (s *Store) All() (sessions []*Session) {
+	s.store.Range(func(name string, sessionI interface{}) bool {
+		sessions = append(sessions, sessionI.(*Session))
+		return true
+	})
+	return
+}
+
 // GetOrNew creates a new Session, but returns an old one if existed
+// The expiry of an old session is restarted, so that it does not expire before the client is connected.
 func (s *Store) GetOrNew(name string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queueLimitsMu.RLock()
+	defer s.queueLimitsMu.RUnlock()
 	sessionI, existed := s.store.LoadOrBuild(name, func() interface{} {
-		return NewSession(name)
+		return s.newSession(name)
 	})
-	return sessionI.(*Session), existed
+	session := sessionI.(*Session)
+	if existed {
+		session.claim()
+	}
+	return session, existed
 }
 
 // Delete a session
@@ -40,3 +108,30 @@ func (s *Store) Delete(name string) {
 		sessionI.(*Session).Delete()
 	}
 }
+
+// DeleteExpired deletes the sessions that are expired at the given time and returns how many were deleted
+// A session is only deleted if it is still expired and still stored under its name, so sessions that are taken over
+// by a reconnecting client in the meantime are kept.
+func (s *Store) DeleteExpired(now time.Time) (deleted int) {
+	candidates := make(map[string]*Session)
+	s.store.Range(func(name string, sessionI interface{}) bool {
+		if session := sessionI.(*Session); session.Expired(now) {
+			candidates[name] = session
+		}
+		return true
+	})
+	var expired []*Session
+	s.mu.Lock()
+	for name, session := range candidates {
+		if sessionI, ok := s.store.Load(name); !ok || sessionI.(*Session) != session || !session.Expired(now) {
+			continue
+		}
+		s.store.Delete(name)
+		expired = append(expired, session)
+	}
+	s.mu.Unlock()
+	for _, session := range expired {
+		session.Delete()
+	}
+	return len(expired)
+}
@@ -2,6 +2,10 @@ package session
 
 import (
 	"testing"
+	"time"
+
+	"github.com/htdvisser/pkg/store"
+	"github.com/htdvisser/squatt/packets"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -35,3 +39,129 @@ func TestSessionStore(t *testing.T) {
 		So(s3Deleted, ShouldBeTrue)
 	})
 }
+
+func TestSessionStoreQueueLimits(t *testing.T) {
+	Convey(`Given a Session Store with a session`, t, func() {
+		s := NewStore()
+		existing, _ := s.GetOrNew("foo")
+
+		Convey(`When the queue limits are set`, func() {
+			s.SetQueueLimits(8, 4)
+			created, _ := s.GetOrNew("bar")
+			Convey(`Then they should apply to the existing session`, func() {
+				So(existing.publishQueueLimit, ShouldEqual, 8)
+				So(existing.inFlightLimit, ShouldEqual, 4)
+			})
+			Convey(`Then they should apply to new sessions`, func() {
+				So(created.publishQueueLimit, ShouldEqual, 8)
+				So(created.inFlightLimit, ShouldEqual, 4)
+			})
+		})
+	})
+}
+
+func TestSessionStoreExpiry(t *testing.T) {
+	Convey(`Given a Session Store with a disconnected persistent session`, t, func() {
+		s := NewStore()
+		session, _ := s.GetOrNew("foo")
+		session.SetPersistent()
+		session.SetExpiry(time.Minute)
+		var deleted bool
+		session.SetOnDelete(func() { deleted = true })
+		session.Connect(make(chan packets.ControlPacket, 1))
+		session.Disconnect()
+
+		Convey(`When deleting the sessions that expired before the expiry interval`, func() {
+			n := s.DeleteExpired(time.Now())
+			Convey(`Then the session should not be deleted`, func() {
+				So(n, ShouldEqual, 0)
+				So(deleted, ShouldBeFalse)
+			})
+		})
+
+		Convey(`When deleting the sessions that expired after the expiry interval`, func() {
+			n := s.DeleteExpired(time.Now().Add(time.Minute))
+			Convey(`Then the session should be deleted`, func() {
+				So(n, ShouldEqual, 1)
+				So(deleted, ShouldBeTrue)
+				_, existed := s.GetOrNew("foo")
+				So(existed, ShouldBeFalse)
+			})
+		})
+
+		Convey(`When the session reconnects`, func() {
+			session.Connect(make(chan packets.ControlPacket, 1))
+			n := s.DeleteExpired(time.Now().Add(time.Minute))
+			Convey(`Then the session should not be deleted`, func() {
+				So(n, ShouldEqual, 0)
+				So(deleted, ShouldBeFalse)
+			})
+		})
+
+		Convey(`When the expired session is taken by a reconnecting client`, func() {
+			session.mu.Lock()
+			session.disconnected = time.Now().Add(-time.Hour)
+			session.mu.Unlock()
+			taken, existed := s.GetOrNew("foo")
+			n := s.DeleteExpired(time.Now())
+			Convey(`Then the session should not be deleted`, func() {
+				So(existed, ShouldBeTrue)
+				So(taken, ShouldEqual, session)
+				So(n, ShouldEqual, 0)
+				So(deleted, ShouldBeFalse)
+			})
+		})
+
+		Convey(`When the session does not expire`, func() {
+			session.SetExpiry(0)
+			n := s.DeleteExpired(time.Now().Add(time.Hour))
+			Convey(`Then the session should not be deleted`, func() {
+				So(n, ShouldEqual, 0)
+				So(deleted, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+// rangeHookStore calls afterRange once, after the next Range
+type rangeHookStore struct {
+	store.Interface
+	afterRange func()
+}
+
+func (s *rangeHookStore) Range(f func(key string, value interface{}) bool) {
+	s.Interface.Range(f)
+	if afterRange := s.afterRange; afterRange != nil {
+		s.afterRange = nil
+		afterRange()
+	}
+}
+
+func TestSessionStoreExpiryReplaced(t *testing.T) {
+	Convey(`Given a Session Store with an expired session`, t, func() {
+		s := NewStore()
+		hooked := &rangeHookStore{Interface: s.store}
+		s.store = hooked
+		old, _ := s.GetOrNew("foo")
+		old.SetExpiry(time.Second)
+		old.Connect(make(chan packets.ControlPacket, 1))
+		old.Disconnect()
+
+		Convey(`When the session is replaced while expired sessions are deleted`, func() {
+			var session *Session
+			var deleted bool
+			hooked.afterRange = func() {
+				session = s.New("foo")
+				session.SetOnDelete(func() { deleted = true })
+			}
+			n := s.DeleteExpired(time.Now().Add(time.Minute))
+			Convey(`Then the new session should not be deleted`, func() {
+				So(n, ShouldEqual, 0)
+				So(deleted, ShouldBeFalse)
+				stored, ok := s.Get("foo")
+				So(ok, ShouldBeTrue)
+				So(stored, ShouldEqual, session)
+			})
+		})
+	})
+}
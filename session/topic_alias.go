@@ -0,0 +1,60 @@
+package session
+
+import (
+	"container/list"
+
+	"github.com/htdvisser/squatt/packets"
+)
+
+type topicAlias struct {
+	topic     string
+	alias     uint16
+	confirmed bool // the client received the mapping of the alias to the topic
+}
+
+// SetTopicAliasMaximum sets the number of topic aliases that the client accepts
+// The aliases are assigned to topics with a least recently used policy.
+func (s *Session) SetTopicAliasMaximum(max uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.topicAliasMaximum = max
+	s.resetTopicAliases()
+}
+
+// resetTopicAliases resets the topic aliases, which is required for every new connection
+// The caller must hold mu
+func (s *Session) resetTopicAliases() {
+	s.topicAliases = make(map[string]*list.Element)
+	s.topicAliasLRU = list.New()
+}
+
+// withTopicAlias returns a PUBLISH packet that uses a topic alias if the client accepts topic aliases
+// The returned packet is a copy, so that the original can be re-sent on a new connection.
+// The caller must hold mu
+func (s *Session) withTopicAlias(msg *packets.PublishPacket) (*packets.PublishPacket, *topicAlias) {
+	if s.topicAliasMaximum == 0 {
+		return msg, nil
+	}
+	var alias *topicAlias
+	if el, ok := s.topicAliases[msg.TopicName]; ok {
+		s.topicAliasLRU.MoveToFront(el)
+		alias = el.Value.(*topicAlias)
+	} else if s.topicAliasLRU.Len() < int(s.topicAliasMaximum) {
+		alias = &topicAlias{topic: msg.TopicName, alias: uint16(s.topicAliasLRU.Len() + 1)}
+		s.topicAliases[msg.TopicName] = s.topicAliasLRU.PushFront(alias)
+	} else {
+		el := s.topicAliasLRU.Back()
+		alias = el.Value.(*topicAlias)
+		delete(s.topicAliases, alias.topic)
+		alias.topic, alias.confirmed = msg.TopicName, false
+		s.topicAliasLRU.MoveToFront(el)
+		s.topicAliases[msg.TopicName] = el
+	}
+	aliased := *msg
+	aliased.Properties = msg.Properties.Copy()
+	aliased.Properties.TopicAlias = packets.Uint16(alias.alias)
+	if alias.confirmed {
+		aliased.TopicName = ""
+	}
+	return &aliased, alias
+}
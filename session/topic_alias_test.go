@@ -0,0 +1,65 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/htdvisser/squatt/packets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTopicAlias(t *testing.T) {
+	Convey(`Given a connected Session that accepts 2 topic aliases`, t, func() {
+		s := NewSession("foo")
+		s.SetTopicAliasMaximum(2)
+		ch := make(chan packets.ControlPacket, 10)
+		s.Connect(ch)
+
+		send := func(topic string) *packets.PublishPacket {
+			msg := &packets.PublishPacket{TopicName: topic}
+			So(s.send(msg), ShouldBeTrue)
+			sent := (<-ch).(*packets.PublishPacket)
+			So(sent, ShouldNotEqual, msg)
+			So(msg.Properties.TopicAlias, ShouldBeNil)
+			return sent
+		}
+
+		Convey(`When sending a message`, func() {
+			sent := send("foo")
+			Convey(`Then it should set a topic alias and the topic name`, func() {
+				So(*sent.Properties.TopicAlias, ShouldEqual, 1)
+				So(sent.TopicName, ShouldEqual, "foo")
+			})
+			Convey(`When sending another message to the same topic`, func() {
+				sent := send("foo")
+				Convey(`Then it should only use the topic alias`, func() {
+					So(*sent.Properties.TopicAlias, ShouldEqual, 1)
+					So(sent.TopicName, ShouldBeEmpty)
+				})
+			})
+			Convey(`When sending messages to two other topics`, func() {
+				So(*send("bar").Properties.TopicAlias, ShouldEqual, 2)
+				sent := send("baz")
+				Convey(`Then the least recently used alias should be re-assigned`, func() {
+					So(*sent.Properties.TopicAlias, ShouldEqual, 1)
+					So(sent.TopicName, ShouldEqual, "baz")
+				})
+			})
+			Convey(`When the session reconnects`, func() {
+				ch = make(chan packets.ControlPacket, 10)
+				s.Connect(ch)
+				sent := send("foo")
+				Convey(`Then it should set the topic name again`, func() {
+					So(*sent.Properties.TopicAlias, ShouldEqual, 1)
+					So(sent.TopicName, ShouldEqual, "foo")
+				})
+			})
+		})
+
+		Convey(`When the client does not accept topic aliases`, func() {
+			s.SetTopicAliasMaximum(0)
+			msg := &packets.PublishPacket{TopicName: "foo"}
+			s.send(msg)
+			Convey(`Then the message should be sent without topic alias`, func() { So(<-ch, ShouldEqual, msg) })
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package session
+
+import (
+	"time"
+
+	"github.com/htdvisser/squatt/packets"
+	"go.uber.org/zap"
+)
+
+// SetWill sets the session will
+func (s *Session) SetWill(topic string, payload []byte, qos uint8, retain bool) {
+	will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	will.TopicName, will.Payload = topic, payload
+	will.Qos, will.Retain = qos, retain
+	s.SetWillMessage(will, 0)
+}
+
+// SetWillMessage sets the session will, that is published after the given delay when the client disconnects
+// The will is not published if the session reconnects within the delay.
+func (s *Session) SetWillMessage(will *packets.PublishPacket, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log.Debug("set will", zap.String("topic", will.TopicName), zap.Duration("delay", delay))
+	s.will, s.willDelay = will, delay
+}
+
+// ClearWill clears the session will
+func (s *Session) ClearWill() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.will != nil {
+		s.log.Debug("clear will")
+		s.will, s.willDelay = nil, 0
+	}
+}
+
+// takeWill removes the will from the session and returns it if it should be published immediately
+// A will with a delay is published by a timer, unless it is cancelled before that.
+// The caller must hold mu
+func (s *Session) takeWill() *packets.PublishPacket {
+	will, delay := s.will, s.willDelay
+	s.will, s.willDelay = nil, 0
+	if will == nil || delay <= 0 {
+		return will
+	}
+	s.log.Debug("delay will", zap.String("topic", will.TopicName), zap.Duration("delay", delay))
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		if s.willTimer != timer {
+			s.mu.Unlock()
+			return // cancelled
+		}
+		s.delayedWill, s.willTimer = nil, nil
+		s.mu.Unlock()
+		s.publishWill(will)
+	})
+	s.delayedWill, s.willTimer = will, timer
+	return nil
+}
+
+// cancelDelayedWill cancels the delayed will and returns it, if there was one
+// The caller must hold mu
+func (s *Session) cancelDelayedWill() *packets.PublishPacket {
+	if s.willTimer == nil {
+		return nil
+	}
+	s.willTimer.Stop()
+	will := s.delayedWill
+	s.delayedWill, s.willTimer = nil, nil
+	return will
+}
+
+// publishWill publishes the will through the same path as other publish messages
+// The publish permission is checked at the moment the will is published.
+// This should be called without lock.
+func (s *Session) publishWill(will *packets.PublishPacket) {
+	if will == nil {
+		return
+	}
+	if !s.CanPublishTo(will.TopicName) {
+		s.log.Debug("will not allowed", zap.String("topic", will.TopicName))
+		return
+	}
+	s.log.Debug("publish will", zap.String("topic", will.TopicName))
+	will.Origin = s.name
+	s.deliver(will)
+}
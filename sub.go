@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"unicode/utf8"
+
+	"github.com/htdvisser/pkg/config"
+	"github.com/htdvisser/squatt/packets"
+	"github.com/htdvisser/squatt/topic"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var subCfg *config.Config
+
+var subCmd = &cobra.Command{
+	Use:   "sub",
+	Short: "Subscribe to topics and print the messages",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := subCfg.ReadInConfig(); err != nil {
+			log.Debug("not using config file", zap.Error(err))
+		}
+		filters := subCfg.GetStringSlice("topic")
+		if len(filters) == 0 {
+			log.Fatal("no topics")
+		}
+		qos := byte(subCfg.GetInt("qos"))
+		if qos > 2 {
+			log.Fatal("invalid QoS", zap.Uint8("qos", qos))
+		}
+		subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		for _, filter := range filters {
+			if err := topic.Validate(filter, true); err != nil {
+				log.Fatal("invalid topic", zap.String("topic", filter), zap.Error(err))
+			}
+			subscribe.Topics = append(subscribe.Topics, filter)
+			subscribe.Qoss = append(subscribe.Qoss, qos)
+		}
+
+		var format func(io.Writer, *packets.PublishPacket) error
+		switch subCfg.GetString("format") {
+		case "text":
+			format = formatText
+		case "json":
+			format = formatJSON
+		default:
+			log.Fatal("invalid format", zap.String("format", subCfg.GetString("format")))
+		}
+
+		count := subCfg.GetInt("count")
+		done := make(chan struct{})
+		var received int
+		c, err := dialBroker(subCfg, func(msg *packets.PublishPacket) {
+			if count > 0 && received >= count {
+				return
+			}
+			if err := format(os.Stdout, msg); err != nil {
+				log.Fatal("could not write message", zap.Error(err))
+			}
+			if received++; received == count {
+				close(done)
+			}
+		})
+		if err != nil {
+			log.Fatal("could not connect to broker", zap.Error(err))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), subCfg.GetDuration("broker.timeout"))
+		suback, err := c.Subscribe(ctx, subscribe)
+		cancel()
+		if err != nil {
+			log.Fatal("could not subscribe", zap.Error(err))
+		}
+		for i, code := range suback.ReturnCodes {
+			if code >= packets.UnspecifiedError {
+				log.Fatal("subscription refused", zap.String("topic", filters[i]), zap.Uint8("reason", code))
+			}
+		}
+
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-sigChan:
+		case <-done:
+		case <-c.Done():
+			log.Fatal("disconnected from broker", zap.Error(c.Err()))
+		}
+		c.Disconnect()
+	},
+}
+
+func formatText(w io.Writer, msg *packets.PublishPacket) error {
+	var retain string
+	if msg.Retain {
+		retain = " retained"
+	}
+	_, err := fmt.Fprintf(w, "%s qos=%d%s %s\n", msg.TopicName, msg.Qos, retain, msg.Payload)
+	return err
+}
+
+// jsonMessage is a received message in JSON lines output
+// The payload is in Payload if it is valid UTF-8, otherwise it is base64 encoded in PayloadBase64.
+type jsonMessage struct {
+	Topic         string  `json:"topic"`
+	QoS           byte    `json:"qos"`
+	Retain        bool    `json:"retain"`
+	Payload       *string `json:"payload,omitempty"`
+	PayloadBase64 []byte  `json:"payload_base64,omitempty"`
+}
+
+func formatJSON(w io.Writer, msg *packets.PublishPacket) error {
+	message := jsonMessage{Topic: msg.TopicName, QoS: msg.Qos, Retain: msg.Retain}
+	if utf8.Valid(msg.Payload) {
+		payload := string(msg.Payload)
+		message.Payload = &payload
+	} else {
+		message.PayloadBase64 = msg.Payload
+	}
+	return json.NewEncoder(w).Encode(message)
+}
+
+type subConfig struct {
+	Broker brokerConfig `name:"broker"`
+	Topic  []string     `name:"topic" description:"Topic filters to subscribe to"`
+	QoS    int          `name:"qos" description:"Maximum QoS of the subscriptions (0, 1 or 2)"`
+	Format string       `name:"format" description:"Output format (text or json)"`
+	Count  int          `name:"count" description:"Exit after receiving this number of messages (0 for no limit)"`
+}
+
+func subDefaults() (defaults subConfig) {
+	defaults.Broker = defaultBrokerConfig()
+	defaults.Format = "text"
+	return
+}
+
+func init() {
+	subCfg = config.Initialize("squatt", subDefaults())
+	subCmd.Flags().AddFlagSet(subCfg.Flags())
+	cmd.AddCommand(subCmd)
+}
@@ -0,0 +1,291 @@
+// Package tlsconfig provides the TLS config of listeners, which can be changed while the listeners are in use
+//
+// Certificates are selected by the server name that clients send (SNI). The certificate files are watched, so that
+// renewed certificates are used for new connections without a restart.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errNoCertificates = errors.New("no certificates")
+
+// Pair is a certificate and its private key
+type Pair struct {
+	CertificateFile string
+	KeyFile         string
+}
+
+// Config is the TLS config of a listener
+type Config struct {
+	// Certificates are selected by the DNS names in the certificates, the first is used for clients without SNI or
+	// with an unknown server name
+	Certificates []Pair
+	// MinVersion is the minimum TLS version (1.0, 1.1, 1.2 or 1.3), the default of crypto/tls is used if empty
+	MinVersion string
+	// CipherSuites are the names of the enabled cipher suites for TLS 1.2 and below, the defaults of crypto/tls are
+	// used if empty
+	CipherSuites []string
+	// ALPN are the supported application protocols, in order of preference
+	ALPN []string
+	// ClientCAFile contains the CAs for verifying client certificates
+	ClientCAFile string
+	// RequireClientCertificate rejects clients without certificate, if ClientCAFile is set
+	RequireClientCertificate bool
+}
+
+// versions are the TLS versions by name
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": 0x0304,
+}
+
+// cipherSuites are the cipher suites by name
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_RC4_128_SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// certificate is a loaded Pair
+type certificate struct {
+	pair    Pair
+	modTime time.Time // latest modification time of the files
+	names   []string  // lowercase DNS names, possibly with wildcard
+	keyPair *tls.Certificate
+}
+
+func modTime(pair Pair) (time.Time, error) {
+	var latest time.Time
+	for _, filename := range []string{pair.CertificateFile, pair.KeyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func loadCertificate(pair Pair) (*certificate, error) {
+	modTime, err := modTime(pair)
+	if err != nil {
+		return nil, err
+	}
+	keyPair, err := tls.LoadX509KeyPair(pair.CertificateFile, pair.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	keyPair.Leaf = leaf
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	c := &certificate{pair: pair, modTime: modTime, keyPair: &keyPair}
+	for _, name := range names {
+		c.names = append(c.names, strings.ToLower(name))
+	}
+	return c, nil
+}
+
+// matches returns true if the certificate is valid for the server name
+func (c *certificate) matches(serverName string) bool {
+	for _, name := range c.names {
+		if name == serverName {
+			return true
+		}
+		if strings.HasPrefix(name, "*.") {
+			if dot := strings.Index(serverName, "."); dot > 0 && serverName[dot:] == name[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Provider provides the TLS config to listeners
+type Provider struct {
+	log *zap.Logger
+
+	// BEGIN mu protected
+	mu           sync.RWMutex
+	config       *tls.Config
+	certificates []*certificate
+	// END mu protected
+}
+
+// NewProvider returns a new Provider without config
+func NewProvider() *Provider {
+	return &Provider{log: zap.NewNop()}
+}
+
+// SetLogger sets the logger
+func (p *Provider) SetLogger(log *zap.Logger) {
+	p.log = log
+}
+
+// Configure loads the certificates and sets the config for new connections
+// The config is not changed if the certificates or other files can not be loaded.
+func (p *Provider) Configure(config Config) error {
+	if len(config.Certificates) == 0 {
+		return errNoCertificates
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: p.getCertificate,
+		NextProtos:     config.ALPN,
+	}
+	if config.MinVersion != "" {
+		version, ok := versions[config.MinVersion]
+		if !ok {
+			return fmt.Errorf("unknown TLS version %s", config.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	for _, name := range config.CipherSuites {
+		cipherSuite, ok := cipherSuites[name]
+		if !ok {
+			return fmt.Errorf("unknown cipher suite %s", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, cipherSuite)
+	}
+	if config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates in " + config.ClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.RequireClientCertificate {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	certificates := make([]*certificate, len(config.Certificates))
+	for i, pair := range config.Certificates {
+		c, err := loadCertificate(pair)
+		if err != nil {
+			return err
+		}
+		certificates[i] = c
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config, p.certificates = tlsConfig, certificates
+	return nil
+}
+
+// Configured returns true if the provider has a config
+func (p *Provider) Configured() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.config != nil
+}
+
+// TLSConfig returns the TLS config for listeners, which uses the latest config of the provider for each connection
+func (p *Provider) TLSConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: p.getConfigForClient}
+}
+
+func (p *Provider) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.config == nil {
+		return nil, errNoCertificates
+	}
+	return p.config, nil
+}
+
+func (p *Provider) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.certificates) == 0 {
+		return nil, errNoCertificates
+	}
+	if serverName := strings.ToLower(hello.ServerName); serverName != "" {
+		for _, c := range p.certificates {
+			if c.matches(serverName) {
+				return c.keyPair, nil
+			}
+		}
+	}
+	return p.certificates[0].keyPair, nil
+}
+
+// Reload loads the certificates whose files changed
+// Certificates that can not be loaded are not replaced.
+func (p *Provider) Reload() {
+	p.mu.RLock()
+	certificates := p.certificates
+	p.mu.RUnlock()
+	for i, c := range certificates {
+		modTime, err := modTime(c.pair)
+		if err != nil || !modTime.After(c.modTime) {
+			continue
+		}
+		reloaded, err := loadCertificate(c.pair)
+		if err != nil {
+			p.log.Warn("could not reload certificate", zap.String("certificate", c.pair.CertificateFile), zap.Error(err))
+			continue
+		}
+		p.mu.Lock()
+		if i < len(p.certificates) && p.certificates[i] == c {
+			p.certificates[i] = reloaded
+		}
+		p.mu.Unlock()
+		p.log.Info("reload certificate", zap.String("certificate", c.pair.CertificateFile), zap.Strings("names", reloaded.names))
+	}
+}
+
+// Watch reloads the certificates whose files changed every interval, until the context is done
+func (p *Provider) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Reload()
+		}
+	}
+}
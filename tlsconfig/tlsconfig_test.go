@@ -0,0 +1,170 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writePair writes a self-signed certificate for the DNS names and its key to files in dir
+func writePair(dir, name string, dnsNames ...string) Pair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	So(err, ShouldBeNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	So(err, ShouldBeNil)
+	pair := Pair{CertificateFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	So(ioutil.WriteFile(pair.CertificateFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), ShouldBeNil)
+	So(ioutil.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), ShouldBeNil)
+	return pair
+}
+
+func commonName(c *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	So(err, ShouldBeNil)
+	return leaf.Subject.CommonName
+}
+
+func TestProvider(t *testing.T) {
+	Convey(`Given a Provider with two certificates`, t, func() {
+		dir, err := ioutil.TempDir("", "tlsconfig")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		p := NewProvider()
+		So(p.Configured(), ShouldBeFalse)
+		defaultPair := writePair(dir, "default", "example.com")
+		otherPair := writePair(dir, "other", "example.org", "*.example.org")
+		So(p.Configure(Config{
+			Certificates: []Pair{defaultPair, otherPair},
+			MinVersion:   "1.2",
+			CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+			ALPN:         []string{"mqtt"},
+		}), ShouldBeNil)
+		So(p.Configured(), ShouldBeTrue)
+
+		config, err := p.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+		So(err, ShouldBeNil)
+		certificateFor := func(serverName string) string {
+			c, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+			So(err, ShouldBeNil)
+			return commonName(c)
+		}
+
+		Convey(`Then the settings should be in the config`, func() {
+			So(config.MinVersion, ShouldEqual, tls.VersionTLS12)
+			So(config.CipherSuites, ShouldResemble, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256})
+			So(config.NextProtos, ShouldResemble, []string{"mqtt"})
+			So(config.ClientAuth, ShouldEqual, tls.NoClientCert)
+		})
+
+		Convey(`Then the certificate should be selected by server name`, func() {
+			So(certificateFor("example.com"), ShouldEqual, "default")
+			So(certificateFor("EXAMPLE.org"), ShouldEqual, "other")
+			So(certificateFor("mqtt.example.org"), ShouldEqual, "other")
+		})
+
+		Convey(`Then the first certificate should be used for other server names`, func() {
+			So(certificateFor(""), ShouldEqual, "default")
+			So(certificateFor("a.b.example.org"), ShouldEqual, "default")
+		})
+
+		Convey(`When a certificate file changes`, func() {
+			renewed := writePair(dir, "renewed", "example.org")
+			So(os.Rename(renewed.CertificateFile, otherPair.CertificateFile), ShouldBeNil)
+			So(os.Rename(renewed.KeyFile, otherPair.KeyFile), ShouldBeNil)
+			future := time.Now().Add(time.Minute)
+			So(os.Chtimes(otherPair.CertificateFile, future, future), ShouldBeNil)
+			p.Reload()
+			Convey(`Then the renewed certificate should be used`, func() {
+				So(certificateFor("example.org"), ShouldEqual, "renewed")
+				So(certificateFor("mqtt.example.org"), ShouldEqual, "default")
+			})
+		})
+
+		Convey(`When a changed certificate file is invalid`, func() {
+			So(ioutil.WriteFile(otherPair.CertificateFile, []byte("invalid"), 0600), ShouldBeNil)
+			future := time.Now().Add(time.Minute)
+			So(os.Chtimes(otherPair.CertificateFile, future, future), ShouldBeNil)
+			p.Reload()
+			Convey(`Then the old certificate should still be used`, func() {
+				So(certificateFor("example.org"), ShouldEqual, "other")
+			})
+		})
+
+		Convey(`When configuring a client CA`, func() {
+			err := p.Configure(Config{
+				Certificates:             []Pair{defaultPair},
+				ClientCAFile:             otherPair.CertificateFile,
+				RequireClientCertificate: true,
+			})
+			So(err, ShouldBeNil)
+			config, err := p.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+			So(err, ShouldBeNil)
+			Convey(`Then client certificates should be required and verified`, func() {
+				So(config.ClientAuth, ShouldEqual, tls.RequireAndVerifyClientCert)
+				So(config.ClientCAs, ShouldNotBeNil)
+			})
+		})
+
+		Convey(`When configuring an invalid config`, func() {
+			for _, config := range []Config{
+				{},
+				{Certificates: []Pair{defaultPair}, MinVersion: "2.0"},
+				{Certificates: []Pair{defaultPair}, CipherSuites: []string{"TLS_FOO"}},
+				{Certificates: []Pair{{CertificateFile: filepath.Join(dir, "missing.crt"), KeyFile: defaultPair.KeyFile}}},
+				{Certificates: []Pair{defaultPair}, ClientCAFile: defaultPair.KeyFile},
+			} {
+				So(p.Configure(config), ShouldNotBeNil)
+			}
+			Convey(`Then the config should not change`, func() {
+				So(certificateFor("example.org"), ShouldEqual, "other")
+			})
+		})
+
+		Convey(`When a client connects`, func() {
+			lis, err := tls.Listen("tcp", "localhost:0", p.TLSConfig())
+			So(err, ShouldBeNil)
+			defer lis.Close()
+			go func() {
+				conn, err := lis.Accept()
+				if err == nil {
+					conn.(*tls.Conn).Handshake()
+					conn.Close()
+				}
+			}()
+			conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{
+				ServerName:         "mqtt.example.org",
+				InsecureSkipVerify: true,
+				NextProtos:         []string{"mqtt"},
+			})
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			Convey(`Then it should get the certificate for its server name`, func() {
+				state := conn.ConnectionState()
+				So(state.PeerCertificates[0].Subject.CommonName, ShouldEqual, "other")
+				So(state.NegotiatedProtocol, ShouldEqual, "mqtt")
+			})
+		})
+	})
+}
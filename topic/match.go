@@ -0,0 +1,24 @@
+package topic
+
+import "strings"
+
+// Match returns true if the topic name matches the topic filter
+// Topic names starting with $ are not matched by filters starting with a wildcard
+func Match(filter, name string) bool {
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterParts, nameParts := strings.Split(filter, "/"), strings.Split(name, "/")
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(nameParts) {
+			return false
+		}
+		if part != "+" && part != nameParts[i] {
+			return false
+		}
+	}
+	return len(filterParts) == len(nameParts)
+}
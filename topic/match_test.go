@@ -0,0 +1,30 @@
+package topic
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMatch(t *testing.T) {
+	Convey(`Testing the Topic matching`, t, func() {
+		So(Match("foo", "foo"), ShouldBeTrue)
+		So(Match("foo", "bar"), ShouldBeFalse)
+		So(Match("foo/bar", "foo"), ShouldBeFalse)
+		So(Match("foo", "foo/bar"), ShouldBeFalse)
+
+		So(Match("#", "foo/bar"), ShouldBeTrue)
+		So(Match("foo/#", "foo"), ShouldBeTrue) // the multi-level wildcard also matches the parent level
+		So(Match("foo/#", "foo/bar/baz"), ShouldBeTrue)
+		So(Match("foo/#", "bar/baz"), ShouldBeFalse)
+
+		So(Match("+", "foo"), ShouldBeTrue)
+		So(Match("+", "foo/bar"), ShouldBeFalse)
+		So(Match("foo/+/baz", "foo/bar/baz"), ShouldBeTrue)
+		So(Match("foo/+", "foo/"), ShouldBeTrue) // empty levels are matched by the single-level wildcard
+
+		So(Match("#", "$SYS/foo"), ShouldBeFalse) // wildcards at the first level do not match topics starting with $
+		So(Match("+/foo", "$SYS/foo"), ShouldBeFalse)
+		So(Match("$SYS/#", "$SYS/foo"), ShouldBeTrue)
+	})
+}
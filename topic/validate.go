@@ -6,8 +6,17 @@ import (
 	"unicode/utf8"
 )
 
+var (
+	// MaxLength is the maximum length of topics in bytes, zero means no limit
+	MaxLength = 65535
+
+	// MaxLevels is the maximum number of levels of topics, zero means no limit
+	MaxLevels = 64
+)
+
 var (
 	errInvalidLength           = errors.New("invalid length")
+	errTooManyLevels           = errors.New("too many levels")
 	errInvalidUTF8             = errors.New("invalid utf-8")
 	errWildcardNotAllowed      = errors.New("wildcard not allowed")
 	errInvalidWildcardLocation = errors.New("wildcard not allowed at this location")
@@ -15,12 +24,15 @@ var (
 
 // Validate a topic
 func Validate(topic string, allowWildcard bool) error {
-	if len(topic) < 1 {
+	if len(topic) < 1 || (MaxLength > 0 && len(topic) > MaxLength) {
 		return errInvalidLength
 	}
 	if !utf8.ValidString(topic) || strings.ContainsRune(topic, '\U00000000') {
 		return errInvalidUTF8
 	}
+	if MaxLevels > 0 && strings.Count(topic, "/") >= MaxLevels {
+		return errTooManyLevels
+	}
 	parts := strings.Split(topic, "/")
 	for i, part := range parts {
 		if strings.ContainsAny(part, "#+") {
@@ -1,6 +1,7 @@
 package topic
 
 import (
+	"strings"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -29,5 +30,22 @@ func TestValidate(t *testing.T) {
 		So(Validate("foo/#bar", true), ShouldEqual, errInvalidWildcardLocation)
 		So(Validate("foo/+bar", true), ShouldEqual, errInvalidWildcardLocation)
 		So(Validate("foo/#/bar", true), ShouldEqual, errInvalidWildcardLocation)
+
+		Convey(`When the topics are limited`, func() {
+			defer func(maxLength, maxLevels int) { MaxLength, MaxLevels = maxLength, maxLevels }(MaxLength, MaxLevels)
+			MaxLength, MaxLevels = 7, 2
+
+			So(Validate("foo/bar", true), ShouldBeNil)
+			So(Validate("foo/barr", true), ShouldEqual, errInvalidLength)
+			So(Validate("a/b/c", true), ShouldEqual, errTooManyLevels)
+		})
+
+		Convey(`When the topics are not limited`, func() {
+			defer func(maxLength, maxLevels int) { MaxLength, MaxLevels = maxLength, maxLevels }(MaxLength, MaxLevels)
+			MaxLength, MaxLevels = 0, 0
+
+			So(Validate("foo/bar", true), ShouldBeNil)
+			So(Validate(strings.Repeat("a/", 100)+"#", true), ShouldBeNil)
+		})
 	})
 }
@@ -0,0 +1,363 @@
+// Package websocket implements the server side of WebSocket connections (RFC 6455) for MQTT over WebSockets
+//
+// The data of binary messages is read and written as a stream, so that connections can be served like TCP
+// connections.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subprotocols are the WebSocket subprotocols that the server accepts, in order of preference
+var Subprotocols = []string{"mqtt", "mqttv3.1"}
+
+// HandshakeTimeout is the time in which clients must complete the HTTP handshake
+var HandshakeTimeout = 10 * time.Second
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close codes
+const (
+	closeNormal          = 1000
+	closeProtocolError   = 1002
+	closeUnsupportedData = 1003
+	closeMessageTooBig   = 1009
+)
+
+const maxControlPayloadSize = 125
+
+var (
+	errClosed            = errors.New("websocket: listener closed")
+	errUnmasked          = errors.New("websocket: unmasked frame from client")
+	errTextMessage       = errors.New("websocket: text messages are not supported")
+	errUnknownOpcode     = errors.New("websocket: unknown opcode")
+	errControlFrame      = errors.New("websocket: invalid control frame")
+	errFrameTooLarge     = errors.New("websocket: frame too large")
+	errProtocolMismatch  = errors.New("websocket: unsupported subprotocol")
+	errInvalidHandshake  = errors.New("websocket: invalid handshake")
+	errHijackUnsupported = errors.New("websocket: connection can not be hijacked")
+)
+
+// Listener accepts WebSocket connections on a net.Listener
+type Listener struct {
+	lis    net.Listener
+	path   string
+	server *http.Server
+	conns  chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	errMu sync.Mutex
+	err   error
+}
+
+// NewListener serves the HTTP handshake of WebSocket connections on lis
+// Connections are accepted on the path, or on any path if it is empty.
+func NewListener(lis net.Listener, path string) *Listener {
+	l := &Listener{
+		lis:   lis,
+		path:  path,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	l.server = &http.Server{Handler: l, ReadHeaderTimeout: HandshakeTimeout}
+	go func() {
+		err := l.server.Serve(lis)
+		l.errMu.Lock()
+		l.err = err
+		l.errMu.Unlock()
+		l.Close()
+	}()
+	return l
+}
+
+// Accept waits for the next WebSocket connection
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		l.errMu.Lock()
+		defer l.errMu.Unlock()
+		if l.err != nil && l.err != http.ErrServerClosed {
+			return nil, l.err
+		}
+		return nil, errClosed
+	}
+}
+
+// Close stops listening, connections that were accepted stay open
+func (l *Listener) Close() (err error) {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.server.Close()
+	})
+	return err
+}
+
+// Addr returns the address of the listener
+func (l *Listener) Addr() net.Addr {
+	return l.lis.Addr()
+}
+
+// ServeHTTP upgrades HTTP requests to WebSocket connections
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.path != "" && r.URL.Path != l.path {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := upgrade(w, r)
+	if err != nil {
+		if err != errHijackUnsupported {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// subprotocol returns the first of Subprotocols that the client supports
+// Clients that do not request a subprotocol are accepted without one.
+func subprotocol(r *http.Request) (string, error) {
+	requested := r.Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")]
+	if len(requested) == 0 {
+		return "", nil
+	}
+	for _, protocol := range Subprotocols {
+		if headerContains(r.Header, "Sec-WebSocket-Protocol", protocol) {
+			return protocol, nil
+		}
+	}
+	return "", errProtocolMismatch
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept for the Sec-WebSocket-Key of a client
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errInvalidHandshake
+	}
+	protocol, err := subprotocol(r)
+	if err != nil {
+		return nil, err
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, errHijackUnsupported.Error(), http.StatusInternalServerError)
+		return nil, errHijackUnsupported
+	}
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, errHijackUnsupported
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n"
+	if protocol != "" {
+		response += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	netConn.SetDeadline(time.Time{})
+	if _, err = netConn.Write([]byte(response + "\r\n")); err != nil {
+		netConn.Close()
+		return nil, errHijackUnsupported
+	}
+	return &Conn{Conn: netConn, r: rw.Reader}, nil
+}
+
+// Conn is a WebSocket connection
+// Read returns the data of the binary messages of the client, Write sends the data as binary messages.
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// only used by Read
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+// Read reads data from the binary messages of the client
+// Ping frames are answered while reading. Read returns io.EOF when the client closes the connection.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	for c.remaining == 0 {
+		if err = c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err = c.r.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+func (c *Conn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// nextFrame reads the header of the next frame, and handles it if it is a control frame
+func (c *Conn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		c.closeWithCode(closeProtocolError)
+		return errUnmasked
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.r, extended[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.r, extended[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+		if length>>63 != 0 {
+			c.closeWithCode(closeMessageTooBig)
+			return errFrameTooLarge
+		}
+	}
+	if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+	switch opcode {
+	case opContinuation, opBinary:
+		c.remaining = length
+		return nil
+	case opText:
+		c.closeWithCode(closeUnsupportedData)
+		return errTextMessage
+	case opClose, opPing, opPong:
+		if length > maxControlPayloadSize || header[0]&0x80 == 0 {
+			c.closeWithCode(closeProtocolError)
+			return errControlFrame
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case opClose:
+			c.closeOnce.Do(func() {
+				if len(payload) > 2 {
+					payload = payload[:2]
+				}
+				c.writeFrame(opClose, payload)
+			})
+			return io.EOF
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		}
+		return nil
+	default:
+		c.closeWithCode(closeProtocolError)
+		return errUnknownOpcode
+	}
+}
+
+// Write sends the data in a binary message
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, byte(length>>8), byte(length))
+	default:
+		var extended [8]byte
+		binary.BigEndian.PutUint64(extended[:], uint64(length))
+		frame = append(append(frame, 127), extended[:]...)
+	}
+	frame = append(frame, payload...)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// closeWithCode sends a close frame with the status code, unless a close frame was already sent
+func (c *Conn) closeWithCode(code uint16) {
+	c.closeOnce.Do(func() {
+		var payload [2]byte
+		binary.BigEndian.PutUint16(payload[:], code)
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(opClose, payload[:])
+	})
+}
+
+// Close sends a close frame and closes the connection
+func (c *Conn) Close() error {
+	c.closeWithCode(closeNormal)
+	return c.Conn.Close()
+}
@@ -0,0 +1,187 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// dial connects to the listener and does the handshake, it returns the connection and the handshake response
+func dial(addr, path, protocol string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	So(err, ShouldBeNil)
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n"
+	if protocol != "" {
+		request += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	_, err = conn.Write([]byte(request + "\r\n"))
+	So(err, ShouldBeNil)
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	So(err, ShouldBeNil)
+	return conn, r, res
+}
+
+// writeFrame writes a masked frame, as clients do
+func writeFrame(w io.Writer, opcode byte, payload []byte) {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	So(err, ShouldBeNil)
+}
+
+// readFrame reads an unmasked frame, as servers send
+func readFrame(r io.Reader) (opcode byte, payload []byte) {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	So(err, ShouldBeNil)
+	So(header[1]&0x80, ShouldEqual, 0)
+	length := int(header[1])
+	if length == 126 {
+		var extended [2]byte
+		_, err = io.ReadFull(r, extended[:])
+		So(err, ShouldBeNil)
+		length = int(binary.BigEndian.Uint16(extended[:]))
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	So(err, ShouldBeNil)
+	return header[0] & 0x0F, payload
+}
+
+func TestAcceptKey(t *testing.T) {
+	Convey(`The accept key should be computed as in RFC 6455`, t, func() {
+		So(AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="), ShouldEqual, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+	})
+}
+
+func TestListener(t *testing.T) {
+	Convey(`Given a WebSocket listener`, t, func() {
+		tcp, err := net.Listen("tcp", "localhost:0")
+		So(err, ShouldBeNil)
+		l := NewListener(tcp, "/mqtt")
+		defer l.Close()
+		addr := l.Addr().String()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		Convey(`When a client connects with the mqtt subprotocol`, func() {
+			conn, r, res := dial(addr, "/mqtt", "mqttv3.1, mqtt")
+			defer conn.Close()
+			var server net.Conn
+			select {
+			case server = <-accepted:
+			case <-time.After(time.Second):
+			}
+			So(server, ShouldNotBeNil)
+			defer server.Close()
+
+			Convey(`Then the handshake should be accepted`, func() {
+				So(res.StatusCode, ShouldEqual, http.StatusSwitchingProtocols)
+				So(res.Header.Get("Sec-WebSocket-Accept"), ShouldEqual, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+				So(res.Header.Get("Sec-WebSocket-Protocol"), ShouldEqual, "mqtt")
+			})
+
+			Convey(`When the client sends binary messages`, func() {
+				writeFrame(conn, opBinary, []byte("hello "))
+				writeFrame(conn, opPing, []byte("ping"))
+				writeFrame(conn, opBinary, make([]byte, 200))
+				Convey(`Then the server should read their data as a stream`, func() {
+					buf := make([]byte, 206)
+					_, err := io.ReadFull(server, buf)
+					So(err, ShouldBeNil)
+					So(string(buf[:6]), ShouldEqual, "hello ")
+					So(buf[6:], ShouldResemble, make([]byte, 200))
+				})
+				Convey(`Then the ping should be answered`, func() {
+					io.ReadFull(server, make([]byte, 206))
+					opcode, payload := readFrame(r)
+					So(opcode, ShouldEqual, opPong)
+					So(string(payload), ShouldEqual, "ping")
+				})
+			})
+
+			Convey(`When the server writes`, func() {
+				_, err := server.Write([]byte("hello"))
+				So(err, ShouldBeNil)
+				Convey(`Then the client should receive a binary message`, func() {
+					opcode, payload := readFrame(r)
+					So(opcode, ShouldEqual, opBinary)
+					So(string(payload), ShouldEqual, "hello")
+				})
+			})
+
+			Convey(`When the client closes the connection`, func() {
+				writeFrame(conn, opClose, []byte{0x03, 0xE8})
+				Convey(`Then the server should read EOF and answer the close`, func() {
+					_, err := server.Read(make([]byte, 1))
+					So(err, ShouldEqual, io.EOF)
+					opcode, payload := readFrame(r)
+					So(opcode, ShouldEqual, opClose)
+					So(payload, ShouldResemble, []byte{0x03, 0xE8})
+				})
+			})
+
+			Convey(`When the client sends a text message`, func() {
+				writeFrame(conn, opText, []byte("hello"))
+				Convey(`Then the server should close the connection`, func() {
+					_, err := server.Read(make([]byte, 1))
+					So(err, ShouldEqual, errTextMessage)
+					opcode, payload := readFrame(r)
+					So(opcode, ShouldEqual, opClose)
+					So(binary.BigEndian.Uint16(payload), ShouldEqual, closeUnsupportedData)
+				})
+			})
+		})
+
+		Convey(`When a client requests an unsupported subprotocol`, func() {
+			conn, _, res := dial(addr, "/mqtt", "chat")
+			defer conn.Close()
+			Convey(`Then the handshake should be rejected`, func() {
+				So(res.StatusCode, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+
+		Convey(`When a client connects on another path`, func() {
+			conn, _, res := dial(addr, "/other", "mqtt")
+			defer conn.Close()
+			Convey(`Then the handshake should be rejected`, func() {
+				So(res.StatusCode, ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey(`When the listener is closed`, func() {
+			So(l.Close(), ShouldBeNil)
+			_, err := l.Accept()
+			Convey(`Then Accept should return an error`, func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}